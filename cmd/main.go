@@ -2,45 +2,150 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/Armunz/learn-mongodb/internal/config"
 	"github.com/Armunz/learn-mongodb/internal/controllers"
+	"github.com/Armunz/learn-mongodb/internal/db"
+	"github.com/Armunz/learn-mongodb/internal/importer"
+	"github.com/Armunz/learn-mongodb/internal/publisher"
 	"github.com/Armunz/learn-mongodb/internal/repositories"
 	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// shutdownTimeout bound how long open requests, such as event streams, may delay shutdown
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	ctx := context.Background()
 	validate := validator.New()
 	cfg := config.New(validate)
 
-	mongoDB := config.NewMongo(ctx, cfg)
+	// subcommand, default to serving the API
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
 
+	switch command {
+	case "serve":
+		serve(ctx, cfg, validate)
+	case "migrate":
+		migrate(ctx, cfg, os.Args[2:])
+	case "seed":
+		seed(ctx, cfg, os.Args[2:])
+	default:
+		log.Fatal().Str("command", command).Msg("unknown command, use serve, migrate or seed")
+	}
+}
+
+func serve(ctx context.Context, cfg config.Config, validate *validator.Validate) {
 	// init repo
-	repo := repositories.New(mongoDB, cfg.AppMongoQueryTimeoutMs)
+	var repo repositories.Repository
+	var history repositories.HistoryRepository
+	var tx repositories.Transactor
+	var outbox repositories.OutboxRepository
+	var webhooks repositories.WebhookRepository
+	var deliveries repositories.WebhookDeliveryRepository
+	var watcher repositories.AccountWatcher
+	var indexes repositories.IndexManager
+	var writer importer.Writer
+	var mongoDB *mongo.Database
+	events := repositories.NewEventBus()
+	switch cfg.AppStorage {
+	case config.StorageMemory:
+		repo = repositories.NewMemory()
+		history = repositories.NewMemoryHistory()
+		tx = repositories.NewMemoryTransactor()
+		outbox = repositories.NewMemoryOutbox()
+		webhooks = repositories.NewMemoryWebhook()
+		deliveries = repositories.NewMemoryWebhookDelivery()
+		watcher = events
+		indexes = repositories.NewMemoryIndexManager()
+		writer = importer.NewRepositoryWriter(repo)
+
+		// seed from fixture, accounts repeated in the fixture keep their first occurrence
+		seeder, err := importer.New(writer, importer.Options{Mode: importer.MODE_SKIP})
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to init seeder")
+		}
+
+		summary, err := seeder.Import(ctx, db.AccountsFixture())
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to seed accounts fixture")
+		}
+
+		log.Info().
+			Int("inserted", summary.Inserted).
+			Int("skipped", summary.Skipped).
+			Int("invalid", summary.Invalid).
+			Msg("using in-memory storage")
+	default:
+		mongoDB = config.NewMongo(ctx, cfg)
+		repo = repositories.New(mongoDB, cfg.AppMongoQueryTimeoutMs)
+		history = repositories.NewHistory(mongoDB, cfg.AppMongoQueryTimeoutMs)
+		tx = newMongoTransactor(ctx, cfg, mongoDB)
+		outbox = repositories.NewOutbox(mongoDB, cfg.AppMongoQueryTimeoutMs)
+		webhooks = repositories.NewWebhook(mongoDB, cfg.AppMongoQueryTimeoutMs)
+		deliveries = repositories.NewWebhookDelivery(mongoDB, cfg.AppMongoQueryTimeoutMs)
+		watcher = repositories.NewWatcher(mongoDB, events)
+		indexes = repositories.NewIndexManager(mongoDB, cfg.AppMongoQueryTimeoutMs)
+		writer = importer.NewMongoWriter(mongoDB.Collection(repositories.ACCOUNTS_COLLECTION_NAME))
+	}
+
+	// create missing indexes, drift is only reported
+	ensureIndexes(ctx, indexes)
 
 	// init service
-	service := services.NewService(repo, cfg.DefaultLimit)
+	service := services.NewService(repo, history, tx, outbox, events, watcher, cfg.DefaultLimit)
+	adminService := services.NewAdminService(indexes, repo, tx, history, outbox, events, time.Duration(cfg.SoftDeleteRetentionDays)*24*time.Hour)
+	importService := services.NewImportService(writer, repo, history, outbox, events)
+	webhookService := services.NewWebhookService(webhooks, deliveries, tx, cfg.DefaultLimit)
+	if cfg.AdminToken == "" {
+		log.Warn().Msg("admin token is not set, admin endpoints are refused")
+	}
+
+	// publish outbox events and send webhook deliveries until shutdown
+	relayCtx, stopRelay := context.WithCancel(ctx)
+	relayDone := startOutboxRelay(relayCtx, cfg, outbox, services.NewWebhookPublisher(webhooks, deliveries))
+	dispatcherDone := startWebhookDispatcher(relayCtx, cfg, webhooks, deliveries)
 
 	// init fiber
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		// allow list query params such as products_any=a,b
+		EnableSplittingOnParsers: true,
+	})
 	app.Use(
 		recover.New(),
+		requestid.New(),
 		cors.New(cors.Config{
 			AllowHeaders: "*",
 		}),
 	)
 
+	// init validation translator
+	translator, err := validation.New(validate)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to register validation translations")
+	}
+
 	// init controller
-	controllers.RegisterHandlers(app.Group("/accounts"), service, validate, cfg.APITimeout)
+	controllers.RegisterHandlers(app.Group("/accounts"), service, importService, validate, translator, cfg.APITimeout)
+	controllers.RegisterAdminHandlers(app.Group("/admin"), adminService, cfg.AdminToken, cfg.APITimeout)
+	controllers.RegisterSubscriptionHandlers(app.Group("/ws"), service, validate, translator, cfg.APITimeout)
+	controllers.RegisterWebhookHandlers(app.Group("/webhooks"), webhookService, validate, translator, cfg.AdminToken, cfg.APITimeout)
 
 	// Listen from a different goroutine
 	address := ":9999"
@@ -55,15 +160,133 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-c
 
+	// close fiber first so requests in flight still reach the database, event streams never end by themselves so
+	// they are cut after a while
+	log.Info().Msg("Shuting down Fiber server...")
+	if err := app.ShutdownWithTimeout(shutdownTimeout); err != nil {
+		log.Err(err).Caller().Msg("failed to shutdown fiber server")
+	}
+
+	// stop the relay and the dispatcher before the database they read from
+	stopRelay()
+	<-relayDone
+	<-dispatcherDone
+
 	// close database
-	log.Info().Msg("Closing MongoDB Connection...")
-	if err := mongoDB.Client().Disconnect(ctx); err != nil {
-		log.Err(err).Caller().Msg("failed to close MySQL database")
+	if mongoDB != nil {
+		log.Info().Msg("Closing MongoDB Connection...")
+		if err := mongoDB.Client().Disconnect(ctx); err != nil {
+			log.Err(err).Caller().Msg("failed to close MySQL database")
+		}
 	}
+}
 
-	// close fiber
-	log.Info().Msg("Shuting down Fiber server...")
-	if err := app.Shutdown(); err != nil {
-		log.Err(err).Caller().Msg("failed to shutdown fiber server")
+// startOutboxRelay run the relay with the configured publisher and webhooks, the returned channel is closed once it
+// stopped and its publishers are closed
+func startOutboxRelay(ctx context.Context, cfg config.Config, outbox repositories.OutboxRepository, webhooks publisher.Publisher) <-chan struct{} {
+	done := make(chan struct{})
+
+	var pub publisher.Publisher
+	var err error
+	switch cfg.OutboxPublisher {
+	case config.PublisherMemory:
+		pub = publisher.NewMemory()
+	case config.PublisherFile:
+		pub, err = publisher.NewFile(cfg.OutboxFilePath)
+	case config.PublisherNATS:
+		pub, err = publisher.NewNATS(cfg.OutboxNATSURL, cfg.OutboxNATSSubject)
+	default:
+		log.Warn().Msg("outbox publisher is not set, account events only go to webhooks")
+	}
+	if err != nil {
+		log.Panic().Err(err).Str("publisher", cfg.OutboxPublisher).Msg("failed to init outbox publisher")
+	}
+
+	if pub == nil {
+		pub = webhooks
+	} else {
+		pub = publisher.NewFanout(pub, webhooks)
+	}
+
+	relay := services.NewOutboxRelay(outbox, pub, time.Duration(cfg.OutboxRelayIntervalMs)*time.Millisecond, cfg.OutboxBatchSize, cfg.OutboxMaxAttempts)
+	go func() {
+		defer close(done)
+		relay.Run(ctx)
+
+		if err := pub.Close(); err != nil {
+			log.Err(err).Caller().Msg("failed to close outbox publisher")
+		}
+	}()
+
+	log.Info().Str("publisher", cfg.OutboxPublisher).Msg("outbox relay started")
+
+	return done
+}
+
+// startWebhookDispatcher send webhook deliveries until ctx is cancelled, the returned channel is closed once it stopped
+func startWebhookDispatcher(ctx context.Context, cfg config.Config, webhooks repositories.WebhookRepository, deliveries repositories.WebhookDeliveryRepository) <-chan struct{} {
+	done := make(chan struct{})
+
+	dispatcher := services.NewWebhookDispatcher(webhooks, deliveries, services.WebhookDispatchOptions{
+		Interval:    time.Duration(cfg.WebhookDispatchIntervalMs) * time.Millisecond,
+		BatchSize:   cfg.WebhookBatchSize,
+		MaxAttempts: cfg.WebhookMaxAttempts,
+		BackoffBase: time.Duration(cfg.WebhookBackoffBaseMs) * time.Millisecond,
+		BackoffMax:  time.Duration(cfg.WebhookBackoffMaxMs) * time.Millisecond,
+		// dispatched only to public addresses unless allowed for development
+		AllowPrivateTargets: cfg.WebhookAllowPrivate,
+		Client: &http.Client{
+			Timeout: time.Duration(cfg.WebhookTimeoutMs) * time.Millisecond,
+			// partners register the exact url, a redirect is a failed attempt
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	})
+
+	go func() {
+		defer close(done)
+		dispatcher.Run(ctx)
+	}()
+
+	return done
+}
+
+// newMongoTransactor refuse a server without transactions, unless standalone servers are allowed for development
+func newMongoTransactor(ctx context.Context, cfg config.Config, database *mongo.Database) repositories.Transactor {
+	supported, err := repositories.SupportTransactions(ctx, database)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to check transactions support")
+	}
+
+	switch {
+	case supported:
+		return repositories.NewTransactor(database)
+	case cfg.AppMongoAllowStandalone:
+		log.Warn().Msg("mongo server does not support transactions, changes are written without them")
+		return repositories.NewStandaloneTransactor()
+	default:
+		log.Panic().Msg("mongo server does not support transactions, use a replica set or set " + config.AppMongoAllowStandalone)
+		return nil
+	}
+}
+
+func ensureIndexes(ctx context.Context, indexes repositories.IndexManager) {
+	statuses, err := indexes.Ensure(ctx)
+	if err != nil {
+		log.Err(err).Caller().Msg("failed to ensure indexes")
+		return
+	}
+
+	for _, st := range statuses {
+		switch st.State {
+		case repositories.INDEX_STATE_OK:
+		case repositories.INDEX_STATE_CREATED:
+			log.Info().Str("index", st.Name).Msg("index created")
+		case repositories.INDEX_STATE_ERROR:
+			log.Error().Str("index", st.Name).Str("detail", st.Detail).Msg("failed to create index")
+		default:
+			log.Warn().Str("index", st.Name).Str("state", st.State).Str("detail", st.Detail).Msg("index drift detected")
+		}
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/config"
+	"github.com/Armunz/learn-mongodb/internal/migrations"
+	"github.com/rs/zerolog/log"
+)
+
+// migrationLockTTL is how long a crashed migrate run keep other instances out
+const migrationLockTTL = 10 * time.Minute
+
+// migrate run schema migrations: status, up [version], down [steps]
+func migrate(ctx context.Context, cfg config.Config, args []string) {
+	if cfg.AppStorage != config.StorageMongo {
+		log.Fatal().Str("storage", cfg.AppStorage).Msg("migrations only run on mongo storage")
+	}
+
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	var n int
+	if len(args) > 1 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+			log.Fatal().Str("arg", args[1]).Msg("migrate argument must be a non-negative number")
+		}
+	}
+
+	mongoDB := config.NewMongo(ctx, cfg)
+	defer func() {
+		if err := mongoDB.Client().Disconnect(ctx); err != nil {
+			log.Err(err).Caller().Msg("failed to close MongoDB connection")
+		}
+	}()
+
+	migrator, err := migrations.New(mongoDB, migrations.All, migrationLockTTL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid migrations")
+	}
+
+	switch action {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read migration status")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED AT\tDESCRIPTION")
+		for _, st := range statuses {
+			status, appliedAt := "pending", "-"
+			if st.Applied {
+				status, appliedAt = "applied", st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", st.Version, status, appliedAt, st.Description)
+		}
+		w.Flush()
+	case "up":
+		applied, err := migrator.Up(ctx, n)
+		for _, v := range applied {
+			log.Info().Int("version", v).Msg("migration applied")
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to apply migrations")
+		}
+	case "down":
+		// roll back one migration unless told otherwise
+		if n == 0 {
+			n = 1
+		}
+
+		rolledBack, err := migrator.Down(ctx, n)
+		for _, v := range rolledBack {
+			log.Info().Int("version", v).Msg("migration rolled back")
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to roll back migrations")
+		}
+	default:
+		log.Fatal().Str("action", action).Msg("unknown migrate action, use status, up or down")
+	}
+}
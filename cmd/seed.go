@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/Armunz/learn-mongodb/internal/config"
+	"github.com/Armunz/learn-mongodb/internal/importer"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// accountIDUniqueIndex is the name of the index seed create, the one of the accounts collection
+	accountIDUniqueIndex string = "account_id_unique"
+
+	// server error code of a collection that does not exist
+	codeNamespaceNotFound = 26
+)
+
+// seed import Extended JSON or NDJSON file (or stdin with "-") into a collection
+func seed(ctx context.Context, cfg config.Config, args []string) {
+	if cfg.AppStorage != config.StorageMongo {
+		log.Fatal().Str("storage", cfg.AppStorage).Msg("seed only run on mongo storage")
+	}
+
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	collection := flags.String("collection", repositories.ACCOUNTS_COLLECTION_NAME, "target collection")
+	mode := flags.String("mode", string(importer.MODE_UPSERT), "on existing account_id: upsert, skip or fail")
+	batchSize := flags.Int("batch", 500, "documents per bulk write")
+	dryRun := flags.Bool("dry-run", false, "validate and count without writing")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal().Msg("usage: seed [-collection name] [-mode upsert|skip|fail] [-batch n] [-dry-run] <file|->")
+	}
+
+	var input io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("file", path).Msg("failed to open seed file")
+		}
+		defer file.Close()
+		input = file
+	}
+
+	mongoDB := config.NewMongo(ctx, cfg)
+	defer func() {
+		if err := mongoDB.Client().Disconnect(ctx); err != nil {
+			log.Err(err).Caller().Msg("failed to close MongoDB connection")
+		}
+	}()
+
+	target := mongoDB.Collection(*collection)
+	if !*dryRun {
+		if err := ensureAccountIDUnique(ctx, target); err != nil {
+			log.Fatal().Err(err).Str("collection", *collection).Msg("target collection needs a unique account_id index")
+		}
+	}
+
+	writer := importer.NewMongoWriter(target)
+	seeder, err := importer.New(writer, importer.Options{
+		Mode:      importer.Mode(*mode),
+		BatchSize: *batchSize,
+		DryRun:    *dryRun,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid seed options")
+	}
+
+	summary, err := seeder.Import(ctx, input)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(summary)
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("seed stopped")
+	}
+}
+
+// ensureAccountIDUnique create the unique account_id index on collection unless it has one already. Writes rely on it
+// to find existing accounts, without it every row would be inserted.
+func ensureAccountIDUnique(ctx context.Context, collection *mongo.Collection) error {
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil && !isNamespaceNotFound(err) {
+		return err
+	}
+
+	keys := bson.D{{Key: "account_id", Value: 1}}
+	for _, spec := range specs {
+		var indexKeys bson.D
+		if err := bson.Unmarshal(spec.KeysDocument, &indexKeys); err != nil {
+			return err
+		}
+
+		if spec.Unique != nil && *spec.Unique && len(indexKeys) == 1 && indexKeys[0].Key == "account_id" {
+			return nil
+		}
+	}
+
+	model := mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetName(accountIDUniqueIndex).SetUnique(true),
+	}
+	_, err = collection.Indexes().CreateOne(ctx, model)
+	return err
+}
+
+// isNamespaceNotFound report whether err is about a collection that does not exist yet
+func isNamespaceNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == codeNamespaceNotFound
+}
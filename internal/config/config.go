@@ -10,6 +10,8 @@ import (
 )
 
 const (
+	AppStorage string = "APP_STORAGE"
+
 	AppMongoURI                      string = "APP_MONGO_URI"
 	AppMongoDatabaseName             string = "APP_MONGO_DATABASE_NAME"
 	AppMongoPoolMin                  string = "APP_MONGO_POOL_MIN"
@@ -17,22 +19,81 @@ const (
 	AppMongoMaxIdleTimeSecond        string = "APP_MONGO_MAX_IDLE_TIME_SECOND"
 	AppMongoInitConnectionTimeSecond string = "APP_MONGO_INIT_CONNECTION_TIME_SECOND"
 	AppMongoQueryTimeoutMs           string = "APP_MONGO_QUERY_TIMEOUT_MS"
+	AppMongoAllowStandalone          string = "APP_MONGO_ALLOW_STANDALONE"
 
 	APITimeout   string = "API_TIMEOUT"
 	DefaultLimit string = "DEFAULT_LIMIT"
+
+	AdminToken              string = "ADMIN_TOKEN"
+	SoftDeleteRetentionDays string = "SOFT_DELETE_RETENTION_DAYS"
+
+	OutboxPublisher       string = "OUTBOX_PUBLISHER"
+	OutboxFilePath        string = "OUTBOX_FILE_PATH"
+	OutboxNATSURL         string = "OUTBOX_NATS_URL"
+	OutboxNATSSubject     string = "OUTBOX_NATS_SUBJECT"
+	OutboxRelayIntervalMs string = "OUTBOX_RELAY_INTERVAL_MS"
+	OutboxBatchSize       string = "OUTBOX_BATCH_SIZE"
+	OutboxMaxAttempts     string = "OUTBOX_MAX_ATTEMPTS"
+
+	WebhookDispatchIntervalMs string = "WEBHOOK_DISPATCH_INTERVAL_MS"
+	WebhookBatchSize          string = "WEBHOOK_BATCH_SIZE"
+	WebhookTimeoutMs          string = "WEBHOOK_TIMEOUT_MS"
+	WebhookMaxAttempts        string = "WEBHOOK_MAX_ATTEMPTS"
+	WebhookBackoffBaseMs      string = "WEBHOOK_BACKOFF_BASE_MS"
+	WebhookBackoffMaxMs       string = "WEBHOOK_BACKOFF_MAX_MS"
+	WebhookAllowPrivate       string = "WEBHOOK_ALLOW_PRIVATE_TARGETS"
+)
+
+// storage backend
+const (
+	StorageMongo  string = "mongo"
+	StorageMemory string = "memory"
+)
+
+// outbox publisher, the relay is off when none is set
+const (
+	PublisherMemory string = "memory"
+	PublisherFile   string = "file"
+	PublisherNATS   string = "nats"
 )
 
 type Config struct {
-	AppMongoURI                      string `validate:"required"`
-	AppMongoDatabaseName             string `validate:"required"`
-	AppMongoPoolMin                  int    `validate:"required"`
-	AppMongoPoolMax                  int    `validate:"required"`
-	AppMongoMaxIdleTimeSecond        int    `validate:"required"`
-	AppMongoInitConnectionTimeSecond int    `validate:"required"`
-	AppMongoQueryTimeoutMs           int    `validate:"required"`
+	AppStorage string `validate:"oneof=mongo memory"`
+
+	AppMongoURI                      string `validate:"required_if=AppStorage mongo"`
+	AppMongoDatabaseName             string `validate:"required_if=AppStorage mongo"`
+	AppMongoPoolMin                  int    `validate:"required_if=AppStorage mongo"`
+	AppMongoPoolMax                  int    `validate:"required_if=AppStorage mongo"`
+	AppMongoMaxIdleTimeSecond        int    `validate:"required_if=AppStorage mongo"`
+	AppMongoInitConnectionTimeSecond int    `validate:"required_if=AppStorage mongo"`
+	AppMongoQueryTimeoutMs           int    `validate:"required_if=AppStorage mongo"`
+	// a server without transactions is refused unless AppMongoAllowStandalone is set, changes are then not atomic
+	AppMongoAllowStandalone bool
 
 	APITimeout   int `validate:"required"`
 	DefaultLimit int `validate:"required"`
+
+	// admin endpoints that destroy data are refused while AdminToken is empty
+	AdminToken              string
+	SoftDeleteRetentionDays int `validate:"gte=0"`
+
+	// events only go to webhooks while OutboxPublisher is empty
+	OutboxPublisher       string `validate:"omitempty,oneof=memory file nats"`
+	OutboxFilePath        string `validate:"required_if=OutboxPublisher file"`
+	OutboxNATSURL         string `validate:"required_if=OutboxPublisher nats"`
+	OutboxNATSSubject     string `validate:"required_if=OutboxPublisher nats"`
+	OutboxRelayIntervalMs int    `validate:"gt=0"`
+	OutboxBatchSize       int    `validate:"gt=0"`
+	OutboxMaxAttempts     int    `validate:"gt=0"`
+
+	WebhookDispatchIntervalMs int `validate:"gt=0"`
+	WebhookBatchSize          int `validate:"gt=0"`
+	WebhookTimeoutMs          int `validate:"gt=0"`
+	WebhookMaxAttempts        int `validate:"gt=0"`
+	WebhookBackoffBaseMs      int `validate:"gt=0"`
+	WebhookBackoffMaxMs       int `validate:"gtefield=WebhookBackoffBaseMs"`
+	// webhooks are only sent to public addresses unless WebhookAllowPrivate is set, for development
+	WebhookAllowPrivate bool
 }
 
 func New(validate *validator.Validate) Config {
@@ -42,6 +103,8 @@ func New(validate *validator.Validate) Config {
 	}
 
 	cfg := Config{
+		AppStorage: getEnvString(AppStorage, StorageMongo),
+
 		AppMongoURI:                      os.Getenv(AppMongoURI),
 		AppMongoDatabaseName:             os.Getenv(AppMongoDatabaseName),
 		AppMongoPoolMin:                  getEnvInt(AppMongoPoolMin, os.Getenv(AppMongoPoolMin)),
@@ -49,9 +112,29 @@ func New(validate *validator.Validate) Config {
 		AppMongoMaxIdleTimeSecond:        getEnvInt(AppMongoMaxIdleTimeSecond, os.Getenv(AppMongoMaxIdleTimeSecond)),
 		AppMongoInitConnectionTimeSecond: getEnvInt(AppMongoInitConnectionTimeSecond, os.Getenv(AppMongoInitConnectionTimeSecond)),
 		AppMongoQueryTimeoutMs:           getEnvInt(AppMongoQueryTimeoutMs, os.Getenv(AppMongoQueryTimeoutMs)),
+		AppMongoAllowStandalone:          getEnvBool(AppMongoAllowStandalone, getEnvString(AppMongoAllowStandalone, "false")),
 
 		APITimeout:   getEnvInt(APITimeout, os.Getenv(APITimeout)),
 		DefaultLimit: getEnvInt(DefaultLimit, os.Getenv(DefaultLimit)),
+
+		AdminToken:              os.Getenv(AdminToken),
+		SoftDeleteRetentionDays: getEnvInt(SoftDeleteRetentionDays, getEnvString(SoftDeleteRetentionDays, "30")),
+
+		OutboxPublisher:       os.Getenv(OutboxPublisher),
+		OutboxFilePath:        getEnvString(OutboxFilePath, "account_events.ndjson"),
+		OutboxNATSURL:         getEnvString(OutboxNATSURL, "nats://localhost:4222"),
+		OutboxNATSSubject:     getEnvString(OutboxNATSSubject, "accounts.events"),
+		OutboxRelayIntervalMs: getEnvInt(OutboxRelayIntervalMs, getEnvString(OutboxRelayIntervalMs, "1000")),
+		OutboxBatchSize:       getEnvInt(OutboxBatchSize, getEnvString(OutboxBatchSize, "100")),
+		OutboxMaxAttempts:     getEnvInt(OutboxMaxAttempts, getEnvString(OutboxMaxAttempts, "10")),
+
+		WebhookDispatchIntervalMs: getEnvInt(WebhookDispatchIntervalMs, getEnvString(WebhookDispatchIntervalMs, "1000")),
+		WebhookBatchSize:          getEnvInt(WebhookBatchSize, getEnvString(WebhookBatchSize, "100")),
+		WebhookTimeoutMs:          getEnvInt(WebhookTimeoutMs, getEnvString(WebhookTimeoutMs, "10000")),
+		WebhookMaxAttempts:        getEnvInt(WebhookMaxAttempts, getEnvString(WebhookMaxAttempts, "8")),
+		WebhookBackoffBaseMs:      getEnvInt(WebhookBackoffBaseMs, getEnvString(WebhookBackoffBaseMs, "5000")),
+		WebhookBackoffMaxMs:       getEnvInt(WebhookBackoffMaxMs, getEnvString(WebhookBackoffMaxMs, "3600000")),
+		WebhookAllowPrivate:       getEnvBool(WebhookAllowPrivate, getEnvString(WebhookAllowPrivate, "false")),
 	}
 
 	if err := validate.Struct(cfg); err != nil {
@@ -61,6 +144,14 @@ func New(validate *validator.Validate) Config {
 	return cfg
 }
 
+// get env value, fallback when env is not set
+func getEnvString(env string, fallback string) string {
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return fallback
+}
+
 // convert env to int
 func getEnvInt(env string, value string) int {
 	i, err := strconv.Atoi(value)
@@ -74,3 +165,17 @@ func getEnvInt(env string, value string) int {
 	}
 	return i
 }
+
+// convert env to bool
+func getEnvBool(env string, value string) bool {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.
+			Err(err).
+			Stack().
+			Str("env", env).
+			Str("value", value).
+			Msg("failed to convert string to bool")
+	}
+	return b
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+type adminResource struct {
+	service services.AdminService
+	timeout int
+}
+
+// RegisterAdminHandlers register admin endpoints, they require adminToken
+func RegisterAdminHandlers(r fiber.Router, service services.AdminService, adminToken string, timeout int) {
+	res := adminResource{
+		service: service,
+		timeout: timeout,
+	}
+
+	r.Get("/indexes", adminOnly(adminToken), res.Indexes)
+	r.Delete("/accounts/deleted", adminOnly(adminToken), res.PurgeDeletedAccounts)
+}
+
+func (r *adminResource) Indexes(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	response, err := r.service.GetIndexStatus(c.UserContext())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+// PurgeDeletedAccounts remove for good accounts soft deleted longer than the retention ago
+func (r *adminResource) PurgeDeletedAccounts(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	response, err := r.service.PurgeDeletedAccounts(c.UserContext())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
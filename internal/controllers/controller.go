@@ -7,28 +7,45 @@ import (
 
 	"github.com/Armunz/learn-mongodb/internal/model"
 	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 )
 
 type resource struct {
-	service  services.Service
-	validate *validator.Validate
-	timeout  int
+	service       services.Service
+	importService services.ImportService
+	validate      *validator.Validate
+	translator    *validation.Translator
+	timeout       int
 }
 
-func RegisterHandlers(r fiber.Router, service services.Service, validate *validator.Validate, timeout int) {
+func RegisterHandlers(r fiber.Router, service services.Service, importService services.ImportService, validate *validator.Validate, translator *validation.Translator, timeout int) {
 	res := resource{
-		service:  service,
-		validate: validate,
-		timeout:  timeout,
+		service:       service,
+		importService: importService,
+		validate:      validate,
+		translator:    translator,
+		timeout:       timeout,
 	}
 
+	r.Use(withRequestContext)
+
 	r.Post("/", res.Create)
+	r.Post("/import", res.Import)
+	r.Post("/_bulk", res.Bulk)
 	r.Get("/", res.Get)
+	r.Get("/export", res.Export)
+	r.Get("/events", res.Events)
 	r.Get("/:id", res.Detail)
 	r.Put("/:id", res.Update)
+	r.Patch("/:id", res.Patch)
 	r.Delete("/:id", res.Delete)
+	r.Post("/:id/restore", res.Restore)
+	r.Get("/:id/history", res.History)
+	r.Get("/:id/diff", res.Diff)
+	r.Post("/:id/products", res.AddProduct)
+	r.Delete("/:id/products/:product", res.RemoveProduct)
 }
 
 func (r *resource) Create(c *fiber.Ctx) error {
@@ -43,11 +60,11 @@ func (r *resource) Create(c *fiber.Ctx) error {
 	}
 
 	if err := r.validate.Struct(request); err != nil {
-		return model.Response(c, fiber.StatusBadRequest)
+		return r.validationErrorResponse(c, err)
 	}
 
 	if err := r.service.CreateAccount(c.UserContext(), request); err != nil {
-		return model.Response(c, fiber.StatusInternalServerError)
+		return errorResponse(c, err)
 	}
 
 	return model.Response(c, fiber.StatusCreated, nil)
@@ -64,14 +81,14 @@ func (r *resource) Get(c *fiber.Ctx) error {
 		return model.Response(c, fiber.StatusBadRequest)
 	}
 
-	response, totalData, totalPage, err := r.service.GetListAccount(c.UserContext(), request)
+	response, responsePage, err := r.service.GetListAccount(c.UserContext(), request)
 	if err != nil {
-		return model.Response(c, fiber.StatusInternalServerError)
+		return errorResponse(c, err)
 	}
 
-	responsePage := model.ResponsePage{
-		TotalData: totalData,
-		TotalPage: totalPage,
+	c.Set(fiber.HeaderETag, listETag(response, responsePage))
+	if c.Fresh() {
+		return c.SendStatus(fiber.StatusNotModified)
 	}
 
 	return model.Response(c, fiber.StatusOK, response, responsePage)
@@ -89,9 +106,19 @@ func (r *resource) Detail(c *fiber.Ctx) error {
 		return model.Response(c, fiber.StatusBadRequest)
 	}
 
-	response, err := r.service.GetAccountDetail(c.UserContext(), accountIDNum)
+	var request model.AccountDetailRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	response, err := r.service.GetAccountDetail(c.UserContext(), accountIDNum, request)
 	if err != nil {
-		return model.Response(c, fiber.StatusInternalServerError)
+		return errorResponse(c, err)
+	}
+
+	c.Set(fiber.HeaderETag, accountETag(response.Version))
+	if c.Fresh() {
+		return c.SendStatus(fiber.StatusNotModified)
 	}
 
 	return model.Response(c, fiber.StatusOK, response)
@@ -115,14 +142,17 @@ func (r *resource) Update(c *fiber.Ctx) error {
 	}
 
 	if err := r.validate.Struct(request); err != nil {
-		return model.Response(c, fiber.StatusBadRequest)
+		return r.validationErrorResponse(c, err)
 	}
 
-	if err := r.service.UpdateAccount(c.UserContext(), accountIDNum, request); err != nil {
-		return model.Response(c, fiber.StatusInternalServerError)
+	response, err := r.service.UpdateAccount(c.UserContext(), accountIDNum, request, ifMatch(c))
+	if err != nil {
+		return errorResponse(c, err)
 	}
 
-	return model.Response(c, fiber.StatusOK)
+	c.Set(fiber.HeaderETag, accountETag(response.Version))
+
+	return model.Response(c, fiber.StatusOK, response)
 }
 
 func (r *resource) Delete(c *fiber.Ctx) error {
@@ -137,9 +167,110 @@ func (r *resource) Delete(c *fiber.Ctx) error {
 		return model.Response(c, fiber.StatusBadRequest)
 	}
 
-	if err := r.service.DeleteAccount(c.UserContext(), accountIDNum); err != nil {
-		return model.Response(c, fiber.StatusInternalServerError)
+	if err := r.service.DeleteAccount(c.UserContext(), accountIDNum, ifMatch(c)); err != nil {
+		return errorResponse(c, err)
 	}
 
 	return model.Response(c, fiber.StatusOK)
 }
+
+// Restore bring back a soft deleted account, conflict when it is not deleted
+func (r *resource) Restore(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	accountID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	response, err := r.service.RestoreAccount(c.UserContext(), accountID, ifMatch(c))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	c.Set(fiber.HeaderETag, accountETag(response.Version))
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+// History list the changes of an account newest first
+func (r *resource) History(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	accountID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	var request model.AccountHistoryRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	response, responsePage, err := r.service.GetAccountHistory(c.UserContext(), accountID, request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response, responsePage)
+}
+
+// Diff compare the revisions of an account at two points in time field by field
+func (r *resource) Diff(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	accountID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	var request model.AccountDiffRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	response, err := r.service.GetAccountDiff(c.UserContext(), accountID, request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+func (r *resource) Bulk(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	var request model.AccountBulkRequest
+	if err := c.BodyParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return r.validationErrorResponse(c, err)
+	}
+
+	// items are checked one by one and reported in the language of the request
+	lang := c.AcceptsLanguages(validation.Languages...)
+	validate := func(item any) []model.ErrorDetail {
+		return r.translator.Details(r.validate.Struct(item), lang)
+	}
+
+	response, err := r.service.Bulk(c.UserContext(), request, validate)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// listedIDs decode the account ids of a list response body
+func listedIDs(t *testing.T, resp io.Reader) []int {
+	t.Helper()
+
+	var body struct {
+		Data []model.AccountResponse `json:"data"`
+	}
+	if err := json.NewDecoder(resp).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]int, 0, len(body.Data))
+	for _, account := range body.Data {
+		ids = append(ids, account.AccountID)
+	}
+
+	return ids
+}
+
+func TestSoftDelete(t *testing.T) {
+	app := testApp(t,
+		entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}, Version: 1},
+		entity.Account{AccountID: 2, Limit: 10, Products: []string{"a"}, Version: 1},
+	)
+
+	if resp := do(t, app, fiber.MethodDelete, "/accounts/1", ""); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("delete status = %d, want 200", resp.StatusCode)
+	}
+
+	// a deleted account is left out of lists and reads unless asked for
+	if ids := listedIDs(t, do(t, app, fiber.MethodGet, "/accounts", "").Body); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("list after delete = %v, want [2]", ids)
+	}
+	if ids := listedIDs(t, do(t, app, fiber.MethodGet, "/accounts?include_deleted=true", "").Body); len(ids) != 2 {
+		t.Errorf("list with include_deleted = %v, want both accounts", ids)
+	}
+	if resp := do(t, app, fiber.MethodGet, "/accounts/1", ""); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("get deleted status = %d, want 404", resp.StatusCode)
+	}
+	if resp := do(t, app, fiber.MethodGet, "/accounts/1?include_deleted=true", ""); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("get deleted with include_deleted status = %d, want 200", resp.StatusCode)
+	}
+
+	if resp := do(t, app, fiber.MethodDelete, "/accounts/1", ""); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("delete twice status = %d, want 404", resp.StatusCode)
+	}
+
+	resp := do(t, app, fiber.MethodPost, "/accounts/1/restore", "")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("restore status = %d, want 200", resp.StatusCode)
+	}
+	if ids := listedIDs(t, do(t, app, fiber.MethodGet, "/accounts", "").Body); len(ids) != 2 {
+		t.Errorf("list after restore = %v, want both accounts", ids)
+	}
+}
+
+func TestRestoreRefused(t *testing.T) {
+	app := testApp(t, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}, Version: 1})
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{name: "live account", target: "/accounts/1/restore", status: fiber.StatusConflict},
+		{name: "missing account", target: "/accounts/9/restore", status: fiber.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := do(t, app, fiber.MethodPost, tt.target, ""); resp.StatusCode != tt.status {
+				t.Errorf("restore status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"errors"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
+	"github.com/gofiber/fiber/v2"
+)
+
+// statusByKind map domain error kind to response status
+var statusByKind = map[errs.Kind]int{
+	errs.NotFound:           fiber.StatusNotFound,
+	errs.Conflict:           fiber.StatusConflict,
+	errs.InvalidArgument:    fiber.StatusBadRequest,
+	errs.Timeout:            fiber.StatusGatewayTimeout,
+	errs.Unavailable:        fiber.StatusServiceUnavailable,
+	errs.FailedPrecondition: fiber.StatusPreconditionFailed,
+	errs.Unauthenticated:    fiber.StatusUnauthorized,
+}
+
+// errorResponse write response of service error, unknown errors are internal server error
+func errorResponse(c *fiber.Ctx, err error) error {
+	var paramErr *services.ParamError
+	if errors.As(err, &paramErr) {
+		return model.ResponseErrors(c, fiber.StatusBadRequest, model.ErrorDetail{
+			Field:   paramErr.Field,
+			Rule:    paramErr.Rule,
+			Message: paramErr.Message,
+		})
+	}
+
+	status, ok := statusByKind[errs.KindOf(err)]
+	if !ok {
+		return model.Response(c, fiber.StatusInternalServerError)
+	}
+
+	// domain error messages are safe to show and tell clients why the request failed
+	var domainErr *errs.Error
+	if errors.As(err, &domainErr) {
+		return model.ResponseErrors(c, status, model.ErrorDetail{Message: domainErr.Message()})
+	}
+
+	return model.Response(c, status)
+}
+
+// validationErrorResponse write bad request with field errors translated by Accept-Language
+func (r *resource) validationErrorResponse(c *fiber.Ctx, err error) error {
+	lang := c.AcceptsLanguages(validation.Languages...)
+	return model.ResponseErrors(c, fiber.StatusBadRequest, r.translator.Details(err, lang)...)
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestErrorResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		// message of the error detail, empty when the response has no detail
+		message string
+	}{
+		{name: "not found", err: errs.New(errs.NotFound, "account not found"), status: fiber.StatusNotFound, code: "002", message: "account not found"},
+		{name: "conflict", err: errs.New(errs.Conflict, "account already exists"), status: fiber.StatusConflict, code: "003", message: "account already exists"},
+		{name: "invalid argument", err: errs.New(errs.InvalidArgument, "cursor is invalid"), status: fiber.StatusBadRequest, code: "001", message: "cursor is invalid"},
+		{name: "timeout", err: errs.New(errs.Timeout, "query timed out"), status: fiber.StatusGatewayTimeout, code: "004", message: "query timed out"},
+		{name: "unavailable", err: errs.New(errs.Unavailable, "database is unavailable"), status: fiber.StatusServiceUnavailable, code: "005", message: "database is unavailable"},
+		{name: "failed precondition", err: errs.New(errs.FailedPrecondition, "version does not match"), status: fiber.StatusPreconditionFailed, code: "007", message: "version does not match"},
+		{name: "unauthenticated", err: errs.New(errs.Unauthenticated, "token is invalid"), status: fiber.StatusUnauthorized, code: "008", message: "token is invalid"},
+		{name: "wrapped", err: fmt.Errorf("get account: %w", errs.Wrap(errs.NotFound, "account not found", errors.New("no documents"))), status: fiber.StatusNotFound, code: "002", message: "account not found"},
+		{name: "deadline", err: context.DeadlineExceeded, status: fiber.StatusGatewayTimeout, code: "004"},
+		{name: "internal", err: errs.New(errs.Internal, "decode failed"), status: fiber.StatusInternalServerError, code: "001"},
+		{name: "unknown", err: errors.New("boom"), status: fiber.StatusInternalServerError, code: "001"},
+		{name: "param", err: &services.ParamError{Field: "sort", Rule: "oneof", Message: "sort key is not supported"}, status: fiber.StatusBadRequest, code: "001", message: "sort key is not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				return errorResponse(c, tt.err)
+			})
+
+			resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var body model.ResponseData
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.status || body.Code != tt.code {
+				t.Errorf("status %d code %s, want %d code %s", resp.StatusCode, body.Code, tt.status, tt.code)
+			}
+
+			var message string
+			if len(body.Errors) > 0 {
+				message = body.Errors[0].Message
+			}
+			if message != tt.message {
+				t.Errorf("error message %q, want %q", message, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// accountETag is the strong entity tag of an account version
+func accountETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// listETag is a weak entity tag of a listing page, it change whenever an account of the page or the totals change
+func listETag(accounts []model.AccountResponse, page model.ResponsePage) string {
+	h := fnv.New64a()
+	for _, a := range accounts {
+		fmt.Fprintf(h, "%d:%d,", a.AccountID, a.Version)
+	}
+	fmt.Fprintf(h, "%d:%s", page.TotalData, page.NextCursor)
+
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// ifMatch parse If-Match header. Missing header and * accept any version, weak or foreign tags never match.
+func ifMatch(c *fiber.Ctx) model.IfMatch {
+	header := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if header == "" || header == "*" {
+		return nil
+	}
+
+	versions := model.IfMatch{}
+	for _, tag := range strings.Split(header, ",") {
+		// If-Match use strong comparison
+		unquoted, err := strconv.Unquote(strings.TrimSpace(tag))
+		if err != nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(unquoted, 10, 64)
+		if err != nil || version <= 0 {
+			continue
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions
+}
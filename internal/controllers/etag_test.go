@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/importer"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// testApp serve the account routes over the in-memory storage holding accounts
+func testApp(t *testing.T, accounts ...entity.Account) *fiber.App {
+	t.Helper()
+
+	validate := validator.New()
+	translator, err := validation.New(validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := repositories.NewMemory(accounts...)
+	history := repositories.NewMemoryHistory()
+	outbox := repositories.NewMemoryOutbox()
+	events := repositories.NewEventBus()
+	service := services.NewService(repo, history, repositories.NewMemoryTransactor(), outbox, events, events, 20)
+	importService := services.NewImportService(importer.NewRepositoryWriter(repo), repo, history, outbox, events)
+
+	app := fiber.New()
+	RegisterHandlers(app.Group("/accounts"), service, importService, validate, translator, 5)
+
+	return app
+}
+
+// do send a request with headers given as name, value pairs
+func do(t *testing.T, app *fiber.App, method, target, body string, headers ...string) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestIfMatch(t *testing.T) {
+	app := testApp(t, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}, Version: 1})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{name: "update", method: fiber.MethodPut, target: "/accounts/1", body: `{"limit":20,"products":["a"]}`},
+		{name: "merge patch", method: fiber.MethodPatch, target: "/accounts/1", body: `{"limit":20}`},
+		{name: "delete", method: fiber.MethodDelete, target: "/accounts/1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := do(t, app, test.method, test.target, test.body, fiber.HeaderIfMatch, `"7"`)
+			if resp.StatusCode != fiber.StatusPreconditionFailed {
+				t.Errorf("status = %d with a stale If-Match, want 412", resp.StatusCode)
+			}
+		})
+	}
+
+	// weak tags never match
+	if resp := do(t, app, fiber.MethodPut, "/accounts/1", `{"limit":20,"products":["a"]}`, fiber.HeaderIfMatch, `W/"1"`); resp.StatusCode != fiber.StatusPreconditionFailed {
+		t.Errorf("status = %d with a weak If-Match, want 412", resp.StatusCode)
+	}
+
+	resp := do(t, app, fiber.MethodPut, "/accounts/1", `{"limit":20,"products":["a"]}`, fiber.HeaderIfMatch, `"1"`)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d with the current If-Match, want 200", resp.StatusCode)
+	}
+	if etag := resp.Header.Get(fiber.HeaderETag); etag != `"2"` {
+		t.Errorf("ETag = %s after update, want \"2\"", etag)
+	}
+
+	// the updated account is returned like PATCH does
+	var body struct {
+		Data model.AccountResponse `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Data.AccountID != 1 || body.Data.Limit != 20 || body.Data.Version != 2 {
+		t.Errorf("update response = %+v, want the account at version 2", body.Data)
+	}
+
+	resp = do(t, app, fiber.MethodDelete, "/accounts/1", "", fiber.HeaderIfMatch, `"1", "2"`)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("status = %d with one matching If-Match tag, want 200", resp.StatusCode)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	app := testApp(t, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}, Version: 1})
+
+	resp := do(t, app, fiber.MethodGet, "/accounts/1", "")
+	etag := resp.Header.Get(fiber.HeaderETag)
+	if resp.StatusCode != fiber.StatusOK || etag != `"1"` {
+		t.Fatalf("status = %d ETag = %s, want 200 and \"1\"", resp.StatusCode, etag)
+	}
+
+	resp = do(t, app, fiber.MethodGet, "/accounts/1", "", fiber.HeaderIfNoneMatch, etag)
+	if resp.StatusCode != fiber.StatusNotModified {
+		t.Errorf("status = %d with the current If-None-Match, want 304", resp.StatusCode)
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+		t.Errorf("304 has a body: %s", body)
+	}
+
+	list := do(t, app, fiber.MethodGet, "/accounts", "")
+	listETag := list.Header.Get(fiber.HeaderETag)
+	if resp := do(t, app, fiber.MethodGet, "/accounts", "", fiber.HeaderIfNoneMatch, listETag); resp.StatusCode != fiber.StatusNotModified {
+		t.Errorf("list status = %d with the current If-None-Match, want 304", resp.StatusCode)
+	}
+
+	if resp := do(t, app, fiber.MethodPut, "/accounts/1", `{"limit":20,"products":["a"]}`); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("update status = %d", resp.StatusCode)
+	}
+
+	resp = do(t, app, fiber.MethodGet, "/accounts/1", "", fiber.HeaderIfNoneMatch, etag)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderETag) != `"2"` {
+		t.Errorf("status = %d ETag = %s after update, want 200 and \"2\"", resp.StatusCode, resp.Header.Get(fiber.HeaderETag))
+	}
+
+	if resp := do(t, app, fiber.MethodGet, "/accounts", "", fiber.HeaderIfNoneMatch, listETag); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("list status = %d after update, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// HEADER_LAST_EVENT_ID is sent by reconnecting event source clients with the id of the last event they got
+	HEADER_LAST_EVENT_ID string = "Last-Event-ID"
+
+	MIME_EVENT_STREAM string = "text/event-stream"
+
+	// SSE_EVENT_ERROR is the event sent before a stream is closed because its feed failed, it is not named error
+	// since event source clients fire error for connection failures
+	SSE_EVENT_ERROR string = "stream_error"
+
+	// sseHeartbeatInterval is how often an idle stream send a comment, so proxies keep it open and a gone client is noticed
+	sseHeartbeatInterval = 15 * time.Second
+)
+
+// Events stream account events as Server-Sent Events, filtered by account_id and product.
+// Clients resume after the last event they got with Last-Event-ID.
+func (r *resource) Events(c *fiber.Ctx) error {
+	var request model.AccountEventsRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	// only opening the feed is bound to the timeout, the stream last until the client leave
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+
+	lastEventID := utils.CopyString(c.Get(HEADER_LAST_EVENT_ID))
+	feed, err := r.service.WatchAccounts(timeout, request, lastEventID)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	c.Set(fiber.HeaderContentType, MIME_EVENT_STREAM)
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer feed.Close()
+
+		if err := writeEvents(w, feed); err != nil {
+			log.Debug().Err(err).Msg("account event stream closed")
+		}
+	})
+
+	return nil
+}
+
+// writeEvents write events of feed until the feed end or the client is gone
+func writeEvents(w *bufio.Writer, feed services.AccountEventFeed) error {
+	ticker := time.NewTicker(sseHeartbeatInterval)
+	defer ticker.Stop()
+
+	// tell the client the stream is open before the first event
+	if _, err := w.WriteString(": connected\n\n"); err != nil {
+		return err
+	}
+
+	for {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		select {
+		case event, ok := <-feed.Events():
+			if !ok {
+				return writeFeedError(w, feed.Err())
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if _, err := w.WriteString(": heartbeat\n\n"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeFeedError tell the client why its stream end, only domain error messages are shown
+func writeFeedError(w *bufio.Writer, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	detail := model.ErrorDetail{Message: "internal server error"}
+	var domainErr *errs.Error
+	if errors.As(err, &domainErr) {
+		detail.Message = domainErr.Message()
+	}
+
+	data, _ := json.Marshal(detail)
+	if _, werr := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", SSE_EVENT_ERROR, data); werr != nil {
+		return werr
+	}
+
+	if werr := w.Flush(); werr != nil {
+		return werr
+	}
+
+	return err
+}
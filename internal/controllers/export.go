@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/Armunz/learn-mongodb/internal/importer"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// export formats
+const (
+	FORMAT_NDJSON  string = "ndjson"
+	FORMAT_CSV     string = "csv"
+	FORMAT_EXTJSON string = "extjson"
+)
+
+var formatContentType = map[string]string{
+	FORMAT_NDJSON:  "application/x-ndjson",
+	FORMAT_CSV:     "text/csv",
+	FORMAT_EXTJSON: "application/ejson",
+}
+
+// exportFlushEvery is how many accounts are written between flushes, a broken connection is noticed on flush
+const exportFlushEvery = 500
+
+// Export stream every account matching the list filters.
+// Format is taken from format param, then Accept header, and default to NDJSON.
+// There is no request timeout, the stream stop when it is done or the client goes away.
+// The status is sent before the first account, so a stream stopped by an error still answer 200,
+// it end with an error record instead (see exportFailures) and a body without one is complete.
+func (r *resource) Export(c *fiber.Ctx) error {
+	var request model.AccountListRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		format = formatByAccept(c)
+	}
+
+	encode, ok := exportEncoders[format]
+	if !ok {
+		return model.ResponseErrors(c, fiber.StatusBadRequest, model.ErrorDetail{
+			Field:   "format",
+			Rule:    "oneof",
+			Message: "format must be one of ndjson, csv or extjson",
+		})
+	}
+
+	stream, err := r.service.ExportAccounts(request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	c.Set(fiber.HeaderContentType, formatContentType[format])
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="accounts.`+format+`"`)
+
+	// the fiber context is released when this handler returns, so the stream get its own context
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if err := encode(ctx, w, stream); err != nil {
+			log.Err(err).Str("format", format).Msg("account export stopped")
+			if err := exportFailures[format](w, err); err != nil {
+				log.Err(err).Str("format", format).Msg("failed to write export error record")
+			}
+		}
+	})
+
+	return nil
+}
+
+func formatByAccept(c *fiber.Ctx) string {
+	switch c.Accepts(formatContentType[FORMAT_NDJSON], formatContentType[FORMAT_CSV], formatContentType[FORMAT_EXTJSON]) {
+	case formatContentType[FORMAT_CSV]:
+		return FORMAT_CSV
+	case formatContentType[FORMAT_EXTJSON]:
+		return FORMAT_EXTJSON
+	}
+
+	return FORMAT_NDJSON
+}
+
+type exportEncoder func(ctx context.Context, w *bufio.Writer, stream services.AccountStream) error
+
+var exportEncoders = map[string]exportEncoder{
+	FORMAT_NDJSON:  exportNDJSON,
+	FORMAT_CSV:     exportCSV,
+	FORMAT_EXTJSON: exportExtJSON,
+}
+
+// exportError is the last record of an export stopped by an error
+type exportError struct {
+	Error string `json:"error"`
+}
+
+// EXPORT_CSV_ERROR is the account_id column of the last CSV row of an export stopped by an error, the message is in the next column
+const EXPORT_CSV_ERROR string = "#error"
+
+type exportFailure func(w *bufio.Writer, err error) error
+
+// exportFailures write the error record closing a stopped stream, the reader tell a truncated export from a complete one by it
+var exportFailures = map[string]exportFailure{
+	FORMAT_NDJSON:  failJSON,
+	FORMAT_CSV:     failCSV,
+	FORMAT_EXTJSON: failJSON,
+}
+
+// failJSON write {"error": "..."} as its own line, it is valid in both NDJSON and Extended JSON
+func failJSON(w *bufio.Writer, err error) error {
+	if err := json.NewEncoder(w).Encode(exportError{Error: err.Error()}); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// failCSV write a row with EXPORT_CSV_ERROR and the message, the import endpoint count it as an invalid row
+func failCSV(w *bufio.Writer, err error) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{EXPORT_CSV_ERROR, err.Error(), ""}); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// exportNDJSON write one JSON account per line
+func exportNDJSON(ctx context.Context, w *bufio.Writer, stream services.AccountStream) error {
+	encoder := json.NewEncoder(w)
+
+	var n int
+	return stream(ctx, func(account model.AccountResponse) error {
+		if err := encoder.Encode(account); err != nil {
+			return err
+		}
+
+		return flushEvery(w, &n)
+	})
+}
+
+// exportCSV write header then one account per row in the layout the import endpoint read
+func exportCSV(ctx context.Context, w *bufio.Writer, stream services.AccountStream) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(importer.CSVHeader); err != nil {
+		return err
+	}
+
+	var n int
+	err := stream(ctx, func(account model.AccountResponse) error {
+		row := []string{
+			strconv.Itoa(account.AccountID),
+			strconv.Itoa(account.Limit),
+			strings.Join(account.Products, importer.CSV_PRODUCTS_SEPARATOR),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+
+		if n++; n%exportFlushEvery == 0 {
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportExtJSON write one canonical Extended JSON document per line, the format mongoexport and the seed command read
+func exportExtJSON(ctx context.Context, w *bufio.Writer, stream services.AccountStream) error {
+	var n int
+	return stream(ctx, func(account model.AccountResponse) error {
+		var doc bson.D
+		if id, err := primitive.ObjectIDFromHex(account.ID); err == nil {
+			doc = append(doc, bson.E{Key: "_id", Value: id})
+		}
+
+		doc = append(doc,
+			bson.E{Key: "account_id", Value: account.AccountID},
+			bson.E{Key: "limit", Value: account.Limit},
+			bson.E{Key: "products", Value: account.Products},
+			bson.E{Key: "created_at", Value: account.CreatedAt},
+			bson.E{Key: "updated_at", Value: account.UpdatedAt},
+		)
+
+		b, err := bson.MarshalExtJSON(doc, true, false)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+
+		return flushEvery(w, &n)
+	})
+}
+
+func flushEvery(w *bufio.Writer, n *int) error {
+	if *n++; *n%exportFlushEvery != 0 {
+		return nil
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+)
+
+// failingStream send one account then stop with err
+func failingStream(err error) services.AccountStream {
+	return func(ctx context.Context, fn func(model.AccountResponse) error) error {
+		if err := fn(model.AccountResponse{AccountID: 1, Limit: 10, Products: []string{"a", "b"}}); err != nil {
+			return err
+		}
+
+		return err
+	}
+}
+
+func TestExportErrorRecord(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{format: FORMAT_NDJSON, want: []string{`"account_id":1`, `{"error":"cursor lost"}`}},
+		{format: FORMAT_EXTJSON, want: []string{`"account_id":{"$numberInt":"1"}`, `{"error":"cursor lost"}`}},
+		{format: FORMAT_CSV, want: []string{"account_id,limit,products", "1,10,a;b", "#error,cursor lost,"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			var body bytes.Buffer
+			w := bufio.NewWriter(&body)
+
+			err := exportEncoders[test.format](context.Background(), w, failingStream(errors.New("cursor lost")))
+			if err == nil {
+				t.Fatal("expected the stream error")
+			}
+			if err := exportFailures[test.format](w, err); err != nil {
+				t.Fatalf("write error record: %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(body.String()), "\n")
+			if len(lines) != len(test.want) {
+				t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(test.want), body.String())
+			}
+			for i, want := range test.want {
+				if !strings.Contains(lines[i], want) {
+					t.Errorf("line %d = %q, want it to contain %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/importer"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
+	"github.com/gofiber/fiber/v2"
+)
+
+// IMPORT_FORM_FILE is the multipart field holding the uploaded file
+const IMPORT_FORM_FILE string = "file"
+
+// Import write accounts of an uploaded CSV or NDJSON, either as raw body or as multipart file.
+// Each row is validated like a create request and reported with its line and status.
+func (r *resource) Import(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	var request model.AccountImportRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return r.validationErrorResponse(c, err)
+	}
+
+	body, format, err := importBody(c)
+	if err != nil {
+		return model.ResponseErrors(c, fiber.StatusBadRequest, model.ErrorDetail{
+			Field:   IMPORT_FORM_FILE,
+			Rule:    "required",
+			Message: err.Error(),
+		})
+	}
+	defer body.Close()
+
+	if request.Format == "" {
+		request.Format = format
+	}
+
+	// rows are reported in the language of the request
+	lang := c.AcceptsLanguages(validation.Languages...)
+	validate := func(account model.AccountCreateRequest) []model.ErrorDetail {
+		return r.translator.Details(r.validate.Struct(account), lang)
+	}
+
+	response, err := r.importService.ImportAccounts(c.UserContext(), request, body, validate)
+	// a stopped import still report the rows written before it stopped
+	switch {
+	case errs.Is(err, errs.Conflict):
+		return model.Response(c, fiber.StatusConflict, response)
+	case errors.Is(err, importer.ErrRejected):
+		return model.Response(c, fiber.StatusUnprocessableEntity, response)
+	}
+
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+// importBody return uploaded content and the format guessed from its content type or file name
+func importBody(c *fiber.Ctx) (io.ReadCloser, string, error) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return io.NopCloser(bytes.NewReader(c.Body())), importFormat(c.Get(fiber.HeaderContentType), ""), nil
+	}
+
+	header, err := c.FormFile(IMPORT_FORM_FILE)
+	if err != nil {
+		return nil, "", err
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return file, importFormat(header.Header.Get(fiber.HeaderContentType), header.Filename), nil
+}
+
+// importFormat is csv for text/csv or .csv files, anything else is read as NDJSON
+func importFormat(contentType, filename string) string {
+	if strings.HasPrefix(contentType, "text/csv") || strings.EqualFold(filepath.Ext(filename), ".csv") {
+		return services.IMPORT_FORMAT_CSV
+	}
+
+	return services.IMPORT_FORMAT_NDJSON
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// HEADER_ACTOR tell who a request act for, it is recorded on the changes the request makes
+const HEADER_ACTOR string = "X-Actor"
+
+// withRequestContext carry the request actor and the id given by the requestid middleware in the user context.
+// Both are copied since they outlive the request buffers fiber reuse.
+func withRequestContext(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	if actor := strings.TrimSpace(c.Get(HEADER_ACTOR)); actor != "" {
+		ctx = services.WithActor(ctx, utils.CopyString(actor))
+	}
+
+	if requestID, ok := c.Locals(requestid.ConfigDefault.ContextKey).(string); ok {
+		ctx = services.WithRequestID(ctx, utils.CopyString(requestID))
+	}
+
+	c.SetUserContext(ctx)
+
+	return c.Next()
+}
+
+// adminOnly require the admin token as bearer token, every request is forbidden when no token is configured
+func adminOnly(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			return model.Response(c, fiber.StatusForbidden)
+		}
+
+		given, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			return model.Response(c, fiber.StatusUnauthorized)
+		}
+
+		return c.Next()
+	}
+}
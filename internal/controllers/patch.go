@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// patch content types, plain JSON is read as a merge patch
+const (
+	MIME_MERGE_PATCH string = "application/merge-patch+json"
+	MIME_JSON_PATCH  string = "application/json-patch+json"
+)
+
+// Patch update some fields of an account atomically and return the updated account.
+// The body is a RFC 7396 merge patch or a RFC 6902 JSON Patch depending on Content-Type.
+func (r *resource) Patch(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	accountID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	mime, _, _ := strings.Cut(c.Get(fiber.HeaderContentType), ";")
+
+	var response model.AccountResponse
+	switch strings.TrimSpace(strings.ToLower(mime)) {
+	case MIME_JSON_PATCH:
+		var ops []model.PatchOperation
+		if err := json.Unmarshal(c.Body(), &ops); err != nil {
+			return model.Response(c, fiber.StatusBadRequest)
+		}
+
+		response, err = r.service.JSONPatchAccount(c.UserContext(), accountID, ops, ifMatch(c))
+	case MIME_MERGE_PATCH, fiber.MIMEApplicationJSON:
+		var doc map[string]json.RawMessage
+		if err := json.Unmarshal(c.Body(), &doc); err != nil || doc == nil {
+			return model.Response(c, fiber.StatusBadRequest)
+		}
+
+		response, err = r.service.MergePatchAccount(c.UserContext(), accountID, doc, ifMatch(c))
+	default:
+		c.Set(fiber.HeaderAcceptPatch, MIME_MERGE_PATCH+", "+MIME_JSON_PATCH)
+		return model.Response(c, fiber.StatusUnsupportedMediaType)
+	}
+
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	c.Set(fiber.HeaderETag, accountETag(response.Version))
+
+	return model.Response(c, fiber.StatusOK, response)
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// AddProduct subscribe account to a product, adding a product it already hold change nothing
+func (r *resource) AddProduct(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	accountID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	var request model.AccountProductRequest
+	if err := c.BodyParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return r.validationErrorResponse(c, err)
+	}
+
+	response, err := r.service.AddProduct(c.UserContext(), accountID, request, ifMatch(c))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	c.Set(fiber.HeaderETag, accountETag(response.Version))
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+// RemoveProduct unsubscribe account from a product, not found when the account does not hold it
+func (r *resource) RemoveProduct(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	accountID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	// product names may hold spaces or slashes, so they come percent encoded
+	product, err := url.PathUnescape(c.Params("product"))
+	if err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	response, err := r.service.RemoveProduct(c.UserContext(), accountID, product, ifMatch(c))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	c.Set(fiber.HeaderETag, accountETag(response.Version))
+
+	return model.Response(c, fiber.StatusOK, response)
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// productsOf decode the products response body
+func productsOf(t *testing.T, resp io.Reader) model.AccountProductsResponse {
+	t.Helper()
+
+	var body struct {
+		Data model.AccountProductsResponse `json:"data"`
+	}
+	if err := json.NewDecoder(resp).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.Data
+}
+
+func TestProducts(t *testing.T) {
+	app := testApp(t, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}, Version: 1})
+
+	// adding a product already held change nothing
+	resp := do(t, app, fiber.MethodPost, "/accounts/1/products", `{"product":"a"}`)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderETag) != `"1"` {
+		t.Fatalf("add held product status = %d ETag = %s, want 200 and \"1\"", resp.StatusCode, resp.Header.Get(fiber.HeaderETag))
+	}
+	if got := productsOf(t, resp.Body); !reflect.DeepEqual(got.Products, []string{"a"}) || got.Version != 1 {
+		t.Errorf("add held product = %+v, want a at version 1", got)
+	}
+
+	resp = do(t, app, fiber.MethodPost, "/accounts/1/products", `{"product":"b"}`, fiber.HeaderIfMatch, `"1"`)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderETag) != `"2"` {
+		t.Fatalf("add status = %d ETag = %s, want 200 and \"2\"", resp.StatusCode, resp.Header.Get(fiber.HeaderETag))
+	}
+	if got := productsOf(t, resp.Body); !reflect.DeepEqual(got.Products, []string{"a", "b"}) {
+		t.Errorf("add = %+v, want a and b", got)
+	}
+
+	if resp := do(t, app, fiber.MethodDelete, "/accounts/1/products/c", ""); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("remove product not held status = %d, want 404", resp.StatusCode)
+	}
+
+	resp = do(t, app, fiber.MethodDelete, "/accounts/1/products/a", "", fiber.HeaderIfMatch, `"2"`)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderETag) != `"3"` {
+		t.Fatalf("remove status = %d ETag = %s, want 200 and \"3\"", resp.StatusCode, resp.Header.Get(fiber.HeaderETag))
+	}
+	if got := productsOf(t, resp.Body); !reflect.DeepEqual(got.Products, []string{"b"}) {
+		t.Errorf("remove = %+v, want b", got)
+	}
+}
+
+func TestProductsIfMatch(t *testing.T) {
+	app := testApp(t, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}, Version: 1})
+
+	if resp := do(t, app, fiber.MethodPost, "/accounts/1/products", `{"product":"b"}`, fiber.HeaderIfMatch, `"7"`); resp.StatusCode != fiber.StatusPreconditionFailed {
+		t.Errorf("add with a stale If-Match status = %d, want 412", resp.StatusCode)
+	}
+
+	// the precondition is checked even when the add would change nothing
+	if resp := do(t, app, fiber.MethodPost, "/accounts/1/products", `{"product":"a"}`, fiber.HeaderIfMatch, `"7"`); resp.StatusCode != fiber.StatusPreconditionFailed {
+		t.Errorf("add held product with a stale If-Match status = %d, want 412", resp.StatusCode)
+	}
+
+	if resp := do(t, app, fiber.MethodDelete, "/accounts/1/products/a", "", fiber.HeaderIfMatch, `"7"`); resp.StatusCode != fiber.StatusPreconditionFailed {
+		t.Errorf("remove with a stale If-Match status = %d, want 412", resp.StatusCode)
+	}
+
+	resp := do(t, app, fiber.MethodGet, "/accounts/1", "")
+	if etag := resp.Header.Get(fiber.HeaderETag); etag != `"1"` {
+		t.Errorf("ETag = %s after refused writes, want \"1\"", etag)
+	}
+}
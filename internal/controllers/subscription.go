@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// websocket client actions and server message types
+const (
+	WS_ACTION_SUBSCRIBE   string = "subscribe"
+	WS_ACTION_UNSUBSCRIBE string = "unsubscribe"
+
+	WS_MESSAGE_SUBSCRIPTIONS string = "subscriptions"
+	WS_MESSAGE_EVENT         string = "event"
+	WS_MESSAGE_ERROR         string = "error"
+)
+
+const (
+	// wsPingInterval is how often clients are pinged, a client not answering within wsPongWait is gone
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+
+	// wsWriteWait bound every write, a client not reading for that long is dropped
+	wsWriteWait = 10 * time.Second
+
+	// wsMaxMessageSize bound client messages, a subscription request is small
+	wsMaxMessageSize int64 = 64 * 1024
+
+	// localLanguage is the local holding the language of validation messages, negotiated before upgrading
+	localLanguage string = "language"
+)
+
+type subscriptionResource struct {
+	service    services.Service
+	validate   *validator.Validate
+	translator *validation.Translator
+	timeout    int
+}
+
+// RegisterSubscriptionHandlers register websocket endpoints pushing account changes to subscribed clients
+func RegisterSubscriptionHandlers(r fiber.Router, service services.Service, validate *validator.Validate, translator *validation.Translator, timeout int) {
+	res := subscriptionResource{
+		service:    service,
+		validate:   validate,
+		translator: translator,
+		timeout:    timeout,
+	}
+
+	r.Get("/accounts", res.Upgrade, websocket.New(res.Accounts))
+}
+
+// Upgrade refuse plain HTTP requests to websocket endpoints
+func (r *subscriptionResource) Upgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return model.Response(c, fiber.StatusUpgradeRequired)
+	}
+
+	c.Locals(localLanguage, c.AcceptsLanguages(validation.Languages...))
+
+	return c.Next()
+}
+
+// Accounts push events of the accounts a client subscribe to, by account id or by product.
+// Clients send {"action": "subscribe" or "unsubscribe", "account_ids": [...], "products": [...]} and get the
+// resulting subscriptions back. A client too slow to take its events is disconnected.
+func (r *subscriptionResource) Accounts(conn *websocket.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.timeout)*time.Second)
+	sub, err := r.service.SubscribeAccounts(ctx)
+	cancel()
+	if err != nil {
+		closeWebSocket(conn, err)
+		return
+	}
+	defer sub.Close()
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	// replies are written by the writer below, a connection support one concurrent reader and one writer
+	replies := make(chan model.AccountSubscriptionMessage)
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		r.readRequests(conn, sub, replies, done)
+	}()
+
+	// the connection is released once this handler return, so the reader must be gone by then
+	defer func() {
+		close(done)
+		_ = conn.Close()
+		<-readerDone
+	}()
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				closeWebSocket(conn, sub.Err())
+				return
+			}
+
+			err = writeWebSocket(conn, model.AccountSubscriptionMessage{Type: WS_MESSAGE_EVENT, Event: &event})
+		case reply := <-replies:
+			err = writeWebSocket(conn, reply)
+		case <-ticker.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		case <-readerDone:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readRequests apply client requests to sub and send the replies until the connection fail or done is closed
+func (r *subscriptionResource) readRequests(conn *websocket.Conn, sub services.AccountSubscription, replies chan<- model.AccountSubscriptionMessage, done <-chan struct{}) {
+	lang, _ := conn.Locals(localLanguage).(string)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		select {
+		case replies <- r.handleRequest(sub, data, lang):
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleRequest apply one client request to sub and return the reply
+func (r *subscriptionResource) handleRequest(sub services.AccountSubscription, data []byte, lang string) model.AccountSubscriptionMessage {
+	var request model.AccountSubscriptionRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return model.AccountSubscriptionMessage{
+			Type:   WS_MESSAGE_ERROR,
+			Errors: []model.ErrorDetail{{Message: "message must be a JSON subscription request"}},
+		}
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return model.AccountSubscriptionMessage{
+			Type:   WS_MESSAGE_ERROR,
+			Errors: r.translator.Details(err, lang),
+		}
+	}
+
+	var subscriptions model.AccountSubscriptionResponse
+	switch request.Action {
+	case WS_ACTION_SUBSCRIBE:
+		var err error
+		subscriptions, err = sub.Subscribe(request)
+
+		var paramErr *services.ParamError
+		if errors.As(err, &paramErr) {
+			return model.AccountSubscriptionMessage{
+				Type: WS_MESSAGE_ERROR,
+				Errors: []model.ErrorDetail{{
+					Field:   paramErr.Field,
+					Rule:    paramErr.Rule,
+					Message: paramErr.Message,
+				}},
+			}
+		}
+	case WS_ACTION_UNSUBSCRIBE:
+		subscriptions = sub.Unsubscribe(request)
+	}
+
+	return model.AccountSubscriptionMessage{Type: WS_MESSAGE_SUBSCRIPTIONS, Subscriptions: &subscriptions}
+}
+
+// writeWebSocket write message as JSON within wsWriteWait
+func writeWebSocket(conn *websocket.Conn, message model.AccountSubscriptionMessage) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+		return err
+	}
+
+	return conn.WriteJSON(message)
+}
+
+// closeWebSocket tell the client why its connection end, unavailable errors such as a dropped slow client may be
+// retried later. Only domain error messages are shown.
+func closeWebSocket(conn *websocket.Conn, err error) {
+	code, text := websocket.CloseNormalClosure, ""
+	if err != nil {
+		code, text = websocket.CloseInternalServerErr, "internal server error"
+		if errs.Is(err, errs.Unavailable) {
+			code = websocket.CloseTryAgainLater
+		}
+
+		var domainErr *errs.Error
+		if errors.As(err, &domainErr) {
+			text = domainErr.Message()
+		}
+	}
+
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(wsWriteWait))
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+type webhookResource struct {
+	service    services.WebhookService
+	validate   *validator.Validate
+	translator *validation.Translator
+	timeout    int
+}
+
+// RegisterWebhookHandlers register endpoints managing webhooks and their deliveries. Webhooks make the server send
+// account data to any url, so like the admin endpoints they require the admin token.
+func RegisterWebhookHandlers(r fiber.Router, service services.WebhookService, validate *validator.Validate, translator *validation.Translator, adminToken string, timeout int) {
+	res := webhookResource{
+		service:    service,
+		validate:   validate,
+		translator: translator,
+		timeout:    timeout,
+	}
+
+	r.Post("/", adminOnly(adminToken), res.Create)
+	r.Get("/", adminOnly(adminToken), res.Get)
+	r.Get("/:id", adminOnly(adminToken), res.Detail)
+	r.Put("/:id", adminOnly(adminToken), res.Update)
+	r.Delete("/:id", adminOnly(adminToken), res.Delete)
+	r.Get("/:id/deliveries", adminOnly(adminToken), res.Deliveries)
+	r.Post("/:id/replay", adminOnly(adminToken), res.Replay)
+}
+
+// Create register a webhook, the response hold its secret which is not shown again
+func (r *webhookResource) Create(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	var request model.WebhookRequest
+	if err := c.BodyParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return r.validationErrorResponse(c, err)
+	}
+
+	response, err := r.service.CreateWebhook(c.UserContext(), request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusCreated, response)
+}
+
+func (r *webhookResource) Get(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	var request model.WebhookListRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	response, responsePage, err := r.service.GetListWebhook(c.UserContext(), request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response, responsePage)
+}
+
+func (r *webhookResource) Detail(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	response, err := r.service.GetWebhook(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+// Update replace a webhook, its secret is kept when none is given
+func (r *webhookResource) Update(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	var request model.WebhookRequest
+	if err := c.BodyParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return r.validationErrorResponse(c, err)
+	}
+
+	response, err := r.service.UpdateWebhook(c.UserContext(), c.Params("id"), request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+func (r *webhookResource) Delete(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	if err := r.service.DeleteWebhook(c.UserContext(), c.Params("id")); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK)
+}
+
+// Deliveries list the deliveries of a webhook newest first with their attempts, filtered by state
+func (r *webhookResource) Deliveries(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	var request model.WebhookDeliveryListRequest
+	if err := c.QueryParser(&request); err != nil {
+		return model.Response(c, fiber.StatusBadRequest)
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return r.validationErrorResponse(c, err)
+	}
+
+	response, responsePage, err := r.service.GetWebhookDeliveries(c.UserContext(), c.Params("id"), request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response, responsePage)
+}
+
+// Replay send deliveries of a webhook again and reactivate it, every dead letter delivery when the body list none
+func (r *webhookResource) Replay(c *fiber.Ctx) error {
+	// set timeout
+	timeout, cancel := context.WithTimeout(c.UserContext(), time.Duration(r.timeout)*time.Second)
+	defer cancel()
+	c.SetUserContext(timeout)
+
+	var request model.WebhookReplayRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return model.Response(c, fiber.StatusBadRequest)
+		}
+	}
+
+	if err := r.validate.Struct(request); err != nil {
+		return r.validationErrorResponse(c, err)
+	}
+
+	response, err := r.service.ReplayWebhook(c.UserContext(), c.Params("id"), request)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return model.Response(c, fiber.StatusOK, response)
+}
+
+// validationErrorResponse write bad request with field errors translated by Accept-Language
+func (r *webhookResource) validationErrorResponse(c *fiber.Ctx, err error) error {
+	lang := c.AcceptsLanguages(validation.Languages...)
+	return model.ResponseErrors(c, fiber.StatusBadRequest, r.translator.Details(err, lang)...)
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"github.com/Armunz/learn-mongodb/internal/services"
+	"github.com/Armunz/learn-mongodb/internal/validation"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestWebhookRequireAdminToken(t *testing.T) {
+	validate := validator.New()
+	translator, err := validation.New(validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := services.NewWebhookService(repositories.NewMemoryWebhook(), repositories.NewMemoryWebhookDelivery(), repositories.NewMemoryTransactor(), 20)
+	app := fiber.New()
+	RegisterWebhookHandlers(app.Group("/webhooks"), service, validate, translator, "secret-token", 5)
+
+	body := `{"url":"https://example.com/hook"}`
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		want   int
+	}{
+		{name: "create without token", method: http.MethodPost, target: "/webhooks", want: http.StatusUnauthorized},
+		{name: "create with a wrong token", method: http.MethodPost, target: "/webhooks", token: "Bearer other", want: http.StatusUnauthorized},
+		{name: "list without token", method: http.MethodGet, target: "/webhooks", want: http.StatusUnauthorized},
+		{name: "replay without token", method: http.MethodPost, target: "/webhooks/0123456789abcdef01234567/replay", want: http.StatusUnauthorized},
+		{name: "create with the token", method: http.MethodPost, target: "/webhooks", token: "Bearer secret-token", want: http.StatusCreated},
+		{name: "list with the token", method: http.MethodGet, target: "/webhooks", token: "Bearer secret-token", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestBody := ""
+			if tt.method == http.MethodPost {
+				requestBody = body
+			}
+
+			resp := do(t, app, tt.method, tt.target, requestBody, fiber.HeaderAuthorization, tt.token)
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
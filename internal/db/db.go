@@ -0,0 +1,15 @@
+package db
+
+import (
+	"bytes"
+	_ "embed"
+	"io"
+)
+
+//go:embed accounts.json
+var accountsFixture []byte
+
+// AccountsFixture return embedded accounts fixture, one Extended JSON document per line
+func AccountsFixture() io.Reader {
+	return bytes.NewReader(accountsFixture)
+}
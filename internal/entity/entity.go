@@ -1,7 +1,19 @@
 package entity
 
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
 type Account struct {
-	AccountID int      `bson:"account_id"`
-	Limit     int      `bson:"limit"`
-	Products  []string `bson:"products"`
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	AccountID int                `bson:"account_id"`
+	Limit     int                `bson:"limit"`
+	Products  []string           `bson:"products"`
+	Version   int64              `bson:"version"`              // start at 1, incremented by every write
+	CreatedAt time.Time          `bson:"created_at"`           // set by the repository on insert
+	UpdatedAt time.Time          `bson:"updated_at"`           // set by the repository on every write
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty"` // set when soft deleted, until restored or purged
+	DeletedBy string             `bson:"deleted_by,omitempty"`
 }
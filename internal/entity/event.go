@@ -0,0 +1,15 @@
+package entity
+
+import "time"
+
+// AccountEvent is a change of an account seen by watchers
+type AccountEvent struct {
+	// ID is the position of the event a watcher can resume after
+	ID        string
+	Type      string
+	AccountID int
+	Version   int64
+	// Account is the account after the change
+	Account *Account
+	At      time.Time
+}
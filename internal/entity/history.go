@@ -0,0 +1,23 @@
+package entity
+
+import "time"
+
+// AccountHistory is an immutable record of one change of an account, it is also the revision of the account from At
+// until the next record
+type AccountHistory struct {
+	AccountID int           `bson:"account_id"`
+	Action    string        `bson:"action"`
+	Version   int64         `bson:"version"` // account version after the change
+	Changes   []FieldChange `bson:"changes"`
+	Account   *Account      `bson:"account,omitempty"` // account after the change, missing on records written before revisions were kept
+	Actor     string        `bson:"actor"`
+	RequestID string        `bson:"request_id,omitempty"`
+	At        time.Time     `bson:"at"`
+}
+
+// FieldChange is the value of a field before and after a change, nil when the field is not set
+type FieldChange struct {
+	Field  string      `bson:"field"`
+	Before interface{} `bson:"before"`
+	After  interface{} `bson:"after"`
+}
@@ -0,0 +1,26 @@
+package entity
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OutboxRecord is an account event waiting to be published, written in the transaction of the change it describe
+type OutboxRecord struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Type      string             `bson:"type"`
+	AccountID int                `bson:"account_id"`
+	Version   int64              `bson:"version"`
+	// Seq order the records of an account as their changes were committed, versions restart when a purged account is
+	// created again so they can not
+	Seq int64 `bson:"seq"`
+	// Account is the account after the change
+	Account *Account  `bson:"account,omitempty"`
+	At      time.Time `bson:"at"`
+	// Attempts count failed publishes, LastError tell why the last one failed
+	Attempts  int    `bson:"attempts"`
+	LastError string `bson:"last_error,omitempty"`
+	// DeadAt is set when the relay gave up publishing the record, it is kept for inspection but never published
+	DeadAt *time.Time `bson:"dead_at,omitempty"`
+}
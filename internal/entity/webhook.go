@@ -0,0 +1,47 @@
+package entity
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook is an endpoint of a partner getting the events of the accounts it follow. It follow every account when it
+// list no account and no product, otherwise the listed accounts and the accounts holding a listed product.
+type Webhook struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty"`
+	URL    string             `bson:"url"`
+	Secret string             `bson:"secret"` // key of the HMAC-SHA256 signature of deliveries
+	// Events is the event types delivered, every type when empty
+	Events     []string  `bson:"events"`
+	AccountIDs []int     `bson:"account_ids"`
+	Products   []string  `bson:"products"`
+	State      string    `bson:"state"`
+	CreatedAt  time.Time `bson:"created_at"`
+	UpdatedAt  time.Time `bson:"updated_at"`
+}
+
+// WebhookDelivery is one account event to send to a webhook, along with the log of its attempts
+type WebhookDelivery struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	WebhookID primitive.ObjectID `bson:"webhook_id"`
+	EventID   string             `bson:"event_id"`
+	EventType string             `bson:"event_type"`
+	AccountID int                `bson:"account_id"`
+	Payload   []byte             `bson:"payload"` // JSON event sent as request body
+	State     string             `bson:"state"`
+	// AttemptCount count attempts since the delivery was created or replayed, it drive the backoff
+	AttemptCount  int              `bson:"attempt_count"`
+	NextAttemptAt time.Time        `bson:"next_attempt_at"`
+	Attempts      []WebhookAttempt `bson:"attempts"` // oldest first, only the latest are kept
+	CreatedAt     time.Time        `bson:"created_at"`
+	DeliveredAt   *time.Time       `bson:"delivered_at,omitempty"`
+}
+
+// WebhookAttempt is the outcome of one request to a webhook, StatusCode is 0 when no response was received
+type WebhookAttempt struct {
+	At         time.Time `bson:"at"`
+	StatusCode int       `bson:"status_code,omitempty"`
+	Error      string    `bson:"error,omitempty"`
+	DurationMs int64     `bson:"duration_ms"`
+}
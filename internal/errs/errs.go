@@ -0,0 +1,82 @@
+package errs
+
+import (
+	"context"
+	"errors"
+)
+
+// Kind is the category of a domain error, controllers decide the response status from it
+type Kind string
+
+const (
+	Internal        Kind = "internal"
+	NotFound        Kind = "not_found"
+	Conflict        Kind = "conflict"
+	InvalidArgument Kind = "invalid_argument"
+	Timeout         Kind = "timeout"
+	Unavailable     Kind = "unavailable"
+	// FailedPrecondition is a write refused because the stored state is not the one the caller expected
+	FailedPrecondition Kind = "failed_precondition"
+	// Unauthenticated is a request without valid credentials
+	Unauthenticated Kind = "unauthenticated"
+	// Aborted is an operation of a batch that was not attempted because an earlier one failed
+	Aborted Kind = "aborted"
+)
+
+// Error is a domain error of a given kind, optionally wrapping the underlying cause
+type Error struct {
+	kind    Kind
+	message string
+	err     error
+}
+
+// New create domain error
+func New(kind Kind, message string) *Error {
+	return &Error{kind: kind, message: message}
+}
+
+// Wrap create domain error caused by err
+func Wrap(kind Kind, message string, err error) *Error {
+	return &Error{kind: kind, message: message, err: err}
+}
+
+func (e *Error) Error() string {
+	if e.err != nil {
+		return e.message + ": " + e.err.Error()
+	}
+	return e.message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Kind return category of the error
+func (e *Error) Kind() Kind {
+	return e.kind
+}
+
+// Message return error message without the wrapped cause, safe to show to clients
+func (e *Error) Message() string {
+	return e.message
+}
+
+// KindOf return kind of the first error in the chain that has one.
+// Deadline exceeded is a timeout, anything else unknown is internal.
+func KindOf(err error) Kind {
+	var kinded interface{ Kind() Kind }
+	if errors.As(err, &kinded) {
+		return kinded.Kind()
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Timeout
+	}
+
+	return Internal
+}
+
+// Is report whether err is a domain error of given kind
+func Is(err error, kind Kind) bool {
+	return KindOf(err) == kind
+}
@@ -0,0 +1,133 @@
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// CSV_PRODUCTS_SEPARATOR split products of the products column
+const CSV_PRODUCTS_SEPARATOR string = ";"
+
+// CSVHeader is the columns of account csv, in the order the export write them
+var CSVHeader = []string{"account_id", "limit", "products"}
+
+var errCSVHeader = errors.New("csv header must have account_id, limit and products columns")
+
+// CSVSource read rows from csv with a CSVHeader header line, columns may come in any order and extra columns are ignored.
+// Empty cells are left zero so validation decide whether they are allowed.
+func CSVSource(r io.Reader) Source {
+	return func(fn func(row Row, err error) error) error {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+
+		header, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		columns, err := csvColumns(header)
+		if err != nil {
+			return err
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+
+			if err != nil {
+				var parseErr *csv.ParseError
+				if !errors.As(err, &parseErr) {
+					return err
+				}
+
+				if err := fn(Row{Line: parseErr.StartLine}, parseErr.Err); err != nil {
+					return err
+				}
+				continue
+			}
+
+			line, _ := reader.FieldPos(0)
+			if err := fn(parseCSVRecord(line, record, columns)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// csvColumns return index of every CSVHeader column
+func csvColumns(header []string) ([]int, error) {
+	columns := make([]int, len(CSVHeader))
+	for i, name := range CSVHeader {
+		columns[i] = -1
+		for j, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				columns[i] = j
+				break
+			}
+		}
+
+		if columns[i] < 0 {
+			return nil, errCSVHeader
+		}
+	}
+
+	return columns, nil
+}
+
+func parseCSVRecord(line int, record []string, columns []int) (Row, error) {
+	cell := func(column int) string {
+		if i := columns[column]; i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	row := Row{Line: line}
+
+	accountID, err := csvInt(CSVHeader[0], cell(0))
+	if err != nil {
+		return row, err
+	}
+	row.Account.AccountID = accountID
+
+	limit, err := csvInt(CSVHeader[1], cell(1))
+	if err != nil {
+		return row, err
+	}
+	row.Account.Limit = limit
+
+	for _, p := range strings.Split(cell(2), CSV_PRODUCTS_SEPARATOR) {
+		if p = strings.TrimSpace(p); p != "" {
+			row.Account.Products = append(row.Account.Products, p)
+		}
+	}
+
+	row.Document, err = bson.Marshal(row.Account)
+
+	return row, err
+}
+
+func csvInt(field, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, &FieldError{Field: field, Rule: "number", Err: fmt.Errorf("%s must be a whole number", field)}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,529 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Mode decide what happen when an account_id already exists
+type Mode string
+
+const (
+	// MODE_UPSERT replace fields of the existing account
+	MODE_UPSERT Mode = "upsert"
+	// MODE_SKIP keep the existing account and count the row as skipped
+	MODE_SKIP Mode = "skip"
+	// MODE_FAIL stop the import on the first conflict
+	MODE_FAIL Mode = "fail"
+)
+
+// row statuses, in dry run they are what would have happened
+const (
+	ROW_INSERTED string = "inserted"
+	ROW_UPDATED  string = "updated"
+	ROW_SKIPPED  string = "skipped"
+	ROW_INVALID  string = "invalid"
+	// ROW_CONFLICT is the row that stopped a MODE_FAIL import
+	ROW_CONFLICT string = "conflict"
+)
+
+// maxRowErrors bound the row errors kept in the summary, counters keep counting past it
+const maxRowErrors = 100
+
+var (
+	ErrConflict = errors.New("account_id already exists")
+
+	// ErrRejected is a row the database refused for another reason than its account_id, it stop a MODE_FAIL import
+	ErrRejected = errors.New("row was rejected by the database")
+
+	// ErrInput wrap errors of an input that can not be read any further
+	ErrInput = errors.New("input is malformed")
+
+	errModeInvalid = errors.New("import mode is invalid, use upsert, skip or fail")
+
+	errAccountIDMissing = errors.New("account_id is missing")
+	errIDNotObjectID    = errors.New("_id must be an ObjectId")
+)
+
+// duplicateDetail is the row error of an account_id that already exists
+var duplicateDetail = model.ErrorDetail{
+	Field:   "account_id",
+	Rule:    "unique",
+	Message: ErrConflict.Error(),
+}
+
+// Row is one valid document of the input, Line is where it starts in the input
+type Row struct {
+	Line     int
+	Document bson.Raw
+	Account  entity.Account
+}
+
+// RowError explain why a row was not imported
+type RowError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// RowResult is the outcome of one row, kept when Options.Report is set
+type RowResult struct {
+	Line      int                 `json:"line"`
+	AccountID int                 `json:"account_id,omitempty"`
+	Status    string              `json:"status"`
+	Errors    []model.ErrorDetail `json:"errors,omitempty"`
+}
+
+// Summary count the outcome of every row. In dry run the counts are what would have happened.
+type Summary struct {
+	Inserted int         `json:"inserted"`
+	Updated  int         `json:"updated"`
+	Skipped  int         `json:"skipped"`
+	Invalid  int         `json:"invalid"`
+	Errors   []RowError  `json:"errors,omitempty"`
+	Rows     []RowResult `json:"rows,omitempty"`
+
+	report bool
+}
+
+// record count row outcome, invalid rows also keep their error and every row is kept when reporting
+func (s *Summary) record(row Row, status string, details ...model.ErrorDetail) {
+	switch status {
+	case ROW_INSERTED:
+		s.Inserted++
+	case ROW_UPDATED:
+		s.Updated++
+	case ROW_SKIPPED:
+		s.Skipped++
+	case ROW_INVALID:
+		s.Invalid++
+		if len(s.Errors) < maxRowErrors {
+			s.Errors = append(s.Errors, RowError{Line: row.Line, Message: detailsMessage(details)})
+		}
+	}
+
+	if s.report {
+		s.Rows = append(s.Rows, RowResult{
+			Line:      row.Line,
+			AccountID: row.Account.AccountID,
+			Status:    status,
+			Errors:    details,
+		})
+	}
+}
+
+// FieldError is a row error caused by one field of the input
+type FieldError struct {
+	Field string
+	Rule  string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// errorDetails turn parse error of a row into error details
+func errorDetails(err error) []model.ErrorDetail {
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		return []model.ErrorDetail{{
+			Field:   fieldErr.Field,
+			Rule:    fieldErr.Rule,
+			Message: fieldErr.Err.Error(),
+		}}
+	}
+
+	return []model.ErrorDetail{{Message: err.Error()}}
+}
+
+func detailsMessage(details []model.ErrorDetail) string {
+	messages := make([]string, len(details))
+	for i, d := range details {
+		messages[i] = d.Message
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Writer store batches of rows in a backend
+type Writer interface {
+	// Write store rows according to mode and add the outcome to summary.
+	// In MODE_FAIL it return ErrConflict (wrapped with the row line) on the first existing account_id
+	// and ErrRejected on the first row refused for another reason, rows after it are not attempted.
+	Write(ctx context.Context, rows []Row, mode Mode, summary *Summary) error
+	// Existing report which account ids are already stored, used by dry run
+	Existing(ctx context.Context, accountIDs []int) (map[int]bool, error)
+}
+
+type Options struct {
+	Mode      Mode
+	BatchSize int
+	DryRun    bool
+	// Report keep the result of every row in Summary.Rows
+	Report bool
+	// Validate check parsed account, rows with details are invalid and not written
+	Validate func(entity.Account) []model.ErrorDetail
+}
+
+// Source call fn with every row of an input. Rows that can not be parsed come with their error
+// and at least their line set, an error returned by fn stop the source.
+type Source func(fn func(row Row, err error) error) error
+
+type Importer struct {
+	writer Writer
+	opts   Options
+}
+
+func New(writer Writer, opts Options) (*Importer, error) {
+	switch opts.Mode {
+	case MODE_UPSERT, MODE_SKIP, MODE_FAIL:
+	default:
+		return nil, errModeInvalid
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+
+	return &Importer{
+		writer: writer,
+		opts:   opts,
+	}, nil
+}
+
+// Import stream documents from r, which is either NDJSON (one document per line or just concatenated)
+// or a JSON array, both in Extended JSON. Invalid rows are counted and reported, they do not stop the import.
+func (im *Importer) Import(ctx context.Context, r io.Reader) (Summary, error) {
+	return im.ImportSource(ctx, JSONSource(r))
+}
+
+// ImportSource write rows of source in batches. Invalid rows are counted and reported, they do not stop the import.
+func (im *Importer) ImportSource(ctx context.Context, source Source) (Summary, error) {
+	summary := Summary{report: im.opts.Report}
+
+	// account ids seen earlier in this input, a repeat behave like an existing account in dry run
+	seen := make(map[int]bool)
+
+	// writeErr tell write errors apart from input errors once the source stopped
+	var writeErr error
+
+	batch := make([]Row, 0, im.opts.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if im.opts.DryRun {
+			writeErr = im.plan(ctx, batch, seen, &summary)
+		} else {
+			writeErr = im.writer.Write(ctx, batch, im.opts.Mode, &summary)
+		}
+
+		batch = batch[:0]
+		return writeErr
+	}
+
+	err := source(func(row Row, err error) error {
+		if err != nil {
+			summary.record(row, ROW_INVALID, errorDetails(err)...)
+			return nil
+		}
+
+		if im.opts.Validate != nil {
+			if details := im.opts.Validate(row.Account); len(details) > 0 {
+				summary.record(row, ROW_INVALID, details...)
+				return nil
+			}
+		}
+
+		batch = append(batch, row)
+		if len(batch) < im.opts.BatchSize {
+			return nil
+		}
+
+		return flush()
+	})
+	switch {
+	case err == nil:
+		err = flush()
+	case writeErr == nil:
+		err = fmt.Errorf("%w: %w", ErrInput, err)
+	}
+
+	// invalid rows are recorded as they are read and valid ones when their batch is written
+	sort.SliceStable(summary.Rows, func(i, j int) bool {
+		return summary.Rows[i].Line < summary.Rows[j].Line
+	})
+
+	return summary, err
+}
+
+// plan classify rows without writing them
+func (im *Importer) plan(ctx context.Context, rows []Row, seen map[int]bool, summary *Summary) error {
+	ids := make([]int, len(rows))
+	for i, row := range rows {
+		ids[i] = row.Account.AccountID
+	}
+
+	existing, err := im.writer.Existing(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		id := row.Account.AccountID
+		if !existing[id] && !seen[id] {
+			seen[id] = true
+			summary.record(row, ROW_INSERTED)
+			continue
+		}
+
+		switch im.opts.Mode {
+		case MODE_UPSERT:
+			summary.record(row, ROW_UPDATED)
+		case MODE_SKIP:
+			summary.record(row, ROW_SKIPPED, duplicateDetail)
+		case MODE_FAIL:
+			summary.record(row, ROW_CONFLICT, duplicateDetail)
+			return fmt.Errorf("line %d: %w", row.Line, ErrConflict)
+		}
+	}
+
+	return nil
+}
+
+// JSONSource read rows from Extended JSON documents of r, see ReadDocuments
+func JSONSource(r io.Reader) Source {
+	return func(fn func(row Row, err error) error) error {
+		return ReadDocuments(r, func(line int, raw json.RawMessage, err error) error {
+			if err != nil {
+				return fn(Row{Line: line}, err)
+			}
+
+			return fn(ParseRow(line, raw))
+		})
+	}
+}
+
+// ParseRow decode Extended JSON document into a row, the document must decode as an account
+func ParseRow(line int, raw json.RawMessage) (Row, error) {
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON(raw, false, &doc); err != nil {
+		return Row{Line: line}, err
+	}
+
+	if _, err := doc.LookupErr("account_id"); err != nil {
+		return Row{Line: line}, &FieldError{Field: "account_id", Rule: "required", Err: errAccountIDMissing}
+	}
+
+	if id, err := doc.LookupErr("_id"); err == nil && id.Type != bsontype.ObjectID {
+		return Row{Line: line}, &FieldError{Field: "_id", Rule: "objectid", Err: errIDNotObjectID}
+	}
+
+	var account entity.Account
+	if err := bson.Unmarshal(doc, &account); err != nil {
+		return Row{Line: line}, err
+	}
+
+	return Row{
+		Line:     line,
+		Document: doc,
+		Account:  account,
+	}, nil
+}
+
+// ReadDocuments call fn with every top level JSON document of r and the line it starts on.
+// A top level array is unwrapped so its elements are the documents. A malformed document outside of an array is given
+// to fn with its error and reading resume on the next document, see resumeAfter. Inside an array where it ends can not
+// be told, so the error stop the reading.
+func ReadDocuments(r io.Reader, fn func(line int, raw json.RawMessage, err error) error) error {
+	counter := &lineCounter{r: bufio.NewReader(r), line: 1}
+	decoder := json.NewDecoder(counter)
+
+	first, err := peekToken(counter)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	array := first == '['
+	if array {
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	}
+
+	// offset in r of the decoder input, it move when a new decoder resume after a malformed document
+	var base int64
+	for decoder.More() {
+		// offset of the next document is after any whitespace the decoder already buffered
+		start := base + decoder.InputOffset() + int64(leadingSpace(decoder))
+		line := counter.lineAt(start)
+
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+
+		var syntaxErr *json.SyntaxError
+		switch {
+		case err == nil:
+			err = fn(line, raw, nil)
+		case !array && errors.Is(err, io.ErrUnexpectedEOF):
+			// the last document is cut short
+			return fn(line, nil, err)
+		case !array && errors.As(err, &syntaxErr):
+			rest, restAt, resumeErr := resumeAfter(decoder, counter, base+decoder.InputOffset(), start)
+			if resumeErr != nil {
+				return resumeErr
+			}
+
+			decoder = json.NewDecoder(io.MultiReader(bytes.NewReader(rest), counter))
+			base = restAt
+			err = fn(line, nil, err)
+		default:
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if array {
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumeAfter skip the malformed document starting at offset start, the failed decoder input left start at bufferedAt.
+// When the line of the error begin with it the document was cut short and the next one start there, otherwise the
+// rest of that line is skipped. It return the input to decode next, which go on with counter, and its offset.
+func resumeAfter(decoder *json.Decoder, counter *lineCounter, bufferedAt int64, start int64) ([]byte, int64, error) {
+	buffered, _ := io.ReadAll(decoder.Buffered())
+	from := int(start - bufferedAt)
+	if from < 0 || from > len(buffered) {
+		from = 0
+	}
+
+	// decode the document alone again to find the byte it fail on
+	at := len(buffered)
+	var syntaxErr *json.SyntaxError
+	if err := json.NewDecoder(bytes.NewReader(buffered[from:])).Decode(new(json.RawMessage)); errors.As(err, &syntaxErr) {
+		at = from + int(syntaxErr.Offset) - 1
+	}
+	if at < from || at > len(buffered) {
+		at = len(buffered)
+	}
+
+	lineStart := bytes.LastIndexByte(buffered[:at], '\n') + 1
+	if lineStart > from && len(bytes.TrimSpace(buffered[lineStart:at])) == 0 {
+		return buffered[lineStart:], bufferedAt + int64(lineStart), nil
+	}
+
+	if end := bytes.IndexByte(buffered[at:], '\n'); end >= 0 {
+		next := at + end + 1
+		return buffered[next:], bufferedAt + int64(next), nil
+	}
+
+	// the line go on past what the decoder read
+	skipped, err := counter.skipLine()
+	return nil, bufferedAt + int64(len(buffered)) + skipped, err
+}
+
+// leadingSpace count whitespace and array separators buffered before the next document
+func leadingSpace(decoder *json.Decoder) int {
+	buffered, _ := io.ReadAll(io.LimitReader(decoder.Buffered(), 4096))
+
+	n := 0
+	for _, b := range buffered {
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' && b != ',' {
+			break
+		}
+		n++
+	}
+
+	return n
+}
+
+// lineCounter remember where lines start so a byte offset can be turned into a line number.
+// Offsets are asked in increasing order, so passed line starts are dropped and memory stay bounded by the decoder buffer.
+type lineCounter struct {
+	r          *bufio.Reader
+	offset     int64
+	line       int
+	lineStarts []int64
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			c.lineStarts = append(c.lineStarts, c.offset+int64(i)+1)
+		}
+	}
+	c.offset += int64(n)
+
+	return n, err
+}
+
+// skipLine read up to the end of the current line and return how many bytes were read
+func (c *lineCounter) skipLine() (int64, error) {
+	var b [1]byte
+	var n int64
+	for {
+		read, err := c.Read(b[:])
+		n += int64(read)
+		if read > 0 && b[0] == '\n' || err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// lineAt return 1-based line of byte offset
+func (c *lineCounter) lineAt(offset int64) int {
+	for len(c.lineStarts) > 0 && c.lineStarts[0] <= offset {
+		c.lineStarts = c.lineStarts[1:]
+		c.line++
+	}
+
+	return c.line
+}
+
+// peekToken return first non whitespace byte without consuming it
+func peekToken(c *lineCounter) (byte, error) {
+	for i := 1; ; i++ {
+		b, err := c.r.Peek(i)
+		if err != nil {
+			return 0, err
+		}
+
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+
+		return b[i-1], nil
+	}
+}
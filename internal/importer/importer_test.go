@@ -0,0 +1,105 @@
+package importer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// document is a document or an error read by ReadDocuments
+type document struct {
+	line int
+	raw  string
+	err  bool
+}
+
+func readAll(t *testing.T, input string) ([]document, error) {
+	t.Helper()
+
+	var documents []document
+	err := ReadDocuments(strings.NewReader(input), func(line int, raw json.RawMessage, err error) error {
+		documents = append(documents, document{line: line, raw: string(raw), err: err != nil})
+		return nil
+	})
+
+	return documents, err
+}
+
+func TestReadDocumentsResumeAfterMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []document
+	}{
+		{
+			name:  "malformed line",
+			input: "{\"account_id\":1}\n{account_id:2}\n{\"account_id\":3}",
+			want: []document{
+				{line: 1, raw: `{"account_id":1}`},
+				{line: 2, err: true},
+				{line: 3, raw: `{"account_id":3}`},
+			},
+		},
+		{
+			name:  "line cut short",
+			input: "{\"account_id\":1\n{\"account_id\":2}\n",
+			want: []document{
+				{line: 1, err: true},
+				{line: 2, raw: `{"account_id":2}`},
+			},
+		},
+		{
+			name:  "concatenated documents after a malformed one",
+			input: "{\"account_id\":1,}\n{\"account_id\":2} {\"account_id\":3}",
+			want: []document{
+				{line: 1, err: true},
+				{line: 2, raw: `{"account_id":2}`},
+				{line: 2, raw: `{"account_id":3}`},
+			},
+		},
+		{
+			name:  "long malformed line",
+			input: "{\"x\":\"" + strings.Repeat("x", 64*1024) + "\" oops}\n{\"account_id\":2}",
+			want: []document{
+				{line: 1, err: true},
+				{line: 2, raw: `{"account_id":2}`},
+			},
+		},
+		{
+			name:  "last document cut short",
+			input: "{\"account_id\":1}\n{\"account_id\":",
+			want: []document{
+				{line: 1, raw: `{"account_id":1}`},
+				{line: 2, err: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readAll(t, tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("document %d is %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadDocumentsArrayStopOnMalformed(t *testing.T) {
+	got, err := readAll(t, "[{\"account_id\":1},\n{bad},\n{\"account_id\":3}]")
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("got error %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %+v", got)
+	}
+}
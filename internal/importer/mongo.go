@@ -0,0 +1,183 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// duplicate key server error code
+const codeDuplicateKey = 11000
+
+type mongoWriter struct {
+	collection *mongo.Collection
+}
+
+// NewMongoWriter write rows with one BulkWrite per batch, documents keep every field of the input including _id
+func NewMongoWriter(collection *mongo.Collection) Writer {
+	return &mongoWriter{
+		collection: collection,
+	}
+}
+
+// Write implements Writer.
+func (w *mongoWriter) Write(ctx context.Context, rows []Row, mode Mode, summary *Summary) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	models := make([]mongo.WriteModel, len(rows))
+	for i, row := range rows {
+		if mode == MODE_UPSERT {
+			models[i] = upsertModel(row, now)
+			continue
+		}
+
+		models[i] = mongo.NewInsertOneModel().SetDocument(withStamps(row, now))
+	}
+
+	// fail mode stop at the first error, other modes let every row of the batch through
+	opts := options.BulkWrite().SetOrdered(mode == MODE_FAIL)
+
+	result, err := w.collection.BulkWrite(ctx, models, opts)
+	var bulkErr mongo.BulkWriteException
+	if err != nil && (!errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil) {
+		return err
+	}
+
+	if result == nil {
+		result = &mongo.BulkWriteResult{}
+	}
+
+	failed := make(map[int]mongo.BulkWriteError, len(bulkErr.WriteErrors))
+	for _, we := range bulkErr.WriteErrors {
+		failed[we.Index] = we
+	}
+
+	// ordered write stop at its first error, later rows of the batch were not attempted
+	attempted := rows
+	if mode == MODE_FAIL && len(bulkErr.WriteErrors) > 0 {
+		attempted = rows[:bulkErr.WriteErrors[0].Index+1]
+	}
+
+	for i, row := range attempted {
+		we, ok := failed[i]
+		switch {
+		case ok && we.Code != codeDuplicateKey && mode == MODE_FAIL:
+			summary.record(row, ROW_INVALID, model.ErrorDetail{Message: we.Message})
+			return fmt.Errorf("line %d: %w: %s", row.Line, ErrRejected, we.Message)
+		case ok && we.Code != codeDuplicateKey:
+			summary.record(row, ROW_INVALID, model.ErrorDetail{Message: we.Message})
+		case ok && mode == MODE_FAIL:
+			summary.record(row, ROW_CONFLICT, duplicateDetail)
+			return fmt.Errorf("line %d: %w", row.Line, ErrConflict)
+		case ok:
+			summary.record(row, ROW_SKIPPED, duplicateDetail)
+		case mode != MODE_UPSERT:
+			summary.record(row, ROW_INSERTED)
+		default:
+			// an upsert either inserted the account or matched the existing one
+			if _, inserted := result.UpsertedIDs[int64(i)]; inserted {
+				summary.record(row, ROW_INSERTED)
+			} else {
+				summary.record(row, ROW_UPDATED)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Existing implements Writer.
+func (w *mongoWriter) Existing(ctx context.Context, accountIDs []int) (map[int]bool, error) {
+	filter := bson.M{"account_id": bson.M{"$in": accountIDs}}
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "account_id": 1})
+
+	cursor, err := w.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	existing := make(map[int]bool, len(accountIDs))
+	for cursor.Next(ctx) {
+		var doc struct {
+			AccountID int `bson:"account_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+
+		existing[doc.AccountID] = true
+	}
+
+	return existing, cursor.Err()
+}
+
+// upsertModel set every input field on the account, _id and created_at are only used when the account is inserted.
+// The version and update time are bumped like any other write, so an inserted account start at version 1.
+// An overwritten account is live again even if it was soft deleted.
+func upsertModel(row Row, now time.Time) mongo.WriteModel {
+	set := bson.D{}
+	setOnInsert := bson.D{{Key: "created_at", Value: createdAt(row.Account, now)}}
+
+	elements, _ := row.Document.Elements()
+	for _, e := range elements {
+		switch e.Key() {
+		case "_id":
+			setOnInsert = append(setOnInsert, bson.E{Key: "_id", Value: e.Value()})
+		case "version", "created_at", "updated_at", "deleted_at", "deleted_by":
+		default:
+			set = append(set, bson.E{Key: e.Key(), Value: e.Value()})
+		}
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$unset", Value: bson.M{"deleted_at": "", "deleted_by": ""}},
+		{Key: "$inc", Value: bson.M{"version": 1}},
+		{Key: "$max", Value: bson.M{"updated_at": now}},
+		{Key: "$setOnInsert", Value: setOnInsert},
+	}
+
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"account_id": row.Account.AccountID}).
+		SetUpdate(update).
+		SetUpsert(true)
+}
+
+// withStamps give an inserted document version 1 and its timestamps, the version and update time of the input are not kept
+func withStamps(row Row, now time.Time) bson.D {
+	elements, _ := row.Document.Elements()
+
+	d := make(bson.D, 0, len(elements)+3)
+	for _, e := range elements {
+		switch e.Key() {
+		case "version", "created_at", "updated_at":
+		default:
+			d = append(d, bson.E{Key: e.Key(), Value: e.Value()})
+		}
+	}
+
+	return append(d,
+		bson.E{Key: "version", Value: int64(1)},
+		bson.E{Key: "created_at", Value: createdAt(row.Account, now)},
+		bson.E{Key: "updated_at", Value: now},
+	)
+}
+
+// createdAt is the creation time of an imported account, the input created_at or else the time in its _id or else now
+func createdAt(account entity.Account, now time.Time) time.Time {
+	switch {
+	case !account.CreatedAt.IsZero():
+		return account.CreatedAt.UTC()
+	case !account.ID.IsZero():
+		return account.ID.Timestamp().UTC()
+	}
+
+	return now
+}
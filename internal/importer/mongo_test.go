@@ -0,0 +1,51 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/mongotest"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMongoWriterFailModeStopOnRejectedRow(t *testing.T) {
+	database := mongotest.Database(t)
+	ctx := context.Background()
+
+	// the validator refuse negative limits, which is not a duplicate key error
+	validator := bson.M{"$jsonSchema": bson.M{"properties": bson.M{"limit": bson.M{"minimum": 0}}}}
+	if err := database.CreateCollection(ctx, "accounts", options.CreateCollection().SetValidator(validator)); err != nil {
+		t.Fatalf("create collection: %v", err)
+	}
+
+	im, err := New(NewMongoWriter(database.Collection("accounts")), Options{Mode: MODE_FAIL, Report: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := strings.Join([]string{
+		`{"account_id":1,"limit":10}`,
+		`{"account_id":2,"limit":-1}`,
+		`{"account_id":3,"limit":10}`,
+	}, "\n")
+
+	summary, err := im.Import(ctx, strings.NewReader(input))
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("err = %v, want ErrRejected", err)
+	}
+
+	if summary.Inserted != 1 || summary.Invalid != 1 {
+		t.Errorf("inserted %d invalid %d, want 1 and 1", summary.Inserted, summary.Invalid)
+	}
+
+	count, err := database.Collection("accounts").CountDocuments(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d accounts stored, want 1, rows after the rejected one are not attempted", count)
+	}
+}
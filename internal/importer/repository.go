@@ -0,0 +1,78 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+type repositoryWriter struct {
+	repo repositories.Repository
+}
+
+// NewRepositoryWriter write rows one account at a time through a repository, meant for the in-memory repository
+// where there is no round trip to batch. Only account fields are kept.
+func NewRepositoryWriter(repo repositories.Repository) Writer {
+	return &repositoryWriter{
+		repo: repo,
+	}
+}
+
+// Write implements Writer.
+func (w *repositoryWriter) Write(ctx context.Context, rows []Row, mode Mode, summary *Summary) error {
+	for _, row := range rows {
+		_, err := w.repo.Create(ctx, row.Account)
+		if err == nil {
+			summary.record(row, ROW_INSERTED)
+			continue
+		}
+
+		if !errs.Is(err, errs.Conflict) {
+			return err
+		}
+
+		switch mode {
+		case MODE_UPSERT:
+			// overwrite whatever version is stored, a soft deleted account is restored first
+			account := row.Account
+			account.Version = 0
+			_, err := w.repo.Update(ctx, account)
+			if errs.Is(err, errs.NotFound) {
+				if _, err = w.repo.Restore(ctx, account.AccountID, 0); err == nil {
+					_, err = w.repo.Update(ctx, account)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			summary.record(row, ROW_UPDATED)
+		case MODE_SKIP:
+			summary.record(row, ROW_SKIPPED, duplicateDetail)
+		case MODE_FAIL:
+			summary.record(row, ROW_CONFLICT, duplicateDetail)
+			return fmt.Errorf("line %d: %w", row.Line, ErrConflict)
+		}
+	}
+
+	return nil
+}
+
+// Existing implements Writer.
+func (w *repositoryWriter) Existing(ctx context.Context, accountIDs []int) (map[int]bool, error) {
+	existing := make(map[int]bool, len(accountIDs))
+	for _, id := range accountIDs {
+		_, err := w.repo.GetByAccountID(ctx, id, true)
+		if err == nil {
+			existing[id] = true
+			continue
+		}
+
+		if !errs.Is(err, errs.NotFound) {
+			return nil, err
+		}
+	}
+
+	return existing, nil
+}
@@ -0,0 +1,360 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DUPLICATES_COLLECTION_NAME string = "accounts_duplicates"
+
+	// server error code of dropping an index or collection that does not exist
+	codeIndexNotFound     = 27
+	codeNamespaceNotFound = 26
+	codeNamespaceExists   = 48
+)
+
+// All is every migration of the accounts database, append new migrations with the next version
+var All = []Migration{
+	{
+		Version:     1,
+		Description: "move duplicate account_id documents to accounts_duplicates",
+		Up:          deduplicateAccountsUp,
+		Down:        deduplicateAccountsDown,
+	},
+	{
+		Version:     2,
+		Description: "create accounts indexes",
+		Up:          accountIndexesUp,
+		Down:        accountIndexesDown,
+	},
+	{
+		Version:     3,
+		Description: "backfill missing products and limit",
+		Up:          backfillAccountFieldsUp,
+		Down:        noop,
+	},
+	{
+		Version:     4,
+		Description: "give every account a version",
+		Up:          accountVersionUp,
+		Down:        accountVersionDown,
+	},
+	{
+		Version:     5,
+		Description: "create accounts deleted_at index",
+		Up:          deletedAtIndexUp,
+		Down:        deletedAtIndexDown,
+	},
+	{
+		Version:     6,
+		Description: "create account history indexes",
+		Up:          historyIndexesUp,
+		Down:        historyIndexesDown,
+	},
+	{
+		Version:     7,
+		Description: "backfill account timestamps from _id",
+		Up:          accountTimestampsUp,
+		Down:        accountTimestampsDown,
+	},
+	{
+		Version:     8,
+		Description: "create account outbox collection",
+		Up:          outboxUp,
+		Down:        outboxDown,
+	},
+	{
+		Version:     9,
+		Description: "create webhook deliveries indexes",
+		Up:          webhookDeliveryIndexesUp,
+		Down:        webhookDeliveryIndexesDown,
+	},
+}
+
+// Index sets are copied as each migration created them, so a migration keep doing the same whatever the declared
+// indexes become. An index declared later in repositories needs a migration of its own.
+var (
+	// accountIndexesV2 are the accounts indexes of migration 2
+	accountIndexesV2 = []repositories.IndexSpec{
+		{Name: "account_id_unique", Keys: bson.D{{Key: "account_id", Value: 1}}, Unique: true},
+		{Name: "products", Keys: bson.D{{Key: "products", Value: 1}}},
+		{Name: "limit_id", Keys: bson.D{{Key: "limit", Value: 1}, {Key: "_id", Value: 1}}},
+		{Name: "limit_account_id", Keys: bson.D{{Key: "limit", Value: 1}, {Key: "account_id", Value: 1}}},
+		{Name: "limit_account_id_desc", Keys: bson.D{{Key: "limit", Value: 1}, {Key: "account_id", Value: -1}}},
+	}
+
+	// deletedAtIndexesV5 are the accounts indexes of migration 5
+	deletedAtIndexesV5 = []repositories.IndexSpec{
+		{Name: "deleted_at", Keys: bson.D{{Key: "deleted_at", Value: 1}}},
+	}
+
+	// historyIndexesV6 are the account history indexes of migration 6
+	historyIndexesV6 = []repositories.IndexSpec{
+		{Name: "account_id_at", Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "at", Value: -1}, {Key: "_id", Value: -1}}},
+	}
+
+	// timestampIndexesV7 are the accounts indexes of migration 7
+	timestampIndexesV7 = []repositories.IndexSpec{
+		{Name: "created_at", Keys: bson.D{{Key: "created_at", Value: 1}}},
+		{Name: "updated_at_id", Keys: bson.D{{Key: "updated_at", Value: 1}, {Key: "_id", Value: 1}}},
+	}
+
+	// outboxIndexesV8 are the account outbox indexes of migration 8
+	outboxIndexesV8 = []repositories.IndexSpec{
+		{Name: "account_id_seq_id", Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "seq", Value: 1}, {Key: "_id", Value: 1}}},
+	}
+
+	// webhookDeliveryIndexesV9 are the webhook deliveries indexes of migration 9
+	webhookDeliveryIndexesV9 = []repositories.IndexSpec{
+		{Name: "webhook_id_event_id_unique", Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "event_id", Value: 1}}, Unique: true},
+		{Name: "state_next_attempt_at", Keys: bson.D{{Key: "state", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Name: "webhook_id_state_id", Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "state", Value: 1}, {Key: "_id", Value: -1}}},
+	}
+)
+
+// deduplicateAccountsUp keep the oldest document of every account_id so the unique index can be built
+func deduplicateAccountsUp(ctx context.Context, db *mongo.Database) error {
+	accounts := db.Collection(repositories.ACCOUNTS_COLLECTION_NAME)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$account_id"},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+	}
+
+	cursor, err := accounts.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var groups []struct {
+		IDs bson.A `bson:"ids"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	var duplicateIDs bson.A
+	for _, g := range groups {
+		duplicateIDs = append(duplicateIDs, g.IDs[1:]...)
+	}
+
+	if len(duplicateIDs) == 0 {
+		return nil
+	}
+
+	return moveDocuments(ctx, accounts, db.Collection(DUPLICATES_COLLECTION_NAME), bson.M{"_id": bson.M{"$in": duplicateIDs}})
+}
+
+func deduplicateAccountsDown(ctx context.Context, db *mongo.Database) error {
+	duplicates := db.Collection(DUPLICATES_COLLECTION_NAME)
+	if err := moveDocuments(ctx, duplicates, db.Collection(repositories.ACCOUNTS_COLLECTION_NAME), bson.M{}); err != nil {
+		return err
+	}
+
+	return ignoreCode(duplicates.Drop(ctx), codeNamespaceNotFound)
+}
+
+func accountIndexesUp(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection(repositories.ACCOUNTS_COLLECTION_NAME), accountIndexesV2)
+}
+
+func accountIndexesDown(ctx context.Context, db *mongo.Database) error {
+	return dropIndexes(ctx, db.Collection(repositories.ACCOUNTS_COLLECTION_NAME), accountIndexesV2)
+}
+
+func historyIndexesUp(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection(repositories.ACCOUNT_HISTORY_COLLECTION_NAME), historyIndexesV6)
+}
+
+func historyIndexesDown(ctx context.Context, db *mongo.Database) error {
+	return dropIndexes(ctx, db.Collection(repositories.ACCOUNT_HISTORY_COLLECTION_NAME), historyIndexesV6)
+}
+
+// backfillAccountFieldsUp give every account a products array and a limit so readers do not deal with missing fields
+func backfillAccountFieldsUp(ctx context.Context, db *mongo.Database) error {
+	accounts := db.Collection(repositories.ACCOUNTS_COLLECTION_NAME)
+
+	// $eq null match both null and missing field
+	if _, err := accounts.UpdateMany(ctx, bson.M{"products": nil}, bson.M{"$set": bson.M{"products": bson.A{}}}); err != nil {
+		return err
+	}
+
+	_, err := accounts.UpdateMany(ctx, bson.M{"limit": nil}, bson.M{"$set": bson.M{"limit": 0}})
+	return err
+}
+
+// accountVersionUp start existing accounts at version 1, the first version of a created account
+func accountVersionUp(ctx context.Context, db *mongo.Database) error {
+	accounts := db.Collection(repositories.ACCOUNTS_COLLECTION_NAME)
+
+	_, err := accounts.UpdateMany(ctx, bson.M{"version": nil}, bson.M{"$set": bson.M{"version": 1}})
+	return err
+}
+
+func accountVersionDown(ctx context.Context, db *mongo.Database) error {
+	accounts := db.Collection(repositories.ACCOUNTS_COLLECTION_NAME)
+
+	_, err := accounts.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"version": ""}})
+	return err
+}
+
+func deletedAtIndexUp(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection(repositories.ACCOUNTS_COLLECTION_NAME), deletedAtIndexesV5)
+}
+
+func deletedAtIndexDown(ctx context.Context, db *mongo.Database) error {
+	return dropIndexes(ctx, db.Collection(repositories.ACCOUNTS_COLLECTION_NAME), deletedAtIndexesV5)
+}
+
+// accountTimestampsUp set created_at of existing accounts to the time in their _id, an account never updated since
+// was last updated then. Accounts inserted with a non ObjectId _id get the time of the migration.
+func accountTimestampsUp(ctx context.Context, db *mongo.Database) error {
+	accounts := db.Collection(repositories.ACCOUNTS_COLLECTION_NAME)
+
+	created := bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$_id"}}, "objectId"}}},
+		bson.D{{Key: "$toDate", Value: "$_id"}},
+		"$$NOW",
+	}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "created_at", Value: created}}}},
+		{{Key: "$set", Value: bson.D{{Key: "updated_at", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$updated_at", "$created_at"}}}}}}},
+	}
+
+	// $eq null match both null and missing field
+	if _, err := accounts.UpdateMany(ctx, bson.M{"created_at": nil}, pipeline); err != nil {
+		return err
+	}
+
+	return createIndexes(ctx, accounts, timestampIndexesV7)
+}
+
+func accountTimestampsDown(ctx context.Context, db *mongo.Database) error {
+	accounts := db.Collection(repositories.ACCOUNTS_COLLECTION_NAME)
+	if err := dropIndexes(ctx, accounts, timestampIndexesV7); err != nil {
+		return err
+	}
+
+	_, err := accounts.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"created_at": "", "updated_at": ""}})
+	return err
+}
+
+// outboxUp create the outbox and sequences collections ahead, servers before 4.4 can not create them inside the
+// transaction of a change. The index is the relay read order.
+func outboxUp(ctx context.Context, db *mongo.Database) error {
+	if err := ignoreCode(db.CreateCollection(ctx, repositories.OUTBOX_COLLECTION_NAME), codeNamespaceExists); err != nil {
+		return err
+	}
+	if err := ignoreCode(db.CreateCollection(ctx, repositories.OUTBOX_SEQUENCE_COLLECTION_NAME), codeNamespaceExists); err != nil {
+		return err
+	}
+
+	return createIndexes(ctx, db.Collection(repositories.OUTBOX_COLLECTION_NAME), outboxIndexesV8)
+}
+
+// outboxDown drop the outbox with the events not published yet, the sequences and the relay lease
+func outboxDown(ctx context.Context, db *mongo.Database) error {
+	for _, name := range []string{
+		repositories.OUTBOX_COLLECTION_NAME,
+		repositories.OUTBOX_SEQUENCE_COLLECTION_NAME,
+		repositories.OUTBOX_LEASE_COLLECTION_NAME,
+	} {
+		if err := db.Collection(name).Drop(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func webhookDeliveryIndexesUp(ctx context.Context, db *mongo.Database) error {
+	return createIndexes(ctx, db.Collection(repositories.WEBHOOK_DELIVERIES_COLLECTION_NAME), webhookDeliveryIndexesV9)
+}
+
+func webhookDeliveryIndexesDown(ctx context.Context, db *mongo.Database) error {
+	return dropIndexes(ctx, db.Collection(repositories.WEBHOOK_DELIVERIES_COLLECTION_NAME), webhookDeliveryIndexesV9)
+}
+
+// createIndexes build specs on collection in one command
+func createIndexes(ctx context.Context, collection *mongo.Collection, specs []repositories.IndexSpec) error {
+	models := make([]mongo.IndexModel, len(specs))
+	for i, spec := range specs {
+		models[i] = mongo.IndexModel{
+			Keys:    spec.Keys,
+			Options: options.Index().SetName(spec.Name).SetUnique(spec.Unique),
+		}
+	}
+
+	_, err := collection.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// dropIndexes drop specs from collection, indexes or a collection already gone are skipped
+func dropIndexes(ctx context.Context, collection *mongo.Collection, specs []repositories.IndexSpec) error {
+	for _, spec := range specs {
+		_, err := collection.Indexes().DropOne(ctx, spec.Name)
+		if ignoreCode(err, codeIndexNotFound) != nil && ignoreCode(err, codeNamespaceNotFound) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// noop is the down of a migration that can not tell backfilled values from original ones
+func noop(ctx context.Context, db *mongo.Database) error {
+	return nil
+}
+
+// moveDocuments copy matching documents to another collection then delete them from the source
+func moveDocuments(ctx context.Context, from, to *mongo.Collection, filter interface{}) error {
+	cursor, err := from.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var docs []interface{}
+	var ids bson.A
+	for cursor.Next(ctx) {
+		var doc bson.Raw
+		doc = append(doc, cursor.Current...)
+		docs = append(docs, doc)
+		ids = append(ids, doc.Lookup("_id"))
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	if _, err := to.InsertMany(ctx, docs); err != nil {
+		return err
+	}
+
+	_, err = from.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+func ignoreCode(err error, code int) error {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && int(cmdErr.Code) == code {
+		return nil
+	}
+
+	return err
+}
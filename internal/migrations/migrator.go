@@ -0,0 +1,287 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MIGRATIONS_COLLECTION_NAME string = "schema_migrations"
+	LOCK_COLLECTION_NAME       string = "schema_migrations_lock"
+
+	lockID string = "lock"
+)
+
+var (
+	ErrLocked = errors.New("migrations are locked by another instance")
+
+	ErrLockLost = errors.New("migration lock was lost to another instance")
+
+	errVersionDuplicate = errors.New("migration version is registered twice")
+)
+
+// Migration is one schema change, versions are applied in ascending order and rolled back in descending order
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// MigrationStatus tell whether a migration has been applied
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+// appliedMigration is a document of schema_migrations collection
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// migrationLock is the single document of the lock collection, an expired lock can be taken over
+type migrationLock struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type Migrator struct {
+	db         *mongo.Database
+	migrations []Migration
+	owner      string
+	lockTTL    time.Duration
+}
+
+// New create migrator of given migrations, lockTTL bound how long a crashed instance may hold the lock
+func New(db *mongo.Database, migrations []Migration, lockTTL time.Duration) (*Migrator, error) {
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Version == sorted[i-1].Version {
+			return nil, fmt.Errorf("%w: %d", errVersionDuplicate, sorted[i].Version)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &Migrator{
+		db:         db,
+		migrations: sorted,
+		owner:      fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		lockTTL:    lockTTL,
+	}, nil
+}
+
+// Status list every registered migration with its applied state
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, mig := range m.migrations {
+		statuses[i] = MigrationStatus{
+			Version:     mig.Version,
+			Description: mig.Description,
+		}
+
+		if a, ok := applied[mig.Version]; ok {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = a.AppliedAt
+		}
+	}
+
+	return statuses, nil
+}
+
+// Up apply pending migrations up to target version (0 means all), it returns applied versions
+func (m *Migrator) Up(ctx context.Context, target int) ([]int, error) {
+	var done []int
+	err := m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if target > 0 && mig.Version > target {
+				break
+			}
+
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			if err := mig.Up(ctx, m.db); err != nil {
+				return fmt.Errorf("migration %d up: %w", mig.Version, err)
+			}
+
+			record := appliedMigration{
+				Version:     mig.Version,
+				Description: mig.Description,
+				AppliedAt:   time.Now().UTC(),
+			}
+			if _, err := m.db.Collection(MIGRATIONS_COLLECTION_NAME).InsertOne(ctx, record); err != nil {
+				return fmt.Errorf("migration %d record: %w", mig.Version, err)
+			}
+
+			done = append(done, mig.Version)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down roll back the latest applied migrations, steps is how many, it returns rolled back versions
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int, error) {
+	var done []int
+	err := m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+
+			if err := mig.Down(ctx, m.db); err != nil {
+				return fmt.Errorf("migration %d down: %w", mig.Version, err)
+			}
+
+			if _, err := m.db.Collection(MIGRATIONS_COLLECTION_NAME).DeleteOne(ctx, bson.M{"_id": mig.Version}); err != nil {
+				return fmt.Errorf("migration %d record: %w", mig.Version, err)
+			}
+
+			done = append(done, mig.Version)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	cursor, err := m.db.Collection(MIGRATIONS_COLLECTION_NAME).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var records []appliedMigration
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]appliedMigration, len(records))
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+
+	return applied, nil
+}
+
+// withLock run fn while holding the migration lock. The lock is renewed every third of its TTL so a long migration keep
+// it, fn is cancelled when it is lost anyway.
+func (m *Migrator) withLock(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lost := make(chan error, 1)
+	go func() {
+		lost <- m.heartbeat(ctx)
+		cancel()
+	}()
+
+	err := fn(ctx)
+	cancel()
+	if lostErr := <-lost; lostErr != nil {
+		return lostErr
+	}
+
+	return err
+}
+
+// heartbeat push the lock expiry back until ctx is done, it return ErrLockLost when the lock is not ours anymore
+func (m *Migrator) heartbeat(ctx context.Context) error {
+	ticker := time.NewTicker(m.lockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		filter := bson.M{"_id": lockID, "owner": m.owner}
+		update := bson.M{"$set": bson.M{"expires_at": time.Now().UTC().Add(m.lockTTL)}}
+		result, err := m.db.Collection(LOCK_COLLECTION_NAME).UpdateOne(ctx, filter, update)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			// a failed renewal is tried again, the lock is only given up once it is taken over
+			continue
+		case result.MatchedCount == 0:
+			return ErrLockLost
+		}
+	}
+}
+
+// lock take the lock when it is free or expired. When another instance hold it the upsert
+// try to insert a second document with the same _id and fail with duplicate key.
+func (m *Migrator) lock(ctx context.Context) error {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":        lockID,
+		"expires_at": bson.M{"$lt": now},
+	}
+	update := bson.M{"$set": migrationLock{
+		ID:        lockID,
+		Owner:     m.owner,
+		ExpiresAt: now.Add(m.lockTTL),
+	}}
+
+	_, err := m.db.Collection(LOCK_COLLECTION_NAME).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrLocked
+	}
+
+	return err
+}
+
+// unlock release the lock if it is still ours, it use a fresh context so a cancelled run still release it
+func (m *Migrator) unlock() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _ = m.db.Collection(LOCK_COLLECTION_NAME).DeleteOne(ctx, bson.M{"_id": lockID, "owner": m.owner})
+}
@@ -0,0 +1,184 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/mongotest"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errTestMigration = errors.New("migration failed")
+
+// recorder register migrations that log their runs as "up 1", "down 1"
+type recorder struct {
+	runs []string
+	// failUp is the version whose up fail
+	failUp int
+}
+
+func (r *recorder) migration(version int) Migration {
+	return Migration{
+		Version:     version,
+		Description: fmt.Sprintf("migration %d", version),
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			if version == r.failUp {
+				return errTestMigration
+			}
+			r.runs = append(r.runs, fmt.Sprintf("up %d", version))
+			return nil
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			r.runs = append(r.runs, fmt.Sprintf("down %d", version))
+			return nil
+		},
+	}
+}
+
+func (r *recorder) migrator(t *testing.T, db *mongo.Database, versions ...int) *Migrator {
+	t.Helper()
+
+	var migrations []Migration
+	for _, version := range versions {
+		migrations = append(migrations, r.migration(version))
+	}
+
+	m, err := New(db, migrations, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// takeRuns return runs logged since the last call
+func (r *recorder) takeRuns() string {
+	runs := fmt.Sprint(r.runs)
+	r.runs = nil
+	return runs
+}
+
+func TestNewRefuseDuplicateVersion(t *testing.T) {
+	r := &recorder{}
+	if _, err := New(nil, []Migration{r.migration(1), r.migration(2), r.migration(1)}, time.Minute); !errors.Is(err, errVersionDuplicate) {
+		t.Errorf("err = %v, want %v", err, errVersionDuplicate)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	r := &recorder{}
+	m := r.migrator(t, mongotest.Database(t), 3, 1, 2)
+
+	done, err := m.Up(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.takeRuns(); got != "[up 1 up 2]" || fmt.Sprint(done) != "[1 2]" {
+		t.Errorf("up to 2 ran %s and returned %v, want versions 1 and 2 in order", got, done)
+	}
+
+	// applied migrations are not run again
+	done, err = m.Up(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.takeRuns(); got != "[up 3]" || fmt.Sprint(done) != "[3]" {
+		t.Errorf("up ran %s and returned %v, want version 3 only", got, done)
+	}
+
+	done, err = m.Up(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.takeRuns(); got != "[]" || len(done) != 0 {
+		t.Errorf("up with nothing pending ran %s and returned %v", got, done)
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range statuses {
+		if status.Version != i+1 || !status.Applied || status.AppliedAt.IsZero() {
+			t.Errorf("status %d = %+v, want version %d applied", i, status, i+1)
+		}
+	}
+
+	done, err = m.Down(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.takeRuns(); got != "[down 3 down 2]" || fmt.Sprint(done) != "[3 2]" {
+		t.Errorf("down 2 ran %s and returned %v, want versions 3 then 2", got, done)
+	}
+
+	statuses, err = m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Applied || statuses[1].Applied || statuses[2].Applied {
+		t.Errorf("statuses after down = %+v, want version 1 applied only", statuses)
+	}
+}
+
+func TestUpStopAtFailure(t *testing.T) {
+	ctx := context.Background()
+	r := &recorder{failUp: 2}
+	m := r.migrator(t, mongotest.Database(t), 1, 2, 3)
+
+	done, err := m.Up(ctx, 0)
+	if !errors.Is(err, errTestMigration) {
+		t.Fatalf("err = %v, want %v", err, errTestMigration)
+	}
+	if got := r.takeRuns(); got != "[up 1]" || fmt.Sprint(done) != "[1]" {
+		t.Errorf("up ran %s and returned %v, want version 1 only", got, done)
+	}
+
+	// the failed migration is pending, it run again once fixed
+	r.failUp = 0
+	if done, err = m.Up(ctx, 0); err != nil || fmt.Sprint(done) != "[2 3]" {
+		t.Errorf("up after the fix = %v, %v, want versions 2 and 3", done, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	db := mongotest.Database(t)
+	r := &recorder{}
+	m := r.migrator(t, db, 1)
+
+	other := r.migrator(t, db, 1)
+	if err := other.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(ctx, 0); !errors.Is(err, ErrLocked) {
+		t.Fatalf("up while locked err = %v, want %v", err, ErrLocked)
+	}
+	if got := r.takeRuns(); got != "[]" {
+		t.Errorf("up while locked ran %s", got)
+	}
+
+	// the lock of an instance that crashed is taken over once expired
+	other.lockTTL = -time.Minute
+	other.unlock()
+	if err := other.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(ctx, 0); err != nil {
+		t.Fatalf("up after the lock expired: %v", err)
+	}
+	if got := r.takeRuns(); got != "[up 1]" {
+		t.Errorf("up after the lock expired ran %s", got)
+	}
+
+	// the lock is released after a run
+	if err := other.lock(ctx); err != nil {
+		t.Errorf("lock after the run: %v", err)
+	}
+}
@@ -1,16 +1,59 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type AccountCreateRequest struct {
 	AccountID int      `json:"account_id" validate:"required"`
 	Limit     int      `json:"limit" validate:"required"`
 	Products  []string `json:"products" validate:"required"`
 }
 
+// AccountListRequest filter and page accounts, deleted ones are left out unless include_deleted is set,
+// updated_since included: clients syncing changes set both to get deletions as tombstones
 type AccountListRequest struct {
-	Product string     `query:"product"`
-	OrderBy OrderField `query:"order_by"`
-	Limit   int        `query:"limit"`
-	Page    int        `query:"page"`
+	Product         string     `query:"product"`
+	ProductsAll     []string   `query:"products_all"`
+	ProductsAny     []string   `query:"products_any"`
+	ProductsNone    []string   `query:"products_none"`
+	LimitMin        *int       `query:"limit_min"`
+	LimitMax        *int       `query:"limit_max"`
+	ProductCountMin *int       `query:"product_count_min"`
+	ProductCountMax *int       `query:"product_count_max"`
+	AccountIDMin    *int       `query:"account_id_min"`
+	AccountIDMax    *int       `query:"account_id_max"`
+	Sort            string     `query:"sort"`
+	OrderBy         OrderField `query:"order_by"`
+	Limit           int        `query:"limit"`
+	Page            int        `query:"page"`
+	Cursor          string     `query:"cursor"`
+	IncludeDeleted  bool       `query:"include_deleted"`
+	CreatedFrom     string     `query:"created_from"`
+	CreatedTo       string     `query:"created_to"`
+	UpdatedSince    string     `query:"updated_since"`
+}
+
+type AccountDetailRequest struct {
+	IncludeDeleted bool   `query:"include_deleted"`
+	AsOf           string `query:"as_of"`
+}
+
+type AccountDiffRequest struct {
+	From string `query:"from"`
+	To   string `query:"to"`
+}
+
+type AccountHistoryRequest struct {
+	Limit int `query:"limit"`
+	Page  int `query:"page"`
+}
+
+type AccountImportRequest struct {
+	Format     string `query:"format" json:"format" validate:"omitempty,oneof=csv ndjson"`
+	DryRun     bool   `query:"dry_run" json:"dry_run"`
+	OnConflict string `query:"on_conflict" json:"on_conflict" validate:"omitempty,oneof=skip overwrite fail"`
 }
 
 type OrderField struct {
@@ -22,8 +65,227 @@ type AccountUpdateRequest struct {
 	Products []string `json:"products" validate:"required"`
 }
 
+type AccountProductRequest struct {
+	Product string `json:"product" validate:"required"`
+}
+
+// PatchOperation is one RFC 6902 JSON Patch operation
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type AccountBulkRequest struct {
+	Ordered bool                       `json:"ordered"`
+	Create  []AccountCreateRequest     `json:"create"`
+	Update  []AccountBulkUpdateRequest `json:"update"`
+	Delete  []int                      `json:"delete"`
+}
+
+type AccountBulkUpdateRequest struct {
+	AccountID int      `json:"account_id" validate:"required"`
+	Limit     int      `json:"limit" validate:"required"`
+	Products  []string `json:"products" validate:"required"`
+}
+
 type AccountResponse struct {
+	ID        string     `json:"id,omitempty"`
+	AccountID int        `json:"account_id"`
+	Limit     int        `json:"limit"`
+	Products  []string   `json:"products"`
+	Version   int64      `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+}
+
+// IfMatch is the versions a write accept, parsed from If-Match. Nil accept any version, an empty list none.
+type IfMatch []int64
+
+type AccountImportResponse struct {
+	DryRun     bool               `json:"dry_run"`
+	OnConflict string             `json:"on_conflict"`
+	Inserted   int                `json:"inserted"`
+	Updated    int                `json:"updated"`
+	Skipped    int                `json:"skipped"`
+	Invalid    int                `json:"invalid"`
+	Rows       []AccountImportRow `json:"rows"`
+}
+
+type AccountImportRow struct {
+	Line      int           `json:"line"`
+	AccountID int           `json:"account_id,omitempty"`
+	Status    string        `json:"status"`
+	Errors    []ErrorDetail `json:"errors,omitempty"`
+}
+
+type AccountProductsResponse struct {
 	AccountID int      `json:"account_id"`
-	Limit     int      `json:"limit"`
 	Products  []string `json:"products"`
+	Version   int64    `json:"version"`
+}
+
+type AccountBulkResponse struct {
+	Ordered   bool              `json:"ordered"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Items     []AccountBulkItem `json:"items"`
+}
+
+type AccountBulkItem struct {
+	Op        string        `json:"op"`
+	Index     int           `json:"index"`
+	AccountID int           `json:"account_id"`
+	Status    string        `json:"status"`
+	Message   string        `json:"message,omitempty"`
+	Errors    []ErrorDetail `json:"errors,omitempty"`
+}
+
+type AccountHistoryResponse struct {
+	AccountID int           `json:"account_id"`
+	Action    string        `json:"action"`
+	Version   int64         `json:"version"`
+	Changes   []FieldChange `json:"changes"`
+	Actor     string        `json:"actor"`
+	RequestID string        `json:"request_id,omitempty"`
+	At        time.Time     `json:"at"`
+}
+
+type AccountEventsRequest struct {
+	AccountIDs []int    `query:"account_id"`
+	Products   []string `query:"product"`
+}
+
+type AccountEvent struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	AccountID int              `json:"account_id"`
+	Version   int64            `json:"version"`
+	Account   *AccountResponse `json:"account,omitempty"`
+	At        time.Time        `json:"at"`
+}
+
+// AccountSubscriptionRequest change the accounts a websocket client is subscribed to
+type AccountSubscriptionRequest struct {
+	Action     string   `json:"action" validate:"required,oneof=subscribe unsubscribe"`
+	AccountIDs []int    `json:"account_ids" validate:"dive,gt=0"`
+	Products   []string `json:"products" validate:"dive,required"`
+}
+
+type AccountSubscriptionResponse struct {
+	AccountIDs []int    `json:"account_ids"`
+	Products   []string `json:"products"`
+}
+
+// AccountSubscriptionMessage is a message sent to websocket clients, only the field of its type is set
+type AccountSubscriptionMessage struct {
+	Type          string                       `json:"type"`
+	Subscriptions *AccountSubscriptionResponse `json:"subscriptions,omitempty"`
+	Event         *AccountEvent                `json:"event,omitempty"`
+	Errors        []ErrorDetail                `json:"errors,omitempty"`
+}
+
+type AccountDiffResponse struct {
+	AccountID int             `json:"account_id"`
+	From      AccountRevision `json:"from"`
+	To        AccountRevision `json:"to"`
+	Changes   []FieldChange   `json:"changes"`
+}
+
+// AccountRevision tell which revision a point in time resolved to
+type AccountRevision struct {
+	At        time.Time `json:"at"`
+	Version   int64     `json:"version"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// FieldChange is the value of a field before and after a change, null when the field was not set
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type AccountPurgeResponse struct {
+	DeletedBefore time.Time `json:"deleted_before"`
+	Purged        int64     `json:"purged"`
+}
+
+type IndexStatusResponse struct {
+	Name   string     `json:"name"`
+	Keys   []IndexKey `json:"keys"`
+	Unique bool       `json:"unique"`
+	State  string     `json:"state"`
+	Detail string     `json:"detail,omitempty"`
+}
+
+type IndexKey struct {
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
+}
+
+// WebhookRequest create or replace a webhook, a replaced webhook keep its secret when none is given
+type WebhookRequest struct {
+	URL        string   `json:"url" validate:"required,http_url,max=2048"`
+	Secret     string   `json:"secret" validate:"omitempty,min=16,max=256"`
+	Events     []string `json:"events" validate:"dive,oneof=created updated deleted restored purged"`
+	AccountIDs []int    `json:"account_ids" validate:"max=1000,dive,gt=0"`
+	Products   []string `json:"products" validate:"max=1000,dive,required"`
+}
+
+type WebhookListRequest struct {
+	Limit int `query:"limit"`
+	Page  int `query:"page"`
+}
+
+// WebhookResponse is a webhook, its secret is only shown when it is created
+type WebhookResponse struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	Events     []string  `json:"events"`
+	AccountIDs []int     `json:"account_ids"`
+	Products   []string  `json:"products"`
+	State      string    `json:"state"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type WebhookDeliveryListRequest struct {
+	State string `query:"state" validate:"omitempty,oneof=pending delivered dead_letter"`
+	Limit int    `query:"limit"`
+	Page  int    `query:"page"`
+}
+
+type WebhookDeliveryResponse struct {
+	ID            string                   `json:"id"`
+	EventID       string                   `json:"event_id"`
+	EventType     string                   `json:"event_type"`
+	AccountID     int                      `json:"account_id"`
+	State         string                   `json:"state"`
+	AttemptCount  int                      `json:"attempt_count"`
+	NextAttemptAt *time.Time               `json:"next_attempt_at,omitempty"`
+	Attempts      []WebhookAttemptResponse `json:"attempts"`
+	Event         json.RawMessage          `json:"event"`
+	CreatedAt     time.Time                `json:"created_at"`
+	DeliveredAt   *time.Time               `json:"delivered_at,omitempty"`
+}
+
+type WebhookAttemptResponse struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// WebhookReplayRequest send deliveries of a webhook again, every dead letter delivery when no id is given
+type WebhookReplayRequest struct {
+	DeliveryIDs []string `json:"delivery_ids" validate:"max=1000,dive,len=24,hexadecimal"`
+}
+
+type WebhookReplayResponse struct {
+	Replayed int64 `json:"replayed"`
 }
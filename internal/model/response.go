@@ -7,10 +7,19 @@ import (
 )
 
 var response = map[int]BaseResponse{
-	http.StatusOK:                  {http.StatusOK, "000", "Successful"},
-	http.StatusCreated:             {http.StatusCreated, "000", "Successful"},
-	http.StatusInternalServerError: {http.StatusInternalServerError, "001", "Internal Server Error"},
-	http.StatusBadRequest:          {http.StatusBadRequest, "001", "Bad Request"},
+	http.StatusOK:                   {http.StatusOK, "000", "Successful"},
+	http.StatusCreated:              {http.StatusCreated, "000", "Successful"},
+	http.StatusInternalServerError:  {http.StatusInternalServerError, "001", "Internal Server Error"},
+	http.StatusBadRequest:           {http.StatusBadRequest, "001", "Bad Request"},
+	http.StatusNotFound:             {http.StatusNotFound, "002", "Not Found"},
+	http.StatusConflict:             {http.StatusConflict, "003", "Conflict"},
+	http.StatusGatewayTimeout:       {http.StatusGatewayTimeout, "004", "Gateway Timeout"},
+	http.StatusServiceUnavailable:   {http.StatusServiceUnavailable, "005", "Service Unavailable"},
+	http.StatusUnsupportedMediaType: {http.StatusUnsupportedMediaType, "006", "Unsupported Media Type"},
+	http.StatusPreconditionFailed:   {http.StatusPreconditionFailed, "007", "Precondition Failed"},
+	http.StatusUnauthorized:         {http.StatusUnauthorized, "008", "Unauthorized"},
+	http.StatusForbidden:            {http.StatusForbidden, "009", "Forbidden"},
+	http.StatusUpgradeRequired:      {http.StatusUpgradeRequired, "010", "Upgrade Required"},
 }
 
 type BaseResponse struct {
@@ -20,14 +29,23 @@ type BaseResponse struct {
 }
 
 type ResponsePage struct {
-	TotalData int64 `json:"total_data"`
-	TotalPage int64 `json:"total_page"`
+	TotalData  int64  `json:"total_data"`
+	TotalPage  int64  `json:"total_page"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type ResponseData struct {
 	BaseResponse
 	*ResponsePage `json:",omitempty"`
-	Data          interface{} `json:"data,omitempty"`
+	Data          interface{}   `json:"data,omitempty"`
+	Errors        []ErrorDetail `json:"errors,omitempty"`
+}
+
+// ErrorDetail explain why a request field is rejected
+type ErrorDetail struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
 }
 
 type ResponseDataList struct {
@@ -65,3 +83,10 @@ func NewResponse(status int, data ...interface{}) (r ResponseData) {
 func Response(ctx *fiber.Ctx, status int, data ...interface{}) error {
 	return ctx.Status(status).JSON(NewResponse(status, data...))
 }
+
+// ResponseErrors write response with error details
+func ResponseErrors(ctx *fiber.Ctx, status int, errs ...ErrorDetail) error {
+	r := NewResponse(status)
+	r.Errors = errs
+	return ctx.Status(status).JSON(r)
+}
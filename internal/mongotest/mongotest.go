@@ -0,0 +1,59 @@
+// Package mongotest give tests a database of their own on the server at TEST_MONGO_URI
+package mongotest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// URI_ENV name the env var of the server used by mongo tests, they are skipped when it is not set
+const URI_ENV string = "TEST_MONGO_URI"
+
+// Database return a database of its own for the test on the server at TEST_MONGO_URI, dropped when the test end
+func Database(t *testing.T) *mongo.Database {
+	t.Helper()
+
+	uri := os.Getenv(URI_ENV)
+	if uri == "" {
+		t.Skipf("%s is not set", URI_ENV)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	database := client.Database(fmt.Sprintf("test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		_ = database.Drop(context.Background())
+		_ = client.Disconnect(context.Background())
+	})
+
+	return database
+}
+
+// RequireReplicaSet skip the test unless database is served by a replica set, transactions need one
+func RequireReplicaSet(t *testing.T, database *mongo.Database) {
+	t.Helper()
+
+	var hello struct {
+		SetName string `bson:"setName"`
+	}
+	if err := database.RunCommand(context.Background(), bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+
+	if hello.SetName == "" {
+		t.Skip("the server is not a replica set")
+	}
+}
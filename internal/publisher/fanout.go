@@ -0,0 +1,103 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// fanoutPendingSize is how many partly published messages the fanout remember, past it the oldest is forgotten and
+// a retry of it go to every publisher again
+const fanoutPendingSize = 1024
+
+type fanoutImpl struct {
+	publishers []Publisher
+
+	mu sync.Mutex
+	// published tell, per id of a message that failed on some publishers, which ones already have it
+	published map[string][]bool
+	// pending hold the ids of published, oldest first
+	pending []string
+}
+
+// NewFanout publish every message to all publishers. A message failing on some of them fail as a whole, its retry
+// only go to the publishers it failed on, so the others do not get it twice. Which publishers have a message is kept
+// in process, after a restart a retry go to all of them again.
+func NewFanout(publishers ...Publisher) Publisher {
+	return &fanoutImpl{
+		publishers: publishers,
+		published:  make(map[string][]bool),
+	}
+}
+
+// Publish implements Publisher.
+func (p *fanoutImpl) Publish(ctx context.Context, message Message) error {
+	published := p.take(message.ID)
+
+	var errs []error
+	for i, pub := range p.publishers {
+		if published[i] {
+			continue
+		}
+
+		if err := pub.Publish(ctx, message); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		published[i] = true
+	}
+
+	if len(errs) > 0 {
+		p.keep(message.ID, published)
+	}
+
+	return errors.Join(errs...)
+}
+
+// take return which publishers have the message and forget it, a message published by many goroutines at once may go
+// to a publisher more than once
+func (p *fanoutImpl) take(id string) []bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	published, ok := p.published[id]
+	if !ok {
+		return make([]bool, len(p.publishers))
+	}
+
+	delete(p.published, id)
+	for i, pending := range p.pending {
+		if pending == id {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			break
+		}
+	}
+
+	return published
+}
+
+// keep remember which publishers have the message until it is published again
+func (p *fanoutImpl) keep(id string, published []bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pending) == fanoutPendingSize {
+		delete(p.published, p.pending[0])
+		p.pending = p.pending[1:]
+	}
+
+	p.published[id] = published
+	p.pending = append(p.pending, id)
+}
+
+// Close implements Publisher.
+func (p *fanoutImpl) Close() error {
+	var errs []error
+	for _, pub := range p.publishers {
+		if err := pub.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
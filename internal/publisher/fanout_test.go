@@ -0,0 +1,114 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// flakyPublisher fail the first failures publishes and keep the later ones
+type flakyPublisher struct {
+	MemoryPublisher
+	failures int
+	calls    int
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, message Message) error {
+	p.calls++
+	if p.calls <= p.failures {
+		return errors.New("destination is down")
+	}
+
+	return p.MemoryPublisher.Publish(ctx, message)
+}
+
+// messageIDs of pub in publish order
+func messageIDs(pub MemoryPublisher) []string {
+	var ids []string
+	for _, message := range pub.Messages() {
+		ids = append(ids, message.ID)
+	}
+
+	return ids
+}
+
+func TestFanoutRetryOnlyFailed(t *testing.T) {
+	ctx := context.Background()
+	healthy := NewMemory()
+	flaky := &flakyPublisher{MemoryPublisher: NewMemory(), failures: 2}
+	fanout := NewFanout(healthy, flaky)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if err := fanout.Publish(ctx, Message{ID: "a"}); err == nil {
+			t.Fatalf("attempt %d succeeded, want the flaky publisher error", attempt)
+		}
+	}
+	if err := fanout.Publish(ctx, Message{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the healthy publisher got it on the first attempt only
+	if ids := messageIDs(healthy); len(ids) != 1 {
+		t.Errorf("healthy publisher got %v, want a once", ids)
+	}
+	if ids := messageIDs(flaky); len(ids) != 1 {
+		t.Errorf("flaky publisher got %v, want a once", ids)
+	}
+
+	// once published the message is forgotten, publishing it again go to every publisher
+	if err := fanout.Publish(ctx, Message{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := messageIDs(healthy); len(ids) != 2 {
+		t.Errorf("healthy publisher got %v, want a twice", ids)
+	}
+}
+
+func TestFanoutDownPublisher(t *testing.T) {
+	ctx := context.Background()
+	down := &flakyPublisher{MemoryPublisher: NewMemory(), failures: 100}
+	webhooks := NewMemory()
+	fanout := NewFanout(down, webhooks)
+
+	// a message given up on after failing on one publisher still reached the others, once
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := fanout.Publish(ctx, Message{ID: "a"}); err == nil {
+			t.Fatal("publish succeeded, want the down publisher error")
+		}
+	}
+	if err := fanout.Publish(ctx, Message{ID: "b"}); err == nil {
+		t.Fatal("publish succeeded, want the down publisher error")
+	}
+
+	if ids := fmt.Sprint(messageIDs(webhooks)); ids != "[a b]" {
+		t.Errorf("other publisher got %s, want [a b]", ids)
+	}
+	if down.calls != 4 {
+		t.Errorf("down publisher tried %d times, want 4", down.calls)
+	}
+}
+
+func TestFanoutForgetOldest(t *testing.T) {
+	ctx := context.Background()
+	healthy := NewMemory()
+	fanout := NewFanout(healthy, &flakyPublisher{MemoryPublisher: NewMemory(), failures: fanoutPendingSize + 1})
+
+	for i := 0; i <= fanoutPendingSize; i++ {
+		if err := fanout.Publish(ctx, Message{ID: fmt.Sprint(i)}); err == nil {
+			t.Fatal("publish succeeded, want the flaky publisher error")
+		}
+	}
+
+	// the first message is forgotten and go to the healthy publisher again, the last one is not
+	if err := fanout.Publish(ctx, Message{ID: "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fanout.Publish(ctx, Message{ID: fmt.Sprint(fanoutPendingSize)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(healthy.Messages()), fanoutPendingSize+2; got != want {
+		t.Errorf("healthy publisher got %d messages, want %d", got, want)
+	}
+}
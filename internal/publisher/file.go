@@ -0,0 +1,51 @@
+package publisher
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+type fileImpl struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFile append messages as newline delimited JSON to the file at path, creating it when missing.
+// Every message is synced to disk before Publish return.
+func NewFile(path string) (Publisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileImpl{file: file}, nil
+}
+
+// Publish implements Publisher.
+func (p *fileImpl) Publish(ctx context.Context, message Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	line := make([]byte, 0, len(message.Data)+1)
+	line = append(line, message.Data...)
+	line = append(line, '\n')
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.file.Write(line); err != nil {
+		return err
+	}
+
+	return p.file.Sync()
+}
+
+// Close implements Publisher.
+func (p *fileImpl) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.file.Close()
+}
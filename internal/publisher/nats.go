@@ -0,0 +1,57 @@
+package publisher
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+type natsImpl struct {
+	conn          *nats.Conn
+	js            nats.JetStreamContext
+	subjectPrefix string
+}
+
+// NewNATS publish messages to JetStream on subjectPrefix.<account_id>, a stream must capture those subjects.
+// The message id is sent as Nats-Msg-Id so the stream drop redeliveries within its duplicate window.
+// An unreachable server is connected to in the background, publishes fail until then.
+func NewNATS(url string, subjectPrefix string) (Publisher, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("learn-mongodb outbox relay"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &natsImpl{
+		conn:          conn,
+		js:            js,
+		subjectPrefix: subjectPrefix,
+	}, nil
+}
+
+// Publish implements Publisher.
+func (p *natsImpl) Publish(ctx context.Context, message Message) error {
+	msg := nats.NewMsg(p.subjectPrefix + "." + strconv.Itoa(message.AccountID))
+	msg.Header.Set(nats.MsgIdHdr, message.ID)
+	msg.Header.Set("Event-Type", message.Type)
+	msg.Data = message.Data
+
+	_, err := p.js.PublishMsg(msg, nats.Context(ctx))
+
+	return err
+}
+
+// Close implements Publisher.
+func (p *natsImpl) Close() error {
+	return p.conn.Drain()
+}
@@ -0,0 +1,66 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+)
+
+// Message is one account event to publish
+type Message struct {
+	// ID is unique per event and the same across redeliveries, consumers use it to drop duplicates
+	ID        string
+	AccountID int
+	Type      string
+	// Data is the JSON encoded event
+	Data []byte
+}
+
+// Publisher deliver messages to consumers outside the service. Publish return once the message is stored by the
+// destination, a message whose publish failed may still have been delivered.
+type Publisher interface {
+	Publish(ctx context.Context, message Message) error
+	Close() error
+}
+
+// MemoryPublisher keep published messages in process, for development and tests
+type MemoryPublisher interface {
+	Publisher
+	// Messages return the published messages in publish order
+	Messages() []Message
+}
+
+type memoryImpl struct {
+	mu       sync.RWMutex
+	messages []Message
+}
+
+func NewMemory() MemoryPublisher {
+	return &memoryImpl{}
+}
+
+// Publish implements Publisher.
+func (p *memoryImpl) Publish(ctx context.Context, message Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.messages = append(p.messages, message)
+
+	return nil
+}
+
+// Close implements Publisher.
+func (p *memoryImpl) Close() error {
+	return nil
+}
+
+// Messages implements MemoryPublisher.
+func (p *memoryImpl) Messages() []Message {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]Message{}, p.messages...)
+}
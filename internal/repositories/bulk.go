@@ -0,0 +1,227 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BulkAbortError is the failure of the item at Index that rolled back a bulk write made in a transaction.
+// A write error abort the whole transaction, so none of the other items are written either.
+type BulkAbortError struct {
+	Index int
+	Err   error
+}
+
+func (e *BulkAbortError) Error() string {
+	return fmt.Sprintf("bulk item %d failed: %v", e.Index, e.Err)
+}
+
+func (e *BulkAbortError) Unwrap() error {
+	return e.Err
+}
+
+// CreateMany implements Repository.
+// Accounts already stored, soft deleted ones included, and ids repeated in the input are looked up before writing,
+// so a transaction is not aborted by their duplicate key errors.
+func (r *repoImpl) CreateMany(ctx context.Context, accounts []entity.Account, ordered bool) ([]error, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	ids := make([]int, len(accounts))
+	for i, account := range accounts {
+		ids[i] = account.AccountID
+	}
+
+	stored, err := r.storedAccountIDs(ctxTimeout, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := writeNow()
+	results := make([]error, len(accounts))
+	var models []mongo.WriteModel
+	var indexes []int
+	for i, account := range accounts {
+		live, found := stored[account.AccountID]
+		switch {
+		case found && !live:
+			results[i] = errAccountDeleted
+		case found:
+			results[i] = errAccountExists
+		}
+
+		if results[i] != nil {
+			if ordered {
+				abortAfter(results, i)
+				break
+			}
+			continue
+		}
+
+		// a later item with the same id is a duplicate
+		stored[account.AccountID] = true
+		models = append(models, mongo.NewInsertOneModel().SetDocument(newAccount(account, now)))
+		indexes = append(indexes, i)
+	}
+
+	if err := r.bulkWrite(ctxTimeout, models, indexes, ordered, results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// UpdateMany implements Repository.
+// A bulk write only report how many documents matched, so missing accounts are looked up before writing.
+// An account deleted between the lookup and the write is reported as updated.
+func (r *repoImpl) UpdateMany(ctx context.Context, accounts []entity.Account, ordered bool) ([]error, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	ids := make([]int, len(accounts))
+	for i, account := range accounts {
+		ids[i] = account.AccountID
+	}
+
+	existing, err := r.storedAccountIDs(ctxTimeout, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := writeNow()
+	results := make([]error, len(accounts))
+	var models []mongo.WriteModel
+	var indexes []int
+	for i, account := range accounts {
+		if !existing[account.AccountID] {
+			results[i] = errAccountNotFound
+			if ordered {
+				abortAfter(results, i)
+				break
+			}
+			continue
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(liveFilter(account.AccountID)).SetUpdate(replaceUpdate(account, now)))
+		indexes = append(indexes, i)
+	}
+
+	if err := r.bulkWrite(ctxTimeout, models, indexes, ordered, results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// DeleteMany implements Repository.
+// Missing accounts are looked up before writing like UpdateMany, an account repeated in the input is not found the second time.
+func (r *repoImpl) DeleteMany(ctx context.Context, accountIDs []int, ordered bool, deletedBy string) ([]error, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	existing, err := r.storedAccountIDs(ctxTimeout, accountIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	update := softDeleteUpdate(deletedBy, writeNow())
+	results := make([]error, len(accountIDs))
+	var models []mongo.WriteModel
+	var indexes []int
+	for i, id := range accountIDs {
+		if !existing[id] {
+			results[i] = errAccountNotFound
+			if ordered {
+				abortAfter(results, i)
+				break
+			}
+			continue
+		}
+
+		existing[id] = false
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(liveFilter(id)).SetUpdate(update))
+		indexes = append(indexes, i)
+	}
+
+	if err := r.bulkWrite(ctxTimeout, models, indexes, ordered, results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// bulkWrite write models in one round trip and set the error of failed items in results,
+// indexes map every model to its item in results. In a transaction a failed item abort the transaction, it is
+// returned as a BulkAbortError instead.
+func (r *repoImpl) bulkWrite(ctx context.Context, models []mongo.WriteModel, indexes []int, ordered bool, results []error) error {
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := r.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(ordered))
+
+	var bulkErr mongo.BulkWriteException
+	if err != nil && (!errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil) {
+		return mapError(err)
+	}
+
+	for _, we := range bulkErr.WriteErrors {
+		if we.Code == codeDuplicateKey {
+			results[indexes[we.Index]] = errs.Wrap(errs.Conflict, errAccountExists.Message(), we)
+			continue
+		}
+
+		results[indexes[we.Index]] = we
+	}
+
+	if len(bulkErr.WriteErrors) > 0 && inTransaction(ctx) {
+		i := indexes[bulkErr.WriteErrors[0].Index]
+		return &BulkAbortError{Index: i, Err: results[i]}
+	}
+
+	// ordered write stop at its first error, even items that were rejected before writing are not reached
+	if ordered && len(bulkErr.WriteErrors) > 0 {
+		abortAfter(results, indexes[bulkErr.WriteErrors[0].Index])
+	}
+
+	return nil
+}
+
+// storedAccountIDs report which of the account ids are stored, with true for live accounts and false for soft deleted ones
+func (r *repoImpl) storedAccountIDs(ctx context.Context, accountIDs []int) (map[int]bool, error) {
+	filter := bson.M{"account_id": bson.M{"$in": accountIDs}}
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "account_id": 1, "deleted_at": 1})
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	stored := make(map[int]bool, len(accountIDs))
+	for cursor.Next(ctx) {
+		var account entity.Account
+		if err := cursor.Decode(&account); err != nil {
+			return nil, err
+		}
+
+		stored[account.AccountID] = account.DeletedAt == nil
+	}
+
+	return stored, mapError(cursor.Err())
+}
+
+// abortAfter mark every item after i as not attempted
+func abortAfter(results []error, i int) {
+	for j := i + 1; j < len(results); j++ {
+		results[j] = ErrBulkAborted
+	}
+}
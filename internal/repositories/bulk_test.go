@@ -0,0 +1,142 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+)
+
+// bulkOutcome name the kind of an item result, ok when it was written
+func bulkOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrBulkAborted):
+		return "aborted"
+	default:
+		return string(errs.KindOf(err))
+	}
+}
+
+func TestBulkWrites(t *testing.T) {
+	create := func(id int) entity.Account {
+		return entity.Account{AccountID: id, Limit: 10, Products: []string{"a"}}
+	}
+	update := func(id int) entity.Account {
+		return entity.Account{AccountID: id, Limit: 20, Products: []string{"b"}}
+	}
+
+	tests := []struct {
+		name    string
+		ordered bool
+		write   func(ctx context.Context, repo Repository, ordered bool) ([]error, error)
+		results []string
+		// accounts live after the write
+		live []int
+	}{
+		{
+			name: "create unordered",
+			write: func(ctx context.Context, repo Repository, ordered bool) ([]error, error) {
+				return repo.CreateMany(ctx, []entity.Account{create(3), create(1), create(4), create(3)}, ordered)
+			},
+			results: []string{"ok", "conflict", "ok", "conflict"},
+			live:    []int{1, 2, 3, 4},
+		},
+		{
+			name:    "create ordered",
+			ordered: true,
+			write: func(ctx context.Context, repo Repository, ordered bool) ([]error, error) {
+				return repo.CreateMany(ctx, []entity.Account{create(3), create(1), create(4), create(3)}, ordered)
+			},
+			results: []string{"ok", "conflict", "aborted", "aborted"},
+			live:    []int{1, 2, 3},
+		},
+		{
+			name: "update unordered",
+			write: func(ctx context.Context, repo Repository, ordered bool) ([]error, error) {
+				return repo.UpdateMany(ctx, []entity.Account{update(1), update(9), update(2)}, ordered)
+			},
+			results: []string{"ok", "not_found", "ok"},
+			live:    []int{1, 2},
+		},
+		{
+			name:    "update ordered",
+			ordered: true,
+			write: func(ctx context.Context, repo Repository, ordered bool) ([]error, error) {
+				return repo.UpdateMany(ctx, []entity.Account{update(1), update(9), update(2)}, ordered)
+			},
+			results: []string{"ok", "not_found", "aborted"},
+			live:    []int{1, 2},
+		},
+		{
+			name: "delete unordered",
+			write: func(ctx context.Context, repo Repository, ordered bool) ([]error, error) {
+				return repo.DeleteMany(ctx, []int{1, 9, 2}, ordered, "test")
+			},
+			results: []string{"ok", "not_found", "ok"},
+		},
+		{
+			name:    "delete ordered",
+			ordered: true,
+			write: func(ctx context.Context, repo Repository, ordered bool) ([]error, error) {
+				return repo.DeleteMany(ctx, []int{1, 9, 2}, ordered, "test")
+			},
+			results: []string{"ok", "not_found", "aborted"},
+			live:    []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepository(t, func(t *testing.T, repo Repository) {
+				ctx := context.Background()
+				seedAccounts(t, repo, create(1), create(2))
+
+				results, err := tt.write(ctx, repo, tt.ordered)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(results) != len(tt.results) {
+					t.Fatalf("results = %v, want %v", results, tt.results)
+				}
+				for i, result := range results {
+					if got := bulkOutcome(result); got != tt.results[i] {
+						t.Errorf("item %d = %s (%v), want %s", i, got, result, tt.results[i])
+					}
+				}
+
+				accounts, _, _, err := repo.List(ctx, ListQuery{Limit: 10})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ids := accountIDs(accounts); !sameIDs(ids, tt.live) {
+					t.Errorf("live accounts = %v, want %v", ids, tt.live)
+				}
+			})
+		})
+	}
+}
+
+func TestBulkUpdateWriteItems(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ctx := context.Background()
+		seedAccounts(t, repo, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}})
+
+		results, err := repo.UpdateMany(ctx, []entity.Account{{AccountID: 1, Limit: 20, Products: []string{"b", "c"}}}, true)
+		if err != nil || results[0] != nil {
+			t.Fatalf("update = %v, %v", results, err)
+		}
+
+		account, err := repo.GetByAccountID(ctx, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Limit != 20 || len(account.Products) != 2 || account.Products[0] != "b" {
+			t.Errorf("account = %+v, want the limit and products of the item", account)
+		}
+	})
+}
@@ -1,15 +1,69 @@
 package repositories
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+)
 
 const (
 	ACCOUNTS_COLLECTION_NAME string = "accounts"
+
+	// documents fetched per round trip when streaming, bound memory used by a stream
+	streamBatchSize int32 = 500
+
+	// duplicate key server error code
+	codeDuplicateKey = 11000
+
+	// version of a created account
+	firstVersion int64 = 1
 )
 
 var (
-	errMetaDataTypeAssertion = errors.New("failed to do type assertion on metadata")
+	errDocumentDecode = errors.New("failed to decode account document")
+
+	errAccountNotFound = errs.New(errs.NotFound, "account not found")
+
+	errAccountExists = errs.New(errs.Conflict, "account already exists")
+
+	// ErrVersionMismatch is a write expecting another version than the stored one
+	ErrVersionMismatch = errs.New(errs.FailedPrecondition, "account version does not match")
+
+	errAccountNotDeleted = errs.New(errs.Conflict, "account is not deleted")
+
+	// the unique account_id index still hold soft deleted accounts, so their id can not be taken until purged
+	errAccountDeleted = errs.New(errs.Conflict, "account is deleted, restore it or wait until it is purged")
+
+	errRevisionNotFound = errs.New(errs.NotFound, "no revision of the account is recorded at that time")
+
+	errProductNotHeld = errs.New(errs.NotFound, "account does not hold the product")
+
+	errLimitNotPositive = errs.New(errs.InvalidArgument, "limit must be positive")
+
+	errOffsetNegative = errs.New(errs.InvalidArgument, "offset must be non-negative")
+
+	errCursorInvalid = errs.New(errs.InvalidArgument, "cursor is invalid")
+
+	errCursorOrderMismatch = errs.New(errs.InvalidArgument, "cursor was issued for a different order")
+
+	errSortKeyInvalid = errs.New(errs.InvalidArgument, "sort key is invalid")
+
+	// ErrPatchTestFailed is a patch whose test operations do not match the account
+	ErrPatchTestFailed = errs.New(errs.Conflict, "account does not match patch test")
+
+	// ErrBulkAborted is the result of a bulk item not attempted because an earlier one failed
+	ErrBulkAborted = errs.New(errs.Aborted, "not attempted after an earlier failure")
+
+	// ErrBulkRolledBack is the result of a bulk item written then rolled back because another item failed in the same transaction
+	ErrBulkRolledBack = errs.New(errs.Aborted, "rolled back after another item failed")
+
+	errEventNotResumable = errs.New(errs.InvalidArgument, "events after the last event id are not available, watch again without it")
+
+	errEventFeedTooSlow = errs.New(errs.Unavailable, "events were not taken fast enough and the feed was dropped")
+
+	errWebhookNotFound = errs.New(errs.NotFound, "webhook not found")
 
-	errDataTypeAssertion = errors.New("failed to do type assertion on data")
+	errOutboxLeaseLost = errs.New(errs.Conflict, "outbox lease is held by another relay")
 
-	errAccountsTypeAssertion = errors.New("failed to do type assertion on account")
+	errDeliveryClaimLost = errs.New(errs.Conflict, "webhook delivery claim expired and was taken by another dispatcher")
 )
@@ -0,0 +1,51 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+)
+
+// listCursor is the position of the last account returned on a page.
+// Values are the sort key values of that account, times as unix milliseconds, Tiebreak is the backend specific unique key
+// (ObjectID hex on mongo, insertion sequence on memory).
+type listCursor struct {
+	Sort     []SortField `json:"s"`
+	Values   []int64     `json:"v"`
+	Tiebreak string      `json:"t"`
+}
+
+func encodeCursor(account entity.Account, fields []SortField, tiebreak string) string {
+	c := listCursor{
+		Sort:     fields,
+		Values:   sortValues(account, fields),
+		Tiebreak: tiebreak,
+	}
+
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parse opaque cursor, fields is the sort requested by client (empty means follow the cursor)
+func decodeCursor(s string, fields []SortField) (listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return listCursor{}, errCursorInvalid
+	}
+
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return listCursor{}, errCursorInvalid
+	}
+
+	if len(c.Sort) == 0 || len(c.Values) != len(c.Sort) || validateSort(c.Sort) != nil {
+		return listCursor{}, errCursorInvalid
+	}
+
+	if len(fields) > 0 && sortSpec(fields) != sortSpec(c.Sort) {
+		return listCursor{}, errCursorOrderMismatch
+	}
+
+	return c, nil
+}
@@ -0,0 +1,123 @@
+package repositories
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+)
+
+func TestCursorDecode(t *testing.T) {
+	byLimit := []SortField{{Key: SORT_LIMIT, Order: 1}}
+	cursor := encodeCursor(entity.Account{AccountID: 7, Limit: 30}, byLimit, "12")
+
+	tests := []struct {
+		name   string
+		cursor string
+		sort   []SortField
+		err    error
+	}{
+		{name: "same sort", cursor: cursor, sort: byLimit},
+		{name: "no sort follow the cursor", cursor: cursor},
+		{name: "other sort", cursor: cursor, sort: []SortField{{Key: SORT_LIMIT, Order: -1}}, err: errCursorOrderMismatch},
+		{name: "other key", cursor: cursor, sort: []SortField{{Key: SORT_ACCOUNT_ID, Order: 1}}, err: errCursorOrderMismatch},
+		{name: "not base64", cursor: "%%%", err: errCursorInvalid},
+		{name: "not json", cursor: base64.RawURLEncoding.EncodeToString([]byte("cursor")), err: errCursorInvalid},
+		{name: "values missing", cursor: base64.RawURLEncoding.EncodeToString([]byte(`{"s":[{"k":"limit","o":1}],"t":"12"}`)), err: errCursorInvalid},
+		{name: "unknown key", cursor: base64.RawURLEncoding.EncodeToString([]byte(`{"s":[{"k":"name","o":1}],"v":[1],"t":"12"}`)), err: errCursorInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := decodeCursor(tt.cursor, tt.sort)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if sortSpec(c.Sort) != sortSpec(byLimit) || len(c.Values) != 1 || c.Values[0] != 30 || c.Tiebreak != "12" {
+				t.Errorf("cursor = %+v, want the position of the encoded account", c)
+			}
+		})
+	}
+}
+
+func TestListKeyset(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		// limits tie so the order within a limit is the insertion one, or its reverse
+		seedAccounts(t, repo,
+			entity.Account{AccountID: 1, Limit: 10},
+			entity.Account{AccountID: 2, Limit: 20},
+			entity.Account{AccountID: 3, Limit: 10},
+			entity.Account{AccountID: 4, Limit: 20},
+			entity.Account{AccountID: 5, Limit: 10},
+		)
+
+		tests := []struct {
+			name  string
+			sort  []SortField
+			limit int
+			ids   []int
+		}{
+			{name: "default", limit: 2, ids: []int{1, 2, 3, 4, 5}},
+			{name: "tie on limit", sort: []SortField{{Key: SORT_LIMIT, Order: 1}}, limit: 2, ids: []int{1, 3, 5, 2, 4}},
+			{name: "tie on limit descending", sort: []SortField{{Key: SORT_LIMIT, Order: -1}}, limit: 2, ids: []int{4, 2, 5, 3, 1}},
+			{name: "second key", sort: []SortField{{Key: SORT_LIMIT, Order: 1}, {Key: SORT_ACCOUNT_ID, Order: -1}}, limit: 2, ids: []int{5, 3, 1, 4, 2}},
+			{name: "product count", sort: []SortField{{Key: SORT_PRODUCT_COUNT, Order: 1}}, limit: 3, ids: []int{1, 2, 3, 4, 5}},
+			{name: "one full page", limit: 5, ids: []int{1, 2, 3, 4, 5}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctx := context.Background()
+
+				var ids []int
+				var cursor string
+				for pages := 0; ; pages++ {
+					if pages > len(tt.ids) {
+						t.Fatalf("no last page after %d pages", pages)
+					}
+
+					// the sort is only sent on the first page, later pages follow the cursor
+					query := ListQuery{Limit: tt.limit, Cursor: cursor}
+					if cursor == "" {
+						query.Sort = tt.sort
+					}
+
+					accounts, total, next, err := repo.List(ctx, query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if total != int64(len(tt.ids)) {
+						t.Errorf("total = %d, want %d", total, len(tt.ids))
+					}
+
+					ids = append(ids, accountIDs(accounts)...)
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+
+				if !sameIDs(ids, tt.ids) {
+					t.Errorf("pages = %v, want %v", ids, tt.ids)
+				}
+			})
+		}
+
+		// a cursor is bound to the sort it was issued for
+		_, _, next, err := repo.List(context.Background(), ListQuery{Limit: 2, Sort: []SortField{{Key: SORT_LIMIT, Order: 1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, _, err = repo.List(context.Background(), ListQuery{Limit: 2, Cursor: next, Sort: []SortField{{Key: SORT_LIMIT, Order: -1}}})
+		if !errors.Is(err, errCursorOrderMismatch) {
+			t.Errorf("cursor with another sort err = %v, want %v", err, errCursorOrderMismatch)
+		}
+	})
+}
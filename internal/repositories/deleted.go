@@ -0,0 +1,94 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// notDeleted is the filter element of every read and write on live accounts, null also match a missing field
+var notDeleted = bson.E{Key: "deleted_at", Value: nil}
+
+// isDeleted is the filter element of soft deleted accounts
+var isDeleted = bson.E{Key: "deleted_at", Value: bson.M{"$ne": nil}}
+
+// liveFilter select a live account by id
+func liveFilter(accountID int) bson.D {
+	return bson.D{{Key: "account_id", Value: accountID}, notDeleted}
+}
+
+// softDeleteUpdate mark an account deleted and stamp it
+func softDeleteUpdate(deletedBy string, deletedAt time.Time) bson.D {
+	update := bson.D{{Key: "$set", Value: bson.M{"deleted_at": deletedAt, "deleted_by": deletedBy}}}
+	return append(update, stampUpdate(deletedAt)...)
+}
+
+// Restore implements Repository.
+// errAccountNotDeleted is returned when the account is live, a non zero version must be the stored one.
+func (r *repoImpl) Restore(ctx context.Context, accountID int, version int64) (entity.Account, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := bson.D{{Key: "account_id", Value: accountID}, isDeleted}
+	if version != 0 {
+		filter = append(filter, bson.E{Key: "version", Value: version})
+	}
+
+	update := append(bson.D{{Key: "$unset", Value: bson.M{"deleted_at": "", "deleted_by": ""}}}, stampUpdate(writeNow())...)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var account entity.Account
+	err := r.collection.FindOneAndUpdate(ctxTimeout, filter, update, opts).Decode(&account)
+	if err == nil {
+		return account, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Account{}, mapError(err)
+	}
+
+	// nothing matched, tell a missing account from a live one or another version
+	if err := r.collection.FindOne(ctxTimeout, bson.M{"account_id": accountID}).Decode(&account); err != nil {
+		return entity.Account{}, mapError(err)
+	}
+
+	return entity.Account{}, restoreFailure(account, version)
+}
+
+// PurgeOne implements Repository.
+func (r *repoImpl) PurgeOne(ctx context.Context, deletedBefore time.Time) (entity.Account, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := bson.M{"deleted_at": bson.M{"$lt": deletedBefore}}
+	opts := options.FindOneAndDelete().SetSort(bson.D{{Key: "deleted_at", Value: 1}})
+
+	var account entity.Account
+	err := r.collection.FindOneAndDelete(ctxTimeout, filter, opts).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Account{}, errAccountNotFound
+	}
+	if err != nil {
+		return entity.Account{}, mapError(err)
+	}
+
+	return account, nil
+}
+
+// restoreFailure tell why account could not be restored
+func restoreFailure(account entity.Account, version int64) error {
+	if account.DeletedAt == nil {
+		return errAccountNotDeleted
+	}
+
+	if !versionMatches(account, version) {
+		return ErrVersionMismatch
+	}
+
+	return errAccountNotFound
+}
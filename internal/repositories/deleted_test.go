@@ -0,0 +1,69 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ctx := context.Background()
+		seedAccounts(t, repo,
+			entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}},
+			entity.Account{AccountID: 2, Limit: 20, Products: []string{"a"}},
+		)
+
+		deleted, err := repo.Delete(ctx, 1, 0, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted.DeletedAt == nil || deleted.DeletedBy != "tester" || deleted.Version != 2 {
+			t.Errorf("deleted = %+v, want it stamped by tester at version 2", deleted)
+		}
+
+		if _, err := repo.Delete(ctx, 1, 0, "tester"); !errors.Is(err, errAccountNotFound) {
+			t.Errorf("delete twice err = %v, want %v", err, errAccountNotFound)
+		}
+		if _, err := repo.GetByAccountID(ctx, 1, false); !errors.Is(err, errAccountNotFound) {
+			t.Errorf("get deleted err = %v, want %v", err, errAccountNotFound)
+		}
+
+		accounts, total, _, err := repo.List(ctx, ListQuery{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := accountIDs(accounts); !sameIDs(ids, []int{2}) || total != 1 {
+			t.Errorf("list = %v total %d, want [2] total 1", ids, total)
+		}
+
+		accounts, total, _, err = repo.List(ctx, ListQuery{Filter: AccountFilter{IncludeDeleted: true}, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := accountIDs(accounts); !sameIDs(ids, []int{1, 2}) || total != 2 {
+			t.Errorf("list with deleted = %v total %d, want [1 2] total 2", ids, total)
+		}
+
+		if _, err := repo.Restore(ctx, 1, 1); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("restore a stale version err = %v, want %v", err, ErrVersionMismatch)
+		}
+
+		restored, err := repo.Restore(ctx, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.DeletedAt != nil || restored.DeletedBy != "" || restored.Version != 3 {
+			t.Errorf("restored = %+v, want it live at version 3", restored)
+		}
+
+		if _, err := repo.Restore(ctx, 1, 0); !errors.Is(err, errAccountNotDeleted) {
+			t.Errorf("restore a live account err = %v, want %v", err, errAccountNotDeleted)
+		}
+		if _, err := repo.Restore(ctx, 9, 0); !errors.Is(err, errAccountNotFound) {
+			t.Errorf("restore a missing account err = %v, want %v", err, errAccountNotFound)
+		}
+	})
+}
@@ -0,0 +1,542 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	WEBHOOK_DELIVERIES_COLLECTION_NAME string = "webhook_deliveries"
+
+	// attempts kept in the log of a delivery, older ones are dropped
+	deliveryAttemptsKept int = 20
+)
+
+// delivery states, a dead letter delivery is not attempted again until replayed
+const (
+	DELIVERY_STATE_PENDING     string = "pending"
+	DELIVERY_STATE_DELIVERED   string = "delivered"
+	DELIVERY_STATE_DEAD_LETTER string = "dead_letter"
+)
+
+// WebhookDeliveryIndexes is the index set required by the webhook deliveries collection
+var WebhookDeliveryIndexes = []IndexSpec{
+	// an event is delivered once per webhook however many times it is enqueued
+	{Name: "webhook_id_event_id_unique", Keys: bson.D{primitive.E{Key: "webhook_id", Value: 1}, primitive.E{Key: "event_id", Value: 1}}, Unique: true},
+	// due deliveries
+	{Name: "state_next_attempt_at", Keys: bson.D{primitive.E{Key: "state", Value: 1}, primitive.E{Key: "next_attempt_at", Value: 1}}},
+	// delivery log of a webhook newest first
+	{Name: "webhook_id_state_id", Keys: bson.D{primitive.E{Key: "webhook_id", Value: 1}, primitive.E{Key: "state", Value: 1}, primitive.E{Key: "_id", Value: -1}}},
+}
+
+// WebhookDeliveryRepository keep the deliveries of webhooks and their attempts
+type WebhookDeliveryRepository interface {
+	// Enqueue store deliveries, a delivery of an event already enqueued for the same webhook is ignored
+	Enqueue(ctx context.Context, deliveries ...entity.WebhookDelivery) error
+	// Claim return up to limit pending deliveries due at now, earliest first. They are not due again until until,
+	// so another dispatcher does not take them meanwhile and a dispatcher stopping halfway does not lose them.
+	Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]entity.WebhookDelivery, error)
+	// RecordAttempt save the state, attempt count and next attempt of delivery and add attempt to its log. claimedUntil
+	// is the next attempt the claim set, once the claim expired and another dispatcher claimed delivery nothing is saved.
+	RecordAttempt(ctx context.Context, delivery entity.WebhookDelivery, claimedUntil time.Time, attempt entity.WebhookAttempt) error
+	// List return deliveries of a webhook in state, every state when empty, newest first and their total number
+	List(ctx context.Context, webhookID primitive.ObjectID, state string, limit int, offset int) ([]entity.WebhookDelivery, int64, error)
+	// Replay make deliveries of a webhook pending and due at at with a fresh attempt count. Every dead letter delivery
+	// of the webhook is replayed when ids is empty. It return the number of deliveries replayed.
+	Replay(ctx context.Context, webhookID primitive.ObjectID, ids []primitive.ObjectID, at time.Time) (int64, error)
+	DeleteByWebhook(ctx context.Context, webhookID primitive.ObjectID) error
+}
+
+type webhookDeliveryImpl struct {
+	collection *mongo.Collection
+	timeoutMs  int
+}
+
+func NewWebhookDelivery(database *mongo.Database, timeoutMs int) WebhookDeliveryRepository {
+	return &webhookDeliveryImpl{
+		collection: database.Collection(WEBHOOK_DELIVERIES_COLLECTION_NAME),
+		timeoutMs:  timeoutMs,
+	}
+}
+
+// Enqueue implements WebhookDeliveryRepository.
+// The unique webhook and event index reject duplicates, unordered inserts still store the other deliveries.
+func (r *webhookDeliveryImpl) Enqueue(ctx context.Context, deliveries ...entity.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	docs := make([]interface{}, len(deliveries))
+	for i, delivery := range deliveries {
+		docs[i] = newDelivery(delivery)
+	}
+
+	_, err := r.collection.InsertMany(ctxTimeout, docs, options.InsertMany().SetOrdered(false))
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil && onlyDuplicateKeys(bulkErr.WriteErrors) {
+		return nil
+	}
+
+	return mapError(err)
+}
+
+// Claim implements WebhookDeliveryRepository.
+// Deliveries are claimed one by one, each claim is atomic so two dispatchers never take the same delivery.
+func (r *webhookDeliveryImpl) Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]entity.WebhookDelivery, error) {
+	if limit <= 0 {
+		return nil, errLimitNotPositive
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := bson.M{
+		"state":           DELIVERY_STATE_PENDING,
+		"next_attempt_at": bson.M{"$lte": now},
+	}
+	update := bson.M{"$set": bson.M{"next_attempt_at": until}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	deliveries := []entity.WebhookDelivery{}
+	for len(deliveries) < limit {
+		var delivery entity.WebhookDelivery
+		err := r.collection.FindOneAndUpdate(ctxTimeout, filter, update, opts).Decode(&delivery)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
+		if err != nil {
+			return deliveries, mapError(err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// RecordAttempt implements WebhookDeliveryRepository.
+func (r *webhookDeliveryImpl) RecordAttempt(ctx context.Context, delivery entity.WebhookDelivery, claimedUntil time.Time, attempt entity.WebhookAttempt) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	set := bson.M{
+		"state":           delivery.State,
+		"attempt_count":   delivery.AttemptCount,
+		"next_attempt_at": delivery.NextAttemptAt,
+	}
+	if delivery.DeliveredAt != nil {
+		set["delivered_at"] = delivery.DeliveredAt
+	}
+
+	update := bson.M{
+		"$set": set,
+		"$push": bson.M{"attempts": bson.M{
+			"$each":  bson.A{attempt},
+			"$slice": -deliveryAttemptsKept,
+		}},
+	}
+
+	// pending with the next attempt the claim set, a later claim has moved it
+	filter := bson.M{"_id": delivery.ID, "state": DELIVERY_STATE_PENDING, "next_attempt_at": claimedUntil}
+	result, err := r.collection.UpdateOne(ctxTimeout, filter, update)
+	if err != nil {
+		return mapError(err)
+	}
+
+	if result.MatchedCount == 0 {
+		return errDeliveryClaimLost
+	}
+
+	return nil
+}
+
+// List implements WebhookDeliveryRepository.
+func (r *webhookDeliveryImpl) List(ctx context.Context, webhookID primitive.ObjectID, state string, limit int, offset int) ([]entity.WebhookDelivery, int64, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	if limit <= 0 {
+		return nil, 0, errLimitNotPositive
+	}
+
+	if offset < 0 {
+		return nil, 0, errOffsetNegative
+	}
+
+	filter := bson.M{"webhook_id": webhookID}
+	if state != "" {
+		filter["state"] = state
+	}
+
+	total, err := r.collection.CountDocuments(ctxTimeout, filter)
+	if err != nil {
+		return nil, 0, mapError(err)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+
+	cursor, err := r.collection.Find(ctxTimeout, filter, opts)
+	if err != nil {
+		return nil, 0, mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	deliveries := []entity.WebhookDelivery{}
+	if err := cursor.All(ctxTimeout, &deliveries); err != nil {
+		return nil, 0, mapError(err)
+	}
+
+	return deliveries, total, nil
+}
+
+// Replay implements WebhookDeliveryRepository.
+func (r *webhookDeliveryImpl) Replay(ctx context.Context, webhookID primitive.ObjectID, ids []primitive.ObjectID, at time.Time) (int64, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := bson.M{"webhook_id": webhookID}
+	if len(ids) > 0 {
+		filter["_id"] = bson.M{"$in": ids}
+	} else {
+		filter["state"] = DELIVERY_STATE_DEAD_LETTER
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"state":           DELIVERY_STATE_PENDING,
+			"attempt_count":   0,
+			"next_attempt_at": at,
+		},
+		"$unset": bson.M{"delivered_at": ""},
+	}
+
+	result, err := r.collection.UpdateMany(ctxTimeout, filter, update)
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// DeleteByWebhook implements WebhookDeliveryRepository.
+func (r *webhookDeliveryImpl) DeleteByWebhook(ctx context.Context, webhookID primitive.ObjectID) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	_, err := r.collection.DeleteMany(ctxTimeout, bson.M{"webhook_id": webhookID})
+
+	return mapError(err)
+}
+
+type memoryWebhookDeliveryImpl struct {
+	mu         sync.Mutex
+	deliveries []entity.WebhookDelivery
+}
+
+// NewMemoryWebhookDelivery create in-memory webhook delivery repository, deliveries are kept in enqueue order
+func NewMemoryWebhookDelivery() WebhookDeliveryRepository {
+	return &memoryWebhookDeliveryImpl{}
+}
+
+// Enqueue implements WebhookDeliveryRepository.
+func (r *memoryWebhookDeliveryImpl) Enqueue(ctx context.Context, deliveries ...entity.WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		if r.enqueued(delivery.WebhookID, delivery.EventID) {
+			continue
+		}
+
+		delivery = newDelivery(delivery)
+		r.keep(ctx, delivery.ID)
+		r.deliveries = append(r.deliveries, delivery)
+	}
+
+	return nil
+}
+
+// Claim implements WebhookDeliveryRepository.
+func (r *memoryWebhookDeliveryImpl) Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]entity.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		return nil, errLimitNotPositive
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []int
+	for i, delivery := range r.deliveries {
+		if delivery.State == DELIVERY_STATE_PENDING && !delivery.NextAttemptAt.After(now) {
+			due = append(due, i)
+		}
+	}
+
+	sort.SliceStable(due, func(a, b int) bool {
+		return r.deliveries[due[a]].NextAttemptAt.Before(r.deliveries[due[b]].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	deliveries := make([]entity.WebhookDelivery, len(due))
+	for i, index := range due {
+		r.keep(ctx, r.deliveries[index].ID)
+		r.deliveries[index].NextAttemptAt = until
+		deliveries[i] = copyDelivery(r.deliveries[index])
+	}
+
+	return deliveries, nil
+}
+
+// RecordAttempt implements WebhookDeliveryRepository.
+func (r *memoryWebhookDeliveryImpl) RecordAttempt(ctx context.Context, delivery entity.WebhookDelivery, claimedUntil time.Time, attempt entity.WebhookAttempt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.deliveries {
+		stored := &r.deliveries[i]
+		if stored.ID != delivery.ID {
+			continue
+		}
+
+		if stored.State != DELIVERY_STATE_PENDING || !stored.NextAttemptAt.Equal(claimedUntil) {
+			return errDeliveryClaimLost
+		}
+
+		r.keep(ctx, stored.ID)
+		stored.State = delivery.State
+		stored.AttemptCount = delivery.AttemptCount
+		stored.NextAttemptAt = delivery.NextAttemptAt
+		if delivery.DeliveredAt != nil {
+			stored.DeliveredAt = delivery.DeliveredAt
+		}
+
+		stored.Attempts = append(stored.Attempts, attempt)
+		if len(stored.Attempts) > deliveryAttemptsKept {
+			stored.Attempts = append([]entity.WebhookAttempt{}, stored.Attempts[len(stored.Attempts)-deliveryAttemptsKept:]...)
+		}
+		return nil
+	}
+
+	// deleted with its webhook
+	return errDeliveryClaimLost
+}
+
+// List implements WebhookDeliveryRepository.
+func (r *memoryWebhookDeliveryImpl) List(ctx context.Context, webhookID primitive.ObjectID, state string, limit int, offset int) ([]entity.WebhookDelivery, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if limit <= 0 {
+		return nil, 0, errLimitNotPositive
+	}
+
+	if offset < 0 {
+		return nil, 0, errOffsetNegative
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var total int64
+	deliveries := []entity.WebhookDelivery{}
+	for i := len(r.deliveries) - 1; i >= 0; i-- {
+		delivery := r.deliveries[i]
+		if delivery.WebhookID != webhookID || (state != "" && delivery.State != state) {
+			continue
+		}
+
+		if total >= int64(offset) && len(deliveries) < limit {
+			deliveries = append(deliveries, copyDelivery(delivery))
+		}
+		total++
+	}
+
+	return deliveries, total, nil
+}
+
+// Replay implements WebhookDeliveryRepository.
+func (r *memoryWebhookDeliveryImpl) Replay(ctx context.Context, webhookID primitive.ObjectID, ids []primitive.ObjectID, at time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	selected := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	var replayed int64
+	for i := range r.deliveries {
+		stored := &r.deliveries[i]
+		if stored.WebhookID != webhookID {
+			continue
+		}
+
+		if len(ids) > 0 && !selected[stored.ID] || len(ids) == 0 && stored.State != DELIVERY_STATE_DEAD_LETTER {
+			continue
+		}
+
+		r.keep(ctx, stored.ID)
+		stored.State = DELIVERY_STATE_PENDING
+		stored.AttemptCount = 0
+		stored.NextAttemptAt = at
+		stored.DeliveredAt = nil
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// DeleteByWebhook implements WebhookDeliveryRepository.
+func (r *memoryWebhookDeliveryImpl) DeleteByWebhook(ctx context.Context, webhookID primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, delivery := range r.deliveries {
+		if delivery.WebhookID == webhookID {
+			r.keep(ctx, delivery.ID)
+		}
+	}
+
+	kept := r.deliveries[:0]
+	for _, delivery := range r.deliveries {
+		if delivery.WebhookID != webhookID {
+			kept = append(kept, delivery)
+		}
+	}
+	r.deliveries = kept
+
+	return nil
+}
+
+// keep register how to put back the delivery with id as stored now when the memory transaction of ctx fail, a
+// delivery not stored yet is removed. Caller must hold the lock.
+func (r *memoryWebhookDeliveryImpl) keep(ctx context.Context, id primitive.ObjectID) {
+	if !undoable(ctx) {
+		return
+	}
+
+	i := r.index(id)
+	var before *entity.WebhookDelivery
+	if i >= 0 {
+		delivery := copyDelivery(r.deliveries[i])
+		before = &delivery
+	}
+
+	onRollback(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		j := r.index(id)
+		switch {
+		case j >= 0 && before == nil:
+			r.deliveries = append(r.deliveries[:j], r.deliveries[j+1:]...)
+		case j >= 0:
+			r.deliveries[j] = *before
+		case before != nil:
+			// deleted, put back at its place in enqueue order
+			if i > len(r.deliveries) {
+				i = len(r.deliveries)
+			}
+			r.deliveries = append(r.deliveries, entity.WebhookDelivery{})
+			copy(r.deliveries[i+1:], r.deliveries[i:])
+			r.deliveries[i] = *before
+		}
+	})
+}
+
+// index is the position of the delivery with id, -1 when missing, caller must hold the lock
+func (r *memoryWebhookDeliveryImpl) index(id primitive.ObjectID) int {
+	for i := range r.deliveries {
+		if r.deliveries[i].ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// enqueued report whether a delivery of event to webhook is stored, caller must hold the lock
+func (r *memoryWebhookDeliveryImpl) enqueued(webhookID primitive.ObjectID, eventID string) bool {
+	for _, delivery := range r.deliveries {
+		if delivery.WebhookID == webhookID && delivery.EventID == eventID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newDelivery give a delivery to enqueue its id and an empty attempt log
+func newDelivery(delivery entity.WebhookDelivery) entity.WebhookDelivery {
+	if delivery.ID.IsZero() {
+		delivery.ID = primitive.NewObjectID()
+	}
+	if delivery.Attempts == nil {
+		delivery.Attempts = []entity.WebhookAttempt{}
+	}
+
+	return delivery
+}
+
+// copyDelivery copy the attempt log of delivery so the stored one is not shared with callers
+func copyDelivery(delivery entity.WebhookDelivery) entity.WebhookDelivery {
+	delivery.Attempts = append([]entity.WebhookAttempt{}, delivery.Attempts...)
+
+	return delivery
+}
+
+func onlyDuplicateKeys(writeErrors []mongo.BulkWriteError) bool {
+	for _, we := range writeErrors {
+		if we.Code != codeDuplicateKey {
+			return false
+		}
+	}
+
+	return true
+}
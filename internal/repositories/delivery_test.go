@@ -0,0 +1,69 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRecordAttemptRefuseLostClaim(t *testing.T) {
+	repositories := []struct {
+		name    string
+		newRepo func(t *testing.T) WebhookDeliveryRepository
+	}{
+		{name: "memory", newRepo: func(t *testing.T) WebhookDeliveryRepository { return NewMemoryWebhookDelivery() }},
+		{name: "mongo", newRepo: func(t *testing.T) WebhookDeliveryRepository {
+			return NewWebhookDelivery(testDatabase(t), testTimeoutMs)
+		}},
+	}
+
+	for _, tt := range repositories {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := tt.newRepo(t)
+			now := time.Now().UTC().Truncate(time.Millisecond)
+
+			webhookID := primitive.NewObjectID()
+			if err := repo.Enqueue(ctx, entity.WebhookDelivery{WebhookID: webhookID, EventID: "e1", State: DELIVERY_STATE_PENDING, NextAttemptAt: now}); err != nil {
+				t.Fatal(err)
+			}
+
+			first, err := repo.Claim(ctx, now, now.Add(time.Second), 10)
+			if err != nil || len(first) != 1 {
+				t.Fatalf("first claim = %+v, %v, want the delivery", first, err)
+			}
+
+			// the first claim expire and another dispatcher take the delivery
+			second, err := repo.Claim(ctx, now.Add(2*time.Second), now.Add(time.Minute), 10)
+			if err != nil || len(second) != 1 {
+				t.Fatalf("second claim = %+v, %v, want the delivery", second, err)
+			}
+
+			late := first[0]
+			late.State = DELIVERY_STATE_DELIVERED
+			late.AttemptCount = 1
+			if err := repo.RecordAttempt(ctx, late, first[0].NextAttemptAt, entity.WebhookAttempt{At: now}); !errors.Is(err, errDeliveryClaimLost) {
+				t.Errorf("record under a lost claim err = %v, want %v", err, errDeliveryClaimLost)
+			}
+
+			current := second[0]
+			current.State = DELIVERY_STATE_DELIVERED
+			current.AttemptCount = 1
+			if err := repo.RecordAttempt(ctx, current, second[0].NextAttemptAt, entity.WebhookAttempt{At: now}); err != nil {
+				t.Fatal(err)
+			}
+
+			deliveries, _, err := repo.List(ctx, webhookID, "", 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deliveries) != 1 || deliveries[0].State != DELIVERY_STATE_DELIVERED || len(deliveries[0].Attempts) != 1 {
+				t.Errorf("deliveries = %+v, want one delivered with the attempt of the current claim only", deliveries)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package repositories
+
+import (
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// decodeAccount decode raw document, int32, int64 and integral double numbers are all accepted for int fields
+func decodeAccount(raw bson.Raw) (entity.Account, error) {
+	var account entity.Account
+	err := bson.Unmarshal(raw, &account)
+
+	return account, err
+}
+
+// rawID return _id of raw document for error reporting
+func rawID(raw bson.Raw) string {
+	id, err := raw.LookupErr("_id")
+	if err != nil {
+		return "unknown"
+	}
+
+	return id.String()
+}
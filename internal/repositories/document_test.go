@@ -0,0 +1,178 @@
+package repositories
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fixtureDocuments read the accounts fixture as raw documents
+func fixtureDocuments(t *testing.T) []bson.Raw {
+	t.Helper()
+
+	var documents []bson.Raw
+	scanner := bufio.NewScanner(db.AccountsFixture())
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var document bson.Raw
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &document); err != nil {
+			t.Fatalf("fixture line %d: %v", line, err)
+		}
+		documents = append(documents, document)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+
+	return documents
+}
+
+func TestDecodeAccountFixture(t *testing.T) {
+	documents := fixtureDocuments(t)
+	if len(documents) == 0 {
+		t.Fatal("fixture is empty")
+	}
+
+	for i, document := range documents {
+		account, err := decodeAccount(document)
+		if err != nil {
+			t.Fatalf("document %d: %v", i, err)
+		}
+
+		if account.ID.IsZero() || account.AccountID == 0 {
+			t.Fatalf("document %d decoded without ids: %+v", i, account)
+		}
+	}
+}
+
+func TestDecodeAccountNumbers(t *testing.T) {
+	tests := []struct {
+		name      string
+		accountID interface{}
+		limit     interface{}
+		wantErr   bool
+	}{
+		{name: "int32", accountID: int32(371138), limit: int32(9000)},
+		{name: "int64", accountID: int64(371138), limit: int64(9000)},
+		{name: "integral double", accountID: float64(371138), limit: float64(9000)},
+		{name: "fractional double", accountID: int32(371138), limit: 9000.5, wantErr: true},
+		{name: "string", accountID: "371138", limit: int32(9000), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := bson.Marshal(bson.D{
+				{Key: "_id", Value: primitive.NewObjectID()},
+				{Key: "account_id", Value: tt.accountID},
+				{Key: "limit", Value: tt.limit},
+				{Key: "products", Value: bson.A{"Brokerage"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			account, err := decodeAccount(raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decoded %+v, want an error", account)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if account.AccountID != 371138 || account.Limit != 9000 {
+				t.Fatalf("decoded %+v", account)
+			}
+		})
+	}
+}
+
+func TestListDecode(t *testing.T) {
+	database := testDatabase(t)
+	repo := New(database, testTimeoutMs)
+	ctx := context.Background()
+
+	documents := fixtureDocuments(t)
+	fixture := make([]interface{}, len(documents))
+	for i, document := range documents {
+		fixture[i] = document
+	}
+
+	collection := database.Collection(ACCOUNTS_COLLECTION_NAME)
+	if _, err := collection.InsertMany(ctx, fixture); err != nil {
+		t.Fatal(err)
+	}
+
+	// synthetic numbers written by other clients
+	if _, err := collection.InsertMany(ctx, []interface{}{
+		bson.D{{Key: "account_id", Value: int64(9000001)}, {Key: "limit", Value: int64(100)}, {Key: "products", Value: bson.A{}}},
+		bson.D{{Key: "account_id", Value: float64(9000002)}, {Key: "limit", Value: float64(200)}, {Key: "products", Value: bson.A{}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	min := 9000000
+	accounts, total, _, err := repo.List(ctx, ListQuery{Filter: AccountFilter{AccountIDMin: &min}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(accounts) != 2 || accounts[0].Limit != 100 || accounts[1].Limit != 200 {
+		t.Fatalf("got %d of %d: %+v", len(accounts), total, accounts)
+	}
+
+	accounts, total, _, err = repo.List(ctx, ListQuery{Limit: len(documents) + 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(total) != len(documents)+2 || len(accounts) != len(documents)+2 {
+		t.Fatalf("got %d of %d, want %d", len(accounts), total, len(documents)+2)
+	}
+
+	// nothing matched is an empty page
+	accounts, total, next, err := repo.List(ctx, ListQuery{Filter: AccountFilter{Product: "missing"}, Limit: 10})
+	if err != nil || total != 0 || len(accounts) != 0 || next != "" {
+		t.Fatalf("got %v of %d, next %q, err %v", accounts, total, next, err)
+	}
+}
+
+func TestListDecodeError(t *testing.T) {
+	database := testDatabase(t)
+	repo := New(database, testTimeoutMs)
+	ctx := context.Background()
+
+	id := primitive.NewObjectID()
+	if _, err := database.Collection(ACCOUNTS_COLLECTION_NAME).InsertMany(ctx, []interface{}{
+		bson.D{{Key: "account_id", Value: 1}, {Key: "limit", Value: 10}},
+		bson.D{{Key: "account_id", Value: 2}, {Key: "limit", Value: 20}},
+		bson.D{{Key: "_id", Value: id}, {Key: "account_id", Value: 3}, {Key: "limit", Value: "many"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err := repo.List(ctx, ListQuery{Limit: 10, Offset: 1})
+	if !errors.Is(err, errDocumentDecode) || !strings.Contains(err.Error(), "at index 2") || !strings.Contains(err.Error(), id.Hex()) {
+		t.Fatalf("got %v", err)
+	}
+
+	// a cursor page report the index within the page
+	_, _, next, err := repo.List(ctx, ListQuery{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = repo.List(ctx, ListQuery{Limit: 10, Cursor: next})
+	if !errors.Is(err, errDocumentDecode) || !strings.Contains(err.Error(), "at index 1") {
+		t.Fatalf("got %v", err)
+	}
+}
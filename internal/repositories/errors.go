@@ -0,0 +1,35 @@
+package repositories
+
+import (
+	"errors"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// mapError translate mongo driver error into domain error, domain errors are returned as is
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var domainErr *errs.Error
+	if errors.As(err, &domainErr) {
+		return err
+	}
+
+	var selectionErr topology.ServerSelectionError
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return errAccountNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return errs.Wrap(errs.Conflict, errAccountExists.Message(), err)
+	case errors.As(err, &selectionErr), errors.Is(err, mongo.ErrClientDisconnected), mongo.IsNetworkError(err):
+		return errs.Wrap(errs.Unavailable, "database is unavailable", err)
+	case mongo.IsTimeout(err):
+		return errs.Wrap(errs.Timeout, "database operation timed out", err)
+	}
+
+	return err
+}
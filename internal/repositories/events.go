@@ -0,0 +1,257 @@
+package repositories
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// account event types, named like the history actions
+const (
+	EVENT_CREATED  string = "created"
+	EVENT_UPDATED  string = "updated"
+	EVENT_DELETED  string = "deleted"
+	EVENT_RESTORED string = "restored"
+	EVENT_PURGED   string = "purged"
+
+	// events the bus keep for feeds resuming after a given event
+	eventBacklogSize int = 1024
+
+	// events buffered per feed on top of its backlog, the bus drop a feed falling further behind
+	eventFeedBuffer int = 256
+)
+
+// AccountWatcher open feeds of account events
+type AccountWatcher interface {
+	// Watch open a feed of the events matching filter that happen after the event resumeAfter, or from now when it is empty.
+	// ctx bound opening the feed only, the feed last until closed.
+	Watch(ctx context.Context, filter EventFilter, resumeAfter string) (EventFeed, error)
+}
+
+// EventFeed deliver account events in the order they happen until it is closed or fail
+type EventFeed interface {
+	Events() <-chan entity.AccountEvent
+	// Err tell why Events was closed once it is, nil when the feed was closed by its owner
+	Err() error
+	Close()
+}
+
+// EventBus is an in-process watcher, it only see the events published to it
+type EventBus interface {
+	AccountWatcher
+	// WatchMatching open a feed from now of the events match accept. The bus call match as events are published, so
+	// what the feed follow may change over time and only the events it follow count against its buffer.
+	// match must be quick and must not call the bus.
+	WatchMatching(ctx context.Context, match func(event entity.AccountEvent) bool) (EventFeed, error)
+	// Publish give events an id and send them to every matching feed, feeds too slow to take them are dropped
+	Publish(events ...entity.AccountEvent)
+}
+
+// EventFilter select events by account or by the products the account hold after the change, empty lists match everything
+type EventFilter struct {
+	AccountIDs []int
+	Products   []string
+}
+
+// matchStage build the $match stage of change events matching the filter
+func (f EventFilter) matchStage() bson.D {
+	filter := bson.D{{Key: "operationType", Value: bson.M{"$in": bson.A{"insert", "update", "replace"}}}}
+	if len(f.AccountIDs) > 0 {
+		filter = append(filter, bson.E{Key: "fullDocument.account_id", Value: bson.M{"$in": f.AccountIDs}})
+	}
+	if len(f.Products) > 0 {
+		filter = append(filter, bson.E{Key: "fullDocument.products", Value: bson.M{"$in": f.Products}})
+	}
+
+	return bson.D{{Key: "$match", Value: filter}}
+}
+
+// match is matchStage for the event bus
+func (f EventFilter) match(event entity.AccountEvent) bool {
+	if len(f.AccountIDs) > 0 {
+		var found bool
+		for _, id := range f.AccountIDs {
+			if id == event.AccountID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Products) == 0 {
+		return true
+	}
+
+	if event.Account == nil {
+		return false
+	}
+
+	for _, p := range f.Products {
+		if containsProduct(event.Account.Products, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type eventBusImpl struct {
+	mu      sync.Mutex
+	lastSeq uint64
+	// backlog hold the latest events, oldest first
+	backlog []busEvent
+	feeds   map[*busFeed]struct{}
+}
+
+type busEvent struct {
+	seq   uint64
+	event entity.AccountEvent
+}
+
+// NewEventBus create in-process event bus, event ids are sequence numbers that restart with the process
+func NewEventBus() EventBus {
+	return &eventBusImpl{
+		backlog: make([]busEvent, 0, eventBacklogSize),
+		feeds:   make(map[*busFeed]struct{}),
+	}
+}
+
+// Watch implements AccountWatcher.
+// Only the latest events are kept, resuming after an older event or an event of another process fail.
+func (b *eventBusImpl) Watch(ctx context.Context, filter EventFilter, resumeAfter string) (EventFeed, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	after := b.lastSeq
+	if resumeAfter != "" {
+		seq, err := strconv.ParseUint(resumeAfter, 10, 64)
+		if err != nil || seq > b.lastSeq {
+			return nil, errEventNotResumable
+		}
+
+		// the event right after seq must still be kept
+		if len(b.backlog) > 0 && seq+1 < b.backlog[0].seq {
+			return nil, errEventNotResumable
+		}
+
+		after = seq
+	}
+
+	var missed []entity.AccountEvent
+	for _, e := range b.backlog {
+		if e.seq > after && filter.match(e.event) {
+			missed = append(missed, e.event)
+		}
+	}
+
+	feed := &busFeed{
+		bus:    b,
+		match:  filter.match,
+		events: make(chan entity.AccountEvent, len(missed)+eventFeedBuffer),
+	}
+	for _, e := range missed {
+		feed.events <- e
+	}
+
+	b.feeds[feed] = struct{}{}
+
+	return feed, nil
+}
+
+// WatchMatching implements EventBus.
+func (b *eventBusImpl) WatchMatching(ctx context.Context, match func(event entity.AccountEvent) bool) (EventFeed, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	feed := &busFeed{
+		bus:    b,
+		match:  match,
+		events: make(chan entity.AccountEvent, eventFeedBuffer),
+	}
+	b.feeds[feed] = struct{}{}
+
+	return feed, nil
+}
+
+// Publish implements EventBus.
+func (b *eventBusImpl) Publish(events ...entity.AccountEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, event := range events {
+		b.lastSeq++
+		event.ID = strconv.FormatUint(b.lastSeq, 10)
+
+		if len(b.backlog) == eventBacklogSize {
+			copy(b.backlog, b.backlog[1:])
+			b.backlog = b.backlog[:len(b.backlog)-1]
+		}
+		b.backlog = append(b.backlog, busEvent{seq: b.lastSeq, event: event})
+
+		for feed := range b.feeds {
+			if !feed.match(event) {
+				continue
+			}
+
+			select {
+			case feed.events <- event:
+			default:
+				b.remove(feed, errEventFeedTooSlow)
+			}
+		}
+	}
+}
+
+// remove stop sending events to feed and close it with err, caller must hold the lock
+func (b *eventBusImpl) remove(feed *busFeed, err error) {
+	if _, ok := b.feeds[feed]; !ok {
+		return
+	}
+
+	delete(b.feeds, feed)
+	feed.err = err
+	close(feed.events)
+}
+
+type busFeed struct {
+	bus    *eventBusImpl
+	match  func(event entity.AccountEvent) bool
+	events chan entity.AccountEvent
+	err    error
+}
+
+// Events implements EventFeed.
+func (f *busFeed) Events() <-chan entity.AccountEvent {
+	return f.events
+}
+
+// Err implements EventFeed.
+func (f *busFeed) Err() error {
+	f.bus.mu.Lock()
+	defer f.bus.mu.Unlock()
+
+	return f.err
+}
+
+// Close implements EventFeed.
+func (f *busFeed) Close() {
+	f.bus.mu.Lock()
+	defer f.bus.mu.Unlock()
+
+	f.bus.remove(f, nil)
+}
@@ -0,0 +1,192 @@
+package repositories
+
+import (
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ListQuery hold filter, sort and pagination of account listing.
+// Empty Sort means account_id ascending. When Cursor is set, Offset is ignored and the page starts right after the cursor position.
+type ListQuery struct {
+	Filter AccountFilter
+	Sort   []SortField
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+// AccountFilter narrow down accounts, every set condition must hold. Nil range bound means unbounded.
+// Soft deleted accounts are left out unless IncludeDeleted is set.
+type AccountFilter struct {
+	IncludeDeleted bool
+
+	Product      string
+	ProductsAll  []string
+	ProductsAny  []string
+	ProductsNone []string
+
+	LimitMin        *int
+	LimitMax        *int
+	ProductCountMin *int
+	ProductCountMax *int
+	AccountIDMin    *int
+	AccountIDMax    *int
+
+	// CreatedFrom is inclusive and CreatedTo exclusive, UpdatedSince is inclusive
+	CreatedFrom  *time.Time
+	CreatedTo    *time.Time
+	UpdatedSince *time.Time
+}
+
+// matchStage build the $match stage of the filter, nil when there is nothing to filter
+func (f AccountFilter) matchStage() bson.D {
+	filter := f.bsonFilter()
+	if len(filter) == 0 {
+		return nil
+	}
+
+	return bson.D{primitive.E{Key: "$match", Value: filter}}
+}
+
+// bsonFilter translate filter into a query document
+func (f AccountFilter) bsonFilter() bson.D {
+	var filter bson.D
+	if !f.IncludeDeleted {
+		filter = append(filter, notDeleted)
+	}
+
+	// products conditions share one key, so they are merged into one operator document
+	all := f.ProductsAll
+	if f.Product != "" {
+		all = append(append([]string{}, all...), f.Product)
+	}
+
+	var products bson.D
+	if len(all) > 0 {
+		products = append(products, primitive.E{Key: "$all", Value: all})
+	}
+	if len(f.ProductsAny) > 0 {
+		products = append(products, primitive.E{Key: "$in", Value: f.ProductsAny})
+	}
+	if len(f.ProductsNone) > 0 {
+		products = append(products, primitive.E{Key: "$nin", Value: f.ProductsNone})
+	}
+	if len(products) > 0 {
+		filter = append(filter, primitive.E{Key: "products", Value: products})
+	}
+
+	if r := rangeFilter(f.LimitMin, f.LimitMax); r != nil {
+		filter = append(filter, primitive.E{Key: "limit", Value: r})
+	}
+
+	if r := rangeFilter(f.AccountIDMin, f.AccountIDMax); r != nil {
+		filter = append(filter, primitive.E{Key: "account_id", Value: r})
+	}
+
+	var created bson.D
+	if f.CreatedFrom != nil {
+		created = append(created, primitive.E{Key: "$gte", Value: *f.CreatedFrom})
+	}
+	if f.CreatedTo != nil {
+		created = append(created, primitive.E{Key: "$lt", Value: *f.CreatedTo})
+	}
+	if len(created) > 0 {
+		filter = append(filter, primitive.E{Key: "created_at", Value: created})
+	}
+
+	if f.UpdatedSince != nil {
+		filter = append(filter, primitive.E{Key: "updated_at", Value: bson.D{primitive.E{Key: "$gte", Value: *f.UpdatedSince}}})
+	}
+
+	// product count is computed, missing products count as zero
+	var productCount bson.A
+	size := bson.D{primitive.E{Key: "$size", Value: bson.D{primitive.E{Key: "$ifNull", Value: bson.A{"$products", bson.A{}}}}}}
+	if f.ProductCountMin != nil {
+		productCount = append(productCount, bson.D{primitive.E{Key: "$gte", Value: bson.A{size, *f.ProductCountMin}}})
+	}
+	if f.ProductCountMax != nil {
+		productCount = append(productCount, bson.D{primitive.E{Key: "$lte", Value: bson.A{size, *f.ProductCountMax}}})
+	}
+	if len(productCount) > 0 {
+		filter = append(filter, primitive.E{Key: "$expr", Value: bson.D{primitive.E{Key: "$and", Value: productCount}}})
+	}
+
+	return filter
+}
+
+// match evaluate the filter the same way as bsonFilter does on mongo
+func (f AccountFilter) match(account entity.Account) bool {
+	if !f.IncludeDeleted && account.DeletedAt != nil {
+		return false
+	}
+
+	if f.Product != "" && !containsProduct(account.Products, f.Product) {
+		return false
+	}
+
+	for _, p := range f.ProductsAll {
+		if !containsProduct(account.Products, p) {
+			return false
+		}
+	}
+
+	if len(f.ProductsAny) > 0 {
+		var found bool
+		for _, p := range f.ProductsAny {
+			if containsProduct(account.Products, p) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for _, p := range f.ProductsNone {
+		if containsProduct(account.Products, p) {
+			return false
+		}
+	}
+
+	if f.CreatedFrom != nil && account.CreatedAt.Before(*f.CreatedFrom) {
+		return false
+	}
+	if f.CreatedTo != nil && !account.CreatedAt.Before(*f.CreatedTo) {
+		return false
+	}
+	if f.UpdatedSince != nil && account.UpdatedAt.Before(*f.UpdatedSince) {
+		return false
+	}
+
+	return inRange(account.Limit, f.LimitMin, f.LimitMax) &&
+		inRange(account.AccountID, f.AccountIDMin, f.AccountIDMax) &&
+		inRange(len(account.Products), f.ProductCountMin, f.ProductCountMax)
+}
+
+func rangeFilter(min, max *int) bson.D {
+	var r bson.D
+	if min != nil {
+		r = append(r, primitive.E{Key: "$gte", Value: *min})
+	}
+	if max != nil {
+		r = append(r, primitive.E{Key: "$lte", Value: *max})
+	}
+
+	return r
+}
+
+func inRange(v int, min, max *int) bool {
+	if min != nil && v < *min {
+		return false
+	}
+	if max != nil && v > *max {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,214 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ACCOUNT_HISTORY_COLLECTION_NAME string = "account_history"
+
+// HistoryIndexes is the index set required by the account history collection
+var HistoryIndexes = []IndexSpec{
+	// history of an account newest first
+	{Name: "account_id_at", Keys: bson.D{primitive.E{Key: "account_id", Value: 1}, primitive.E{Key: "at", Value: -1}, primitive.E{Key: "_id", Value: -1}}},
+}
+
+// HistoryRepository keep the change records of accounts, records are never updated nor deleted
+type HistoryRepository interface {
+	Append(ctx context.Context, records ...entity.AccountHistory) error
+	// List return records of an account newest first and the total number of its records
+	List(ctx context.Context, accountID int, limit int, offset int) ([]entity.AccountHistory, int64, error)
+	// AsOf return the last record holding a revision of the account at or before at, errRevisionNotFound when there is none
+	AsOf(ctx context.Context, accountID int, at time.Time) (entity.AccountHistory, error)
+}
+
+type historyImpl struct {
+	collection *mongo.Collection
+	timeoutMs  int
+}
+
+func NewHistory(database *mongo.Database, timeoutMs int) HistoryRepository {
+	return &historyImpl{
+		collection: database.Collection(ACCOUNT_HISTORY_COLLECTION_NAME),
+		timeoutMs:  timeoutMs,
+	}
+}
+
+// Append implements HistoryRepository.
+func (r *historyImpl) Append(ctx context.Context, records ...entity.AccountHistory) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		docs[i] = record
+	}
+
+	_, err := r.collection.InsertMany(ctxTimeout, docs)
+
+	return mapError(err)
+}
+
+// List implements HistoryRepository.
+func (r *historyImpl) List(ctx context.Context, accountID int, limit int, offset int) ([]entity.AccountHistory, int64, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	if limit <= 0 {
+		return nil, 0, errLimitNotPositive
+	}
+
+	if offset < 0 {
+		return nil, 0, errOffsetNegative
+	}
+
+	filter := bson.M{"account_id": accountID}
+	total, err := r.collection.CountDocuments(ctxTimeout, filter)
+	if err != nil {
+		return nil, 0, mapError(err)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+
+	cursor, err := r.collection.Find(ctxTimeout, filter, opts)
+	if err != nil {
+		return nil, 0, mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	records := []entity.AccountHistory{}
+	if err := cursor.All(ctxTimeout, &records); err != nil {
+		return nil, 0, mapError(err)
+	}
+
+	return records, total, nil
+}
+
+// AsOf implements HistoryRepository.
+func (r *historyImpl) AsOf(ctx context.Context, accountID int, at time.Time) (entity.AccountHistory, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := bson.D{
+		{Key: "account_id", Value: accountID},
+		{Key: "at", Value: bson.M{"$lte": at}},
+		{Key: "account", Value: bson.M{"$exists": true}},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}})
+
+	var record entity.AccountHistory
+	err := r.collection.FindOne(ctxTimeout, filter, opts).Decode(&record)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.AccountHistory{}, errRevisionNotFound
+	}
+
+	return record, mapError(err)
+}
+
+type memoryHistoryImpl struct {
+	mu      sync.RWMutex
+	records map[int][]entity.AccountHistory
+}
+
+// NewMemoryHistory create in-memory history repository, records of an account are kept in append order
+func NewMemoryHistory() HistoryRepository {
+	return &memoryHistoryImpl{
+		records: make(map[int][]entity.AccountHistory),
+	}
+}
+
+// Append implements HistoryRepository.
+func (r *memoryHistoryImpl) Append(ctx context.Context, records ...entity.AccountHistory) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if undoable(ctx) {
+		// history is only appended in transactions which run one at a time, the records appended since are these
+		lengths := make(map[int]int, len(records))
+		for _, record := range records {
+			if _, ok := lengths[record.AccountID]; !ok {
+				lengths[record.AccountID] = len(r.records[record.AccountID])
+			}
+		}
+
+		onRollback(ctx, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			for accountID, length := range lengths {
+				r.records[accountID] = r.records[accountID][:length]
+			}
+		})
+	}
+
+	for _, record := range records {
+		r.records[record.AccountID] = append(r.records[record.AccountID], record)
+	}
+
+	return nil
+}
+
+// List implements HistoryRepository.
+func (r *memoryHistoryImpl) List(ctx context.Context, accountID int, limit int, offset int) ([]entity.AccountHistory, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if limit <= 0 {
+		return nil, 0, errLimitNotPositive
+	}
+
+	if offset < 0 {
+		return nil, 0, errOffsetNegative
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored := r.records[accountID]
+	records := []entity.AccountHistory{}
+	for i := len(stored) - 1 - offset; i >= 0 && len(records) < limit; i-- {
+		records = append(records, stored[i])
+	}
+
+	return records, int64(len(stored)), nil
+}
+
+// AsOf implements HistoryRepository.
+func (r *memoryHistoryImpl) AsOf(ctx context.Context, accountID int, at time.Time) (entity.AccountHistory, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.AccountHistory{}, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored := r.records[accountID]
+	for i := len(stored) - 1; i >= 0; i-- {
+		if stored[i].Account != nil && !stored[i].At.After(at) {
+			return stored[i], nil
+		}
+	}
+
+	return entity.AccountHistory{}, errRevisionNotFound
+}
@@ -0,0 +1,265 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// index states
+const (
+	INDEX_STATE_OK      string = "ok"
+	INDEX_STATE_CREATED string = "created"
+	INDEX_STATE_MISSING string = "missing"
+	INDEX_STATE_DRIFT   string = "drift"
+	INDEX_STATE_EXTRA   string = "extra"
+	INDEX_STATE_ERROR   string = "error"
+)
+
+// IndexSpec is an index declared by the application
+type IndexSpec struct {
+	Name   string
+	Keys   bson.D
+	Unique bool
+}
+
+// IndexStatus compare a declared index with the one on the collection.
+// Extra indexes exist on the collection but are not declared, drift means same name with different keys or options.
+type IndexStatus struct {
+	Name   string
+	Keys   bson.D
+	Unique bool
+	State  string
+	Detail string
+}
+
+// AccountIndexes is the index set required by the accounts collection
+var AccountIndexes = []IndexSpec{
+	// one document per account, also serve account_id sort, the default one, and keyset pagination
+	{Name: "account_id_unique", Keys: bson.D{primitive.E{Key: "account_id", Value: 1}}, Unique: true},
+	// multikey index for product filters
+	{Name: "products", Keys: bson.D{primitive.E{Key: "products", Value: 1}}},
+	// limit sort alone, which break ties on _id, also serve limit range filter
+	{Name: "limit_id", Keys: bson.D{primitive.E{Key: "limit", Value: 1}, primitive.E{Key: "_id", Value: 1}}},
+	// limit then account_id sort in the same direction, and in opposite directions
+	{Name: "limit_account_id", Keys: bson.D{primitive.E{Key: "limit", Value: 1}, primitive.E{Key: "account_id", Value: 1}}},
+	{Name: "limit_account_id_desc", Keys: bson.D{primitive.E{Key: "limit", Value: 1}, primitive.E{Key: "account_id", Value: -1}}},
+	// product_count is computed by the listing pipeline so its sorts can not use an index
+	// purge of soft deleted accounts past retention
+	{Name: "deleted_at", Keys: bson.D{primitive.E{Key: "deleted_at", Value: 1}}},
+	// created_from and created_to filters
+	{Name: "created_at", Keys: bson.D{primitive.E{Key: "created_at", Value: 1}}},
+	// updated_since filter and the updated_at sort, which break ties on _id
+	{Name: "updated_at_id", Keys: bson.D{primitive.E{Key: "updated_at", Value: 1}, primitive.E{Key: "_id", Value: 1}}},
+}
+
+type IndexManager interface {
+	// Ensure create missing declared indexes, drifted indexes are reported and left untouched
+	Ensure(ctx context.Context) ([]IndexStatus, error)
+	// Status report declared and existing indexes without changing anything
+	Status(ctx context.Context) ([]IndexStatus, error)
+}
+
+type indexManagerImpl struct {
+	collection *mongo.Collection
+	specs      []IndexSpec
+	timeoutMs  int
+}
+
+func NewIndexManager(database *mongo.Database, timeoutMs int) IndexManager {
+	return &indexManagerImpl{
+		collection: database.Collection(ACCOUNTS_COLLECTION_NAME),
+		specs:      AccountIndexes,
+		timeoutMs:  timeoutMs,
+	}
+}
+
+// Ensure implements IndexManager.
+func (m *indexManagerImpl) Ensure(ctx context.Context) ([]IndexStatus, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, status := range statuses {
+		if status.State != INDEX_STATE_MISSING {
+			continue
+		}
+
+		// index build may take longer than a query, so it only follows the caller context
+		model := mongo.IndexModel{
+			Keys:    status.Keys,
+			Options: options.Index().SetName(status.Name).SetUnique(status.Unique),
+		}
+		if _, err := m.collection.Indexes().CreateOne(ctx, model); err != nil {
+			statuses[i].State = INDEX_STATE_ERROR
+			statuses[i].Detail = mapError(err).Error()
+			continue
+		}
+
+		statuses[i].State = INDEX_STATE_CREATED
+	}
+
+	return statuses, nil
+}
+
+// Status implements IndexManager.
+func (m *indexManagerImpl) Status(ctx context.Context) ([]IndexStatus, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(m.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	specs, err := m.collection.Indexes().ListSpecifications(ctxTimeout)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	existing := make(map[string]IndexSpec, len(specs))
+	for _, s := range specs {
+		var keys bson.D
+		if err := bson.Unmarshal(s.KeysDocument, &keys); err != nil {
+			return nil, err
+		}
+
+		existing[s.Name] = IndexSpec{
+			Name:   s.Name,
+			Keys:   keys,
+			Unique: s.Unique != nil && *s.Unique,
+		}
+	}
+
+	return compareIndexes(m.specs, existing), nil
+}
+
+// compareIndexes report declared specs in order, followed by extra existing indexes other than _id
+func compareIndexes(declared []IndexSpec, existing map[string]IndexSpec) []IndexStatus {
+	statuses := make([]IndexStatus, 0, len(declared)+len(existing))
+	known := map[string]bool{"_id_": true}
+
+	for _, spec := range declared {
+		known[spec.Name] = true
+		status := IndexStatus{
+			Name:   spec.Name,
+			Keys:   spec.Keys,
+			Unique: spec.Unique,
+			State:  INDEX_STATE_OK,
+		}
+
+		current, ok := existing[spec.Name]
+		switch {
+		case !ok:
+			status.State = INDEX_STATE_MISSING
+			if other, found := findIndexByKeys(existing, spec.Keys); found {
+				status.Detail = fmt.Sprintf("same keys are indexed as %q", other)
+			}
+		case !sameIndexKeys(current.Keys, spec.Keys):
+			status.State = INDEX_STATE_DRIFT
+			status.Detail = fmt.Sprintf("keys are %s, expected %s", indexKeysString(current.Keys), indexKeysString(spec.Keys))
+		case current.Unique != spec.Unique:
+			status.State = INDEX_STATE_DRIFT
+			status.Detail = fmt.Sprintf("unique is %t, expected %t", current.Unique, spec.Unique)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	var extras []string
+	for name := range existing {
+		if !known[name] {
+			extras = append(extras, name)
+		}
+	}
+	sort.Strings(extras)
+
+	for _, name := range extras {
+		statuses = append(statuses, IndexStatus{
+			Name:   name,
+			Keys:   existing[name].Keys,
+			Unique: existing[name].Unique,
+			State:  INDEX_STATE_EXTRA,
+		})
+	}
+
+	return statuses
+}
+
+func findIndexByKeys(existing map[string]IndexSpec, keys bson.D) (string, bool) {
+	for name, spec := range existing {
+		if sameIndexKeys(spec.Keys, keys) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// sameIndexKeys compare key documents, numeric directions may come back as int32, int64 or double
+func sameIndexKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(normalizeIndexValue(a[i].Value)) != fmt.Sprint(normalizeIndexValue(b[i].Value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func normalizeIndexValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+
+	return v
+}
+
+func indexKeysString(keys bson.D) string {
+	s := "{"
+	for i, k := range keys {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s: %v", k.Key, normalizeIndexValue(k.Value))
+	}
+
+	return s + "}"
+}
+
+type memoryIndexManagerImpl struct {
+	specs []IndexSpec
+}
+
+// NewMemoryIndexManager report declared indexes of the in-memory repository, which enforce them natively
+func NewMemoryIndexManager() IndexManager {
+	return &memoryIndexManagerImpl{
+		specs: AccountIndexes,
+	}
+}
+
+// Ensure implements IndexManager.
+func (m *memoryIndexManagerImpl) Ensure(ctx context.Context) ([]IndexStatus, error) {
+	return m.Status(ctx)
+}
+
+// Status implements IndexManager.
+func (m *memoryIndexManagerImpl) Status(ctx context.Context) ([]IndexStatus, error) {
+	existing := make(map[string]IndexSpec, len(m.specs))
+	for _, spec := range m.specs {
+		existing[spec.Name] = spec
+	}
+
+	return compareIndexes(m.specs, existing), nil
+}
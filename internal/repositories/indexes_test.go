@@ -0,0 +1,173 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var testIndexes = []IndexSpec{
+	{Name: "account_id_unique", Keys: bson.D{primitive.E{Key: "account_id", Value: 1}}, Unique: true},
+	{Name: "limit_id", Keys: bson.D{primitive.E{Key: "limit", Value: 1}, primitive.E{Key: "_id", Value: 1}}},
+	{Name: "products", Keys: bson.D{primitive.E{Key: "products", Value: 1}}},
+}
+
+// indexStates map index names to their state
+func indexStates(statuses []IndexStatus) map[string]string {
+	states := make(map[string]string, len(statuses))
+	for _, status := range statuses {
+		states[status.Name] = status.State
+	}
+
+	return states
+}
+
+func TestCompareIndexes(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []IndexSpec
+		states   map[string]string
+	}{
+		{
+			name: "missing",
+			states: map[string]string{
+				"account_id_unique": INDEX_STATE_MISSING,
+				"limit_id":          INDEX_STATE_MISSING,
+				"products":          INDEX_STATE_MISSING,
+			},
+		},
+		{
+			name: "ok whatever the number type of directions",
+			existing: []IndexSpec{
+				{Name: "_id_", Keys: bson.D{primitive.E{Key: "_id", Value: int32(1)}}},
+				{Name: "account_id_unique", Keys: bson.D{primitive.E{Key: "account_id", Value: int32(1)}}, Unique: true},
+				{Name: "limit_id", Keys: bson.D{primitive.E{Key: "limit", Value: float64(1)}, primitive.E{Key: "_id", Value: int64(1)}}},
+				{Name: "products", Keys: bson.D{primitive.E{Key: "products", Value: int32(1)}}},
+			},
+			states: map[string]string{
+				"account_id_unique": INDEX_STATE_OK,
+				"limit_id":          INDEX_STATE_OK,
+				"products":          INDEX_STATE_OK,
+			},
+		},
+		{
+			name: "drift and extra",
+			existing: []IndexSpec{
+				{Name: "account_id_unique", Keys: bson.D{primitive.E{Key: "account_id", Value: int32(1)}}},
+				{Name: "limit_id", Keys: bson.D{primitive.E{Key: "limit", Value: int32(-1)}, primitive.E{Key: "_id", Value: int32(1)}}},
+				{Name: "products_1", Keys: bson.D{primitive.E{Key: "products", Value: int32(1)}}},
+			},
+			states: map[string]string{
+				"account_id_unique": INDEX_STATE_DRIFT,
+				"limit_id":          INDEX_STATE_DRIFT,
+				"products":          INDEX_STATE_MISSING,
+				"products_1":        INDEX_STATE_EXTRA,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := make(map[string]IndexSpec, len(tt.existing))
+			for _, spec := range tt.existing {
+				existing[spec.Name] = spec
+			}
+
+			statuses := compareIndexes(testIndexes, existing)
+			states := indexStates(statuses)
+			if len(states) != len(tt.states) {
+				t.Fatalf("statuses = %+v, want %v", statuses, tt.states)
+			}
+			for name, want := range tt.states {
+				if states[name] != want {
+					t.Errorf("%s = %s, want %s", name, states[name], want)
+				}
+			}
+
+			// declared indexes come first in declaration order
+			for i, spec := range testIndexes {
+				if statuses[i].Name != spec.Name {
+					t.Errorf("status %d = %s, want %s", i, statuses[i].Name, spec.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareIndexesDetail(t *testing.T) {
+	statuses := compareIndexes(testIndexes, map[string]IndexSpec{
+		"account_id_unique": {Name: "account_id_unique", Keys: bson.D{primitive.E{Key: "account_id", Value: int32(1)}}},
+		"limit_id":          {Name: "limit_id", Keys: bson.D{primitive.E{Key: "limit", Value: int32(-1)}, primitive.E{Key: "_id", Value: int32(1)}}},
+		"products_1":        {Name: "products_1", Keys: bson.D{primitive.E{Key: "products", Value: int32(1)}}},
+	})
+
+	want := []string{
+		"unique is false, expected true",
+		"keys are {limit: -1, _id: 1}, expected {limit: 1, _id: 1}",
+		`same keys are indexed as "products_1"`,
+	}
+	for i, detail := range want {
+		if statuses[i].Detail != detail {
+			t.Errorf("%s detail = %q, want %q", statuses[i].Name, statuses[i].Detail, detail)
+		}
+	}
+}
+
+func TestIndexManagerEnsure(t *testing.T) {
+	ctx := context.Background()
+	database := testDatabase(t)
+	manager := &indexManagerImpl{collection: database.Collection(ACCOUNTS_COLLECTION_NAME), specs: testIndexes, timeoutMs: testTimeoutMs}
+
+	// account_id_unique exist without its unique option
+	_, err := manager.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "account_id", Value: 1}},
+		Options: options.Index().SetName("account_id_unique"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := manager.Ensure(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"account_id_unique": INDEX_STATE_DRIFT,
+		"limit_id":          INDEX_STATE_CREATED,
+		"products":          INDEX_STATE_CREATED,
+	}
+	for name, state := range want {
+		if got := indexStates(statuses)[name]; got != state {
+			t.Errorf("first ensure %s = %s, want %s", name, got, state)
+		}
+	}
+
+	// created indexes are ok from then on, drift is left for an operator to fix
+	statuses, err = manager.Ensure(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want["limit_id"], want["products"] = INDEX_STATE_OK, INDEX_STATE_OK
+	for name, state := range want {
+		if got := indexStates(statuses)[name]; got != state {
+			t.Errorf("second ensure %s = %s, want %s", name, got, state)
+		}
+	}
+}
+
+func TestMemoryIndexManager(t *testing.T) {
+	statuses, err := NewMemoryIndexManager().Ensure(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range statuses {
+		if status.State != INDEX_STATE_OK {
+			t.Errorf("%s = %s, want ok", status.Name, status.State)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+)
+
+type memoryImpl struct {
+	mu      sync.RWMutex
+	records []memoryRecord
+	lastSeq uint64
+}
+
+// memoryRecord is a stored account, seq play the role of _id as unique insertion key
+type memoryRecord struct {
+	seq     uint64
+	account entity.Account
+}
+
+// sortedRecord is a record with its sort key values
+type sortedRecord struct {
+	memoryRecord
+	values []int64
+}
+
+// NewMemory create in-memory repository, accounts are kept in insertion order like a mongo collection natural order.
+// account_id is unique like the account_id_unique index, so later duplicates of seed accounts are skipped.
+func NewMemory(accounts ...entity.Account) Repository {
+	r := &memoryImpl{
+		records: make([]memoryRecord, 0, len(accounts)),
+	}
+
+	now := writeNow()
+	for _, a := range accounts {
+		_, _ = r.insert(a, now)
+	}
+
+	return r
+}
+
+// Create implements Repository.
+func (r *memoryImpl) Create(ctx context.Context, account entity.Account) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keep(ctx, account.AccountID)
+	return r.insert(account, writeNow())
+}
+
+// Delete implements Repository.
+func (r *memoryImpl) Delete(ctx context.Context, accountID int, version int64, deletedBy string) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.liveIndexOf(accountID)
+	if i < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	if !versionMatches(r.records[i].account, version) {
+		return entity.Account{}, ErrVersionMismatch
+	}
+
+	r.keep(ctx, accountID)
+	softDelete(&r.records[i].account, deletedBy, writeNow())
+
+	return copyAccount(r.records[i].account), nil
+}
+
+// Restore implements Repository.
+func (r *memoryImpl) Restore(ctx context.Context, accountID int, version int64) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.indexOf(accountID)
+	if i < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	account := &r.records[i].account
+	if account.DeletedAt == nil || !versionMatches(*account, version) {
+		return entity.Account{}, restoreFailure(*account, version)
+	}
+
+	r.keep(ctx, accountID)
+	account.DeletedAt = nil
+	account.DeletedBy = ""
+	stampAccount(account, writeNow())
+
+	return copyAccount(*account), nil
+}
+
+// PurgeOne implements Repository.
+func (r *memoryImpl) PurgeOne(ctx context.Context, deletedBefore time.Time) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	first := -1
+	for i, rec := range r.records {
+		deletedAt := rec.account.DeletedAt
+		if deletedAt == nil || !deletedAt.Before(deletedBefore) {
+			continue
+		}
+
+		if first < 0 || deletedAt.Before(*r.records[first].account.DeletedAt) {
+			first = i
+		}
+	}
+
+	if first < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	account := r.records[first].account
+	r.keep(ctx, account.AccountID)
+	r.records = append(r.records[:first], r.records[first+1:]...)
+
+	return copyAccount(account), nil
+}
+
+// GetByAccountID implements Repository.
+func (r *memoryImpl) GetByAccountID(ctx context.Context, accountID int, includeDeleted bool) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i := r.liveIndexOf(accountID)
+	if includeDeleted {
+		i = r.indexOf(accountID)
+	}
+
+	if i < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	return copyAccount(r.records[i].account), nil
+}
+
+// GetByAccountIDs implements Repository.
+func (r *memoryImpl) GetByAccountIDs(ctx context.Context, accountIDs []int) (map[int]entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	accounts := make(map[int]entity.Account, len(accountIDs))
+	for _, id := range accountIDs {
+		if i := r.indexOf(id); i >= 0 {
+			accounts[id] = copyAccount(r.records[i].account)
+		}
+	}
+
+	return accounts, nil
+}
+
+// List implements Repository.
+func (r *memoryImpl) List(ctx context.Context, query ListQuery) ([]entity.Account, int64, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, "", err
+	}
+
+	// same constraints as $limit and $skip stage
+	if query.Limit <= 0 {
+		return nil, 0, "", errLimitNotPositive
+	}
+
+	if query.Offset < 0 {
+		return nil, 0, "", errOffsetNegative
+	}
+
+	if err := validateSort(query.Sort); err != nil {
+		return nil, 0, "", err
+	}
+
+	sortFields := query.Sort
+
+	var after *listCursor
+	var afterSeq uint64
+	if query.Cursor != "" {
+		c, err := decodeCursor(query.Cursor, sortFields)
+		if err != nil {
+			return nil, 0, "", err
+		}
+
+		afterSeq, err = strconv.ParseUint(c.Tiebreak, 10, 64)
+		if err != nil {
+			return nil, 0, "", errCursorInvalid
+		}
+
+		after = &c
+		sortFields = c.Sort
+	}
+
+	if len(sortFields) == 0 {
+		sortFields = defaultSort
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// match stage, sort values are computed once per record
+	matched := make([]sortedRecord, 0, len(r.records))
+	for _, rec := range r.records {
+		if !query.Filter.match(rec.account) {
+			continue
+		}
+
+		matched = append(matched, sortedRecord{
+			memoryRecord: rec,
+			values:       sortValues(rec.account, sortFields),
+		})
+	}
+
+	totalCount := int64(len(matched))
+
+	// sort stage, seq is the tiebreaker so pages are stable
+	sort.SliceStable(matched, func(i, j int) bool {
+		return compareSortValues(matched[i].values, matched[i].seq, matched[j].values, matched[j].seq, sortFields) < 0
+	})
+
+	// pagination stage
+	var page []sortedRecord
+	if after != nil {
+		start := sort.Search(len(matched), func(i int) bool {
+			return compareSortValues(matched[i].values, matched[i].seq, after.Values, afterSeq, sortFields) > 0
+		})
+		page = matched[start:]
+	} else if query.Offset < len(matched) {
+		page = matched[query.Offset:]
+	}
+
+	hasNext := len(page) > query.Limit
+	if hasNext {
+		page = page[:query.Limit]
+	}
+
+	var accounts []entity.Account
+	for _, rec := range page {
+		accounts = append(accounts, copyAccount(rec.account))
+	}
+
+	var nextCursor string
+	if hasNext {
+		last := page[len(page)-1]
+		nextCursor = encodeCursor(last.account, sortFields, strconv.FormatUint(last.seq, 10))
+	}
+
+	return accounts, totalCount, nextCursor, nil
+}
+
+// Stream implements Repository.
+// Matching accounts are copied under the lock, fn is called after the lock is released.
+func (r *memoryImpl) Stream(ctx context.Context, filter AccountFilter, sortFields []SortField, fn func(entity.Account) error) error {
+	if err := validateSort(sortFields); err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	matched := make([]sortedRecord, 0, len(r.records))
+	for _, rec := range r.records {
+		if filter.match(rec.account) {
+			matched = append(matched, sortedRecord{
+				memoryRecord: memoryRecord{seq: rec.seq, account: copyAccount(rec.account)},
+				values:       sortValues(rec.account, sortFields),
+			})
+		}
+	}
+	r.mu.RUnlock()
+
+	if len(sortFields) > 0 {
+		sort.SliceStable(matched, func(i, j int) bool {
+			return compareSortValues(matched[i].values, matched[i].seq, matched[j].values, matched[j].seq, sortFields) < 0
+		})
+	}
+
+	for _, rec := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(rec.account); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Update implements Repository.
+func (r *memoryImpl) Update(ctx context.Context, account entity.Account) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.liveIndexOf(account.AccountID)
+	if i < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	stored := &r.records[i].account
+	if !versionMatches(*stored, account.Version) {
+		return entity.Account{}, ErrVersionMismatch
+	}
+
+	r.keep(ctx, account.AccountID)
+	stored.Limit = account.Limit
+	stored.Products = copyAccount(account).Products
+	stampAccount(stored, writeNow())
+
+	return copyAccount(*stored), nil
+}
+
+// Patch implements Repository.
+func (r *memoryImpl) Patch(ctx context.Context, accountID int, patch AccountPatch) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.liveIndexOf(accountID)
+	if i < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	account := copyAccount(r.records[i].account)
+	// the version or the index of a pulled product changed
+	if !patch.matches(account) {
+		return entity.Account{}, ErrVersionMismatch
+	}
+
+	if !patch.IsEmpty() {
+		patch.apply(&account)
+		stampAccount(&account, writeNow())
+		r.keep(ctx, accountID)
+		r.records[i].account = account
+	}
+
+	return copyAccount(account), nil
+}
+
+// AddProduct implements Repository.
+func (r *memoryImpl) AddProduct(ctx context.Context, accountID int, product string, version int64) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.liveIndexOf(accountID)
+	if i < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	account := &r.records[i].account
+	if !versionMatches(*account, version) {
+		return entity.Account{}, ErrVersionMismatch
+	}
+
+	if !containsProduct(account.Products, product) {
+		r.keep(ctx, accountID)
+		account.Products = append(account.Products, product)
+		stampAccount(account, writeNow())
+	}
+
+	return copyAccount(*account), nil
+}
+
+// RemoveProduct implements Repository.
+func (r *memoryImpl) RemoveProduct(ctx context.Context, accountID int, product string, version int64) (entity.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Account{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.liveIndexOf(accountID)
+	if i < 0 {
+		return entity.Account{}, errAccountNotFound
+	}
+
+	account := &r.records[i].account
+	if !versionMatches(*account, version) {
+		return entity.Account{}, ErrVersionMismatch
+	}
+
+	if !containsProduct(account.Products, product) {
+		return entity.Account{}, errProductNotHeld
+	}
+
+	r.keep(ctx, accountID)
+
+	// like $pull every occurrence is removed
+	kept := make([]string, 0, len(account.Products))
+	for _, p := range account.Products {
+		if p != product {
+			kept = append(kept, p)
+		}
+	}
+	account.Products = kept
+	stampAccount(account, writeNow())
+
+	return copyAccount(*account), nil
+}
+
+// CreateMany implements Repository.
+func (r *memoryImpl) CreateMany(ctx context.Context, accounts []entity.Account, ordered bool) ([]error, error) {
+	now := writeNow()
+	return r.applyMany(ctx, len(accounts), ordered, func(i int) error {
+		r.keep(ctx, accounts[i].AccountID)
+		_, err := r.insert(accounts[i], now)
+		return err
+	})
+}
+
+// UpdateMany implements Repository.
+func (r *memoryImpl) UpdateMany(ctx context.Context, accounts []entity.Account, ordered bool) ([]error, error) {
+	now := writeNow()
+	return r.applyMany(ctx, len(accounts), ordered, func(i int) error {
+		j := r.liveIndexOf(accounts[i].AccountID)
+		if j < 0 {
+			return errAccountNotFound
+		}
+
+		r.keep(ctx, accounts[i].AccountID)
+		stored := &r.records[j].account
+		stored.Limit = accounts[i].Limit
+		stored.Products = copyAccount(accounts[i]).Products
+		stampAccount(stored, now)
+		return nil
+	})
+}
+
+// DeleteMany implements Repository.
+func (r *memoryImpl) DeleteMany(ctx context.Context, accountIDs []int, ordered bool, deletedBy string) ([]error, error) {
+	deletedAt := writeNow()
+	return r.applyMany(ctx, len(accountIDs), ordered, func(i int) error {
+		j := r.liveIndexOf(accountIDs[i])
+		if j < 0 {
+			return errAccountNotFound
+		}
+
+		r.keep(ctx, accountIDs[i])
+		softDelete(&r.records[j].account, deletedBy, deletedAt)
+		return nil
+	})
+}
+
+// applyMany run op for n items under one lock, like a bulk write in one round trip
+func (r *memoryImpl) applyMany(ctx context.Context, n int, ordered bool, op func(i int) error) ([]error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]error, n)
+	for i := range results {
+		results[i] = op(i)
+		if results[i] != nil && ordered {
+			abortAfter(results, i)
+			break
+		}
+	}
+
+	return results, nil
+}
+
+// insert append account as a new record written at and return it, caller must hold the lock
+func (r *memoryImpl) insert(account entity.Account, at time.Time) (entity.Account, error) {
+	if i := r.indexOf(account.AccountID); i >= 0 {
+		if r.records[i].account.DeletedAt != nil {
+			return entity.Account{}, errAccountDeleted
+		}
+		return entity.Account{}, errAccountExists
+	}
+
+	account = newAccount(copyAccount(account), at)
+
+	r.lastSeq++
+	r.records = append(r.records, memoryRecord{
+		seq:     r.lastSeq,
+		account: account,
+	})
+
+	return copyAccount(account), nil
+}
+
+// keep register how to put back account accountID as stored now when the memory transaction of ctx fail, an account
+// not stored yet is removed. Caller must hold the lock.
+func (r *memoryImpl) keep(ctx context.Context, accountID int) {
+	if !undoable(ctx) {
+		return
+	}
+
+	var before *memoryRecord
+	if i := r.indexOf(accountID); i >= 0 {
+		rec := r.records[i]
+		rec.account = copyAccount(rec.account)
+		before = &rec
+	}
+
+	r.onRollback(ctx, accountID, before)
+}
+
+// onRollback register putting back before as the record of accountID when the memory transaction of ctx fail, the
+// record is removed when before is nil
+func (r *memoryImpl) onRollback(ctx context.Context, accountID int, before *memoryRecord) {
+	onRollback(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		i := r.indexOf(accountID)
+		switch {
+		case i >= 0 && before == nil:
+			r.records = append(r.records[:i], r.records[i+1:]...)
+		case i >= 0:
+			r.records[i] = *before
+		case before != nil:
+			// purged, put back at its place in insertion order
+			j := sort.Search(len(r.records), func(k int) bool {
+				return r.records[k].seq > before.seq
+			})
+			r.records = append(r.records, memoryRecord{})
+			copy(r.records[j+1:], r.records[j:])
+			r.records[j] = *before
+		}
+	})
+}
+
+// indexOf return position of the first account with given account id, caller must hold the lock
+func (r *memoryImpl) indexOf(accountID int) int {
+	for i, rec := range r.records {
+		if rec.account.AccountID == accountID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// liveIndexOf is indexOf for accounts that are not soft deleted, caller must hold the lock
+func (r *memoryImpl) liveIndexOf(accountID int) int {
+	i := r.indexOf(accountID)
+	if i < 0 || r.records[i].account.DeletedAt != nil {
+		return -1
+	}
+
+	return i
+}
+
+// softDelete is softDeleteUpdate for the in-memory repository
+func softDelete(account *entity.Account, deletedBy string, deletedAt time.Time) {
+	account.DeletedAt = &deletedAt
+	account.DeletedBy = deletedBy
+	stampAccount(account, deletedAt)
+}
+
+// compareSortValues compare two positions by sort key values then seq, in sort order
+func compareSortValues(a []int64, aSeq uint64, b []int64, bSeq uint64, fields []SortField) int {
+	for i, f := range fields {
+		switch {
+		case a[i] < b[i]:
+			return -f.Order
+		case a[i] > b[i]:
+			return f.Order
+		}
+	}
+
+	switch {
+	case aSeq < bSeq:
+		return -tiebreakOrder(fields)
+	case aSeq > bSeq:
+		return tiebreakOrder(fields)
+	}
+
+	return 0
+}
+
+func containsProduct(products []string, product string) bool {
+	for _, p := range products {
+		if p == product {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyAccount prevent callers from mutating stored products slice
+func copyAccount(account entity.Account) entity.Account {
+	if account.Products != nil {
+		products := make([]string, len(account.Products))
+		copy(products, account.Products)
+		account.Products = products
+	}
+
+	return account
+}
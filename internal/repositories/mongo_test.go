@@ -0,0 +1,17 @@
+package repositories
+
+import (
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/mongotest"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testTimeoutMs is the query timeout of repositories under test
+const testTimeoutMs = 5000
+
+// testDatabase return a database of its own for the test, see mongotest.Database
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	return mongotest.Database(t)
+}
@@ -0,0 +1,392 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	OUTBOX_COLLECTION_NAME          string = "account_outbox"
+	OUTBOX_LEASE_COLLECTION_NAME    string = "account_outbox_lease"
+	OUTBOX_SEQUENCE_COLLECTION_NAME string = "account_outbox_sequence"
+
+	// id of the single lease document, one relay publish at a time so events of an account stay in order
+	outboxLeaseID string = "relay"
+)
+
+// OutboxRepository keep account events until a relay publish them. Records of an account are read in the order of
+// their sequence, which is the order their changes were committed in.
+type OutboxRepository interface {
+	// Append store records and give each the next sequence of its account, they are part of the transaction of ctx if any
+	Append(ctx context.Context, records ...entity.OutboxRecord) error
+	// Pending return records neither published nor dead ordered by account then sequence, leaving out accounts of skip
+	Pending(ctx context.Context, limit int, skip []int) ([]entity.OutboxRecord, error)
+	// MarkPublished remove a published record, errOutboxLeaseLost when owner no longer hold the relay lease
+	MarkPublished(ctx context.Context, owner string, id primitive.ObjectID) error
+	// MarkFailed count a failed publish of a record, it stay pending unless dead is set.
+	// errOutboxLeaseLost is returned when owner no longer hold the relay lease.
+	MarkFailed(ctx context.Context, owner string, id primitive.ObjectID, reason string, dead bool) error
+	// Lease take or extend the relay lease for owner until ttl from now, false when another owner hold it
+	Lease(ctx context.Context, owner string, ttl time.Duration) (bool, error)
+}
+
+// outboxOrder is the read order of the outbox, _id order records appended before sequences were kept
+var outboxOrder = bson.D{{Key: "account_id", Value: 1}, {Key: "seq", Value: 1}, {Key: "_id", Value: 1}}
+
+type outboxLease struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type outboxSequence struct {
+	AccountID int   `bson:"_id"`
+	Seq       int64 `bson:"seq"`
+}
+
+type outboxImpl struct {
+	collection *mongo.Collection
+	leases     *mongo.Collection
+	sequences  *mongo.Collection
+	timeoutMs  int
+}
+
+func NewOutbox(database *mongo.Database, timeoutMs int) OutboxRepository {
+	return &outboxImpl{
+		collection: database.Collection(OUTBOX_COLLECTION_NAME),
+		leases:     database.Collection(OUTBOX_LEASE_COLLECTION_NAME),
+		sequences:  database.Collection(OUTBOX_SEQUENCE_COLLECTION_NAME),
+		timeoutMs:  timeoutMs,
+	}
+}
+
+// Append implements OutboxRepository.
+// The sequence document of an account is written by every change of the account, so within transactions sequences
+// follow the commit order: a transaction committing later conflict with the earlier one and retry after it.
+func (r *outboxImpl) Append(ctx context.Context, records ...entity.OutboxRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	counts := make(map[int]int64)
+	for _, record := range records {
+		counts[record.AccountID]++
+	}
+
+	// reserve the sequences of each account in one round trip, then hand them out in append order
+	next := make(map[int]int64, len(counts))
+	for accountID, count := range counts {
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		update := bson.M{"$inc": bson.M{"seq": count}}
+
+		var sequence outboxSequence
+		if err := r.sequences.FindOneAndUpdate(ctxTimeout, bson.M{"_id": accountID}, update, opts).Decode(&sequence); err != nil {
+			return mapError(err)
+		}
+		next[accountID] = sequence.Seq - count + 1
+	}
+
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		if record.ID.IsZero() {
+			record.ID = primitive.NewObjectID()
+		}
+		record.Seq = next[record.AccountID]
+		next[record.AccountID]++
+		docs[i] = record
+	}
+
+	_, err := r.collection.InsertMany(ctxTimeout, docs)
+
+	return mapError(err)
+}
+
+// Pending implements OutboxRepository.
+func (r *outboxImpl) Pending(ctx context.Context, limit int, skip []int) ([]entity.OutboxRecord, error) {
+	if limit <= 0 {
+		return nil, errLimitNotPositive
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := bson.M{"dead_at": nil}
+	if len(skip) > 0 {
+		filter["account_id"] = bson.M{"$nin": skip}
+	}
+
+	opts := options.Find().SetSort(outboxOrder).SetLimit(int64(limit))
+	cursor, err := r.collection.Find(ctxTimeout, filter, opts)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	records := []entity.OutboxRecord{}
+	if err := cursor.All(ctxTimeout, &records); err != nil {
+		return nil, mapError(err)
+	}
+
+	return records, nil
+}
+
+// MarkPublished implements OutboxRepository.
+func (r *outboxImpl) MarkPublished(ctx context.Context, owner string, id primitive.ObjectID) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	if err := r.holding(ctxTimeout, owner); err != nil {
+		return err
+	}
+
+	_, err := r.collection.DeleteOne(ctxTimeout, bson.M{"_id": id})
+
+	return mapError(err)
+}
+
+// MarkFailed implements OutboxRepository.
+func (r *outboxImpl) MarkFailed(ctx context.Context, owner string, id primitive.ObjectID, reason string, dead bool) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	if err := r.holding(ctxTimeout, owner); err != nil {
+		return err
+	}
+
+	set := bson.M{"last_error": reason}
+	if dead {
+		set["dead_at"] = time.Now().UTC()
+	}
+	update := bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": set,
+	}
+	_, err := r.collection.UpdateOne(ctxTimeout, bson.M{"_id": id}, update)
+
+	return mapError(err)
+}
+
+// holding check that owner still hold the lease, errOutboxLeaseLost otherwise
+func (r *outboxImpl) holding(ctx context.Context, owner string) error {
+	filter := bson.M{"_id": outboxLeaseID, "owner": owner, "expires_at": bson.M{"$gt": time.Now().UTC()}}
+
+	count, err := r.leases.CountDocuments(ctx, filter)
+	if err != nil {
+		return mapError(err)
+	}
+	if count == 0 {
+		return errOutboxLeaseLost
+	}
+
+	return nil
+}
+
+// Lease implements OutboxRepository.
+// Like the migration lock, the upsert match the lease when it is ours or expired, otherwise it try to insert a second
+// document with the same _id and fail with duplicate key.
+func (r *outboxImpl) Lease(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id": outboxLeaseID,
+		"$or": bson.A{
+			bson.M{"owner": owner},
+			bson.M{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": outboxLease{
+		ID:        outboxLeaseID,
+		Owner:     owner,
+		ExpiresAt: now.Add(ttl),
+	}}
+
+	_, err := r.leases.UpdateOne(ctxTimeout, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, mapError(err)
+	}
+
+	return true, nil
+}
+
+type memoryOutboxImpl struct {
+	mu      sync.Mutex
+	records []entity.OutboxRecord
+	// sequences hold the last sequence of every account, rolled back appends leave gaps like on mongo
+	sequences map[int]int64
+	lease     outboxLease
+}
+
+// NewMemoryOutbox create in-memory outbox repository, records are kept in append order
+func NewMemoryOutbox() OutboxRepository {
+	return &memoryOutboxImpl{
+		sequences: make(map[int]int64),
+	}
+}
+
+// Append implements OutboxRepository.
+func (r *memoryOutboxImpl) Append(ctx context.Context, records ...entity.OutboxRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	appended := make(map[primitive.ObjectID]bool, len(records))
+	for _, record := range records {
+		if record.ID.IsZero() {
+			record.ID = primitive.NewObjectID()
+		}
+		r.sequences[record.AccountID]++
+		record.Seq = r.sequences[record.AccountID]
+		r.records = append(r.records, record)
+		appended[record.ID] = true
+	}
+
+	onRollback(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		kept := r.records[:0]
+		for _, record := range r.records {
+			if !appended[record.ID] {
+				kept = append(kept, record)
+			}
+		}
+		r.records = kept
+	})
+
+	return nil
+}
+
+// Pending implements OutboxRepository.
+func (r *memoryOutboxImpl) Pending(ctx context.Context, limit int, skip []int) ([]entity.OutboxRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		return nil, errLimitNotPositive
+	}
+
+	skipped := make(map[int]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pending := []entity.OutboxRecord{}
+	for _, record := range r.records {
+		if record.DeadAt == nil && !skipped[record.AccountID] {
+			pending = append(pending, record)
+		}
+	}
+
+	// records are appended in sequence order, a stable sort by account keep it
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].AccountID < pending[j].AccountID
+	})
+
+	if limit > len(pending) {
+		limit = len(pending)
+	}
+
+	return pending[:limit], nil
+}
+
+// MarkPublished implements OutboxRepository.
+func (r *memoryOutboxImpl) MarkPublished(ctx context.Context, owner string, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.holding(owner) {
+		return errOutboxLeaseLost
+	}
+
+	for i := range r.records {
+		if r.records[i].ID == id {
+			r.records = append(r.records[:i], r.records[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// MarkFailed implements OutboxRepository.
+func (r *memoryOutboxImpl) MarkFailed(ctx context.Context, owner string, id primitive.ObjectID, reason string, dead bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.holding(owner) {
+		return errOutboxLeaseLost
+	}
+
+	for i := range r.records {
+		if r.records[i].ID == id {
+			r.records[i].Attempts++
+			r.records[i].LastError = reason
+			if dead {
+				deadAt := time.Now().UTC()
+				r.records[i].DeadAt = &deadAt
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// holding report whether owner still hold the lease, caller must hold the lock
+func (r *memoryOutboxImpl) holding(owner string) bool {
+	return r.lease.Owner == owner && r.lease.ExpiresAt.After(time.Now().UTC())
+}
+
+// Lease implements OutboxRepository.
+func (r *memoryOutboxImpl) Lease(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	if r.lease.Owner != owner && r.lease.ExpiresAt.After(now) {
+		return false, nil
+	}
+
+	r.lease = outboxLease{ID: outboxLeaseID, Owner: owner, ExpiresAt: now.Add(ttl)}
+
+	return true, nil
+}
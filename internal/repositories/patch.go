@@ -0,0 +1,137 @@
+package repositories
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AccountPatch is a targeted update applied atomically to one account, the fields it set must not be the ones it unset.
+// Products are either set, pushed or pulled, mongo refuse an update changing them more than one way.
+type AccountPatch struct {
+	// Set replace fields, limit take an int and products a []string
+	Set map[string]interface{}
+	// Unset remove fields
+	Unset []string
+	// Push append products
+	Push []string
+	// Pull remove products by index, the product must still be at its index for the patch to apply
+	Pull map[int]string
+	// Version the account must have, 0 for any
+	Version int64
+}
+
+// IsEmpty report whether patch change nothing, an empty patch only check the version and keep it
+func (p AccountPatch) IsEmpty() bool {
+	return len(p.Set) == 0 && len(p.Unset) == 0 && len(p.Push) == 0 && len(p.Pull) == 0
+}
+
+// filter is the account filter with the patch version and the index of every pulled product
+func (p AccountPatch) filter(accountID int) bson.D {
+	filter := versionFilter(accountID, p.Version)
+	for _, i := range p.pullIndexes() {
+		filter = append(filter, bson.E{Key: "products." + strconv.Itoa(i), Value: p.Pull[i]})
+	}
+
+	return filter
+}
+
+// update is the update document of the patch, stamped at
+func (p AccountPatch) update(at time.Time) bson.D {
+	update := bson.D{}
+	if len(p.Set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: p.Set})
+	}
+
+	if len(p.Unset) > 0 {
+		unset := bson.D{}
+		for _, path := range p.Unset {
+			unset = append(unset, bson.E{Key: path, Value: ""})
+		}
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+
+	if len(p.Push) > 0 {
+		update = append(update, bson.E{Key: "$push", Value: bson.M{"products": bson.M{"$each": p.Push}}})
+	}
+
+	if len(p.Pull) > 0 {
+		pulled := make([]string, 0, len(p.Pull))
+		for _, i := range p.pullIndexes() {
+			pulled = append(pulled, p.Pull[i])
+		}
+		update = append(update, bson.E{Key: "$pull", Value: bson.M{"products": bson.M{"$in": pulled}}})
+	}
+
+	return append(update, stampUpdate(at)...)
+}
+
+// pullIndexes return indexes of pulled products in order
+func (p AccountPatch) pullIndexes() []int {
+	indexes := make([]int, 0, len(p.Pull))
+	for i := range p.Pull {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+// matches report whether account has the patch version and hold the pulled products at their index, like filter does in mongo
+func (p AccountPatch) matches(account entity.Account) bool {
+	if !versionMatches(account, p.Version) {
+		return false
+	}
+
+	for i, product := range p.Pull {
+		if i >= len(account.Products) || account.Products[i] != product {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply change account the way update does in mongo, except for the stamp
+func (p AccountPatch) apply(account *entity.Account) {
+	for field, value := range p.Set {
+		switch field {
+		case "limit":
+			account.Limit = value.(int)
+		case "products":
+			account.Products = append([]string{}, value.([]string)...)
+		}
+	}
+
+	for _, field := range p.Unset {
+		switch field {
+		case "limit":
+			account.Limit = 0
+		case "products":
+			account.Products = nil
+		}
+	}
+
+	if len(p.Push) > 0 {
+		account.Products = append(append([]string{}, account.Products...), p.Push...)
+	}
+
+	// $pull remove every element equal to a pulled product
+	if len(p.Pull) > 0 {
+		pulled := make(map[string]bool, len(p.Pull))
+		for _, product := range p.Pull {
+			pulled[product] = true
+		}
+
+		var kept []string
+		for _, product := range account.Products {
+			if !pulled[product] {
+				kept = append(kept, product)
+			}
+		}
+		account.Products = append([]string{}, kept...)
+	}
+}
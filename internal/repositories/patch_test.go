@@ -0,0 +1,92 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPatchUpdate(t *testing.T) {
+	at := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	patch := AccountPatch{Push: []string{"d"}, Version: 3}
+	pull := AccountPatch{Pull: map[int]string{2: "c", 0: "a"}}
+
+	tests := []struct {
+		name string
+		got  bson.D
+		want bson.D
+	}{
+		{
+			name: "push filter",
+			got:  patch.filter(7),
+			want: versionFilter(7, 3),
+		},
+		{
+			name: "push update",
+			got:  patch.update(at),
+			want: append(bson.D{{Key: "$push", Value: bson.M{"products": bson.M{"$each": []string{"d"}}}}}, stampUpdate(at)...),
+		},
+		{
+			name: "pull filter check every index",
+			got:  pull.filter(7),
+			want: append(liveFilter(7), bson.E{Key: "products.0", Value: "a"}, bson.E{Key: "products.2", Value: "c"}),
+		},
+		{
+			name: "pull update",
+			got:  pull.update(at),
+			want: append(bson.D{{Key: "$pull", Value: bson.M{"products": bson.M{"$in": []string{"a", "c"}}}}}, stampUpdate(at)...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchPushAndPull(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ctx := context.Background()
+		seedAccounts(t, repo, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a", "b", "c"}})
+
+		account, err := repo.Patch(ctx, 1, AccountPatch{Push: []string{"d", "e"}, Version: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(account.Products, []string{"a", "b", "c", "d", "e"}) || account.Version != 2 {
+			t.Fatalf("after push = %+v, want d and e appended at version 2", account)
+		}
+
+		account, err = repo.Patch(ctx, 1, AccountPatch{Pull: map[int]string{1: "b", 3: "d"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(account.Products, []string{"a", "c", "e"}) || account.Version != 3 {
+			t.Fatalf("after pull = %+v, want b and d removed at version 3", account)
+		}
+
+		// the product is not at that index anymore, a concurrent write moved it
+		if _, err := repo.Patch(ctx, 1, AccountPatch{Pull: map[int]string{0: "c"}}); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("pull at a stale index err = %v, want %v", err, ErrVersionMismatch)
+		}
+		if _, err := repo.Patch(ctx, 1, AccountPatch{Pull: map[int]string{5: "e"}}); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("pull past the end err = %v, want %v", err, ErrVersionMismatch)
+		}
+
+		stored, err := repo.GetByAccountID(ctx, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stored.Products, []string{"a", "c", "e"}) || stored.Version != 3 {
+			t.Errorf("stored = %+v, want the refused pulls left out", stored)
+		}
+	})
+}
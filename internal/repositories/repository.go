@@ -2,20 +2,40 @@ package repositories
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/Armunz/learn-mongodb/internal/entity"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Repository interface {
-	Create(ctx context.Context, account entity.Account) error
-	List(ctx context.Context, product string, orderBy int, limit int, offset int) ([]entity.Account, int64, error)
-	GetByAccountID(ctx context.Context, accountID int) (entity.Account, error)
-	Update(ctx context.Context, account entity.Account) error
-	Delete(ctx context.Context, accountID int) error
+	Create(ctx context.Context, account entity.Account) (entity.Account, error)
+	List(ctx context.Context, query ListQuery) ([]entity.Account, int64, string, error)
+	Stream(ctx context.Context, filter AccountFilter, sort []SortField, fn func(entity.Account) error) error
+	// GetByAccountID find a live account, or a soft deleted one too when includeDeleted is set
+	GetByAccountID(ctx context.Context, accountID int, includeDeleted bool) (entity.Account, error)
+	// GetByAccountIDs find stored accounts by id, soft deleted ones included
+	GetByAccountIDs(ctx context.Context, accountIDs []int) (map[int]entity.Account, error)
+	Update(ctx context.Context, account entity.Account) (entity.Account, error)
+	Patch(ctx context.Context, accountID int, patch AccountPatch) (entity.Account, error)
+	AddProduct(ctx context.Context, accountID int, product string, version int64) (entity.Account, error)
+	RemoveProduct(ctx context.Context, accountID int, product string, version int64) (entity.Account, error)
+	// Delete soft delete an account, it is kept for Restore until purged
+	Delete(ctx context.Context, accountID int, version int64, deletedBy string) (entity.Account, error)
+	Restore(ctx context.Context, accountID int, version int64) (entity.Account, error)
+	// PurgeOne remove for good the account soft deleted first, if it was before deletedBefore, and return it.
+	// errAccountNotFound is returned when no account is left to purge.
+	PurgeOne(ctx context.Context, deletedBefore time.Time) (entity.Account, error)
+	// CreateMany, UpdateMany and DeleteMany return the error of every item in input order, nil when it succeeded.
+	// Ordered writes stop at the first failure and report the remaining items as aborted.
+	CreateMany(ctx context.Context, accounts []entity.Account, ordered bool) ([]error, error)
+	UpdateMany(ctx context.Context, accounts []entity.Account, ordered bool) ([]error, error)
+	DeleteMany(ctx context.Context, accountIDs []int, ordered bool, deletedBy string) ([]error, error)
 }
 
 type repoImpl struct {
@@ -31,132 +51,394 @@ func New(database *mongo.Database, timeoutMs int) Repository {
 }
 
 // Create implements Repository.
-func (r *repoImpl) Create(ctx context.Context, account entity.Account) error {
+func (r *repoImpl) Create(ctx context.Context, account entity.Account) (entity.Account, error) {
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
 	defer cancel()
 
+	account = newAccount(account, writeNow())
 	_, err := r.collection.InsertOne(ctxTimeout, account)
+	if mongo.IsDuplicateKeyError(err) {
+		return entity.Account{}, r.existsFailure(ctxTimeout, account.AccountID)
+	}
+	if err != nil {
+		return entity.Account{}, mapError(err)
+	}
+
+	return account, nil
+}
+
+// existsFailure tell why an account could not be inserted with an id already stored, a soft deleted account is not
+// visible to readers but still hold its id
+func (r *repoImpl) existsFailure(ctx context.Context, accountID int) error {
+	count, err := r.collection.CountDocuments(ctx, bson.D{{Key: "account_id", Value: accountID}, isDeleted})
+	if err != nil {
+		return mapError(err)
+	}
 
-	return err
+	if count > 0 {
+		return errAccountDeleted
+	}
+
+	return errAccountExists
 }
 
 // Delete implements Repository.
-func (r *repoImpl) Delete(ctx context.Context, accountID int) error {
+// A non zero version must be the stored one, otherwise ErrVersionMismatch is returned.
+func (r *repoImpl) Delete(ctx context.Context, accountID int, version int64, deletedBy string) (entity.Account, error) {
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
 	defer cancel()
 
-	filter := bson.M{"account_id": accountID}
-	_, err := r.collection.DeleteOne(ctxTimeout, filter)
+	filter := versionFilter(accountID, version)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var deleted entity.Account
+	err := r.collection.FindOneAndUpdate(ctxTimeout, filter, softDeleteUpdate(deletedBy, writeNow()), opts).Decode(&deleted)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Account{}, r.notMatched(ctxTimeout, accountID, version)
+	}
 
-	return err
+	return deleted, mapError(err)
 }
 
 // GetByAccountID implements Repository.
-func (r *repoImpl) GetByAccountID(ctx context.Context, accountID int) (entity.Account, error) {
+func (r *repoImpl) GetByAccountID(ctx context.Context, accountID int, includeDeleted bool) (entity.Account, error) {
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
 	defer cancel()
 
 	var account entity.Account
-	filter := bson.M{"account_id": accountID}
+	filter := liveFilter(accountID)
+	if includeDeleted {
+		filter = bson.D{{Key: "account_id", Value: accountID}}
+	}
 	err := r.collection.FindOne(ctxTimeout, filter).Decode(&account)
 
-	return account, err
+	return account, mapError(err)
+}
+
+// GetByAccountIDs implements Repository.
+func (r *repoImpl) GetByAccountIDs(ctx context.Context, accountIDs []int) (map[int]entity.Account, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	cursor, err := r.collection.Find(ctxTimeout, bson.M{"account_id": bson.M{"$in": accountIDs}})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	accounts := make(map[int]entity.Account, len(accountIDs))
+	for cursor.Next(ctxTimeout) {
+		var account entity.Account
+		if err := cursor.Decode(&account); err != nil {
+			return nil, err
+		}
+
+		accounts[account.AccountID] = account
+	}
+
+	return accounts, mapError(cursor.Err())
 }
 
 // List implements Repository.
-func (r *repoImpl) List(ctx context.Context, product string, orderBy int, limit int, offset int) ([]entity.Account, int64, error) {
+// It returns the page, total matched accounts and the cursor of the next page (empty on last page).
+// The filter and keyset run as the leading $match so they can use indexes, the total is counted separately.
+func (r *repoImpl) List(ctx context.Context, query ListQuery) ([]entity.Account, int64, string, error) {
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
 	defer cancel()
 
-	// build pipeline
-	var metadataStage bson.A
-	var dataStage bson.A
+	// checked before the server does, so both repositories refuse them the same way
+	if query.Limit <= 0 {
+		return nil, 0, "", errLimitNotPositive
+	}
+
+	if query.Offset < 0 {
+		return nil, 0, "", errOffsetNegative
+	}
+
+	if err := validateSort(query.Sort); err != nil {
+		return nil, 0, "", err
+	}
+
+	sortFields := query.Sort
+
+	var after *listCursor
+	if query.Cursor != "" {
+		c, err := decodeCursor(query.Cursor, sortFields)
+		if err != nil {
+			return nil, 0, "", err
+		}
+
+		after = &c
+		sortFields = c.Sort
+	}
+
+	if len(sortFields) == 0 {
+		sortFields = defaultSort
+	}
 
-	// match stage
-	if product != "" {
-		dataStage = append(dataStage, bson.D{primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "products", Value: product}}}})
-		metadataStage = append(metadataStage, bson.D{primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "products", Value: product}}}})
+	// build pipeline
+	filter := query.Filter.bsonFilter()
+	pipeline := mongo.Pipeline{}
+
+	// keyset stage, merged into the match when it only compare stored fields
+	var keyset bson.D
+	if after != nil {
+		var err error
+		if keyset, err = keysetMatch(sortFields, *after); err != nil {
+			return nil, 0, "", err
+		}
 	}
 
-	// sort stage
-	if orderBy != 0 {
-		dataStage = append(dataStage, bson.D{primitive.E{Key: "$sort", Value: bson.D{primitive.E{Key: "account_id", Value: orderBy}}}})
+	computed := hasSortKey(sortFields, SORT_PRODUCT_COUNT)
+	match := filter
+	if keyset != nil && !computed {
+		match = append(append(bson.D{}, filter...), keyset...)
+	}
+	if len(match) > 0 {
+		pipeline = append(pipeline, bson.D{primitive.E{Key: "$match", Value: match}})
 	}
 
-	// pagination stage
-	dataStage = append(dataStage, bson.D{primitive.E{Key: "$skip", Value: offset}})
-	dataStage = append(dataStage, bson.D{primitive.E{Key: "$limit", Value: limit}})
+	// computed sort key, the keyset on it can only be matched after it is added
+	if computed {
+		pipeline = append(pipeline, productCountStage())
+		if keyset != nil {
+			pipeline = append(pipeline, bson.D{primitive.E{Key: "$match", Value: keyset}})
+		}
+	}
 
-	// count stage
-	metadataStage = append(metadataStage, bson.D{primitive.E{Key: "$count", Value: "total_count"}})
+	// sort stage, _id is the tiebreaker so pages are stable
+	pipeline = append(pipeline, sortStage(sortFields))
 
-	// facet stage
-	facet := bson.M{
-		"metadata": metadataStage,
-		"data":     dataStage,
+	// pagination stage, fetch one extra document to know whether there is a next page
+	if after == nil {
+		pipeline = append(pipeline, bson.D{primitive.E{Key: "$skip", Value: query.Offset}})
 	}
+	pipeline = append(pipeline, bson.D{primitive.E{Key: "$limit", Value: query.Limit + 1}})
 
-	pipeline := mongo.Pipeline{
-		{primitive.E{Key: "$facet", Value: facet}},
+	// count stage, the keyset is left out so total count still cover the whole listing
+	if filter == nil {
+		filter = bson.D{}
+	}
+	totalCount, err := r.collection.CountDocuments(ctxTimeout, filter)
+	if err != nil {
+		return nil, 0, "", mapError(err)
 	}
 
-	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	cursor, err := r.collection.Aggregate(ctxTimeout, pipeline)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, "", mapError(err)
 	}
 	defer cursor.Close(context.Background())
 
-	var results []bson.M
-	if err := cursor.All(ctxTimeout, &results); err != nil {
-		return nil, 0, err
+	var data []bson.Raw
+	for cursor.Next(ctxTimeout) {
+		data = append(data, append(bson.Raw{}, cursor.Current...))
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, 0, "", mapError(err)
+	}
+
+	hasNext := len(data) > query.Limit
+	if hasNext {
+		data = data[:query.Limit]
+	}
+
+	// index of the first document in the listing, a cursor page position is not known so its index is within the page
+	first := query.Offset
+	if after != nil {
+		first = 0
 	}
 
-	var totalCount int64
 	var accounts []entity.Account
-	if len(results) > 0 {
-		metadata, ok := results[0]["metadata"].(bson.A)[0].(bson.M)
-		if !ok {
-			return nil, 0, errMetaDataTypeAssertion
+	var last entity.Account
+	for i, raw := range data {
+		account, err := decodeAccount(raw)
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("%w at index %d (_id: %s): %w", errDocumentDecode, first+i, rawID(raw), err)
 		}
 
-		data, ok := results[0]["data"].(bson.A)
-		if !ok {
-			return nil, 0, errDataTypeAssertion
+		accounts = append(accounts, account)
+		last = account
+	}
+
+	var nextCursor string
+	if hasNext && len(data) > 0 {
+		nextCursor = encodeCursor(last, sortFields, last.ID.Hex())
+	}
+
+	return accounts, totalCount, nextCursor, nil
+}
+
+// Stream implements Repository.
+// It iterate a cursor without query timeout so exports of the whole collection can finish, cancel ctx to stop.
+func (r *repoImpl) Stream(ctx context.Context, filter AccountFilter, sort []SortField, fn func(entity.Account) error) error {
+	if err := validateSort(sort); err != nil {
+		return err
+	}
+
+	pipeline := mongo.Pipeline{}
+	if match := filter.matchStage(); match != nil {
+		pipeline = append(pipeline, match)
+	}
+
+	if hasSortKey(sort, SORT_PRODUCT_COUNT) {
+		pipeline = append(pipeline, productCountStage())
+	}
+
+	if len(sort) > 0 {
+		pipeline = append(pipeline, sortStage(sort))
+	}
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true).SetBatchSize(streamBatchSize))
+	if err != nil {
+		return mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	for i := 0; cursor.Next(ctx); i++ {
+		account, err := decodeAccount(cursor.Current)
+		if err != nil {
+			return fmt.Errorf("%w at index %d (_id: %s): %w", errDocumentDecode, i, rawID(cursor.Current), err)
 		}
 
-		totalCount = int64(metadata["total_count"].(int32))
-		for _, d := range data {
-			ac, ok := d.(bson.M)
-			if !ok {
-				return nil, 0, errAccountsTypeAssertion
-			}
-
-			acProducts := ac["products"].(bson.A)
-			products := make([]string, 0, len(acProducts))
-			for _, p := range acProducts {
-				products = append(products, p.(string))
-			}
-
-			account := entity.Account{
-				AccountID: int(ac["account_id"].(int32)),
-				Limit:     int(ac["limit"].(int32)),
-				Products:  products,
-			}
-
-			accounts = append(accounts, account)
+		if err := fn(account); err != nil {
+			return err
 		}
 	}
 
-	return accounts, totalCount, nil
+	return mapError(cursor.Err())
+}
+
+// Patch implements Repository.
+// The patch is applied by a single update and the updated account is returned. When the account exists but
+// does not have the patch version, ErrVersionMismatch is returned.
+func (r *repoImpl) Patch(ctx context.Context, accountID int, patch AccountPatch) (entity.Account, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	var result *mongo.SingleResult
+	if patch.IsEmpty() {
+		result = r.collection.FindOne(ctxTimeout, patch.filter(accountID))
+	} else {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		result = r.collection.FindOneAndUpdate(ctxTimeout, patch.filter(accountID), patch.update(writeNow()), opts)
+	}
+
+	var account entity.Account
+	err := result.Decode(&account)
+	if err == nil {
+		return account, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Account{}, mapError(err)
+	}
+
+	// nothing matched, tell a missing account from a changed version or index of a pulled product
+	if err := r.collection.FindOne(ctxTimeout, liveFilter(accountID)).Decode(&account); err != nil {
+		return entity.Account{}, mapError(err)
+	}
+
+	return entity.Account{}, ErrVersionMismatch
+}
+
+// AddProduct implements Repository.
+// Adding a product the account already hold change nothing, not even the version. The resulting account is returned either way.
+// A non zero version must be the stored one, even when nothing change.
+func (r *repoImpl) AddProduct(ctx context.Context, accountID int, product string, version int64) (entity.Account, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := append(versionFilter(accountID, version), bson.E{Key: "products", Value: bson.M{"$ne": product}})
+	update := append(bson.D{{Key: "$push", Value: bson.M{"products": product}}}, stampUpdate(writeNow())...)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var account entity.Account
+	err := r.collection.FindOneAndUpdate(ctxTimeout, filter, update, opts).Decode(&account)
+	if err == nil {
+		return account, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Account{}, mapError(err)
+	}
+
+	// either missing, at another version or already holding the product
+	if err := r.collection.FindOne(ctxTimeout, liveFilter(accountID)).Decode(&account); err != nil {
+		return entity.Account{}, mapError(err)
+	}
+
+	if !versionMatches(account, version) {
+		return entity.Account{}, ErrVersionMismatch
+	}
+
+	return account, nil
+}
+
+// RemoveProduct implements Repository.
+// errProductNotHeld is returned when the account exists without the product, a non zero version must be the stored one.
+func (r *repoImpl) RemoveProduct(ctx context.Context, accountID int, product string, version int64) (entity.Account, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := append(versionFilter(accountID, version), bson.E{Key: "products", Value: product})
+	update := append(bson.D{{Key: "$pull", Value: bson.M{"products": product}}}, stampUpdate(writeNow())...)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var account entity.Account
+	err := r.collection.FindOneAndUpdate(ctxTimeout, filter, update, opts).Decode(&account)
+	if err == nil {
+		return account, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Account{}, mapError(err)
+	}
+
+	// either missing, at another version or not holding the product
+	if err := r.collection.FindOne(ctxTimeout, liveFilter(accountID)).Decode(&account); err != nil {
+		return entity.Account{}, mapError(err)
+	}
+
+	if !versionMatches(account, version) {
+		return entity.Account{}, ErrVersionMismatch
+	}
+
+	return entity.Account{}, errProductNotHeld
 }
 
 // Update implements Repository.
-func (r *repoImpl) Update(ctx context.Context, account entity.Account) error {
+// limit and products are replaced and the updated account is returned, a non zero account version must be the stored one.
+func (r *repoImpl) Update(ctx context.Context, account entity.Account) (entity.Account, error) {
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
 	defer cancel()
 
-	filter := bson.M{"account_id": account.AccountID}
-	_, err := r.collection.UpdateOne(ctxTimeout, filter, bson.M{"$set": account})
+	filter := versionFilter(account.AccountID, account.Version)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated entity.Account
+	err := r.collection.FindOneAndUpdate(ctxTimeout, filter, replaceUpdate(account, writeNow()), opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Account{}, r.notMatched(ctxTimeout, account.AccountID, account.Version)
+	}
+
+	return updated, mapError(err)
+}
+
+// notMatched tell why a write filtered by versionFilter matched nothing
+func (r *repoImpl) notMatched(ctx context.Context, accountID int, version int64) error {
+	if version == 0 {
+		return errAccountNotFound
+	}
+
+	count, err := r.collection.CountDocuments(ctx, liveFilter(accountID))
+	if err != nil {
+		return mapError(err)
+	}
+
+	if count == 0 {
+		return errAccountNotFound
+	}
 
-	return err
+	return ErrVersionMismatch
 }
@@ -0,0 +1,170 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+)
+
+// forEachRepository run fn against the memory repository and, when TEST_MONGO_URI is set, the mongo one
+func forEachRepository(t *testing.T, fn func(t *testing.T, repo Repository)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemory())
+	})
+
+	t.Run("mongo", func(t *testing.T) {
+		fn(t, New(testDatabase(t), testTimeoutMs))
+	})
+}
+
+// seedAccounts create accounts in order, ids are given out of order so insertion order is not the account_id one
+func seedAccounts(t *testing.T, repo Repository, accounts ...entity.Account) {
+	t.Helper()
+
+	for _, account := range accounts {
+		if _, err := repo.Create(context.Background(), account); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// accountIDs of accounts in order
+func accountIDs(accounts []entity.Account) []int {
+	ids := make([]int, 0, len(accounts))
+	for _, account := range accounts {
+		ids = append(ids, account.AccountID)
+	}
+
+	return ids
+}
+
+func sameIDs(got, want []int) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestRepositoryCreateAndGet(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ctx := context.Background()
+		seedAccounts(t, repo, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a", "b"}})
+
+		account, err := repo.GetByAccountID(ctx, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Limit != 10 || len(account.Products) != 2 || account.Version != firstVersion {
+			t.Errorf("account = %+v, want the created one at the first version", account)
+		}
+
+		if _, err := repo.Create(ctx, entity.Account{AccountID: 1, Limit: 20}); !errs.Is(err, errs.Conflict) {
+			t.Errorf("duplicate create err = %v, want conflict", err)
+		}
+
+		if _, err := repo.GetByAccountID(ctx, 2, false); !errs.Is(err, errs.NotFound) {
+			t.Errorf("get missing err = %v, want not found", err)
+		}
+
+		found, err := repo.GetByAccountIDs(ctx, []int{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[1].Limit != 10 {
+			t.Errorf("get by ids = %+v, want account 1 only", found)
+		}
+	})
+}
+
+func TestRepositoryList(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		seedAccounts(t, repo,
+			entity.Account{AccountID: 3, Limit: 30, Products: []string{"a"}},
+			entity.Account{AccountID: 1, Limit: 10, Products: []string{"a", "b"}},
+			entity.Account{AccountID: 4, Limit: 40, Products: []string{"b"}},
+			entity.Account{AccountID: 2, Limit: 20, Products: []string{"a"}},
+			entity.Account{AccountID: 5, Limit: 50},
+		)
+
+		tests := []struct {
+			name  string
+			query ListQuery
+			ids   []int
+			total int64
+		}{
+			{
+				name:  "account_id order",
+				query: ListQuery{Limit: 10},
+				ids:   []int{1, 2, 3, 4, 5},
+				total: 5,
+			},
+			{
+				name:  "descending",
+				query: ListQuery{Limit: 10, Sort: []SortField{{Key: SORT_ACCOUNT_ID, Order: -1}}},
+				ids:   []int{5, 4, 3, 2, 1},
+				total: 5,
+			},
+			{
+				name:  "skip and limit",
+				query: ListQuery{Limit: 2, Offset: 1},
+				ids:   []int{2, 3},
+				total: 5,
+			},
+			{
+				name:  "offset past the end",
+				query: ListQuery{Limit: 2, Offset: 10},
+				total: 5,
+			},
+			{
+				name:  "product",
+				query: ListQuery{Limit: 2, Filter: AccountFilter{Product: "a"}},
+				ids:   []int{1, 2},
+				total: 3,
+			},
+			{
+				name:  "unknown product",
+				query: ListQuery{Limit: 2, Filter: AccountFilter{Product: "z"}},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				accounts, total, _, err := repo.List(context.Background(), tt.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if ids := accountIDs(accounts); !sameIDs(ids, tt.ids) || total != tt.total {
+					t.Errorf("list = %v of %d, want %v of %d", ids, total, tt.ids, tt.total)
+				}
+			})
+		}
+	})
+}
+
+func TestRepositoryListRefuseInvalidPage(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		seedAccounts(t, repo, entity.Account{AccountID: 1, Limit: 10})
+
+		for name, query := range map[string]ListQuery{
+			"zero limit":      {Limit: 0},
+			"negative limit":  {Limit: -1},
+			"negative offset": {Limit: 10, Offset: -1},
+			"unknown sort":    {Limit: 10, Sort: []SortField{{Key: "name", Order: 1}}},
+			"sort order":      {Limit: 10, Sort: []SortField{{Key: SORT_LIMIT, Order: 2}}},
+		} {
+			if _, _, _, err := repo.List(context.Background(), query); !errs.Is(err, errs.InvalidArgument) {
+				t.Errorf("%s: err = %v, want invalid argument", name, err)
+			}
+		}
+	})
+}
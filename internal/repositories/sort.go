@@ -0,0 +1,150 @@
+package repositories
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sortable keys of account listing
+const (
+	SORT_ACCOUNT_ID    string = "account_id"
+	SORT_LIMIT         string = "limit"
+	SORT_PRODUCT_COUNT string = "product_count"
+	SORT_UPDATED_AT    string = "updated_at"
+)
+
+// defaultSort order listings without a sort so they can be paged with a cursor, _id still break ties
+var defaultSort = []SortField{{Key: SORT_ACCOUNT_ID, Order: 1}}
+
+// SortField is one key of the listing sort, Order is 1 for ascending and -1 for descending
+type SortField struct {
+	Key   string `json:"k"`
+	Order int    `json:"o"`
+}
+
+// validateSort check sort keys and orders, unknown keys would make mongo sort on missing fields silently
+func validateSort(fields []SortField) error {
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		switch f.Key {
+		case SORT_ACCOUNT_ID, SORT_LIMIT, SORT_PRODUCT_COUNT, SORT_UPDATED_AT:
+		default:
+			return errSortKeyInvalid
+		}
+
+		if f.Order != 1 && f.Order != -1 || seen[f.Key] {
+			return errSortKeyInvalid
+		}
+		seen[f.Key] = true
+	}
+
+	return nil
+}
+
+// sortSpec is the canonical text form of a sort, used to bind a cursor to its sort
+func sortSpec(fields []SortField) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = fmt.Sprintf("%s:%d", f.Key, f.Order)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// sortValues return values of sort keys of an account, times are unix milliseconds which is the precision mongo keep
+func sortValues(account entity.Account, fields []SortField) []int64 {
+	values := make([]int64, len(fields))
+	for i, f := range fields {
+		switch f.Key {
+		case SORT_ACCOUNT_ID:
+			values[i] = int64(account.AccountID)
+		case SORT_LIMIT:
+			values[i] = int64(account.Limit)
+		case SORT_PRODUCT_COUNT:
+			values[i] = int64(len(account.Products))
+		case SORT_UPDATED_AT:
+			values[i] = account.UpdatedAt.UnixMilli()
+		}
+	}
+
+	return values
+}
+
+// sortValue is the stored form of a sort key value, to be compared by mongo
+func sortValue(key string, value int64) interface{} {
+	if key == SORT_UPDATED_AT {
+		return time.UnixMilli(value).UTC()
+	}
+
+	return value
+}
+
+// hasSortKey report whether sort use given key
+func hasSortKey(fields []SortField, key string) bool {
+	for _, f := range fields {
+		if f.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tiebreakOrder is the order of the unique key appended to every sort so pages are stable
+func tiebreakOrder(fields []SortField) int {
+	return fields[0].Order
+}
+
+// productCountStage compute product_count field so it can be sorted and compared
+func productCountStage() bson.D {
+	size := bson.D{primitive.E{Key: "$size", Value: bson.D{primitive.E{Key: "$ifNull", Value: bson.A{"$products", bson.A{}}}}}}
+	return bson.D{primitive.E{Key: "$addFields", Value: bson.D{primitive.E{Key: SORT_PRODUCT_COUNT, Value: size}}}}
+}
+
+// sortStage build $sort stage with _id as the last key, unless account_id already make the order unique so the sort
+// keeps the shape of the declared indexes
+func sortStage(fields []SortField) bson.D {
+	var keys bson.D
+	for _, f := range fields {
+		keys = append(keys, primitive.E{Key: f.Key, Value: f.Order})
+	}
+	if !hasSortKey(fields, SORT_ACCOUNT_ID) {
+		keys = append(keys, primitive.E{Key: "_id", Value: tiebreakOrder(fields)})
+	}
+
+	return bson.D{primitive.E{Key: "$sort", Value: keys}}
+}
+
+// keysetMatch build filter of accounts positioned after the cursor in sort order.
+// For sort (a, b, _id) it is: a after v0 OR (a = v0 AND b after v1) OR (a = v0 AND b = v1 AND _id after t).
+func keysetMatch(fields []SortField, c listCursor) (bson.D, error) {
+	id, err := primitive.ObjectIDFromHex(c.Tiebreak)
+	if err != nil {
+		return nil, errCursorInvalid
+	}
+
+	var or bson.A
+	var equal bson.D
+	for i, f := range fields {
+		value := sortValue(f.Key, c.Values[i])
+		cond := append(append(bson.D{}, equal...), primitive.E{Key: f.Key, Value: bson.D{primitive.E{Key: afterOperator(f.Order), Value: value}}})
+		or = append(or, cond)
+		equal = append(equal, primitive.E{Key: f.Key, Value: value})
+	}
+	or = append(or, append(equal, primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: afterOperator(tiebreakOrder(fields)), Value: id}}}))
+
+	return bson.D{primitive.E{Key: "$or", Value: or}}, nil
+}
+
+func afterOperator(order int) string {
+	if order < 0 {
+		return "$lt"
+	}
+
+	return "$gt"
+}
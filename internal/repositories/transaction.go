@@ -0,0 +1,163 @@
+package repositories
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Transactor is the unit of work of the repositories: fn run as one transaction, repository calls belong to it when
+// they are given the ctx passed to fn, and their writes are kept only when fn return nil. fn may be run more than once
+// so it must not keep state from a previous run. Calling WithTransaction with a ctx already in a transaction join it.
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// transactionKey mark the ctx given to fn, its value is the undo log of memory transactions
+type transactionKey struct{}
+
+// inTransaction report whether ctx belong to a running transaction
+func inTransaction(ctx context.Context) bool {
+	return ctx.Value(transactionKey{}) != nil
+}
+
+type mongoTransactor struct {
+	client *mongo.Client
+}
+
+// NewTransactor create transactor on the client of database. Transactions need a replica set or a sharded cluster,
+// check the server with SupportTransactions first: on a standalone server every transaction fail.
+func NewTransactor(database *mongo.Database) Transactor {
+	return &mongoTransactor{
+		client: database.Client(),
+	}
+}
+
+// SupportTransactions report whether the server of database can run transactions, that is a replica set member or
+// a mongos
+func SupportTransactions(ctx context.Context, database *mongo.Database) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+
+	err := database.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, mapError(err)
+	}
+
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
+// WithTransaction implements Transactor.
+// The driver retry the whole transaction on transient errors and the commit on unknown commit results, errors returned
+// by repositories keep the labels telling them apart.
+func (t *mongoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if inTransaction(ctx) {
+		return fn(ctx)
+	}
+
+	session, err := t.client.StartSession()
+	if err != nil {
+		return mapError(err)
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(context.WithValue(sc, transactionKey{}, true))
+	})
+
+	return err
+}
+
+type standaloneTransactor struct{}
+
+// NewStandaloneTransactor create transactor running fn without a transaction, for standalone development servers
+// only: a failed fn keep the writes it made before failing.
+func NewStandaloneTransactor() Transactor {
+	return standaloneTransactor{}
+}
+
+// WithTransaction implements Transactor.
+func (standaloneTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// memoryWrites serialize memory transactions with the memory writes made outside of them, so a rollback never
+// overwrite a write made while the transaction ran. It is shared by the memory repositories of the process.
+var memoryWrites sync.Mutex
+
+// memoryWrite take memoryWrites for a memory write made with ctx and return its release, a write of a memory
+// transaction already run under it. Memory repositories call it before taking their own lock.
+func memoryWrite(ctx context.Context) func() {
+	if undoable(ctx) {
+		return func() {}
+	}
+
+	memoryWrites.Lock()
+	return memoryWrites.Unlock
+}
+
+type memoryTransactor struct{}
+
+// memoryTransaction is the undo log of a memory transaction
+type memoryTransaction struct {
+	mu   sync.Mutex
+	undo []func()
+}
+
+// NewMemoryTransactor create transactor of the in-memory repositories. Transactions are run one at a time, writes made
+// outside of them wait for the running one, and the writes of a failed one are undone. Reads are not isolated.
+func NewMemoryTransactor() Transactor {
+	return &memoryTransactor{}
+}
+
+// WithTransaction implements Transactor.
+func (t *memoryTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if inTransaction(ctx) {
+		return fn(ctx)
+	}
+
+	memoryWrites.Lock()
+	defer memoryWrites.Unlock()
+
+	tx := &memoryTransaction{}
+	err := fn(context.WithValue(ctx, transactionKey{}, tx))
+	if err != nil {
+		tx.rollback()
+	}
+
+	return err
+}
+
+// rollback undo the writes of the transaction, latest first
+func (t *memoryTransaction) rollback() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+// onRollback register undo to be run when the memory transaction of ctx fail, a write made without a transaction is
+// final and nothing is registered. undo is run without the lock of the repository held.
+func onRollback(ctx context.Context, undo func()) {
+	tx, ok := ctx.Value(transactionKey{}).(*memoryTransaction)
+	if !ok {
+		return
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.undo = append(tx.undo, undo)
+}
+
+// undoable report whether writes made with ctx are undone when its memory transaction fail
+func undoable(ctx context.Context) bool {
+	_, ok := ctx.Value(transactionKey{}).(*memoryTransaction)
+	return ok
+}
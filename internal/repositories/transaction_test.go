@@ -0,0 +1,176 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/mongotest"
+)
+
+var errTestAbort = errors.New("abort")
+
+// forEachTransactor run fn against the memory repositories and, when TEST_MONGO_URI is a replica set, the mongo ones
+func forEachTransactor(t *testing.T, fn func(t *testing.T, repo Repository, outbox OutboxRepository, tx Transactor)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemory(), NewMemoryOutbox(), NewMemoryTransactor())
+	})
+
+	t.Run("mongo", func(t *testing.T) {
+		database := testDatabase(t)
+		mongotest.RequireReplicaSet(t, database)
+
+		// collections can not be created inside a transaction before 4.4
+		for _, name := range []string{ACCOUNTS_COLLECTION_NAME, OUTBOX_COLLECTION_NAME, OUTBOX_SEQUENCE_COLLECTION_NAME} {
+			if err := database.CreateCollection(context.Background(), name); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		fn(t, New(database, testTimeoutMs), NewOutbox(database, testTimeoutMs), NewTransactor(database))
+	})
+}
+
+func TestTransactionRollback(t *testing.T) {
+	forEachTransactor(t, func(t *testing.T, repo Repository, outbox OutboxRepository, tx Transactor) {
+		ctx := context.Background()
+		if _, err := repo.Create(ctx, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := tx.WithTransaction(ctx, func(ctx context.Context) error {
+			if _, err := repo.Create(ctx, entity.Account{AccountID: 2, Limit: 10}); err != nil {
+				return err
+			}
+			if _, err := repo.AddProduct(ctx, 1, "b", 1); err != nil {
+				return err
+			}
+			if _, err := repo.Delete(ctx, 1, 2, "test"); err != nil {
+				return err
+			}
+			if err := outbox.Append(ctx, entity.OutboxRecord{Type: EVENT_CREATED, AccountID: 2, Version: 1}); err != nil {
+				return err
+			}
+
+			return errTestAbort
+		})
+		if !errors.Is(err, errTestAbort) {
+			t.Fatalf("transaction err = %v, want %v", err, errTestAbort)
+		}
+
+		if _, err := repo.GetByAccountID(ctx, 2, true); err == nil {
+			t.Error("account created in the rolled back transaction is stored")
+		}
+
+		stored, err := repo.GetByAccountID(ctx, 1, false)
+		if err != nil {
+			t.Fatalf("account deleted in the rolled back transaction: %v", err)
+		}
+		if stored.Version != 1 || len(stored.Products) != 1 {
+			t.Errorf("account = %+v, want version 1 with its product only", stored)
+		}
+
+		pending, err := outbox.Pending(ctx, 10, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("outbox = %+v, want empty", pending)
+		}
+	})
+}
+
+func TestTransactionNested(t *testing.T) {
+	forEachTransactor(t, func(t *testing.T, repo Repository, outbox OutboxRepository, tx Transactor) {
+		ctx := context.Background()
+
+		// a nested transaction join the outer one, its writes go with the outcome of the outer transaction
+		err := tx.WithTransaction(ctx, func(ctx context.Context) error {
+			if _, err := repo.Create(ctx, entity.Account{AccountID: 1, Limit: 10}); err != nil {
+				return err
+			}
+
+			inner := tx.WithTransaction(ctx, func(ctx context.Context) error {
+				if _, err := repo.Create(ctx, entity.Account{AccountID: 2, Limit: 10}); err != nil {
+					return err
+				}
+				return errTestAbort
+			})
+			if !errors.Is(inner, errTestAbort) {
+				t.Errorf("inner err = %v, want %v", inner, errTestAbort)
+			}
+
+			// the outer transaction go on and commit
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, id := range []int{1, 2} {
+			if _, err := repo.GetByAccountID(ctx, id, false); err != nil {
+				t.Errorf("account %d of the committed transaction: %v", id, err)
+			}
+		}
+
+		err = tx.WithTransaction(ctx, func(ctx context.Context) error {
+			return tx.WithTransaction(ctx, func(ctx context.Context) error {
+				if _, err := repo.Create(ctx, entity.Account{AccountID: 3, Limit: 10}); err != nil {
+					return err
+				}
+				return errTestAbort
+			})
+		})
+		if !errors.Is(err, errTestAbort) {
+			t.Fatalf("err = %v, want %v", err, errTestAbort)
+		}
+		if _, err := repo.GetByAccountID(ctx, 3, true); err == nil {
+			t.Error("account of the inner transaction is kept after the outer one failed")
+		}
+	})
+}
+
+// a write made outside of a memory transaction wait for it, the rollback can not overwrite it
+func TestMemoryRollbackKeepOutsideWrite(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemory(entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}})
+	tx := NewMemoryTransactor()
+
+	var wg sync.WaitGroup
+	var outsideErr error
+	err := tx.WithTransaction(ctx, func(txCtx context.Context) error {
+		if _, err := repo.Patch(txCtx, 1, AccountPatch{Set: map[string]interface{}{"limit": 20}}); err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, outsideErr = repo.AddProduct(ctx, 1, "outside", 0)
+		}()
+
+		// leave the outside write time to run if it was not held back
+		time.Sleep(20 * time.Millisecond)
+
+		return errTestAbort
+	})
+	if !errors.Is(err, errTestAbort) {
+		t.Fatalf("transaction err = %v, want %v", err, errTestAbort)
+	}
+
+	wg.Wait()
+	if outsideErr != nil {
+		t.Fatalf("outside write: %v", outsideErr)
+	}
+
+	stored, err := repo.GetByAccountID(ctx, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Limit != 10 || !containsProduct(stored.Products, "outside") {
+		t.Errorf("account = %+v, want the limit rolled back and the outside product kept", stored)
+	}
+}
@@ -0,0 +1,72 @@
+package repositories
+
+import (
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// versionFilter select live account by id, and by version unless it is 0
+func versionFilter(accountID int, version int64) bson.D {
+	filter := liveFilter(accountID)
+	if version != 0 {
+		filter = append(filter, bson.E{Key: "version", Value: version})
+	}
+
+	return filter
+}
+
+// writeNow is the time of a write, truncated to the millisecond precision of bson dates
+func writeNow() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// stampUpdate is the update elements every write carry, it bump the version and the update time.
+// $max keep updated_at from going back when clocks of several instances disagree.
+func stampUpdate(at time.Time) bson.D {
+	return bson.D{
+		{Key: "$inc", Value: bson.M{"version": 1}},
+		{Key: "$max", Value: bson.M{"updated_at": at}},
+	}
+}
+
+// replaceUpdate replace limit and products of an account and stamp it
+func replaceUpdate(account entity.Account, at time.Time) bson.D {
+	update := bson.D{{Key: "$set", Value: bson.M{"limit": account.Limit, "products": account.Products}}}
+	return append(update, stampUpdate(at)...)
+}
+
+// newAccount prepare account for insert. An account without _id get a new one, created_at default to the time
+// encoded in a given _id or to at.
+func newAccount(account entity.Account, at time.Time) entity.Account {
+	if account.ID.IsZero() {
+		account.ID = primitive.NewObjectID()
+		if account.CreatedAt.IsZero() {
+			account.CreatedAt = at
+		}
+	}
+
+	if account.CreatedAt.IsZero() {
+		account.CreatedAt = account.ID.Timestamp().UTC()
+	}
+
+	account.Version = firstVersion
+	account.UpdatedAt = at
+
+	return account
+}
+
+// stampAccount is stampUpdate for the in-memory repository
+func stampAccount(account *entity.Account, at time.Time) {
+	account.Version++
+	if at.After(account.UpdatedAt) {
+		account.UpdatedAt = at
+	}
+}
+
+// versionMatches is versionFilter for the in-memory repository
+func versionMatches(account entity.Account, version int64) bool {
+	return version == 0 || account.Version == version
+}
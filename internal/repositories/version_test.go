@@ -0,0 +1,137 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+)
+
+func TestWriteBumpVersion(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ctx := context.Background()
+		const id = 42
+
+		var version int64
+		// write change account id and must leave it at the next version
+		step := func(name string, write func(version int64) (entity.Account, error)) {
+			t.Helper()
+
+			account, err := write(version)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			stored, err := repo.GetByAccountID(ctx, id, true)
+			if err != nil {
+				t.Fatalf("%s: get: %v", name, err)
+			}
+
+			if account.Version != version+1 || stored.Version != version+1 {
+				t.Fatalf("%s: returned version %d and stored %d, want %d", name, account.Version, stored.Version, version+1)
+			}
+			version = stored.Version
+		}
+		// stored return the account after a write that only report per item errors
+		stored := func(results []error, err error) (entity.Account, error) {
+			if err == nil && results[0] != nil {
+				err = results[0]
+			}
+			if err != nil {
+				return entity.Account{}, err
+			}
+
+			return repo.GetByAccountID(ctx, id, true)
+		}
+
+		step("create", func(int64) (entity.Account, error) {
+			return repo.Create(ctx, entity.Account{AccountID: id, Limit: 1, Products: []string{"a"}})
+		})
+		step("update", func(v int64) (entity.Account, error) {
+			return repo.Update(ctx, entity.Account{AccountID: id, Limit: 2, Products: []string{"a"}, Version: v})
+		})
+		step("patch", func(v int64) (entity.Account, error) {
+			return repo.Patch(ctx, id, AccountPatch{Set: map[string]interface{}{"limit": 3}, Version: v})
+		})
+		step("add product", func(v int64) (entity.Account, error) {
+			return repo.AddProduct(ctx, id, "b", v)
+		})
+		step("remove product", func(v int64) (entity.Account, error) {
+			return repo.RemoveProduct(ctx, id, "b", v)
+		})
+		step("delete", func(v int64) (entity.Account, error) {
+			return repo.Delete(ctx, id, v, "test")
+		})
+		step("restore", func(v int64) (entity.Account, error) {
+			return repo.Restore(ctx, id, v)
+		})
+		step("update many", func(v int64) (entity.Account, error) {
+			return stored(repo.UpdateMany(ctx, []entity.Account{{AccountID: id, Limit: 4, Products: []string{"a"}}}, true))
+		})
+		step("delete many", func(v int64) (entity.Account, error) {
+			return stored(repo.DeleteMany(ctx, []int{id}, true, "test"))
+		})
+
+		// a write that change nothing keep the version
+		if _, err := repo.Restore(ctx, id, version); err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		account, err := repo.AddProduct(ctx, id, "a", version+1)
+		if err != nil {
+			t.Fatalf("add held product: %v", err)
+		}
+		if account.Version != version+1 {
+			t.Errorf("adding a held product moved version %d to %d", version+1, account.Version)
+		}
+	})
+}
+
+func TestWriteRefuseStaleVersion(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ctx := context.Background()
+		const id = 43
+
+		if _, err := repo.Create(ctx, entity.Account{AccountID: id, Limit: 1, Products: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		const stale = 5
+		writes := map[string]func() error{
+			"update": func() error {
+				_, err := repo.Update(ctx, entity.Account{AccountID: id, Limit: 2, Products: []string{"a"}, Version: stale})
+				return err
+			},
+			"patch": func() error {
+				_, err := repo.Patch(ctx, id, AccountPatch{Set: map[string]interface{}{"limit": 3}, Version: stale})
+				return err
+			},
+			"add product": func() error {
+				_, err := repo.AddProduct(ctx, id, "b", stale)
+				return err
+			},
+			"remove product": func() error {
+				_, err := repo.RemoveProduct(ctx, id, "a", stale)
+				return err
+			},
+			"delete": func() error {
+				_, err := repo.Delete(ctx, id, stale, "test")
+				return err
+			},
+		}
+
+		for name, write := range writes {
+			if err := write(); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("%s: err = %v, want ErrVersionMismatch", name, err)
+			}
+		}
+
+		account, err := repo.GetByAccountID(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Version != firstVersion {
+			t.Errorf("version = %d after refused writes, want %d", account.Version, firstVersion)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// server error codes of change streams
+const (
+	codeChangeStreamNotSupported = 40573
+	codeInvalidResumeToken       = 260
+	codeChangeStreamFatalError   = 280
+	codeChangeStreamHistoryLost  = 286
+)
+
+type mongoWatcher struct {
+	collection  *mongo.Collection
+	fallback    EventBus
+	unsupported atomic.Bool
+}
+
+// NewWatcher create watcher on the change stream of the accounts collection, event ids are resume tokens.
+// Change streams need a replica set or a sharded cluster, on a standalone server feeds come from fallback after
+// the first attempt fails.
+func NewWatcher(database *mongo.Database, fallback EventBus) AccountWatcher {
+	return &mongoWatcher{
+		collection: database.Collection(ACCOUNTS_COLLECTION_NAME),
+		fallback:   fallback,
+	}
+}
+
+// Watch implements AccountWatcher.
+// Soft deletes and restores are updates of the account. A purge remove the document and leave nothing to look up,
+// so purged events only come from the event bus and the outbox.
+func (w *mongoWatcher) Watch(ctx context.Context, filter EventFilter, resumeAfter string) (EventFeed, error) {
+	if w.unsupported.Load() {
+		return w.fallback.Watch(ctx, filter, resumeAfter)
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeAfter != "" {
+		opts.SetResumeAfter(bson.D{{Key: "_data", Value: resumeAfter}})
+	}
+
+	stream, err := w.collection.Watch(ctx, mongo.Pipeline{filter.matchStage()}, opts)
+
+	if changeStreamsUnsupported(err) {
+		log.Warn().Err(err).Msg("change streams are not supported by the server, watching the in-process event bus")
+		w.unsupported.Store(true)
+		return w.fallback.Watch(ctx, filter, resumeAfter)
+	}
+
+	if err != nil {
+		return nil, mapWatchError(err)
+	}
+
+	feedCtx, cancel := context.WithCancel(context.Background())
+	feed := &streamFeed{
+		stream: stream,
+		events: make(chan entity.AccountEvent, eventFeedBuffer),
+		cancel: cancel,
+	}
+	go feed.run(feedCtx)
+
+	return feed, nil
+}
+
+type streamFeed struct {
+	stream *mongo.ChangeStream
+	events chan entity.AccountEvent
+	cancel context.CancelFunc
+	// err is set before events is closed
+	err error
+}
+
+// changeEvent is the part of a change event the feed use
+type changeEvent struct {
+	OperationType     string          `bson:"operationType"`
+	FullDocument      *entity.Account `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+	ClusterTime primitive.Timestamp `bson:"clusterTime"`
+}
+
+// run send change events to the feed until ctx is done or the stream fail
+func (f *streamFeed) run(ctx context.Context) {
+	defer close(f.events)
+	defer f.stream.Close(context.Background())
+
+	for f.stream.Next(ctx) {
+		var change changeEvent
+		if err := f.stream.Decode(&change); err != nil {
+			f.err = err
+			return
+		}
+
+		// the account was purged before its change was looked up
+		if change.FullDocument == nil {
+			continue
+		}
+
+		event := entity.AccountEvent{
+			ID:        f.stream.ResumeToken().Lookup("_data").StringValue(),
+			Type:      change.eventType(),
+			AccountID: change.FullDocument.AccountID,
+			Version:   change.FullDocument.Version,
+			Account:   change.FullDocument,
+			At:        change.FullDocument.UpdatedAt,
+		}
+		if event.At.IsZero() {
+			event.At = time.Unix(int64(change.ClusterTime.T), 0).UTC()
+		}
+
+		select {
+		case f.events <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if ctx.Err() == nil {
+		f.err = mapWatchError(f.stream.Err())
+	}
+}
+
+// eventType tell the kind of change, soft deletes set deleted_at and restores remove it
+func (c changeEvent) eventType() string {
+	if c.OperationType == "insert" {
+		return EVENT_CREATED
+	}
+
+	if _, err := c.UpdateDescription.UpdatedFields.LookupErr("deleted_at"); err == nil {
+		return EVENT_DELETED
+	}
+
+	for _, field := range c.UpdateDescription.RemovedFields {
+		if field == "deleted_at" {
+			return EVENT_RESTORED
+		}
+	}
+
+	return EVENT_UPDATED
+}
+
+// Events implements EventFeed.
+func (f *streamFeed) Events() <-chan entity.AccountEvent {
+	return f.events
+}
+
+// Err implements EventFeed.
+func (f *streamFeed) Err() error {
+	return f.err
+}
+
+// Close implements EventFeed.
+func (f *streamFeed) Close() {
+	f.cancel()
+}
+
+// changeStreamsUnsupported tell if err is the server refusing change streams, as a standalone server does
+func changeStreamsUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(codeChangeStreamNotSupported)
+}
+
+// mapWatchError is mapError for change streams, a resume token the server can not resume from is the client fault
+func mapWatchError(err error) error {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && (serverErr.HasErrorCode(codeInvalidResumeToken) ||
+		serverErr.HasErrorCode(codeChangeStreamFatalError) || serverErr.HasErrorCode(codeChangeStreamHistoryLost)) {
+		return errEventNotResumable
+	}
+
+	return mapError(err)
+}
@@ -0,0 +1,146 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// updateEvent build the change event of an update setting and removing the given fields
+func updateEvent(t *testing.T, updated bson.M, removed ...string) changeEvent {
+	t.Helper()
+
+	raw, err := bson.Marshal(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change := changeEvent{OperationType: "update"}
+	change.UpdateDescription.UpdatedFields = raw
+	change.UpdateDescription.RemovedFields = removed
+
+	return change
+}
+
+func TestChangeEventType(t *testing.T) {
+	at := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		change changeEvent
+		want   string
+	}{
+		{name: "insert", change: changeEvent{OperationType: "insert"}, want: EVENT_CREATED},
+		{name: "update", change: updateEvent(t, bson.M{"limit": 20, "version": 2}), want: EVENT_UPDATED},
+		{name: "replace", change: changeEvent{OperationType: "replace"}, want: EVENT_UPDATED},
+		{name: "soft delete set deleted_at", change: updateEvent(t, bson.M{"deleted_at": at, "deleted_by": "tester"}), want: EVENT_DELETED},
+		{name: "restore remove deleted_at", change: updateEvent(t, bson.M{"version": 3}, "deleted_at", "deleted_by"), want: EVENT_RESTORED},
+		{name: "other removed field", change: updateEvent(t, bson.M{"version": 3}, "products"), want: EVENT_UPDATED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.change.eventType(); got != tt.want {
+				t.Errorf("eventType() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangeStreamsUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "standalone server", err: mongo.CommandError{Code: codeChangeStreamNotSupported, Message: "The $changeStream stage is only supported on replica sets"}, want: true},
+		{name: "other server error", err: mongo.CommandError{Code: codeInvalidResumeToken}, want: false},
+		{name: "not a server error", err: errors.New("connection refused"), want: false},
+		{name: "no error", err: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changeStreamsUnsupported(tt.err); got != tt.want {
+				t.Errorf("changeStreamsUnsupported(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// receive wait for the next event of feed
+func receive(t *testing.T, feed EventFeed) entity.AccountEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-feed.Events():
+		if !ok {
+			t.Fatalf("feed closed: %v", feed.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+
+	return entity.AccountEvent{}
+}
+
+func TestWatchFallback(t *testing.T) {
+	bus := NewEventBus()
+	watcher := &mongoWatcher{fallback: bus}
+	watcher.unsupported.Store(true)
+
+	// once change streams are known unsupported the collection is not asked again
+	feed, err := watcher.Watch(context.Background(), EventFilter{AccountIDs: []int{1}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	bus.Publish(entity.AccountEvent{Type: EVENT_UPDATED, AccountID: 2}, entity.AccountEvent{Type: EVENT_UPDATED, AccountID: 1, Version: 2})
+	if event := receive(t, feed); event.AccountID != 1 || event.Version != 2 {
+		t.Errorf("event = %+v, want the account 1 one from the bus", event)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	database := testDatabase(t)
+	bus := NewEventBus()
+	watcher := NewWatcher(database, bus)
+	repo := New(database, testTimeoutMs)
+	ctx := context.Background()
+
+	feed, err := watcher.Watch(ctx, EventFilter{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	// a standalone server refuse change streams, the feed then come from the bus
+	if watcher.(*mongoWatcher).unsupported.Load() {
+		bus.Publish(entity.AccountEvent{Type: EVENT_CREATED, AccountID: 1, Version: 1})
+		if event := receive(t, feed); event.Type != EVENT_CREATED || event.AccountID != 1 {
+			t.Errorf("event = %+v, want the created one from the bus", event)
+		}
+		return
+	}
+
+	seedAccounts(t, repo, entity.Account{AccountID: 1, Limit: 10, Products: []string{"a"}})
+	if _, err := repo.Delete(ctx, 1, 0, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Restore(ctx, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{EVENT_CREATED, EVENT_DELETED, EVENT_RESTORED} {
+		if event := receive(t, feed); event.Type != want || event.AccountID != 1 {
+			t.Errorf("event = %+v, want %s of account 1", event, want)
+		}
+	}
+}
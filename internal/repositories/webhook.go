@@ -0,0 +1,431 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const WEBHOOKS_COLLECTION_NAME string = "webhooks"
+
+// webhook states, a failing webhook stay active and only its deliveries go to dead letter
+const (
+	WEBHOOK_STATE_ACTIVE string = "active"
+)
+
+// WebhookRepository keep the webhooks partners registered
+type WebhookRepository interface {
+	// Create store a new active webhook and return it with its id and timestamps
+	Create(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error)
+	Get(ctx context.Context, id primitive.ObjectID) (entity.Webhook, error)
+	// List return webhooks oldest first and the total number of webhooks
+	List(ctx context.Context, limit int, offset int) ([]entity.Webhook, int64, error)
+	// Update replace the url, secret, events and filters of a webhook and return it
+	Update(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Matching return the webhooks getting events of eventType for the account holding products
+	Matching(ctx context.Context, eventType string, accountID int, products []string) ([]entity.Webhook, error)
+}
+
+type webhookImpl struct {
+	collection *mongo.Collection
+	timeoutMs  int
+}
+
+func NewWebhook(database *mongo.Database, timeoutMs int) WebhookRepository {
+	return &webhookImpl{
+		collection: database.Collection(WEBHOOKS_COLLECTION_NAME),
+		timeoutMs:  timeoutMs,
+	}
+}
+
+// Create implements WebhookRepository.
+func (r *webhookImpl) Create(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	webhook = newWebhook(webhook, writeNow())
+	if _, err := r.collection.InsertOne(ctxTimeout, webhook); err != nil {
+		return entity.Webhook{}, mapError(err)
+	}
+
+	return webhook, nil
+}
+
+// Get implements WebhookRepository.
+func (r *webhookImpl) Get(ctx context.Context, id primitive.ObjectID) (entity.Webhook, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	var webhook entity.Webhook
+	err := r.collection.FindOne(ctxTimeout, bson.M{"_id": id}).Decode(&webhook)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Webhook{}, errWebhookNotFound
+	}
+
+	return webhook, mapError(err)
+}
+
+// List implements WebhookRepository.
+func (r *webhookImpl) List(ctx context.Context, limit int, offset int) ([]entity.Webhook, int64, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	if limit <= 0 {
+		return nil, 0, errLimitNotPositive
+	}
+
+	if offset < 0 {
+		return nil, 0, errOffsetNegative
+	}
+
+	total, err := r.collection.CountDocuments(ctxTimeout, bson.M{})
+	if err != nil {
+		return nil, 0, mapError(err)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+
+	cursor, err := r.collection.Find(ctxTimeout, bson.M{}, opts)
+	if err != nil {
+		return nil, 0, mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	webhooks := []entity.Webhook{}
+	if err := cursor.All(ctxTimeout, &webhooks); err != nil {
+		return nil, 0, mapError(err)
+	}
+
+	return webhooks, total, nil
+}
+
+// Update implements WebhookRepository.
+func (r *webhookImpl) Update(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"url":         webhook.URL,
+		"secret":      webhook.Secret,
+		"events":      nonNilStrings(webhook.Events),
+		"account_ids": nonNilInts(webhook.AccountIDs),
+		"products":    nonNilStrings(webhook.Products),
+		"updated_at":  writeNow(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated entity.Webhook
+	err := r.collection.FindOneAndUpdate(ctxTimeout, bson.M{"_id": webhook.ID}, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entity.Webhook{}, errWebhookNotFound
+	}
+
+	return updated, mapError(err)
+}
+
+// Delete implements WebhookRepository.
+func (r *webhookImpl) Delete(ctx context.Context, id primitive.ObjectID) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	result, err := r.collection.DeleteOne(ctxTimeout, bson.M{"_id": id})
+	if err != nil {
+		return mapError(err)
+	}
+
+	if result.DeletedCount == 0 {
+		return errWebhookNotFound
+	}
+
+	return nil
+}
+
+// Matching implements WebhookRepository.
+func (r *webhookImpl) Matching(ctx context.Context, eventType string, accountID int, products []string) ([]entity.Webhook, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Duration(r.timeoutMs)*time.Millisecond)
+	defer cancel()
+
+	filter := bson.M{"$and": bson.A{
+		bson.M{"$or": bson.A{
+			bson.M{"events": bson.M{"$size": 0}},
+			bson.M{"events": eventType},
+		}},
+		bson.M{"$or": bson.A{
+			bson.M{"account_ids": bson.M{"$size": 0}, "products": bson.M{"$size": 0}},
+			bson.M{"account_ids": accountID},
+			bson.M{"products": bson.M{"$in": nonNilStrings(products)}},
+		}},
+	}}
+
+	cursor, err := r.collection.Find(ctxTimeout, filter)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	defer cursor.Close(context.Background())
+
+	webhooks := []entity.Webhook{}
+	if err := cursor.All(ctxTimeout, &webhooks); err != nil {
+		return nil, mapError(err)
+	}
+
+	return webhooks, nil
+}
+
+type memoryWebhookImpl struct {
+	mu       sync.RWMutex
+	webhooks []entity.Webhook
+}
+
+// NewMemoryWebhook create in-memory webhook repository, webhooks are kept in creation order
+func NewMemoryWebhook() WebhookRepository {
+	return &memoryWebhookImpl{}
+}
+
+// Create implements WebhookRepository.
+func (r *memoryWebhookImpl) Create(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Webhook{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	webhook = newWebhook(webhook, writeNow())
+	r.keep(ctx, webhook.ID)
+	r.webhooks = append(r.webhooks, copyWebhook(webhook))
+
+	return webhook, nil
+}
+
+// Get implements WebhookRepository.
+func (r *memoryWebhookImpl) Get(ctx context.Context, id primitive.ObjectID) (entity.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Webhook{}, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i := r.index(id)
+	if i < 0 {
+		return entity.Webhook{}, errWebhookNotFound
+	}
+
+	return copyWebhook(r.webhooks[i]), nil
+}
+
+// List implements WebhookRepository.
+func (r *memoryWebhookImpl) List(ctx context.Context, limit int, offset int) ([]entity.Webhook, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if limit <= 0 {
+		return nil, 0, errLimitNotPositive
+	}
+
+	if offset < 0 {
+		return nil, 0, errOffsetNegative
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	webhooks := []entity.Webhook{}
+	for i := offset; i < len(r.webhooks) && len(webhooks) < limit; i++ {
+		webhooks = append(webhooks, copyWebhook(r.webhooks[i]))
+	}
+
+	return webhooks, int64(len(r.webhooks)), nil
+}
+
+// Update implements WebhookRepository.
+func (r *memoryWebhookImpl) Update(ctx context.Context, webhook entity.Webhook) (entity.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Webhook{}, err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.index(webhook.ID)
+	if i < 0 {
+		return entity.Webhook{}, errWebhookNotFound
+	}
+
+	r.keep(ctx, webhook.ID)
+	stored := &r.webhooks[i]
+	stored.URL = webhook.URL
+	stored.Secret = webhook.Secret
+	stored.Events = nonNilStrings(webhook.Events)
+	stored.AccountIDs = nonNilInts(webhook.AccountIDs)
+	stored.Products = nonNilStrings(webhook.Products)
+	stored.UpdatedAt = writeNow()
+	*stored = copyWebhook(*stored)
+
+	return copyWebhook(*stored), nil
+}
+
+// Delete implements WebhookRepository.
+func (r *memoryWebhookImpl) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	defer memoryWrite(ctx)()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.index(id)
+	if i < 0 {
+		return errWebhookNotFound
+	}
+
+	r.keep(ctx, id)
+	r.webhooks = append(r.webhooks[:i], r.webhooks[i+1:]...)
+
+	return nil
+}
+
+// Matching implements WebhookRepository.
+func (r *memoryWebhookImpl) Matching(ctx context.Context, eventType string, accountID int, products []string) ([]entity.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	webhooks := []entity.Webhook{}
+	for _, webhook := range r.webhooks {
+		if webhookMatch(webhook, eventType, accountID, products) {
+			webhooks = append(webhooks, copyWebhook(webhook))
+		}
+	}
+
+	return webhooks, nil
+}
+
+// keep register how to put back the webhook with id as stored now when the memory transaction of ctx fail, a webhook
+// not stored yet is removed. Caller must hold the lock.
+func (r *memoryWebhookImpl) keep(ctx context.Context, id primitive.ObjectID) {
+	if !undoable(ctx) {
+		return
+	}
+
+	i := r.index(id)
+	var before *entity.Webhook
+	if i >= 0 {
+		webhook := copyWebhook(r.webhooks[i])
+		before = &webhook
+	}
+
+	onRollback(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		j := r.index(id)
+		switch {
+		case j >= 0 && before == nil:
+			r.webhooks = append(r.webhooks[:j], r.webhooks[j+1:]...)
+		case j >= 0:
+			r.webhooks[j] = *before
+		case before != nil:
+			// deleted, put back at its place in creation order
+			if i > len(r.webhooks) {
+				i = len(r.webhooks)
+			}
+			r.webhooks = append(r.webhooks, entity.Webhook{})
+			copy(r.webhooks[i+1:], r.webhooks[i:])
+			r.webhooks[i] = *before
+		}
+	})
+}
+
+// index is the position of the webhook with id, -1 when missing, caller must hold the lock
+func (r *memoryWebhookImpl) index(id primitive.ObjectID) int {
+	for i := range r.webhooks {
+		if r.webhooks[i].ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// newWebhook give a webhook to create its id, state and timestamps
+func newWebhook(webhook entity.Webhook, at time.Time) entity.Webhook {
+	webhook.ID = primitive.NewObjectID()
+	webhook.State = WEBHOOK_STATE_ACTIVE
+	webhook.Events = nonNilStrings(webhook.Events)
+	webhook.AccountIDs = nonNilInts(webhook.AccountIDs)
+	webhook.Products = nonNilStrings(webhook.Products)
+	webhook.CreatedAt = at
+	webhook.UpdatedAt = at
+
+	return webhook
+}
+
+// webhookMatch report whether webhook get events of eventType for the account holding products, like Matching
+func webhookMatch(webhook entity.Webhook, eventType string, accountID int, products []string) bool {
+	if len(webhook.Events) > 0 && !containsProduct(webhook.Events, eventType) {
+		return false
+	}
+
+	if len(webhook.AccountIDs) == 0 && len(webhook.Products) == 0 {
+		return true
+	}
+
+	for _, id := range webhook.AccountIDs {
+		if id == accountID {
+			return true
+		}
+	}
+
+	for _, p := range products {
+		if containsProduct(webhook.Products, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyWebhook copy the lists of webhook so the stored one is not shared with callers
+func copyWebhook(webhook entity.Webhook) entity.Webhook {
+	webhook.Events = append([]string{}, webhook.Events...)
+	webhook.AccountIDs = append([]int{}, webhook.AccountIDs...)
+	webhook.Products = append([]string{}, webhook.Products...)
+
+	return webhook
+}
+
+// nonNilStrings store empty lists as empty arrays, $size does not match missing or null fields
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
+
+func nonNilInts(values []int) []int {
+	if values == nil {
+		return []int{}
+	}
+
+	return values
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+type AdminService interface {
+	GetIndexStatus(ctx context.Context) ([]model.IndexStatusResponse, error)
+	PurgeDeletedAccounts(ctx context.Context) (model.AccountPurgeResponse, error)
+}
+
+type adminServiceImpl struct {
+	recorder
+	indexes   repositories.IndexManager
+	repo      repositories.Repository
+	tx        repositories.Transactor
+	retention time.Duration
+}
+
+// NewAdminService create admin service, soft deleted accounts are kept for retention before they can be purged
+func NewAdminService(indexes repositories.IndexManager, repo repositories.Repository, tx repositories.Transactor, history repositories.HistoryRepository, outbox repositories.OutboxRepository, events repositories.EventBus, retention time.Duration) AdminService {
+	return &adminServiceImpl{
+		recorder:  newRecorder(history, outbox, events),
+		indexes:   indexes,
+		repo:      repo,
+		tx:        tx,
+		retention: retention,
+	}
+}
+
+// PurgeDeletedAccounts implements AdminService.
+// Accounts soft deleted longer than the retention ago are removed for good, they can not be restored anymore.
+// Each account is purged in its own transaction with its history record, a failure keep the accounts purged before it.
+func (s *adminServiceImpl) PurgeDeletedAccounts(ctx context.Context) (model.AccountPurgeResponse, error) {
+	response := model.AccountPurgeResponse{
+		DeletedBefore: time.Now().UTC().Add(-s.retention).Truncate(time.Millisecond),
+	}
+
+	for {
+		var record entity.AccountHistory
+		err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+			account, err := s.repo.PurgeOne(ctx, response.DeletedBefore)
+			if err != nil {
+				return err
+			}
+
+			record = newPurgeHistory(ctx, account)
+			return s.record(ctx, record)
+		})
+		if errs.Is(err, errs.NotFound) {
+			return response, nil
+		}
+		if err != nil {
+			return response, err
+		}
+
+		s.publish(record)
+		response.Purged++
+	}
+}
+
+// GetIndexStatus implements AdminService.
+func (s *adminServiceImpl) GetIndexStatus(ctx context.Context) ([]model.IndexStatusResponse, error) {
+	statuses, err := s.indexes.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]model.IndexStatusResponse, len(statuses))
+	for i, st := range statuses {
+		keys := make([]model.IndexKey, len(st.Keys))
+		for j, k := range st.Keys {
+			keys[j] = model.IndexKey{
+				Field: k.Key,
+				Value: k.Value,
+			}
+		}
+
+		response[i] = model.IndexStatusResponse{
+			Name:   st.Name,
+			Keys:   keys,
+			Unique: st.Unique,
+			State:  st.State,
+			Detail: st.Detail,
+		}
+	}
+
+	return response, nil
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// bulk operations and item statuses
+const (
+	BULK_OP_CREATE string = "create"
+	BULK_OP_UPDATE string = "update"
+	BULK_OP_DELETE string = "delete"
+
+	BULK_STATUS_CREATED   string = "created"
+	BULK_STATUS_UPDATED   string = "updated"
+	BULK_STATUS_DELETED   string = "deleted"
+	BULK_STATUS_NOT_FOUND string = "not_found"
+	BULK_STATUS_CONFLICT  string = "conflict"
+	BULK_STATUS_ABORTED   string = "aborted"
+	BULK_STATUS_INVALID   string = "invalid"
+	BULK_STATUS_FAILED    string = "failed"
+
+	// BULK_MAX_ITEMS bound items of one bulk request
+	BULK_MAX_ITEMS int = 1000
+)
+
+// BulkValidator check a bulk create or update item the way the single request is checked, returning why it is rejected
+type BulkValidator func(item any) []model.ErrorDetail
+
+// bulkDeleteIDRequired is the error of a delete item without account id
+var bulkDeleteIDRequired = model.ErrorDetail{Field: "account_id", Rule: "required", Message: "account_id is required"}
+
+var bulkStatusByKind = map[errs.Kind]string{
+	errs.NotFound: BULK_STATUS_NOT_FOUND,
+	errs.Conflict: BULK_STATUS_CONFLICT,
+	errs.Aborted:  BULK_STATUS_ABORTED,
+}
+
+// CreateMany implements Service.
+func (s *serviceImpl) CreateMany(ctx context.Context, requests []model.AccountCreateRequest, ordered bool) ([]model.AccountBulkItem, error) {
+	accounts := make([]entity.Account, len(requests))
+	ids := make([]int, len(requests))
+	for i, request := range requests {
+		accounts[i] = entity.Account{
+			AccountID: request.AccountID,
+			Limit:     request.Limit,
+			Products:  request.Products,
+		}
+		ids[i] = request.AccountID
+	}
+
+	results, err := s.changeMany(ctx, HISTORY_ACTION_CREATED, ids, func(ctx context.Context) ([]error, error) {
+		return s.repo.CreateMany(ctx, accounts, ordered)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bulkItems(BULK_OP_CREATE, ids, results, BULK_STATUS_CREATED), nil
+}
+
+// UpdateMany implements Service.
+func (s *serviceImpl) UpdateMany(ctx context.Context, requests []model.AccountBulkUpdateRequest, ordered bool) ([]model.AccountBulkItem, error) {
+	accounts := make([]entity.Account, len(requests))
+	ids := make([]int, len(requests))
+	for i, request := range requests {
+		accounts[i] = entity.Account{
+			AccountID: request.AccountID,
+			Limit:     request.Limit,
+			Products:  request.Products,
+		}
+		ids[i] = request.AccountID
+	}
+
+	results, err := s.changeMany(ctx, HISTORY_ACTION_UPDATED, ids, func(ctx context.Context) ([]error, error) {
+		return s.repo.UpdateMany(ctx, accounts, ordered)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bulkItems(BULK_OP_UPDATE, ids, results, BULK_STATUS_UPDATED), nil
+}
+
+// DeleteMany implements Service.
+func (s *serviceImpl) DeleteMany(ctx context.Context, accountIDs []int, ordered bool) ([]model.AccountBulkItem, error) {
+	results, err := s.changeMany(ctx, HISTORY_ACTION_DELETED, accountIDs, func(ctx context.Context) ([]error, error) {
+		return s.repo.DeleteMany(ctx, accountIDs, ordered, ActorFrom(ctx))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bulkItems(BULK_OP_DELETE, accountIDs, results, BULK_STATUS_DELETED), nil
+}
+
+// Bulk implements Service.
+// Creates run first, then updates, then deletes. In ordered mode the first failed item abort everything after it.
+// Items are checked with validate, an invalid item is reported with its errors and not written.
+func (s *serviceImpl) Bulk(ctx context.Context, request model.AccountBulkRequest, validate BulkValidator) (model.AccountBulkResponse, error) {
+	total := len(request.Create) + len(request.Update) + len(request.Delete)
+	if total == 0 {
+		return model.AccountBulkResponse{}, &ParamError{
+			Field:   "create",
+			Rule:    "required",
+			Message: "at least one create, update or delete item is required",
+		}
+	}
+
+	if total > BULK_MAX_ITEMS {
+		return model.AccountBulkResponse{}, &ParamError{
+			Field:   "create",
+			Rule:    "max",
+			Message: fmt.Sprintf("a bulk request can have at most %d items", BULK_MAX_ITEMS),
+		}
+	}
+
+	// invalid items get their own result, they do not fail the request
+	createIDs := make([]int, len(request.Create))
+	createInvalid := make([][]model.ErrorDetail, len(request.Create))
+	for i, c := range request.Create {
+		createIDs[i] = c.AccountID
+		createInvalid[i] = validate(c)
+	}
+
+	updateIDs := make([]int, len(request.Update))
+	updateInvalid := make([][]model.ErrorDetail, len(request.Update))
+	for i, u := range request.Update {
+		updateIDs[i] = u.AccountID
+		updateInvalid[i] = validate(u)
+	}
+
+	deleteInvalid := make([][]model.ErrorDetail, len(request.Delete))
+	for i, id := range request.Delete {
+		if id == 0 {
+			deleteInvalid[i] = []model.ErrorDetail{bulkDeleteIDRequired}
+		}
+	}
+
+	steps := []struct {
+		op      string
+		success string
+		ids     []int
+		invalid [][]model.ErrorDetail
+		run     func(keep []int) ([]model.AccountBulkItem, error)
+	}{
+		{BULK_OP_CREATE, BULK_STATUS_CREATED, createIDs, createInvalid, func(keep []int) ([]model.AccountBulkItem, error) {
+			return s.CreateMany(ctx, pick(request.Create, keep), request.Ordered)
+		}},
+		{BULK_OP_UPDATE, BULK_STATUS_UPDATED, updateIDs, updateInvalid, func(keep []int) ([]model.AccountBulkItem, error) {
+			return s.UpdateMany(ctx, pick(request.Update, keep), request.Ordered)
+		}},
+		{BULK_OP_DELETE, BULK_STATUS_DELETED, request.Delete, deleteInvalid, func(keep []int) ([]model.AccountBulkItem, error) {
+			return s.DeleteMany(ctx, pick(request.Delete, keep), request.Ordered)
+		}},
+	}
+
+	response := model.AccountBulkResponse{
+		Ordered: request.Ordered,
+		Items:   make([]model.AccountBulkItem, 0, total),
+	}
+
+	for _, step := range steps {
+		if len(step.ids) == 0 {
+			continue
+		}
+
+		var items []model.AccountBulkItem
+		if request.Ordered && response.Failed > 0 {
+			items = bulkItems(step.op, step.ids, abortedResults(len(step.ids)), step.success)
+		} else {
+			var err error
+			items, err = bulkStep(step.op, step.success, step.ids, step.invalid, request.Ordered, step.run)
+			if err != nil {
+				return model.AccountBulkResponse{}, err
+			}
+		}
+
+		for _, item := range items {
+			if item.Status == step.success {
+				response.Succeeded++
+			} else {
+				response.Failed++
+			}
+		}
+
+		response.Items = append(response.Items, items...)
+	}
+
+	return response, nil
+}
+
+// bulkStep write the valid items of one operation with run and put every result at the index of its item.
+// In ordered mode items after the first invalid one are aborted, in unordered mode only invalid items are left out.
+func bulkStep(op, success string, ids []int, invalid [][]model.ErrorDetail, ordered bool, run func(keep []int) ([]model.AccountBulkItem, error)) ([]model.AccountBulkItem, error) {
+	items := make([]model.AccountBulkItem, len(ids))
+	keep := make([]int, 0, len(ids))
+	for i, id := range ids {
+		if len(invalid[i]) == 0 {
+			keep = append(keep, i)
+			continue
+		}
+
+		items[i] = model.AccountBulkItem{
+			Op:        op,
+			Index:     i,
+			AccountID: id,
+			Status:    BULK_STATUS_INVALID,
+			Message:   "item is invalid",
+			Errors:    invalid[i],
+		}
+
+		if ordered {
+			rest := bulkItems(op, ids[i+1:], abortedResults(len(ids)-i-1), success)
+			for j, item := range rest {
+				item.Index = i + 1 + j
+				items[item.Index] = item
+			}
+			break
+		}
+	}
+
+	if len(keep) == 0 {
+		return items, nil
+	}
+
+	written, err := run(keep)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, item := range written {
+		item.Index = keep[j]
+		items[item.Index] = item
+	}
+
+	return items, nil
+}
+
+// pick return the elements of s at indexes
+func pick[T any](s []T, indexes []int) []T {
+	picked := make([]T, len(indexes))
+	for i, index := range indexes {
+		picked[i] = s[index]
+	}
+
+	return picked
+}
+
+// bulkItems turn repository results into items, successful items get the success status
+func bulkItems(op string, accountIDs []int, results []error, success string) []model.AccountBulkItem {
+	items := make([]model.AccountBulkItem, len(results))
+	for i, err := range results {
+		items[i] = model.AccountBulkItem{
+			Op:        op,
+			Index:     i,
+			AccountID: accountIDs[i],
+			Status:    success,
+		}
+
+		if err == nil {
+			continue
+		}
+
+		status, ok := bulkStatusByKind[errs.KindOf(err)]
+		if !ok {
+			status = BULK_STATUS_FAILED
+		}
+
+		items[i].Status = status
+		items[i].Message = "write failed"
+
+		var domainErr *errs.Error
+		if errors.As(err, &domainErr) {
+			items[i].Message = domainErr.Message()
+		}
+	}
+
+	return items
+}
+
+// abortedResults is the results of n items that were never attempted
+func abortedResults(n int) []error {
+	results := make([]error, n)
+	for i := range results {
+		results[i] = repositories.ErrBulkAborted
+	}
+
+	return results
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+)
+
+// validLimit reject create and update items without limit
+func validLimit(item any) []model.ErrorDetail {
+	var limit int
+	switch i := item.(type) {
+	case model.AccountCreateRequest:
+		limit = i.Limit
+	case model.AccountBulkUpdateRequest:
+		limit = i.Limit
+	}
+
+	if limit == 0 {
+		return []model.ErrorDetail{{Field: "limit", Rule: "required", Message: "limit is a required field"}}
+	}
+
+	return nil
+}
+
+func TestBulkMixed(t *testing.T) {
+	request := func(ordered bool) model.AccountBulkRequest {
+		return model.AccountBulkRequest{
+			Ordered: ordered,
+			Create: []model.AccountCreateRequest{
+				{AccountID: 3, Limit: 10, Products: []string{"a"}},
+				{AccountID: 4, Products: []string{"a"}},
+				{AccountID: 1, Limit: 10, Products: []string{"a"}},
+			},
+			Update: []model.AccountBulkUpdateRequest{
+				{AccountID: 2, Limit: 20, Products: []string{"b"}},
+				{AccountID: 9, Limit: 20, Products: []string{"b"}},
+			},
+			Delete: []int{2, 0},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		ordered  bool
+		statuses []string
+		// accounts created by the bulk
+		created []int
+	}{
+		{
+			name:    "unordered",
+			ordered: false,
+			statuses: []string{
+				BULK_STATUS_CREATED, BULK_STATUS_INVALID, BULK_STATUS_CONFLICT,
+				BULK_STATUS_UPDATED, BULK_STATUS_NOT_FOUND,
+				BULK_STATUS_DELETED, BULK_STATUS_INVALID,
+			},
+			created: []int{3},
+		},
+		{
+			// the invalid create abort the items after it, later operations included
+			name:    "ordered",
+			ordered: true,
+			statuses: []string{
+				BULK_STATUS_CREATED, BULK_STATUS_INVALID, BULK_STATUS_ABORTED,
+				BULK_STATUS_ABORTED, BULK_STATUS_ABORTED,
+				BULK_STATUS_ABORTED, BULK_STATUS_ABORTED,
+			},
+			created: []int{3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStorage(t, func(t *testing.T, storage testStorage) {
+				ctx := context.Background()
+				service := storage.service()
+
+				for _, id := range []int{1, 2} {
+					if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: id, Limit: 10, Products: []string{"a"}}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				response, err := service.Bulk(ctx, request(tt.ordered), validLimit)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(response.Items) != len(tt.statuses) {
+					t.Fatalf("items = %+v, want %d", response.Items, len(tt.statuses))
+				}
+
+				succeeded := 0
+				for i, item := range response.Items {
+					if item.Status != tt.statuses[i] {
+						t.Errorf("item %d (%s %d) = %s, want %s", i, item.Op, item.AccountID, item.Status, tt.statuses[i])
+					}
+					switch item.Status {
+					case BULK_STATUS_CREATED, BULK_STATUS_UPDATED, BULK_STATUS_DELETED:
+						succeeded++
+					}
+				}
+				if response.Succeeded != succeeded || response.Failed != len(tt.statuses)-succeeded || response.Ordered != tt.ordered {
+					t.Errorf("response counts %d succeeded %d failed, want %d and %d", response.Succeeded, response.Failed, succeeded, len(tt.statuses)-succeeded)
+				}
+
+				// items keep their index within their operation
+				for i, want := range []int{0, 1, 2, 0, 1, 0, 1} {
+					if response.Items[i].Index != want {
+						t.Errorf("item %d index = %d, want %d", i, response.Items[i].Index, want)
+					}
+				}
+
+				// invalid items carry their errors
+				if details := response.Items[1].Errors; len(details) != 1 || details[0].Field != "limit" {
+					t.Errorf("invalid item errors = %+v, want the limit one", details)
+				}
+
+				for _, id := range tt.created {
+					if _, err := storage.repo.GetByAccountID(ctx, id, false); err != nil {
+						t.Errorf("created account %d: %v", id, err)
+					}
+				}
+				if _, err := storage.repo.GetByAccountID(ctx, 4, true); err == nil {
+					t.Error("invalid account 4 is stored")
+				}
+			})
+		})
+	}
+}
+
+func TestBulkRefuseEmptyAndOversized(t *testing.T) {
+	service := memoryStorage().service()
+
+	if _, err := service.Bulk(context.Background(), model.AccountBulkRequest{}, validAll); err == nil {
+		t.Error("empty bulk accepted")
+	}
+
+	oversized := model.AccountBulkRequest{Delete: make([]int, BULK_MAX_ITEMS+1)}
+	if _, err := service.Bulk(context.Background(), oversized, validAll); err == nil {
+		t.Error("oversized bulk accepted")
+	}
+}
@@ -1,9 +1,26 @@
 package services
 
-import "errors"
+import "github.com/Armunz/learn-mongodb/internal/errs"
 
 var (
-	errOrderByInvalid = errors.New("order by param is invalid")
+	errOrderByInvalid = errs.New(errs.InvalidArgument, "order by param is invalid")
+
+	errProductEmpty = &ParamError{Field: "product", Rule: "required", Message: "product must not be blank"}
+
+	// errChangeContended is a change without If-Match that lost the race against other writes on every attempt
+	errChangeContended = errs.New(errs.Conflict, "account kept changing while it was written, try again")
+
+	errPatchPathMissing = errs.New(errs.Conflict, "patch path does not exist on the account")
+
+	errDeletedAsOf = errs.New(errs.NotFound, "account was deleted at that time")
+
+	errRevisionNotRecorded = errs.New(errs.NotFound, "no revision of the account is recorded at that time, it was changed without a record")
+
+	errNoRevisionFrom = errs.New(errs.NotFound, "no revision of the account is recorded at from")
+
+	errNoRevisionTo = errs.New(errs.NotFound, "no revision of the account is recorded at to")
+
+	errWebhookIDInvalid = errs.New(errs.InvalidArgument, "webhook id is invalid")
 )
 
 const (
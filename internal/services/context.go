@@ -0,0 +1,35 @@
+package services
+
+import "context"
+
+// ACTOR_ANONYMOUS is the actor of requests that do not tell who they act for
+const ACTOR_ANONYMOUS string = "anonymous"
+
+type actorKey struct{}
+
+type requestIDKey struct{}
+
+// WithActor return ctx carrying who the request act for, recorded on the changes it makes
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom return the actor carried by ctx, ACTOR_ANONYMOUS when there is none
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+
+	return ACTOR_ANONYMOUS
+}
+
+// WithRequestID return ctx carrying the id of the request, recorded on the changes it makes
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFrom return the request id carried by ctx, empty when there is none
+func RequestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
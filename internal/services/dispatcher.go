@@ -0,0 +1,345 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"github.com/Armunz/learn-mongodb/internal/webhook"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errWebhookTargetNotPublic is the attempt error of a webhook url resolving to a loopback, private or link-local address
+var errWebhookTargetNotPublic = errors.New("webhook target is not a public address")
+
+const (
+	// webhookWorkers bound the requests in flight, a slow endpoint only hold one of them
+	webhookWorkers int = 8
+
+	// webhookResponseLimit bound the response body read before the connection is reused
+	webhookResponseLimit int64 = 64 * 1024
+
+	// minDeliveryClaimTTL is the least time a claimed delivery is left to its dispatcher
+	minDeliveryClaimTTL = 30 * time.Second
+
+	// webhookUserAgent identify webhook requests
+	webhookUserAgent string = "learn-mongodb-webhooks/1"
+)
+
+// WebhookDispatchOptions tune how deliveries are sent
+type WebhookDispatchOptions struct {
+	// Interval is how often due deliveries are looked for
+	Interval  time.Duration
+	BatchSize int
+	// MaxAttempts is how many failed attempts move a delivery to dead letter, other deliveries of its webhook go on
+	MaxAttempts int
+	// BackoffBase is the wait after the first failed attempt, it double after each failure up to BackoffMax
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// Client send the requests, its Timeout bound every attempt. Redirects should not be followed since partners
+	// register the exact url. Default to a client with a 10 seconds timeout.
+	// Its Transport is replaced by one dialing public addresses only, unless AllowPrivateTargets is set.
+	Client *http.Client
+	// AllowPrivateTargets let webhooks reach loopback, private and link-local addresses, for development and tests
+	AllowPrivateTargets bool
+}
+
+// WebhookDispatcher send pending webhook deliveries
+type WebhookDispatcher interface {
+	// Run send due deliveries every interval until ctx is cancelled
+	Run(ctx context.Context)
+}
+
+type webhookDispatcherImpl struct {
+	webhooks   repositories.WebhookRepository
+	deliveries repositories.WebhookDeliveryRepository
+	options    WebhookDispatchOptions
+	claimTTL   time.Duration
+}
+
+// NewWebhookDispatcher create a dispatcher POSTing deliveries to their webhook, signed with its secret. A delivery is
+// delivered once the webhook answer 2xx, otherwise it is attempted again after an exponential backoff. Deliveries are
+// claimed before they are sent, so several instances can dispatch at once, a delivery whose outcome was not recorded
+// is sent again: webhooks may get an event more than once and should drop duplicate event ids.
+func NewWebhookDispatcher(webhooks repositories.WebhookRepository, deliveries repositories.WebhookDeliveryRepository, options WebhookDispatchOptions) WebhookDispatcher {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if options.Client != nil {
+		client = *options.Client
+	}
+	if !options.AllowPrivateTargets {
+		client.Transport = publicTransport()
+	}
+	options.Client = &client
+
+	// leave time to record the outcome of the slowest attempt before the delivery can be claimed again
+	claimTTL := 2 * options.Client.Timeout
+	if claimTTL < minDeliveryClaimTTL {
+		claimTTL = minDeliveryClaimTTL
+	}
+
+	return &webhookDispatcherImpl{
+		webhooks:   webhooks,
+		deliveries: deliveries,
+		options:    options,
+		claimTTL:   claimTTL,
+	}
+}
+
+// Run implements WebhookDispatcher.
+func (d *webhookDispatcherImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// a full batch may leave more due deliveries behind, keep going until none is due
+		for {
+			full, err := d.dispatch(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Err(err).Msg("failed to dispatch webhook deliveries")
+			}
+			if err != nil || !full {
+				break
+			}
+		}
+	}
+}
+
+// dispatch send one batch of due deliveries and report whether the batch was full
+func (d *webhookDispatcherImpl) dispatch(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	deliveries, err := d.deliveries.Claim(ctx, now, now.Add(d.claimTTL), d.options.BatchSize)
+	if err != nil {
+		return false, err
+	}
+
+	webhooks, err := d.webhooksOf(ctx, deliveries)
+	if err != nil {
+		return false, err
+	}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, webhookWorkers)
+	for _, delivery := range deliveries {
+		workers <- struct{}{}
+		wg.Add(1)
+
+		go func(delivery entity.WebhookDelivery) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			if err := d.attempt(ctx, webhooks[delivery.WebhookID], delivery); err != nil && ctx.Err() == nil {
+				log.Err(err).Str("delivery_id", delivery.ID.Hex()).Msg("failed to record webhook delivery attempt")
+			}
+		}(delivery)
+	}
+	wg.Wait()
+
+	return len(deliveries) == d.options.BatchSize, nil
+}
+
+// webhooksOf read the webhooks of deliveries, a deleted webhook is missing from the result
+func (d *webhookDispatcherImpl) webhooksOf(ctx context.Context, deliveries []entity.WebhookDelivery) (map[primitive.ObjectID]*entity.Webhook, error) {
+	webhooks := make(map[primitive.ObjectID]*entity.Webhook)
+	for _, delivery := range deliveries {
+		if _, ok := webhooks[delivery.WebhookID]; ok {
+			continue
+		}
+
+		stored, err := d.webhooks.Get(ctx, delivery.WebhookID)
+		if errs.Is(err, errs.NotFound) {
+			webhooks[delivery.WebhookID] = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks[delivery.WebhookID] = &stored
+	}
+
+	return webhooks, nil
+}
+
+// attempt send delivery to its webhook unless the webhook is gone, and record the outcome while the claim hold
+func (d *webhookDispatcherImpl) attempt(ctx context.Context, target *entity.Webhook, delivery entity.WebhookDelivery) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	attempt := entity.WebhookAttempt{At: now}
+	claimedUntil := delivery.NextAttemptAt
+
+	if target == nil {
+		// enqueued while the webhook was deleted
+		attempt.Error = "not sent, the webhook was deleted"
+		delivery.State = repositories.DELIVERY_STATE_DEAD_LETTER
+		return d.deliveries.RecordAttempt(ctx, delivery, claimedUntil, attempt)
+	}
+
+	attempt.StatusCode, attempt.Error = d.send(ctx, *target, delivery, now)
+	attempt.DurationMs = time.Since(now).Milliseconds()
+	if ctx.Err() != nil {
+		// stopped halfway, the claim expire and the delivery is sent again
+		return ctx.Err()
+	}
+
+	delivery.AttemptCount++
+	switch {
+	case attempt.Error == "":
+		delivery.State = repositories.DELIVERY_STATE_DELIVERED
+		delivery.DeliveredAt = &attempt.At
+	case delivery.AttemptCount >= d.options.MaxAttempts:
+		delivery.State = repositories.DELIVERY_STATE_DEAD_LETTER
+		log.Warn().
+			Str("webhook_id", target.ID.Hex()).
+			Str("delivery_id", delivery.ID.Hex()).
+			Int("attempts", delivery.AttemptCount).
+			Str("error", attempt.Error).
+			Msg("webhook delivery failed too many times, moving it to dead letter")
+	default:
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.AttemptCount))
+	}
+
+	return d.deliveries.RecordAttempt(ctx, delivery, claimedUntil, attempt)
+}
+
+// send POST the delivery payload to target and return the response status and why the attempt failed, empty on 2xx
+func (d *webhookDispatcherImpl) send(ctx context.Context, target entity.Webhook, delivery entity.WebhookDelivery, at time.Time) (int, string) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	timestamp := at.Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", webhookUserAgent)
+	request.Header.Set(webhook.HEADER_WEBHOOK_ID, target.ID.Hex())
+	request.Header.Set(webhook.HEADER_DELIVERY_ID, delivery.ID.Hex())
+	request.Header.Set(webhook.HEADER_EVENT_TYPE, delivery.EventType)
+	request.Header.Set(webhook.HEADER_TIMESTAMP, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(webhook.HEADER_SIGNATURE, webhook.Sign(target.Secret, timestamp, delivery.Payload))
+
+	response, err := d.options.Client.Do(request)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+
+	// drain what is small enough so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, webhookResponseLimit))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, "unexpected response status " + response.Status
+	}
+
+	return response.StatusCode, ""
+}
+
+// publicTransport is a transport dialing public addresses only. The address is checked as it is dialed, after DNS
+// resolution, so a host name resolving to a private address is refused too. Proxies are not used since they would
+// dial in our place.
+func publicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublicOnly,
+	}
+
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// dialPublicOnly is a dialer control refusing addresses that are not public
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errWebhookTargetNotPublic, host)
+	}
+
+	return nil
+}
+
+// nonPublicNetworks are the reserved ranges net.IP has no method for
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+// isPublicIP report whether ip is a public unicast address
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return network
+}
+
+// backoff is the wait after the failed attempt number attempts, with up to 20% jitter so failed deliveries of an
+// endpoint coming back do not all hit it at once. The jitter is added before clamping, the wait never exceed BackoffMax.
+func (d *webhookDispatcherImpl) backoff(attempts int) time.Duration {
+	wait := d.options.BackoffBase
+	for i := 1; i < attempts && wait < d.options.BackoffMax; i++ {
+		wait *= 2
+	}
+
+	wait += time.Duration(rand.Int63n(int64(wait)/5 + 1))
+	if wait > d.options.BackoffMax {
+		wait = d.options.BackoffMax
+	}
+
+	return wait
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/publisher"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"github.com/Armunz/learn-mongodb/internal/webhook"
+)
+
+const testWebhookSecret = "0123456789abcdef0123456789abcdef"
+
+// receiver is a webhook endpoint answering status, it verify the signature of every request it get
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	received []string
+	invalid  int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	timestamp := request.Header.Get(webhook.HEADER_TIMESTAMP)
+	signature := request.Header.Get(webhook.HEADER_SIGNATURE)
+	if !webhook.Verify(testWebhookSecret, timestamp, signature, body, time.Minute, time.Now()) {
+		r.invalid++
+	}
+	r.received = append(r.received, request.Header.Get(webhook.HEADER_EVENT_TYPE))
+
+	w.WriteHeader(r.status)
+}
+
+func (r *receiver) answer(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status = status
+}
+
+// webhookFixture is a webhook on a receiver, its dispatcher and the publisher enqueuing its deliveries
+type webhookFixture struct {
+	receiver   *receiver
+	service    WebhookService
+	publisher  publisher.Publisher
+	dispatcher *webhookDispatcherImpl
+	webhookID  string
+}
+
+func newWebhookFixture(t *testing.T, options WebhookDispatchOptions) *webhookFixture {
+	t.Helper()
+
+	rcv := &receiver{status: http.StatusOK}
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+
+	webhooks := repositories.NewMemoryWebhook()
+	deliveries := repositories.NewMemoryWebhookDelivery()
+	service := NewWebhookService(webhooks, deliveries, repositories.NewMemoryTransactor(), 20)
+
+	created, err := service.CreateWebhook(context.Background(), model.WebhookRequest{URL: server.URL, Secret: testWebhookSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options.Interval = time.Hour
+	options.BatchSize = 10
+	dispatcher := NewWebhookDispatcher(webhooks, deliveries, options).(*webhookDispatcherImpl)
+
+	return &webhookFixture{
+		receiver:   rcv,
+		service:    service,
+		publisher:  NewWebhookPublisher(webhooks, deliveries),
+		dispatcher: dispatcher,
+		webhookID:  created.ID,
+	}
+}
+
+// publish enqueue an account event for the webhook
+func (f *webhookFixture) publish(t *testing.T, eventType string) {
+	t.Helper()
+
+	data, _ := json.Marshal(model.AccountEvent{ID: eventType, Type: eventType, AccountID: 1, At: time.Now()})
+	if err := f.publisher.Publish(context.Background(), publisher.Message{ID: eventType, AccountID: 1, Type: eventType, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dispatch send the due deliveries once
+func (f *webhookFixture) dispatch(t *testing.T) {
+	t.Helper()
+
+	if _, err := f.dispatcher.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *webhookFixture) deliveries(t *testing.T) []model.WebhookDeliveryResponse {
+	t.Helper()
+
+	deliveries, _, err := f.service.GetWebhookDeliveries(context.Background(), f.webhookID, model.WebhookDeliveryListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return deliveries
+}
+
+func TestDispatchSigned(t *testing.T) {
+	f := newWebhookFixture(t, WebhookDispatchOptions{MaxAttempts: 3, BackoffBase: time.Second, BackoffMax: time.Second, AllowPrivateTargets: true})
+
+	f.publish(t, repositories.EVENT_CREATED)
+	f.dispatch(t)
+
+	if len(f.receiver.received) != 1 || f.receiver.invalid != 0 {
+		t.Fatalf("received %v with %d invalid signatures, want one signed request", f.receiver.received, f.receiver.invalid)
+	}
+
+	deliveries := f.deliveries(t)
+	if len(deliveries) != 1 || deliveries[0].State != repositories.DELIVERY_STATE_DELIVERED || deliveries[0].AttemptCount != 1 {
+		t.Errorf("deliveries = %+v, want one delivered after one attempt", deliveries)
+	}
+}
+
+func TestDispatchBackoff(t *testing.T) {
+	d := NewWebhookDispatcher(nil, nil, WebhookDispatchOptions{BackoffBase: time.Second, BackoffMax: 5 * time.Second}).(*webhookDispatcherImpl)
+
+	// the wait double from the base up to the max, plus at most 20% jitter, and never exceed the max
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, base := range want {
+		highest := base + base/5
+		if highest > 5*time.Second {
+			highest = 5 * time.Second
+		}
+
+		for n := 0; n < 20; n++ {
+			if wait := d.backoff(i + 1); wait < base || wait > highest {
+				t.Fatalf("backoff after attempt %d = %v, want between %v and %v", i+1, wait, base, highest)
+			}
+		}
+	}
+}
+
+func TestDispatchDeadLetterAndReplay(t *testing.T) {
+	ctx := context.Background()
+	f := newWebhookFixture(t, WebhookDispatchOptions{MaxAttempts: 2, BackoffBase: time.Millisecond, BackoffMax: time.Millisecond, AllowPrivateTargets: true})
+	f.receiver.answer(http.StatusInternalServerError)
+
+	f.publish(t, repositories.EVENT_CREATED)
+	f.dispatch(t)
+
+	deliveries := f.deliveries(t)
+	if deliveries[0].State != repositories.DELIVERY_STATE_PENDING || deliveries[0].NextAttemptAt == nil {
+		t.Fatalf("delivery after a failed attempt = %+v, want pending with a next attempt", deliveries[0])
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	f.dispatch(t)
+
+	deliveries = f.deliveries(t)
+	if deliveries[0].State != repositories.DELIVERY_STATE_DEAD_LETTER || deliveries[0].AttemptCount != 2 {
+		t.Fatalf("delivery after max attempts = %+v, want dead letter after 2 attempts", deliveries[0])
+	}
+
+	// only the delivery is dead, the webhook stay active and get the next events
+	if stored, err := f.service.GetWebhook(ctx, f.webhookID); err != nil || stored.State != repositories.WEBHOOK_STATE_ACTIVE {
+		t.Fatalf("webhook = %+v, %v, want active", stored, err)
+	}
+
+	f.receiver.answer(http.StatusOK)
+	f.publish(t, repositories.EVENT_UPDATED)
+	f.dispatch(t)
+
+	for _, delivery := range f.deliveries(t) {
+		want := repositories.DELIVERY_STATE_DELIVERED
+		if delivery.EventType == repositories.EVENT_CREATED {
+			want = repositories.DELIVERY_STATE_DEAD_LETTER
+		}
+		if delivery.State != want {
+			t.Errorf("delivery %s = %s, want %s", delivery.EventType, delivery.State, want)
+		}
+	}
+
+	replayed, err := f.service.ReplayWebhook(ctx, f.webhookID, model.WebhookReplayRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Replayed != 1 {
+		t.Errorf("replayed %d deliveries, want 1", replayed.Replayed)
+	}
+
+	f.dispatch(t)
+	for _, delivery := range f.deliveries(t) {
+		if delivery.State != repositories.DELIVERY_STATE_DELIVERED {
+			t.Errorf("delivery %s after replay = %s, want delivered", delivery.EventType, delivery.State)
+		}
+	}
+}
+
+func TestDispatchRefusePrivateTarget(t *testing.T) {
+	f := newWebhookFixture(t, WebhookDispatchOptions{MaxAttempts: 3, BackoffBase: time.Second, BackoffMax: time.Second})
+
+	f.publish(t, repositories.EVENT_CREATED)
+	f.dispatch(t)
+
+	if len(f.receiver.received) != 0 {
+		t.Errorf("loopback receiver got %v", f.receiver.received)
+	}
+
+	deliveries := f.deliveries(t)
+	if len(deliveries[0].Attempts) != 1 || !strings.Contains(deliveries[0].Attempts[0].Error, errWebhookTargetNotPublic.Error()) {
+		t.Errorf("attempts = %+v, want one refused as not public", deliveries[0].Attempts)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for address, want := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if got := isPublicIP(net.ParseIP(address)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
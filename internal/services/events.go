@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// AccountEventFeed deliver account events until it is closed or fail
+type AccountEventFeed interface {
+	Events() <-chan model.AccountEvent
+	// Err tell why Events was closed once it is, nil when the feed was closed by its owner
+	Err() error
+	Close()
+}
+
+// WatchAccounts implements Service.
+// Events after lastEventID are sent first when it is given, then events as they happen.
+func (s *serviceImpl) WatchAccounts(ctx context.Context, request model.AccountEventsRequest, lastEventID string) (AccountEventFeed, error) {
+	filter := repositories.EventFilter{
+		AccountIDs: request.AccountIDs,
+		Products:   cleanProducts(request.Products),
+	}
+
+	feed, err := s.watcher.Watch(ctx, filter, lastEventID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAccountEventFeed(feed, nil), nil
+}
+
+// publish send the changes recorded in history to the watchers of the event bus
+func (s recorder) publish(records ...entity.AccountHistory) {
+	if len(records) == 0 {
+		return
+	}
+
+	events := make([]entity.AccountEvent, len(records))
+	for i, record := range records {
+		events[i] = entity.AccountEvent{
+			Type:      record.Action,
+			AccountID: record.AccountID,
+			Version:   record.Version,
+			Account:   record.Account,
+			At:        record.At,
+		}
+	}
+
+	s.events.Publish(events...)
+}
+
+// accountEventFeed convert events of a repository feed to responses
+type accountEventFeed struct {
+	feed   repositories.EventFeed
+	match  func(entity.AccountEvent) bool
+	events chan model.AccountEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newAccountEventFeed start converting events of feed that match, every event when match is nil
+func newAccountEventFeed(feed repositories.EventFeed, match func(entity.AccountEvent) bool) *accountEventFeed {
+	f := &accountEventFeed{
+		feed:   feed,
+		match:  match,
+		events: make(chan model.AccountEvent),
+		done:   make(chan struct{}),
+	}
+	go f.run()
+
+	return f
+}
+
+func (f *accountEventFeed) run() {
+	defer close(f.events)
+
+	for event := range f.feed.Events() {
+		if f.match != nil && !f.match(event) {
+			continue
+		}
+
+		select {
+		case f.events <- newAccountEvent(event):
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// Events implements AccountEventFeed.
+func (f *accountEventFeed) Events() <-chan model.AccountEvent {
+	return f.events
+}
+
+// Err implements AccountEventFeed.
+func (f *accountEventFeed) Err() error {
+	return f.feed.Err()
+}
+
+// Close implements AccountEventFeed.
+func (f *accountEventFeed) Close() {
+	f.once.Do(func() {
+		close(f.done)
+		f.feed.Close()
+	})
+}
+
+func newAccountEvent(event entity.AccountEvent) model.AccountEvent {
+	response := model.AccountEvent{
+		ID:        event.ID,
+		Type:      event.Type,
+		AccountID: event.AccountID,
+		Version:   event.Version,
+		At:        event.At,
+	}
+
+	if event.Account != nil {
+		account := newAccountResponse(*event.Account)
+		response.Account = &account
+	}
+
+	return response
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// ParamError is returned when a request param is invalid, or filters can never match any account
+type ParamError struct {
+	Field   string
+	Rule    string
+	Message string
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("param %s is invalid: %s", e.Field, e.Message)
+}
+
+// Kind implements errs kind lookup, param errors are invalid arguments
+func (e *ParamError) Kind() errs.Kind {
+	return errs.InvalidArgument
+}
+
+// buildFilter validate filter combination of list request and convert it to repository filter
+func buildFilter(request model.AccountListRequest) (repositories.AccountFilter, error) {
+	filter := repositories.AccountFilter{
+		IncludeDeleted:  request.IncludeDeleted,
+		Product:         strings.TrimSpace(request.Product),
+		ProductsAll:     cleanProducts(request.ProductsAll),
+		ProductsAny:     cleanProducts(request.ProductsAny),
+		ProductsNone:    cleanProducts(request.ProductsNone),
+		LimitMin:        request.LimitMin,
+		LimitMax:        request.LimitMax,
+		ProductCountMin: request.ProductCountMin,
+		ProductCountMax: request.ProductCountMax,
+		AccountIDMin:    request.AccountIDMin,
+		AccountIDMax:    request.AccountIDMax,
+	}
+
+	if err := validateRange("limit", filter.LimitMin, filter.LimitMax); err != nil {
+		return repositories.AccountFilter{}, err
+	}
+
+	if err := validateRange("account_id", filter.AccountIDMin, filter.AccountIDMax); err != nil {
+		return repositories.AccountFilter{}, err
+	}
+
+	if err := validateRange("product_count", filter.ProductCountMin, filter.ProductCountMax); err != nil {
+		return repositories.AccountFilter{}, err
+	}
+
+	var err error
+	if filter.CreatedFrom, err = parseOptionalTime("created_from", request.CreatedFrom); err != nil {
+		return repositories.AccountFilter{}, err
+	}
+
+	if filter.CreatedTo, err = parseOptionalTime("created_to", request.CreatedTo); err != nil {
+		return repositories.AccountFilter{}, err
+	}
+
+	if filter.UpdatedSince, err = parseOptionalTime("updated_since", request.UpdatedSince); err != nil {
+		return repositories.AccountFilter{}, err
+	}
+
+	if filter.CreatedFrom != nil && filter.CreatedTo != nil && !filter.CreatedFrom.Before(*filter.CreatedTo) {
+		return repositories.AccountFilter{}, &ParamError{
+			Field:   "created_from",
+			Rule:    "ltfield",
+			Message: "created_from must be before created_to",
+		}
+	}
+
+	if filter.ProductCountMin != nil && *filter.ProductCountMin < 0 {
+		return repositories.AccountFilter{}, &ParamError{
+			Field:   "product_count_min",
+			Rule:    "gte",
+			Message: "product_count_min must be 0 or greater",
+		}
+	}
+
+	// required products can not be excluded at the same time
+	required := filter.ProductsAll
+	if filter.Product != "" {
+		required = append(append([]string{}, required...), filter.Product)
+	}
+
+	excluded := make(map[string]bool, len(filter.ProductsNone))
+	for _, p := range filter.ProductsNone {
+		excluded[p] = true
+	}
+
+	for _, p := range required {
+		if excluded[p] {
+			return repositories.AccountFilter{}, &ParamError{
+				Field:   "products_none",
+				Rule:    "excluded_with",
+				Message: fmt.Sprintf("product %q is both required and excluded", p),
+			}
+		}
+	}
+
+	if len(filter.ProductsAny) > 0 {
+		allExcluded := true
+		for _, p := range filter.ProductsAny {
+			if !excluded[p] {
+				allExcluded = false
+				break
+			}
+		}
+
+		if allExcluded {
+			return repositories.AccountFilter{}, &ParamError{
+				Field:   "products_any",
+				Rule:    "excluded_with",
+				Message: "every product in products_any is excluded by products_none",
+			}
+		}
+	}
+
+	if filter.ProductCountMax != nil {
+		distinct := make(map[string]bool, len(required))
+		for _, p := range required {
+			distinct[p] = true
+		}
+
+		if len(distinct) > *filter.ProductCountMax {
+			return repositories.AccountFilter{}, &ParamError{
+				Field:   "product_count_max",
+				Rule:    "gte",
+				Message: fmt.Sprintf("product_count_max is lower than the %d required products", len(distinct)),
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+func validateRange(field string, min, max *int) error {
+	if min != nil && max != nil && *min > *max {
+		return &ParamError{
+			Field:   field + "_min",
+			Rule:    "ltefield",
+			Message: fmt.Sprintf("%s_min must not be greater than %s_max", field, field),
+		}
+	}
+
+	return nil
+}
+
+// parseOptionalTime is parseTime for params that may be left out, nil when value is empty
+func parseOptionalTime(field string, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := parseTime(field, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// cleanProducts trim products and drop empty values
+func cleanProducts(products []string) []string {
+	var cleaned []string
+	for _, p := range products {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			cleaned = append(cleaned, p)
+		}
+	}
+
+	return cleaned
+}
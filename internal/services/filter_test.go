@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestBuildFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		request model.AccountListRequest
+		// field of the param error, empty when the filter is valid
+		field string
+	}{
+		{
+			name:    "no filter",
+			request: model.AccountListRequest{},
+		},
+		{
+			name: "every filter",
+			request: model.AccountListRequest{
+				Product:         "a",
+				ProductsAll:     []string{"b"},
+				ProductsAny:     []string{"c", "d"},
+				ProductsNone:    []string{"d"},
+				LimitMin:        intPtr(1),
+				LimitMax:        intPtr(10),
+				ProductCountMin: intPtr(2),
+				ProductCountMax: intPtr(2),
+				AccountIDMin:    intPtr(5),
+				AccountIDMax:    intPtr(5),
+			},
+		},
+		{
+			name:    "limit range reversed",
+			request: model.AccountListRequest{LimitMin: intPtr(10), LimitMax: intPtr(1)},
+			field:   "limit_min",
+		},
+		{
+			name:    "account_id range reversed",
+			request: model.AccountListRequest{AccountIDMin: intPtr(2), AccountIDMax: intPtr(1)},
+			field:   "account_id_min",
+		},
+		{
+			name:    "product_count range reversed",
+			request: model.AccountListRequest{ProductCountMin: intPtr(3), ProductCountMax: intPtr(2)},
+			field:   "product_count_min",
+		},
+		{
+			name:    "negative product_count_min",
+			request: model.AccountListRequest{ProductCountMin: intPtr(-1)},
+			field:   "product_count_min",
+		},
+		{
+			name:    "product required and excluded",
+			request: model.AccountListRequest{Product: "a", ProductsNone: []string{"a"}},
+			field:   "products_none",
+		},
+		{
+			name:    "products_all required and excluded",
+			request: model.AccountListRequest{ProductsAll: []string{"a", "b"}, ProductsNone: []string{" b "}},
+			field:   "products_none",
+		},
+		{
+			name:    "products_any all excluded",
+			request: model.AccountListRequest{ProductsAny: []string{"a", "b"}, ProductsNone: []string{"a", "b", "c"}},
+			field:   "products_any",
+		},
+		{
+			name:    "product_count_max below required",
+			request: model.AccountListRequest{Product: "a", ProductsAll: []string{"b", "c"}, ProductCountMax: intPtr(2)},
+			field:   "product_count_max",
+		},
+		{
+			name:    "required product counted once",
+			request: model.AccountListRequest{Product: "a", ProductsAll: []string{"a", "b"}, ProductCountMax: intPtr(2)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildFilter(tt.request)
+
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("err = %v, want none", err)
+				}
+				return
+			}
+
+			var paramErr *ParamError
+			if !errors.As(err, &paramErr) || paramErr.Field != tt.field {
+				t.Fatalf("err = %v, want a param error on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestBuildFilterCleanProducts(t *testing.T) {
+	filter, err := buildFilter(model.AccountListRequest{Product: " a ", ProductsAny: []string{" b", "", "  "}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.Product != "a" || len(filter.ProductsAny) != 1 || filter.ProductsAny[0] != "b" {
+		t.Errorf("filter = %+v, want trimmed products without empty ones", filter)
+	}
+}
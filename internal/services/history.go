@@ -0,0 +1,281 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// history actions
+const (
+	HISTORY_ACTION_CREATED  string = "created"
+	HISTORY_ACTION_UPDATED  string = "updated"
+	HISTORY_ACTION_DELETED  string = "deleted"
+	HISTORY_ACTION_RESTORED string = "restored"
+	HISTORY_ACTION_PURGED   string = "purged"
+
+	// changeAttempts bound how many times a change losing the race against another write is retried
+	changeAttempts int = 3
+)
+
+// GetAccountHistory implements Service.
+// Records are listed newest first, an account without records has an empty history.
+func (s *serviceImpl) GetAccountHistory(ctx context.Context, accountID int, request model.AccountHistoryRequest) ([]model.AccountHistoryResponse, model.ResponsePage, error) {
+	limit := request.Limit
+	if limit == 0 {
+		limit = s.defaultLimit
+	}
+
+	var offset int
+	if request.Page > 0 {
+		offset = (request.Page - 1) * limit
+	}
+
+	records, count, err := s.history.List(ctx, accountID, limit, offset)
+	if err != nil {
+		return nil, model.ResponsePage{}, err
+	}
+
+	var totalPages int64
+	if limit > 0 {
+		totalPages = count / int64(limit)
+		if count%int64(limit) != 0 {
+			totalPages++
+		}
+	}
+
+	response := make([]model.AccountHistoryResponse, len(records))
+	for i, record := range records {
+		response[i] = model.AccountHistoryResponse{
+			AccountID: record.AccountID,
+			Action:    record.Action,
+			Version:   record.Version,
+			Changes:   newFieldChanges(record.Changes),
+			Actor:     record.Actor,
+			RequestID: record.RequestID,
+			At:        record.At,
+		}
+	}
+
+	page := model.ResponsePage{
+		TotalData: count,
+		TotalPage: totalPages,
+	}
+
+	return response, page, nil
+}
+
+// change apply write to a stored account and append its history and outbox records, in one transaction when the storage
+// support it, then publish the change.
+// write is given the account before the change and must fail when its version is not stored anymore, so the
+// recorded before state is exact. Without If-Match a change losing the race against another write is retried, and is a
+// conflict once out of attempts.
+func (s *serviceImpl) change(ctx context.Context, accountID int, action string, ifMatch model.IfMatch, write func(ctx context.Context, before entity.Account) (entity.Account, error)) (entity.Account, error) {
+	for attempt := 1; ; attempt++ {
+		var after entity.Account
+		var records []entity.AccountHistory
+		err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+			// the driver retry the whole function on transient errors
+			records = nil
+
+			before, err := s.repo.GetByAccountID(ctx, accountID, true)
+			if err != nil {
+				return err
+			}
+
+			if ifMatch != nil && !containsVersion(ifMatch, before.Version) {
+				return repositories.ErrVersionMismatch
+			}
+
+			after, err = write(ctx, before)
+			if err != nil {
+				return err
+			}
+
+			// nothing changed, such as adding a product the account already hold
+			if after.Version == before.Version {
+				return nil
+			}
+
+			records = append(records, newHistory(ctx, action, &before, &after))
+			return s.record(ctx, records...)
+		})
+		if err == nil {
+			s.publish(records...)
+		}
+
+		// only a version the client asked for is a failed precondition, a lost race is a conflict
+		if ifMatch != nil || !errs.Is(err, errs.FailedPrecondition) {
+			return after, err
+		}
+
+		if attempt == changeAttempts {
+			return after, errChangeContended
+		}
+	}
+}
+
+// changeMany apply a bulk write and append one history and outbox record per changed account, in one transaction when
+// the storage support it, then publish the changes. Accounts are read before and after the write, so an account written
+// twice by the bulk get one record. Without transactions a concurrent write may show up in the recorded before state.
+// An item failing in the transaction abort it, the item keep its error and every other item is reported rolled back.
+func (s *serviceImpl) changeMany(ctx context.Context, action string, accountIDs []int, write func(ctx context.Context) ([]error, error)) ([]error, error) {
+	var results []error
+	var records []entity.AccountHistory
+	err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		// the driver retry the whole function on transient errors
+		records = nil
+
+		before, err := s.repo.GetByAccountIDs(ctx, accountIDs)
+		if err != nil {
+			return err
+		}
+
+		results, err = write(ctx)
+		if err != nil {
+			return err
+		}
+
+		after, err := s.repo.GetByAccountIDs(ctx, accountIDs)
+		if err != nil {
+			return err
+		}
+
+		recorded := make(map[int]bool, len(accountIDs))
+		for i, id := range accountIDs {
+			if results[i] != nil || recorded[id] {
+				continue
+			}
+			recorded[id] = true
+
+			a, ok := after[id]
+			if !ok {
+				continue
+			}
+
+			var b *entity.Account
+			if stored, ok := before[id]; ok {
+				b = &stored
+			}
+
+			records = append(records, newHistory(ctx, action, b, &a))
+		}
+
+		return s.record(ctx, records...)
+	})
+
+	var abortErr *repositories.BulkAbortError
+	if errors.As(err, &abortErr) {
+		results = make([]error, len(accountIDs))
+		for i := range results {
+			results[i] = repositories.ErrBulkRolledBack
+		}
+		results[abortErr.Index] = abortErr.Err
+
+		return results, nil
+	}
+
+	if err == nil {
+		s.publish(records...)
+	}
+
+	return results, err
+}
+
+// newHistory build the record of a change by the actor and request of ctx, before is nil for a created account
+func newHistory(ctx context.Context, action string, before, after *entity.Account) entity.AccountHistory {
+	revision := *after
+	revision.Products = append([]string{}, after.Products...)
+
+	return entity.AccountHistory{
+		AccountID: after.AccountID,
+		Action:    action,
+		Version:   after.Version,
+		Changes:   accountChanges(before, after),
+		Account:   &revision,
+		Actor:     ActorFrom(ctx),
+		RequestID: RequestIDFrom(ctx),
+		At:        time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+// newPurgeHistory build the record of an account removed for good, its revision is the deleted account so the account
+// read as of a later time is deleted
+func newPurgeHistory(ctx context.Context, account entity.Account) entity.AccountHistory {
+	record := newHistory(ctx, HISTORY_ACTION_PURGED, &account, &account)
+	record.Changes = accountChanges(&account, nil)
+
+	return record
+}
+
+// accountChanges list fields whose value differ between before and after
+func accountChanges(before, after *entity.Account) []entity.FieldChange {
+	b := historyFields(before)
+	a := historyFields(after)
+
+	var changes []entity.FieldChange
+	for i := range a {
+		if !reflect.DeepEqual(b[i].value, a[i].value) {
+			changes = append(changes, entity.FieldChange{
+				Field:  a[i].field,
+				Before: b[i].value,
+				After:  a[i].value,
+			})
+		}
+	}
+
+	return changes
+}
+
+type historyField struct {
+	field string
+	value interface{}
+}
+
+// historyFields return recorded fields of account in a fixed order, unset fields are nil
+func historyFields(account *entity.Account) []historyField {
+	fields := []historyField{{field: "limit"}, {field: "products"}, {field: "deleted_at"}, {field: "deleted_by"}}
+	if account == nil {
+		return fields
+	}
+
+	fields[0].value = account.Limit
+	fields[1].value = append([]string{}, account.Products...)
+	if account.DeletedAt != nil {
+		fields[2].value = *account.DeletedAt
+	}
+	if account.DeletedBy != "" {
+		fields[3].value = account.DeletedBy
+	}
+
+	return fields
+}
+
+func newFieldChanges(changes []entity.FieldChange) []model.FieldChange {
+	response := make([]model.FieldChange, len(changes))
+	for i, c := range changes {
+		response[i] = model.FieldChange{
+			Field:  c.Field,
+			Before: c.Before,
+			After:  c.After,
+		}
+	}
+
+	return response
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
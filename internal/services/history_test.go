@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// racingRepository lose every update to another writer that bump the version just before it
+type racingRepository struct {
+	repositories.Repository
+	updates int
+}
+
+func (r *racingRepository) Update(ctx context.Context, account entity.Account) (entity.Account, error) {
+	r.updates++
+	if _, err := r.Repository.AddProduct(ctx, account.AccountID, "racer", 0); err != nil {
+		return entity.Account{}, err
+	}
+	if _, err := r.Repository.RemoveProduct(ctx, account.AccountID, "racer", 0); err != nil {
+		return entity.Account{}, err
+	}
+
+	return r.Repository.Update(ctx, account)
+}
+
+func TestChangeLosingRace(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorage()
+	repo := &racingRepository{Repository: storage.repo}
+	storage.repo = repo
+	service := storage.service()
+
+	if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// without If-Match the change is retried, then it is a conflict
+	_, err := service.UpdateAccount(ctx, 1, model.AccountUpdateRequest{Limit: 20, Products: []string{"a"}}, nil)
+	if !errors.Is(err, errChangeContended) || errs.KindOf(err) != errs.Conflict {
+		t.Errorf("err = %v, want %v", err, errChangeContended)
+	}
+	if repo.updates != changeAttempts {
+		t.Errorf("update tried %d times, want %d", repo.updates, changeAttempts)
+	}
+
+	// the version given by If-Match is gone, that is a failed precondition and it is not retried
+	account, err := storage.repo.GetByAccountID(ctx, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.updates = 0
+	_, err = service.UpdateAccount(ctx, 1, model.AccountUpdateRequest{Limit: 20, Products: []string{"a"}}, model.IfMatch{account.Version})
+	if !errors.Is(err, repositories.ErrVersionMismatch) || errs.KindOf(err) != errs.FailedPrecondition {
+		t.Errorf("err with If-Match = %v, want %v", err, repositories.ErrVersionMismatch)
+	}
+	if repo.updates != 1 {
+		t.Errorf("update with If-Match tried %d times, want 1", repo.updates)
+	}
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/importer"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// import params
+const (
+	IMPORT_FORMAT_CSV    string = "csv"
+	IMPORT_FORMAT_NDJSON string = "ndjson"
+
+	ON_CONFLICT_SKIP      string = "skip"
+	ON_CONFLICT_OVERWRITE string = "overwrite"
+	ON_CONFLICT_FAIL      string = "fail"
+)
+
+var importModes = map[string]importer.Mode{
+	ON_CONFLICT_SKIP:      importer.MODE_SKIP,
+	ON_CONFLICT_OVERWRITE: importer.MODE_UPSERT,
+	ON_CONFLICT_FAIL:      importer.MODE_FAIL,
+}
+
+// AccountValidator check an account the way a create request is checked, returning why it is rejected
+type AccountValidator func(request model.AccountCreateRequest) []model.ErrorDetail
+
+type ImportService interface {
+	// ImportAccounts write every valid row of body. On a conflict with on_conflict=fail the report so far
+	// is returned along with a conflict error.
+	ImportAccounts(ctx context.Context, request model.AccountImportRequest, body io.Reader, validate AccountValidator) (model.AccountImportResponse, error)
+}
+
+type importServiceImpl struct {
+	writer importer.Writer
+}
+
+// NewImportService create import service writing rows with writer, the accounts changed by every batch are recorded
+// in the history and the outbox like any other change
+func NewImportService(writer importer.Writer, repo repositories.Repository, history repositories.HistoryRepository, outbox repositories.OutboxRepository, events repositories.EventBus) ImportService {
+	return &importServiceImpl{
+		writer: &recordingWriter{
+			Writer:   writer,
+			recorder: newRecorder(history, outbox, events),
+			repo:     repo,
+		},
+	}
+}
+
+// recordingWriter record the accounts a batch of rows changed, accounts are read before and after the batch is written.
+// An import is not a transaction, a write racing the batch may show up in its records, and a batch written when its
+// records fail to be appended is not recorded.
+type recordingWriter struct {
+	importer.Writer
+	recorder
+	repo repositories.Repository
+}
+
+// Write implements importer.Writer.
+func (w *recordingWriter) Write(ctx context.Context, rows []importer.Row, mode importer.Mode, summary *importer.Summary) error {
+	ids := make([]int, 0, len(rows))
+	seen := make(map[int]bool, len(rows))
+	for _, row := range rows {
+		if id := row.Account.AccountID; !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	before, err := w.repo.GetByAccountIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	// rows written before a failure are recorded too
+	writeErr := w.Writer.Write(ctx, rows, mode, summary)
+
+	after, err := w.repo.GetByAccountIDs(ctx, ids)
+	if err != nil {
+		return errors.Join(writeErr, err)
+	}
+
+	var records []entity.AccountHistory
+	for _, id := range ids {
+		a, ok := after[id]
+		if !ok {
+			continue
+		}
+
+		b, existed := before[id]
+		switch {
+		case !existed:
+			records = append(records, newHistory(ctx, HISTORY_ACTION_CREATED, nil, &a))
+		case b.Version != a.Version:
+			records = append(records, newHistory(ctx, HISTORY_ACTION_UPDATED, &b, &a))
+		}
+	}
+
+	if err := w.record(ctx, records...); err != nil {
+		return errors.Join(writeErr, err)
+	}
+	w.publish(records...)
+
+	return writeErr
+}
+
+// ImportAccounts implements ImportService.
+func (s *importServiceImpl) ImportAccounts(ctx context.Context, request model.AccountImportRequest, body io.Reader, validate AccountValidator) (model.AccountImportResponse, error) {
+	if request.Format == "" {
+		request.Format = IMPORT_FORMAT_NDJSON
+	}
+
+	if request.OnConflict == "" {
+		request.OnConflict = ON_CONFLICT_SKIP
+	}
+
+	var source importer.Source
+	switch request.Format {
+	case IMPORT_FORMAT_CSV:
+		source = importer.CSVSource(body)
+	default:
+		source = importer.JSONSource(body)
+	}
+
+	im, err := importer.New(s.writer, importer.Options{
+		Mode:   importModes[request.OnConflict],
+		DryRun: request.DryRun,
+		Report: true,
+		Validate: func(account entity.Account) []model.ErrorDetail {
+			return validate(model.AccountCreateRequest{
+				AccountID: account.AccountID,
+				Limit:     account.Limit,
+				Products:  account.Products,
+			})
+		},
+	})
+	if err != nil {
+		return model.AccountImportResponse{}, &ParamError{Field: "on_conflict", Rule: "oneof", Message: err.Error()}
+	}
+
+	summary, err := im.ImportSource(ctx, source)
+
+	response := model.AccountImportResponse{
+		DryRun:     request.DryRun,
+		OnConflict: request.OnConflict,
+		Inserted:   summary.Inserted,
+		Updated:    summary.Updated,
+		Skipped:    summary.Skipped,
+		Invalid:    summary.Invalid,
+		Rows:       make([]model.AccountImportRow, len(summary.Rows)),
+	}
+	for i, row := range summary.Rows {
+		response.Rows[i] = model.AccountImportRow{
+			Line:      row.Line,
+			AccountID: row.AccountID,
+			Status:    row.Status,
+			Errors:    row.Errors,
+		}
+	}
+
+	switch {
+	case err == nil:
+		return response, nil
+	case errors.Is(err, importer.ErrConflict):
+		return response, errs.Wrap(errs.Conflict, "import stopped on existing account", err)
+	case errors.Is(err, importer.ErrRejected):
+		return response, errs.Wrap(errs.InvalidArgument, "import stopped on rejected row", err)
+	case errors.Is(err, importer.ErrInput):
+		return response, &ParamError{Field: "body", Rule: request.Format, Message: err.Error()}
+	}
+
+	return response, err
+}
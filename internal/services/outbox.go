@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/publisher"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// outboxLeaseTTL is how long a relay keep publishing after it last renewed its lease, another instance take over after
+	outboxLeaseTTL = 30 * time.Second
+
+	// outboxPublishTimeout bound one publish, a hanging destination must not hold the lease forever. It is well below
+	// outboxLeaseTTL so a publish started under the lease end before another instance can take it.
+	outboxPublishTimeout = 10 * time.Second
+)
+
+// recorder keep the history and outbox records of account changes and publish them, it is shared by every service
+// changing accounts so none of them bypass the history or the outbox
+type recorder struct {
+	history repositories.HistoryRepository
+	outbox  repositories.OutboxRepository
+	events  repositories.EventBus
+}
+
+func newRecorder(history repositories.HistoryRepository, outbox repositories.OutboxRepository, events repositories.EventBus) recorder {
+	return recorder{
+		history: history,
+		outbox:  outbox,
+		events:  events,
+	}
+}
+
+// record append the history records of a change and their outbox records, caller pass the ctx of its transaction
+// so both are written with the change or not at all
+func (s recorder) record(ctx context.Context, records ...entity.AccountHistory) error {
+	if err := s.history.Append(ctx, records...); err != nil {
+		return err
+	}
+
+	outbox := make([]entity.OutboxRecord, len(records))
+	for i, record := range records {
+		outbox[i] = entity.OutboxRecord{
+			Type:      record.Action,
+			AccountID: record.AccountID,
+			Version:   record.Version,
+			Account:   record.Account,
+			At:        record.At,
+		}
+	}
+
+	return s.outbox.Append(ctx, outbox...)
+}
+
+// OutboxRelay publish the account events written to the outbox
+type OutboxRelay interface {
+	// Run publish pending events every interval until ctx is cancelled
+	Run(ctx context.Context)
+}
+
+type outboxRelayImpl struct {
+	outbox      repositories.OutboxRepository
+	publisher   publisher.Publisher
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	owner       string
+}
+
+// NewOutboxRelay create a relay publishing events of outbox with publisher. Only the instance holding the outbox lease
+// publish, so events of an account are published in the order they were written. An event is removed once published,
+// an event whose publish or removal failed is published again later, so consumers may get it more than once.
+// An event failing maxAttempts times is dead, it is kept in the outbox and the later events of its account go on.
+func NewOutboxRelay(outbox repositories.OutboxRepository, publisher publisher.Publisher, interval time.Duration, batchSize int, maxAttempts int) OutboxRelay {
+	hostname, _ := os.Hostname()
+
+	return &outboxRelayImpl{
+		outbox:      outbox,
+		publisher:   publisher,
+		interval:    interval,
+		batchSize:   batchSize,
+		maxAttempts: maxAttempts,
+		owner:       fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+	}
+}
+
+// Run implements OutboxRelay.
+func (r *outboxRelayImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.drain(ctx); err != nil && ctx.Err() == nil {
+			log.Err(err).Msg("failed to relay outbox events")
+		}
+	}
+}
+
+// drain publish batches until no pending event is left but those of accounts blocked by a failed event, they are
+// retried on the next tick
+func (r *outboxRelayImpl) drain(ctx context.Context) error {
+	blocked := make(map[int]bool)
+	for {
+		full, err := r.relay(ctx, blocked)
+		if err != nil || !full {
+			return err
+		}
+	}
+}
+
+// relay publish one batch of pending events of accounts not blocked and report whether the batch was full. An account
+// whose event failed is blocked so its later events wait and keep their order, other accounts go on.
+func (r *outboxRelayImpl) relay(ctx context.Context, blocked map[int]bool) (bool, error) {
+	leased, err := r.outbox.Lease(ctx, r.owner, outboxLeaseTTL)
+	if err != nil || !leased {
+		return false, err
+	}
+
+	skip := make([]int, 0, len(blocked))
+	for accountID := range blocked {
+		skip = append(skip, accountID)
+	}
+
+	records, err := r.outbox.Pending(ctx, r.batchSize, skip)
+	if err != nil {
+		return false, err
+	}
+
+	for _, record := range records {
+		if blocked[record.AccountID] {
+			continue
+		}
+
+		// the lease outlive the publish timeout, renewed right before a publish it is still ours once the publish end
+		leased, err := r.outbox.Lease(ctx, r.owner, outboxLeaseTTL)
+		if err != nil || !leased {
+			return false, err
+		}
+
+		if err := r.publish(ctx, record); err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+
+			attempts := record.Attempts + 1
+			dead := attempts >= r.maxAttempts
+			if err := r.outbox.MarkFailed(ctx, r.owner, record.ID, err.Error(), dead); err != nil {
+				return false, err
+			}
+
+			if dead {
+				log.Error().Err(err).
+					Str("event_id", record.ID.Hex()).
+					Int("account_id", record.AccountID).
+					Int("attempts", attempts).
+					Msg("outbox event is dead after too many failed publishes")
+				continue
+			}
+
+			blocked[record.AccountID] = true
+			log.Warn().Err(err).
+				Str("event_id", record.ID.Hex()).
+				Int("account_id", record.AccountID).
+				Int("attempts", attempts).
+				Msg("failed to publish outbox event")
+			continue
+		}
+
+		if err := r.outbox.MarkPublished(ctx, r.owner, record.ID); err != nil {
+			return false, err
+		}
+	}
+
+	return len(records) == r.batchSize, nil
+}
+
+// publish send record as the account event watchers get, with the record id as event id
+func (r *outboxRelayImpl) publish(ctx context.Context, record entity.OutboxRecord) error {
+	event := newAccountEvent(entity.AccountEvent{
+		ID:        record.ID.Hex(),
+		Type:      record.Type,
+		AccountID: record.AccountID,
+		Version:   record.Version,
+		Account:   record.Account,
+		At:        record.At,
+	})
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+	defer cancel()
+
+	return r.publisher.Publish(ctxTimeout, publisher.Message{
+		ID:        event.ID,
+		AccountID: record.AccountID,
+		Type:      record.Type,
+		Data:      data,
+	})
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/publisher"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// failingPublisher refuse the events down report and keep the others
+type failingPublisher struct {
+	publisher.MemoryPublisher
+	down func(event model.AccountEvent) bool
+}
+
+func (p failingPublisher) Publish(ctx context.Context, message publisher.Message) error {
+	var event model.AccountEvent
+	if err := json.Unmarshal(message.Data, &event); err != nil {
+		return err
+	}
+
+	if p.down(event) {
+		return errors.New("destination is down")
+	}
+
+	return p.MemoryPublisher.Publish(ctx, message)
+}
+
+// newTestRelay is a relay over a memory outbox holding an update of every account:version of events
+func newTestRelay(t *testing.T, maxAttempts int, down func(event model.AccountEvent) bool, events ...string) (*outboxRelayImpl, repositories.OutboxRepository, publisher.MemoryPublisher) {
+	t.Helper()
+
+	outbox := repositories.NewMemoryOutbox()
+	for _, event := range events {
+		var record entity.OutboxRecord
+		if _, err := fmt.Sscanf(event, "%d:%d", &record.AccountID, &record.Version); err != nil {
+			t.Fatal(err)
+		}
+		record.Type = HISTORY_ACTION_UPDATED
+		record.At = time.Now()
+
+		if err := outbox.Append(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pub := publisher.NewMemory()
+	relay := NewOutboxRelay(outbox, failingPublisher{MemoryPublisher: pub, down: down}, time.Hour, 2, maxAttempts)
+
+	return relay.(*outboxRelayImpl), outbox, pub
+}
+
+// publishedEvents list account:version of the published events in publish order
+func publishedEvents(t *testing.T, pub publisher.MemoryPublisher) string {
+	t.Helper()
+
+	var events []string
+	for _, message := range pub.Messages() {
+		var event model.AccountEvent
+		if err := json.Unmarshal(message.Data, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, fmt.Sprintf("%d:%d", event.AccountID, event.Version))
+	}
+
+	return strings.Join(events, ",")
+}
+
+func TestRelaySkipBlockedAccount(t *testing.T) {
+	ctx := context.Background()
+	down := func(event model.AccountEvent) bool { return event.AccountID == 1 }
+	relay, outbox, pub := newTestRelay(t, 10, down, "1:1", "2:1", "1:2", "3:1", "2:2", "3:2")
+
+	if err := relay.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// account 1 is at the head of every batch, the other accounts still go out in order
+	if got := publishedEvents(t, pub); got != "2:1,2:2,3:1,3:2" {
+		t.Errorf("published %s, want 2:1,2:2,3:1,3:2", got)
+	}
+
+	pending, err := outbox.Pending(ctx, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Version != 1 || pending[0].Attempts != 1 || pending[1].Attempts != 0 {
+		t.Errorf("pending = %+v, want both events of account 1 with one attempt on the first", pending)
+	}
+}
+
+func TestRelayDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	down := func(event model.AccountEvent) bool { return event.AccountID == 1 && event.Version == 1 }
+	relay, outbox, pub := newTestRelay(t, 2, down, "1:1", "1:2")
+
+	for i := 0; i < 2; i++ {
+		if err := relay.drain(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first event is dead after its second attempt, the next one is not held back any longer
+	if got := publishedEvents(t, pub); got != "1:2" {
+		t.Errorf("published %s, want 1:2", got)
+	}
+
+	pending, err := outbox.Pending(ctx, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending = %+v, want none", pending)
+	}
+}
+
+func TestRelayDeadLetterFanout(t *testing.T) {
+	ctx := context.Background()
+	relay, outbox, broker := newTestRelay(t, 2, func(event model.AccountEvent) bool { return true }, "1:1")
+	webhooks := publisher.NewMemory()
+	relay.publisher = publisher.NewFanout(relay.publisher, webhooks)
+
+	for i := 0; i < 2; i++ {
+		if err := relay.drain(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the event is dead on the broker, webhooks got it on the first attempt and not again
+	if got := publishedEvents(t, broker); got != "" {
+		t.Errorf("broker got %s, want nothing", got)
+	}
+	if got := publishedEvents(t, webhooks); got != "1:1" {
+		t.Errorf("webhooks got %s, want 1:1", got)
+	}
+
+	pending, err := outbox.Pending(ctx, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending = %+v, want none", pending)
+	}
+}
+
+func TestRelayWithoutLease(t *testing.T) {
+	ctx := context.Background()
+	relay, outbox, pub := newTestRelay(t, 10, func(model.AccountEvent) bool { return false }, "1:1")
+
+	if leased, err := outbox.Lease(ctx, "other", time.Minute); err != nil || !leased {
+		t.Fatalf("lease = %v, %v", leased, err)
+	}
+
+	if err := relay.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := publishedEvents(t, pub); got != "" {
+		t.Errorf("published %s without the lease", got)
+	}
+
+	// a relay that lost the lease can not remove what it published
+	pending, err := outbox.Pending(ctx, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.MarkPublished(ctx, relay.owner, pending[0].ID); err == nil {
+		t.Error("record marked published without the lease")
+	}
+}
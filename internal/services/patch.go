@@ -0,0 +1,540 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// RFC 6902 operations
+const (
+	PATCH_OP_ADD     string = "add"
+	PATCH_OP_REMOVE  string = "remove"
+	PATCH_OP_REPLACE string = "replace"
+	PATCH_OP_MOVE    string = "move"
+	PATCH_OP_COPY    string = "copy"
+	PATCH_OP_TEST    string = "test"
+)
+
+// update operators a merge patch is translated into
+const (
+	operatorSet   = "$set"
+	operatorUnset = "$unset"
+)
+
+// patchBuilder collect merge patch members into one repository patch, rejecting members that
+// can not be applied together by a single update
+type patchBuilder struct {
+	accountID int
+	patch     repositories.AccountPatch
+	touched   []touchedPath
+}
+
+type touchedPath struct {
+	path     string
+	operator string
+}
+
+func newPatchBuilder(accountID int) *patchBuilder {
+	return &patchBuilder{
+		accountID: accountID,
+		patch: repositories.AccountPatch{
+			Set: make(map[string]interface{}),
+		},
+	}
+}
+
+// buildMergePatch translate RFC 7396 merge patch, null remove a field and any other value replace it
+func buildMergePatch(accountID int, doc map[string]json.RawMessage) (repositories.AccountPatch, error) {
+	b := newPatchBuilder(accountID)
+
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		raw := doc[key]
+		remove := isJSONNull(raw)
+
+		var err error
+		switch {
+		case key == "account_id":
+			err = keepAccountID(b.accountID, key, raw)
+		case remove && (key == "limit" || key == "products"):
+			err = b.unset(key)
+		case key == "limit" || key == "products":
+			err = b.setField(key, key, raw)
+		default:
+			err = &ParamError{Field: key, Rule: "unknown", Message: fmt.Sprintf("%s is not an account field", key)}
+		}
+
+		if err != nil {
+			return repositories.AccountPatch{}, err
+		}
+	}
+
+	return b.patch, nil
+}
+
+func (b *patchBuilder) setField(pointer, field string, raw json.RawMessage) error {
+	var value interface{}
+	var err error
+	if field == "limit" {
+		value, err = decodeLimit(pointer, raw)
+	} else {
+		value, err = decodeProducts(pointer, raw)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.touch(field, operatorSet); err != nil {
+		return err
+	}
+
+	b.patch.Set[field] = value
+	return nil
+}
+
+func (b *patchBuilder) unset(field string) error {
+	if err := b.touch(field, operatorUnset); err != nil {
+		return err
+	}
+
+	b.patch.Unset = append(b.patch.Unset, field)
+	return nil
+}
+
+// keepAccountID accept account_id only when it is unchanged
+func keepAccountID(accountID int, pointer string, raw json.RawMessage) error {
+	var value int
+	if err := json.Unmarshal(raw, &value); err != nil || value != accountID {
+		return &ParamError{Field: pointer, Rule: "immutable", Message: "account_id can not be changed"}
+	}
+
+	return nil
+}
+
+// touch record that path is changed by operator, a single update can not change overlapping paths
+// with different operators
+func (b *patchBuilder) touch(path, operator string) error {
+	for _, t := range b.touched {
+		if !pathsOverlap(t.path, path) {
+			continue
+		}
+
+		if t.operator != operator || t.path != path {
+			return &ParamError{
+				Field:   path,
+				Rule:    "conflict",
+				Message: fmt.Sprintf("%s is changed by more than one kind of operation", path),
+			}
+		}
+	}
+
+	b.touched = append(b.touched, touchedPath{path: path, operator: operator})
+	return nil
+}
+
+// jsonPatchStep is a checked RFC 6902 operation, value is decoded for the type of path
+type jsonPatchStep struct {
+	op      string
+	pointer string
+	path    patchPath
+	from    patchPath
+	value   interface{}
+}
+
+// patchPath is an account field and, for products, an array index or "-"
+type patchPath struct {
+	field string
+	index string
+}
+
+// kind is the type of the value at path, a value moved or copied must keep it
+func (p patchPath) kind() string {
+	switch {
+	case p.field == "products" && p.index != "":
+		return "string"
+	case p.field == "products":
+		return "array"
+	}
+
+	return "number"
+}
+
+// buildJSONPatch check RFC 6902 operations without the account, so a malformed patch is refused whatever the account hold.
+// Operations are applied in order to the stored account by applyJSONPatch.
+func buildJSONPatch(accountID int, ops []model.PatchOperation) ([]jsonPatchStep, error) {
+	steps := make([]jsonPatchStep, len(ops))
+	for i, op := range ops {
+		step, err := checkJSONPatchOp(accountID, op)
+		if err != nil {
+			var paramErr *ParamError
+			if errors.As(err, &paramErr) {
+				paramErr.Message = fmt.Sprintf("operation %d: %s", i, paramErr.Message)
+			}
+			return nil, err
+		}
+
+		steps[i] = step
+	}
+
+	return steps, nil
+}
+
+func checkJSONPatchOp(accountID int, op model.PatchOperation) (jsonPatchStep, error) {
+	step := jsonPatchStep{op: op.Op, pointer: op.Path}
+
+	var err error
+	step.path.field, step.path.index, err = parsePointer(op.Path)
+	if err != nil {
+		return step, err
+	}
+
+	immutable := &ParamError{Field: op.Path, Rule: "immutable", Message: "account_id can not be changed"}
+
+	switch op.Op {
+	case PATCH_OP_ADD, PATCH_OP_REPLACE:
+		if step.path.field == "account_id" {
+			step.value = accountID
+			return step, keepAccountID(accountID, op.Path, op.Value)
+		}
+		if op.Op == PATCH_OP_REPLACE && step.path.index == "-" {
+			return step, pointerError(op.Path, "replace need an existing index")
+		}
+		step.value, err = decodePatchValue(op.Path, step.path, op.Value)
+	case PATCH_OP_TEST:
+		if step.path.index == "-" {
+			return step, pointerError(op.Path, "test need an existing index")
+		}
+		step.value, err = decodePatchValue(op.Path, step.path, op.Value)
+	case PATCH_OP_REMOVE:
+		switch {
+		case step.path.field == "account_id":
+			return step, immutable
+		case step.path.index == "-":
+			return step, pointerError(op.Path, "remove need an existing index")
+		}
+	case PATCH_OP_MOVE, PATCH_OP_COPY:
+		step.from.field, step.from.index, err = parsePointer(op.From)
+		switch {
+		case err != nil:
+			var paramErr *ParamError
+			if errors.As(err, &paramErr) {
+				paramErr.Field = "from"
+			}
+		case step.path.field == "account_id", op.Op == PATCH_OP_MOVE && step.from.field == "account_id":
+			return step, immutable
+		case step.from.index == "-":
+			return step, &ParamError{Field: "from", Rule: "path", Message: "from need an existing index"}
+		case step.from.kind() != step.path.kind():
+			return step, &ParamError{Field: "from", Rule: "type", Message: fmt.Sprintf("a %s can not be put at %s", step.from.kind(), op.Path)}
+		}
+	default:
+		return step, &ParamError{Field: "op", Rule: "oneof", Message: fmt.Sprintf("op %q is invalid", op.Op)}
+	}
+
+	return step, err
+}
+
+func decodePatchValue(pointer string, path patchPath, raw json.RawMessage) (interface{}, error) {
+	switch path.kind() {
+	case "string":
+		return decodeProduct(pointer, raw)
+	case "array":
+		return decodeProducts(pointer, raw)
+	}
+
+	if path.field == "limit" {
+		return decodeLimit(pointer, raw)
+	}
+
+	var accountID int
+	if err := json.Unmarshal(raw, &accountID); err != nil || isJSONNull(raw) {
+		return nil, &ParamError{Field: pointer, Rule: "number", Message: "account_id must be a whole number"}
+	}
+
+	return accountID, nil
+}
+
+// applyJSONPatch apply steps in order to a copy of account, a failed test fail the whole patch.
+// A removed limit is zero and removed products are nil, like a merge patch removing them.
+func applyJSONPatch(account entity.Account, steps []jsonPatchStep) (entity.Account, error) {
+	doc := jsonPatchDocument{
+		"account_id": account.AccountID,
+		"limit":      account.Limit,
+		"products":   append([]string{}, account.Products...),
+	}
+
+	for _, step := range steps {
+		if err := doc.apply(step); err != nil {
+			return entity.Account{}, err
+		}
+	}
+
+	account.Limit, _ = doc["limit"].(int)
+	account.Products, _ = doc["products"].([]string)
+
+	return account, nil
+}
+
+// jsonPatchUpdate translate the change from before to after into a targeted patch. Appended products are pushed and
+// removed ones pulled at their index, a product held twice can not be pulled alone so any other change replace products.
+func jsonPatchUpdate(before, after entity.Account) repositories.AccountPatch {
+	patch := repositories.AccountPatch{Set: make(map[string]interface{})}
+
+	switch {
+	case after.Limit == before.Limit:
+	case after.Limit == 0:
+		patch.Unset = append(patch.Unset, "limit")
+	default:
+		patch.Set["limit"] = after.Limit
+	}
+
+	switch {
+	case after.Products == nil && before.Products != nil:
+		patch.Unset = append(patch.Unset, "products")
+	case sameProducts(after.Products, before.Products):
+	case len(after.Products) > len(before.Products) && sameProducts(after.Products[:len(before.Products)], before.Products):
+		patch.Push = append([]string{}, after.Products[len(before.Products):]...)
+	default:
+		if pull, ok := productsPulled(before.Products, after.Products); ok {
+			patch.Pull = pull
+		} else {
+			patch.Set["products"] = after.Products
+		}
+	}
+
+	return patch
+}
+
+// productsPulled return the products removed from before to get after by their index in before, it fails when after
+// is not before with some products left out or a removed product is held more than once
+func productsPulled(before, after []string) (map[int]string, bool) {
+	held := make(map[string]int, len(before))
+	for _, product := range before {
+		held[product]++
+	}
+
+	pulled := make(map[int]string)
+	j := 0
+	for i, product := range before {
+		if j < len(after) && after[j] == product {
+			j++
+			continue
+		}
+
+		if held[product] > 1 {
+			return nil, false
+		}
+		pulled[i] = product
+	}
+
+	return pulled, j == len(after)
+}
+
+// jsonPatchDocument is an account the way JSON Patch see it, a removed field is absent
+type jsonPatchDocument map[string]interface{}
+
+func (d jsonPatchDocument) apply(step jsonPatchStep) error {
+	switch step.op {
+	case PATCH_OP_ADD:
+		return d.add(step.path, step.value)
+	case PATCH_OP_REMOVE:
+		_, err := d.remove(step.path)
+		return err
+	case PATCH_OP_REPLACE:
+		if _, err := d.remove(step.path); err != nil {
+			return err
+		}
+		return d.add(step.path, step.value)
+	case PATCH_OP_MOVE:
+		if step.from == step.path {
+			return nil
+		}
+		value, err := d.remove(step.from)
+		if err != nil {
+			return err
+		}
+		return d.add(step.path, value)
+	case PATCH_OP_COPY:
+		value, ok := d.get(step.from)
+		if !ok {
+			return errPatchPathMissing
+		}
+		if products, ok := value.([]string); ok {
+			value = append([]string{}, products...)
+		}
+		return d.add(step.path, value)
+	case PATCH_OP_TEST:
+		value, ok := d.get(step.path)
+		if !ok || !reflect.DeepEqual(value, step.value) {
+			return repositories.ErrPatchTestFailed
+		}
+	}
+
+	return nil
+}
+
+func (d jsonPatchDocument) get(path patchPath) (interface{}, bool) {
+	value, ok := d[path.field]
+	if !ok || path.index == "" {
+		return value, ok
+	}
+
+	products := value.([]string)
+	n, _ := strconv.Atoi(path.index)
+	if n >= len(products) {
+		return nil, false
+	}
+
+	return products[n], true
+}
+
+// add set a field or insert a product before index, "-" append it
+func (d jsonPatchDocument) add(path patchPath, value interface{}) error {
+	if path.index == "" {
+		d[path.field] = value
+		return nil
+	}
+
+	products, ok := d["products"].([]string)
+	if !ok {
+		return errPatchPathMissing
+	}
+
+	n := len(products)
+	if path.index != "-" {
+		n, _ = strconv.Atoi(path.index)
+	}
+	if n > len(products) {
+		return errPatchPathMissing
+	}
+
+	inserted := append([]string{}, products[:n]...)
+	inserted = append(inserted, value.(string))
+	d["products"] = append(inserted, products[n:]...)
+	return nil
+}
+
+// remove delete the value at path and return it
+func (d jsonPatchDocument) remove(path patchPath) (interface{}, error) {
+	value, ok := d.get(path)
+	if !ok {
+		return nil, errPatchPathMissing
+	}
+
+	if path.index == "" {
+		delete(d, path.field)
+		return value, nil
+	}
+
+	products := d["products"].([]string)
+	n, _ := strconv.Atoi(path.index)
+	d["products"] = append(append([]string{}, products[:n]...), products[n+1:]...)
+	return value, nil
+}
+
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// parsePointer split JSON pointer into account field and array index, index is empty when there is none
+func parsePointer(pointer string) (string, string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return "", "", pointerError(pointer, "path must start with /")
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	field := tokens[0]
+	switch {
+	case field != "account_id" && field != "limit" && field != "products":
+		return "", "", pointerError(pointer, fmt.Sprintf("%s is not an account field", field))
+	case len(tokens) == 1:
+		return field, "", nil
+	case len(tokens) > 2 || field != "products":
+		return "", "", pointerError(pointer, "only products can be indexed")
+	}
+
+	index := tokens[1]
+	if index == "-" {
+		return field, index, nil
+	}
+
+	// array index has no sign and no leading zero
+	if n, err := strconv.Atoi(index); err != nil || n < 0 || strconv.Itoa(n) != index {
+		return "", "", pointerError(pointer, fmt.Sprintf("%s is not an array index", index))
+	}
+
+	return field, index, nil
+}
+
+func pointerError(pointer, message string) *ParamError {
+	return &ParamError{Field: pointer, Rule: "path", Message: message}
+}
+
+func decodeLimit(pointer string, raw json.RawMessage) (int, error) {
+	var limit int
+	if err := json.Unmarshal(raw, &limit); err != nil || isJSONNull(raw) {
+		return 0, &ParamError{Field: pointer, Rule: "number", Message: "limit must be a whole number"}
+	}
+
+	if limit == 0 {
+		return 0, &ParamError{Field: pointer, Rule: "required", Message: "limit must not be zero"}
+	}
+
+	return limit, nil
+}
+
+func decodeProducts(pointer string, raw json.RawMessage) ([]string, error) {
+	var products []string
+	if err := json.Unmarshal(raw, &products); err != nil || products == nil {
+		return nil, &ParamError{Field: pointer, Rule: "array", Message: "products must be an array of strings"}
+	}
+
+	return products, nil
+}
+
+func decodeProduct(pointer string, raw json.RawMessage) (string, error) {
+	var product string
+	if err := json.Unmarshal(raw, &product); err != nil || strings.TrimSpace(product) == "" {
+		return "", &ParamError{Field: pointer, Rule: "required", Message: "product must be a non empty string"}
+	}
+
+	return product, nil
+}
+
+func isJSONNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+}
+
+// sameProducts report whether a and b hold the same products in the same order, nil and empty are the same
+func sameProducts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
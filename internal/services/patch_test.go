@@ -0,0 +1,258 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+func patchOps(t *testing.T, doc string) []model.PatchOperation {
+	t.Helper()
+
+	var ops []model.PatchOperation
+	if err := json.Unmarshal([]byte(doc), &ops); err != nil {
+		t.Fatalf("unmarshal %s: %v", doc, err)
+	}
+
+	return ops
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	account := entity.Account{AccountID: 7, Limit: 10, Products: []string{"a", "b", "c"}, Version: 3}
+
+	tests := []struct {
+		name     string
+		ops      string
+		limit    int
+		products []string
+		err      error
+	}{
+		{
+			name:     "remove by index without test",
+			ops:      `[{"op":"remove","path":"/products/1"}]`,
+			limit:    10,
+			products: []string{"a", "c"},
+		},
+		{
+			name:     "test after a change see the change",
+			ops:      `[{"op":"replace","path":"/limit","value":20},{"op":"test","path":"/limit","value":20}]`,
+			limit:    20,
+			products: []string{"a", "b", "c"},
+		},
+		{
+			name:     "indexes shift after an earlier add",
+			ops:      `[{"op":"add","path":"/products/0","value":"z"},{"op":"remove","path":"/products/1"}]`,
+			limit:    10,
+			products: []string{"z", "b", "c"},
+		},
+		{
+			name:     "move",
+			ops:      `[{"op":"move","from":"/products/0","path":"/products/-"}]`,
+			limit:    10,
+			products: []string{"b", "c", "a"},
+		},
+		{
+			name:     "copy",
+			ops:      `[{"op":"copy","from":"/products/2","path":"/products/0"}]`,
+			limit:    10,
+			products: []string{"c", "a", "b", "c"},
+		},
+		{
+			name:     "remove field",
+			ops:      `[{"op":"remove","path":"/products"}]`,
+			limit:    10,
+			products: nil,
+		},
+		{
+			name: "failed test",
+			ops:  `[{"op":"test","path":"/products/0","value":"b"}]`,
+			err:  repositories.ErrPatchTestFailed,
+		},
+		{
+			name: "index past the end",
+			ops:  `[{"op":"remove","path":"/products/3"}]`,
+			err:  errPatchPathMissing,
+		},
+		{
+			name: "add to removed products",
+			ops:  `[{"op":"remove","path":"/products"},{"op":"add","path":"/products/-","value":"a"}]`,
+			err:  errPatchPathMissing,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			steps, err := buildJSONPatch(account.AccountID, patchOps(t, test.ops))
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+
+			got, err := applyJSONPatch(account, steps)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("err = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			if got.Limit != test.limit || !reflect.DeepEqual(got.Products, test.products) {
+				t.Errorf("got limit %d products %v, want %d %v", got.Limit, got.Products, test.limit, test.products)
+			}
+			if got.AccountID != account.AccountID || got.Version != account.Version {
+				t.Errorf("account_id and version changed: %+v", got)
+			}
+			if !reflect.DeepEqual(account.Products, []string{"a", "b", "c"}) {
+				t.Errorf("the read account was changed: %v", account.Products)
+			}
+		})
+	}
+}
+
+func TestBuildJSONPatchRejectMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  string
+	}{
+		{name: "unknown op", ops: `[{"op":"merge","path":"/limit"}]`},
+		{name: "unknown field", ops: `[{"op":"add","path":"/name","value":"x"}]`},
+		{name: "account_id change", ops: `[{"op":"replace","path":"/account_id","value":8}]`},
+		{name: "account_id move", ops: `[{"op":"move","from":"/account_id","path":"/limit"}]`},
+		{name: "type change", ops: `[{"op":"move","from":"/products/0","path":"/limit"}]`},
+		{name: "zero limit", ops: `[{"op":"replace","path":"/limit","value":0}]`},
+		{name: "replace end", ops: `[{"op":"replace","path":"/products/-","value":"x"}]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := buildJSONPatch(7, patchOps(t, test.ops))
+			if errs.KindOf(err) != errs.InvalidArgument {
+				t.Errorf("err = %v, want an invalid argument", err)
+			}
+		})
+	}
+}
+
+func TestJSONPatchUpdate(t *testing.T) {
+	account := entity.Account{AccountID: 7, Limit: 10, Products: []string{"a", "b", "c"}, Version: 3}
+
+	tests := []struct {
+		name  string
+		ops   string
+		patch repositories.AccountPatch
+	}{
+		{
+			name:  "only tests",
+			ops:   `[{"op":"test","path":"/limit","value":10}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{}},
+		},
+		{
+			name:  "append",
+			ops:   `[{"op":"add","path":"/products/-","value":"d"},{"op":"add","path":"/products/-","value":"e"}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{}, Push: []string{"d", "e"}},
+		},
+		{
+			name:  "remove by index",
+			ops:   `[{"op":"remove","path":"/products/1"}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{}, Pull: map[int]string{1: "b"}},
+		},
+		{
+			name:  "remove twice at the same index",
+			ops:   `[{"op":"remove","path":"/products/0"},{"op":"remove","path":"/products/0"}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{}, Pull: map[int]string{0: "a", 1: "b"}},
+		},
+		{
+			name:  "insert",
+			ops:   `[{"op":"add","path":"/products/0","value":"z"}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{"products": []string{"z", "a", "b", "c"}}},
+		},
+		{
+			name:  "append and remove",
+			ops:   `[{"op":"add","path":"/products/-","value":"d"},{"op":"remove","path":"/products/0"}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{"products": []string{"b", "c", "d"}}},
+		},
+		{
+			name:  "replace limit and remove products",
+			ops:   `[{"op":"replace","path":"/limit","value":20},{"op":"remove","path":"/products"}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{"limit": 20}, Unset: []string{"products"}},
+		},
+		{
+			name:  "remove limit",
+			ops:   `[{"op":"remove","path":"/limit"}]`,
+			patch: repositories.AccountPatch{Set: map[string]interface{}{}, Unset: []string{"limit"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			steps, err := buildJSONPatch(account.AccountID, patchOps(t, test.ops))
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+
+			after, err := applyJSONPatch(account, steps)
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			if patch := jsonPatchUpdate(account, after); !reflect.DeepEqual(patch, test.patch) {
+				t.Errorf("patch = %+v, want %+v", patch, test.patch)
+			}
+		})
+	}
+
+	// a product held twice can not be pulled alone, $pull would remove both
+	twice := entity.Account{AccountID: 7, Limit: 10, Products: []string{"a", "b", "a"}}
+	patch := jsonPatchUpdate(twice, entity.Account{AccountID: 7, Limit: 10, Products: []string{"b", "a"}})
+	if len(patch.Pull) != 0 || !reflect.DeepEqual(patch.Set["products"], []string{"b", "a"}) {
+		t.Errorf("patch removing a product held twice = %+v, want products replaced", patch)
+	}
+}
+
+// racingPatchRepository lose every patch to another writer that bump the version just before it
+type racingPatchRepository struct {
+	repositories.Repository
+}
+
+func (r racingPatchRepository) Patch(ctx context.Context, accountID int, patch repositories.AccountPatch) (entity.Account, error) {
+	if _, err := r.Repository.Patch(ctx, accountID, repositories.AccountPatch{Set: map[string]interface{}{"limit": 30}}); err != nil {
+		return entity.Account{}, err
+	}
+
+	return r.Repository.Patch(ctx, accountID, patch)
+}
+
+func TestJSONPatchLosingRace(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorage()
+	storage.repo = racingPatchRepository{Repository: storage.repo}
+	service := storage.service()
+
+	if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := patchOps(t, `[{"op":"add","path":"/products/-","value":"b"}]`)
+
+	// without If-Match a lost race is a conflict, with it a failed precondition
+	if _, err := service.JSONPatchAccount(ctx, 1, ops, nil); !errors.Is(err, errChangeContended) {
+		t.Errorf("err = %v, want %v", err, errChangeContended)
+	}
+
+	account, err := storage.repo.GetByAccountID(ctx, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.JSONPatchAccount(ctx, 1, ops, model.IfMatch{account.Version}); !errors.Is(err, repositories.ErrVersionMismatch) {
+		t.Errorf("err with If-Match = %v, want %v", err, repositories.ErrVersionMismatch)
+	}
+}
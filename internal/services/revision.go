@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/errs"
+	"github.com/Armunz/learn-mongodb/internal/model"
+)
+
+// getAccountAsOf rebuild the account from its revision at request.AsOf, an account deleted at that time is not found
+// unless deleted accounts are included
+func (s *serviceImpl) getAccountAsOf(ctx context.Context, accountID int, request model.AccountDetailRequest) (model.AccountResponse, error) {
+	at, err := parseTime("as_of", request.AsOf)
+	if err != nil {
+		return model.AccountResponse{}, err
+	}
+
+	record, err := s.revisionAt(ctx, accountID, at)
+	if err != nil {
+		return model.AccountResponse{}, err
+	}
+
+	if record.Account.DeletedAt != nil && !request.IncludeDeleted {
+		return model.AccountResponse{}, errDeletedAsOf
+	}
+
+	return newAccountResponse(*record.Account), nil
+}
+
+// GetAccountDiff implements Service.
+// from and to are resolved to the revisions at those times, to default to now. from may be after to.
+func (s *serviceImpl) GetAccountDiff(ctx context.Context, accountID int, request model.AccountDiffRequest) (model.AccountDiffResponse, error) {
+	from, err := parseTime("from", request.From)
+	if err != nil {
+		return model.AccountDiffResponse{}, err
+	}
+
+	to := time.Now().UTC().Truncate(time.Millisecond)
+	if request.To != "" {
+		if to, err = parseTime("to", request.To); err != nil {
+			return model.AccountDiffResponse{}, err
+		}
+	}
+
+	// tell which of the two times has no revision
+	fromRecord, err := s.revisionAt(ctx, accountID, from)
+	if errs.Is(err, errs.NotFound) {
+		return model.AccountDiffResponse{}, errNoRevisionFrom
+	}
+	if err != nil {
+		return model.AccountDiffResponse{}, err
+	}
+
+	toRecord, err := s.revisionAt(ctx, accountID, to)
+	if errs.Is(err, errs.NotFound) {
+		return model.AccountDiffResponse{}, errNoRevisionTo
+	}
+	if err != nil {
+		return model.AccountDiffResponse{}, err
+	}
+
+	return model.AccountDiffResponse{
+		AccountID: accountID,
+		From:      newAccountRevision(from, fromRecord),
+		To:        newAccountRevision(to, toRecord),
+		Changes:   newFieldChanges(accountChanges(fromRecord.Account, toRecord.Account)),
+	}, nil
+}
+
+// revisionAt return the record of the account revision at at. Seeds and migrations change accounts without recording
+// them, such a change is seen as a stored version the last record does not have. The account at a time after the last
+// record is then unknown, unless a single change made after that time explain the stored version.
+func (s *serviceImpl) revisionAt(ctx context.Context, accountID int, at time.Time) (entity.AccountHistory, error) {
+	record, err := s.history.AsOf(ctx, accountID, at)
+	if err != nil {
+		return entity.AccountHistory{}, err
+	}
+
+	last, _, err := s.history.List(ctx, accountID, 1, 0)
+	if err != nil {
+		return entity.AccountHistory{}, err
+	}
+
+	// a later record exist, only changes after the last record are checked
+	if len(last) == 0 || last[0].At.After(at) {
+		return record, nil
+	}
+
+	stored, err := s.repo.GetByAccountID(ctx, accountID, true)
+	if errs.Is(err, errs.NotFound) {
+		if last[0].Action == HISTORY_ACTION_PURGED {
+			return record, nil
+		}
+
+		// purged without a record
+		return entity.AccountHistory{}, errRevisionNotRecorded
+	}
+	if err != nil {
+		return entity.AccountHistory{}, err
+	}
+
+	untracked := stored.Version != last[0].Version
+	if untracked && !(stored.Version == last[0].Version+1 && stored.UpdatedAt.After(at)) {
+		return entity.AccountHistory{}, errRevisionNotRecorded
+	}
+
+	return record, nil
+}
+
+func newAccountRevision(at time.Time, record entity.AccountHistory) model.AccountRevision {
+	return model.AccountRevision{
+		At:        at,
+		Version:   record.Version,
+		ChangedAt: record.At,
+	}
+}
+
+// parseTime parse a RFC 3339 time param
+func parseTime(field string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, &ParamError{
+			Field:   field,
+			Rule:    "required",
+			Message: field + " is required",
+		}
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, &ParamError{
+			Field:   field,
+			Rule:    "datetime",
+			Message: field + " must be a RFC 3339 time such as 2026-01-01T00:00:00Z",
+		}
+	}
+
+	return t.UTC(), nil
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"strings"
 
 	"github.com/Armunz/learn-mongodb/internal/entity"
@@ -11,20 +12,45 @@ import (
 
 type Service interface {
 	CreateAccount(ctx context.Context, request model.AccountCreateRequest) error
-	GetListAccount(ctx context.Context, request model.AccountListRequest) ([]model.AccountResponse, int64, int64, error)
-	GetAccountDetail(ctx context.Context, accountID int) (model.AccountResponse, error)
-	UpdateAccount(ctx context.Context, accountID int, request model.AccountUpdateRequest) error
-	DeleteAccount(ctx context.Context, accountID int) error
+	GetListAccount(ctx context.Context, request model.AccountListRequest) ([]model.AccountResponse, model.ResponsePage, error)
+	GetAccountDetail(ctx context.Context, accountID int, request model.AccountDetailRequest) (model.AccountResponse, error)
+	GetAccountDiff(ctx context.Context, accountID int, request model.AccountDiffRequest) (model.AccountDiffResponse, error)
+	UpdateAccount(ctx context.Context, accountID int, request model.AccountUpdateRequest, ifMatch model.IfMatch) (model.AccountResponse, error)
+	MergePatchAccount(ctx context.Context, accountID int, doc map[string]json.RawMessage, ifMatch model.IfMatch) (model.AccountResponse, error)
+	JSONPatchAccount(ctx context.Context, accountID int, ops []model.PatchOperation, ifMatch model.IfMatch) (model.AccountResponse, error)
+	AddProduct(ctx context.Context, accountID int, request model.AccountProductRequest, ifMatch model.IfMatch) (model.AccountProductsResponse, error)
+	RemoveProduct(ctx context.Context, accountID int, product string, ifMatch model.IfMatch) (model.AccountProductsResponse, error)
+	DeleteAccount(ctx context.Context, accountID int, ifMatch model.IfMatch) error
+	RestoreAccount(ctx context.Context, accountID int, ifMatch model.IfMatch) (model.AccountResponse, error)
+	ExportAccounts(request model.AccountListRequest) (AccountStream, error)
+	CreateMany(ctx context.Context, requests []model.AccountCreateRequest, ordered bool) ([]model.AccountBulkItem, error)
+	UpdateMany(ctx context.Context, requests []model.AccountBulkUpdateRequest, ordered bool) ([]model.AccountBulkItem, error)
+	DeleteMany(ctx context.Context, accountIDs []int, ordered bool) ([]model.AccountBulkItem, error)
+	Bulk(ctx context.Context, request model.AccountBulkRequest, validate BulkValidator) (model.AccountBulkResponse, error)
+	GetAccountHistory(ctx context.Context, accountID int, request model.AccountHistoryRequest) ([]model.AccountHistoryResponse, model.ResponsePage, error)
+	WatchAccounts(ctx context.Context, request model.AccountEventsRequest, lastEventID string) (AccountEventFeed, error)
+	SubscribeAccounts(ctx context.Context) (AccountSubscription, error)
 }
 
+// AccountStream send accounts to fn one by one until done, fn error or ctx cancellation
+type AccountStream func(ctx context.Context, fn func(model.AccountResponse) error) error
+
+// serviceImpl record every create, update and delete in the account history and the outbox, along with the change
+// itself. Recorded changes are published to events once written, the outbox relay publish them outside the service.
 type serviceImpl struct {
+	recorder
 	repo         repositories.Repository
+	tx           repositories.Transactor
+	watcher      repositories.AccountWatcher
 	defaultLimit int
 }
 
-func NewService(repo repositories.Repository, defaultLimit int) Service {
+func NewService(repo repositories.Repository, history repositories.HistoryRepository, tx repositories.Transactor, outbox repositories.OutboxRepository, events repositories.EventBus, watcher repositories.AccountWatcher, defaultLimit int) Service {
 	return &serviceImpl{
+		recorder:     newRecorder(history, outbox, events),
 		repo:         repo,
+		tx:           tx,
+		watcher:      watcher,
 		defaultLimit: defaultLimit,
 	}
 }
@@ -37,32 +63,67 @@ func (s *serviceImpl) CreateAccount(ctx context.Context, request model.AccountCr
 		Products:  request.Products,
 	}
 
-	return s.repo.Create(ctx, account)
+	var record entity.AccountHistory
+	err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		created, err := s.repo.Create(ctx, account)
+		if err != nil {
+			return err
+		}
+
+		record = newHistory(ctx, HISTORY_ACTION_CREATED, nil, &created)
+		return s.record(ctx, record)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publish(record)
+
+	return nil
 }
 
 // DeleteAccount implements Service.
-func (s *serviceImpl) DeleteAccount(ctx context.Context, accountID int) error {
-	return s.repo.Delete(ctx, accountID)
+// The account is soft deleted by the actor of ctx, it can be restored until purged.
+func (s *serviceImpl) DeleteAccount(ctx context.Context, accountID int, ifMatch model.IfMatch) error {
+	_, err := s.change(ctx, accountID, HISTORY_ACTION_DELETED, ifMatch, func(ctx context.Context, before entity.Account) (entity.Account, error) {
+		return s.repo.Delete(ctx, accountID, before.Version, ActorFrom(ctx))
+	})
+
+	return err
 }
 
-// GetAccountDetail implements Service.
-func (s *serviceImpl) GetAccountDetail(ctx context.Context, accountID int) (model.AccountResponse, error) {
-	account, err := s.repo.GetByAccountID(ctx, accountID)
+// RestoreAccount implements Service.
+func (s *serviceImpl) RestoreAccount(ctx context.Context, accountID int, ifMatch model.IfMatch) (model.AccountResponse, error) {
+	account, err := s.change(ctx, accountID, HISTORY_ACTION_RESTORED, ifMatch, func(ctx context.Context, before entity.Account) (entity.Account, error) {
+		return s.repo.Restore(ctx, accountID, before.Version)
+	})
 	if err != nil {
 		return model.AccountResponse{}, err
 	}
 
-	response := model.AccountResponse{
-		AccountID: account.AccountID,
-		Limit:     account.Limit,
-		Products:  account.Products,
+	return newAccountResponse(account), nil
+}
+
+// GetAccountDetail implements Service.
+// With as_of the account is rebuilt from its revision at that time instead of read from the accounts.
+func (s *serviceImpl) GetAccountDetail(ctx context.Context, accountID int, request model.AccountDetailRequest) (model.AccountResponse, error) {
+	if request.AsOf != "" {
+		return s.getAccountAsOf(ctx, accountID, request)
 	}
 
+	account, err := s.repo.GetByAccountID(ctx, accountID, request.IncludeDeleted)
+	if err != nil {
+		return model.AccountResponse{}, err
+	}
+
+	response := newAccountResponse(account)
+
 	return response, nil
 }
 
 // GetListAccount implements Service.
-func (s *serviceImpl) GetListAccount(ctx context.Context, request model.AccountListRequest) ([]model.AccountResponse, int64, int64, error) {
+// Page is used for offset pagination, when cursor is given the page after the cursor is returned instead.
+func (s *serviceImpl) GetListAccount(ctx context.Context, request model.AccountListRequest) ([]model.AccountResponse, model.ResponsePage, error) {
 	limit := request.Limit
 	if limit == 0 {
 		limit = s.defaultLimit
@@ -73,14 +134,27 @@ func (s *serviceImpl) GetListAccount(ctx context.Context, request model.AccountL
 		offset = (request.Page - 1) * limit
 	}
 
-	orderBy, err := validateOrderByRequest(request.OrderBy)
+	sortFields, err := buildSort(request)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, model.ResponsePage{}, err
 	}
 
-	accounts, count, err := s.repo.List(ctx, request.Product, orderBy, limit, offset)
+	filter, err := buildFilter(request)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, model.ResponsePage{}, err
+	}
+
+	query := repositories.ListQuery{
+		Filter: filter,
+		Sort:   sortFields,
+		Limit:  limit,
+		Offset: offset,
+		Cursor: request.Cursor,
+	}
+
+	accounts, count, nextCursor, err := s.repo.List(ctx, query)
+	if err != nil {
+		return nil, model.ResponsePage{}, err
 	}
 
 	// count total pages
@@ -94,27 +168,134 @@ func (s *serviceImpl) GetListAccount(ctx context.Context, request model.AccountL
 
 	response := make([]model.AccountResponse, len(accounts))
 	for i, a := range accounts {
-		response[i] = model.AccountResponse{
-			AccountID: a.AccountID,
-			Limit:     a.Limit,
-			Products:  a.Products,
-		}
+		response[i] = newAccountResponse(a)
+	}
+
+	page := model.ResponsePage{
+		TotalData:  count,
+		TotalPage:  totalPages,
+		NextCursor: nextCursor,
+	}
+
+	return response, page, nil
+}
+
+// ExportAccounts implements Service.
+// Filters and sort are validated right away so errors can be reported before streaming starts,
+// pagination params are ignored.
+func (s *serviceImpl) ExportAccounts(request model.AccountListRequest) (AccountStream, error) {
+	sortFields, err := buildSort(request)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := buildFilter(request)
+	if err != nil {
+		return nil, err
 	}
 
-	return response, count, totalPages, nil
+	stream := func(ctx context.Context, fn func(model.AccountResponse) error) error {
+		return s.repo.Stream(ctx, filter, sortFields, func(a entity.Account) error {
+			return fn(newAccountResponse(a))
+		})
+	}
+
+	return stream, nil
 }
 
 // UpdateAccount implements Service.
-func (s *serviceImpl) UpdateAccount(ctx context.Context, accountID int, request model.AccountUpdateRequest) error {
-	account, err := s.repo.GetByAccountID(ctx, accountID)
+// limit and products are replaced in one write guarded by the version read for the history record.
+func (s *serviceImpl) UpdateAccount(ctx context.Context, accountID int, request model.AccountUpdateRequest, ifMatch model.IfMatch) (model.AccountResponse, error) {
+	account, err := s.change(ctx, accountID, HISTORY_ACTION_UPDATED, ifMatch, func(ctx context.Context, before entity.Account) (entity.Account, error) {
+		return s.repo.Update(ctx, entity.Account{
+			AccountID: accountID,
+			Limit:     request.Limit,
+			Products:  request.Products,
+			Version:   before.Version,
+		})
+	})
 	if err != nil {
-		return err
+		return model.AccountResponse{}, err
 	}
 
-	account.Limit = request.Limit
-	account.Products = request.Products
+	return newAccountResponse(account), nil
+}
 
-	return s.repo.Update(ctx, account)
+// MergePatchAccount implements Service.
+func (s *serviceImpl) MergePatchAccount(ctx context.Context, accountID int, doc map[string]json.RawMessage, ifMatch model.IfMatch) (model.AccountResponse, error) {
+	patch, err := buildMergePatch(accountID, doc)
+	if err != nil {
+		return model.AccountResponse{}, err
+	}
+
+	return s.patchAccount(ctx, accountID, patch, ifMatch)
+}
+
+// JSONPatchAccount implements Service.
+// Operations are checked in order against the stored account, then written as one targeted update guarded by the version read.
+func (s *serviceImpl) JSONPatchAccount(ctx context.Context, accountID int, ops []model.PatchOperation, ifMatch model.IfMatch) (model.AccountResponse, error) {
+	steps, err := buildJSONPatch(accountID, ops)
+	if err != nil {
+		return model.AccountResponse{}, err
+	}
+
+	account, err := s.change(ctx, accountID, HISTORY_ACTION_UPDATED, ifMatch, func(ctx context.Context, before entity.Account) (entity.Account, error) {
+		after, err := applyJSONPatch(before, steps)
+		if err != nil {
+			return entity.Account{}, err
+		}
+
+		// only tests, or changes that cancel out, leave the patch empty and the account unchanged
+		patch := jsonPatchUpdate(before, after)
+		patch.Version = before.Version
+		return s.repo.Patch(ctx, accountID, patch)
+	})
+	if err != nil {
+		return model.AccountResponse{}, err
+	}
+
+	return newAccountResponse(account), nil
+}
+
+func (s *serviceImpl) patchAccount(ctx context.Context, accountID int, patch repositories.AccountPatch, ifMatch model.IfMatch) (model.AccountResponse, error) {
+	account, err := s.change(ctx, accountID, HISTORY_ACTION_UPDATED, ifMatch, func(ctx context.Context, before entity.Account) (entity.Account, error) {
+		patch.Version = before.Version
+		return s.repo.Patch(ctx, accountID, patch)
+	})
+	if err != nil {
+		return model.AccountResponse{}, err
+	}
+
+	return newAccountResponse(account), nil
+}
+
+// AddProduct implements Service.
+func (s *serviceImpl) AddProduct(ctx context.Context, accountID int, request model.AccountProductRequest, ifMatch model.IfMatch) (model.AccountProductsResponse, error) {
+	product := strings.TrimSpace(request.Product)
+	if product == "" {
+		return model.AccountProductsResponse{}, errProductEmpty
+	}
+
+	account, err := s.change(ctx, accountID, HISTORY_ACTION_UPDATED, ifMatch, func(ctx context.Context, before entity.Account) (entity.Account, error) {
+		return s.repo.AddProduct(ctx, accountID, product, before.Version)
+	})
+	if err != nil {
+		return model.AccountProductsResponse{}, err
+	}
+
+	return model.AccountProductsResponse{AccountID: accountID, Products: account.Products, Version: account.Version}, nil
+}
+
+// RemoveProduct implements Service.
+func (s *serviceImpl) RemoveProduct(ctx context.Context, accountID int, product string, ifMatch model.IfMatch) (model.AccountProductsResponse, error) {
+	account, err := s.change(ctx, accountID, HISTORY_ACTION_UPDATED, ifMatch, func(ctx context.Context, before entity.Account) (entity.Account, error) {
+		return s.repo.RemoveProduct(ctx, accountID, product, before.Version)
+	})
+	if err != nil {
+		return model.AccountProductsResponse{}, err
+	}
+
+	return model.AccountProductsResponse{AccountID: accountID, Products: account.Products, Version: account.Version}, nil
 }
 
 func validateOrderByRequest(orderBy model.OrderField) (int, error) {
@@ -132,3 +313,23 @@ func validateOrderByRequest(orderBy model.OrderField) (int, error) {
 
 	return 0, nil
 }
+
+func newAccountResponse(account entity.Account) model.AccountResponse {
+	response := model.AccountResponse{
+		AccountID: account.AccountID,
+		Limit:     account.Limit,
+		Products:  account.Products,
+		Version:   account.Version,
+		CreatedAt: account.CreatedAt,
+		UpdatedAt: account.UpdatedAt,
+		DeletedAt: account.DeletedAt,
+		DeletedBy: account.DeletedBy,
+	}
+
+	// revisions recorded before accounts had ids carry none
+	if !account.ID.IsZero() {
+		response.ID = account.ID.Hex()
+	}
+
+	return response
+}
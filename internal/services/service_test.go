@@ -0,0 +1,363 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/importer"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/mongotest"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// testStorage is the repositories of one backend, wired like the server does
+type testStorage struct {
+	repo    repositories.Repository
+	history repositories.HistoryRepository
+	tx      repositories.Transactor
+	outbox  repositories.OutboxRepository
+	events  repositories.EventBus
+	writer  importer.Writer
+}
+
+func memoryStorage() testStorage {
+	repo := repositories.NewMemory()
+	return testStorage{
+		repo:    repo,
+		history: repositories.NewMemoryHistory(),
+		tx:      repositories.NewMemoryTransactor(),
+		outbox:  repositories.NewMemoryOutbox(),
+		events:  repositories.NewEventBus(),
+		writer:  importer.NewRepositoryWriter(repo),
+	}
+}
+
+// mongoStorage is a storage on a replica set of its own, the test is skipped without one
+func mongoStorage(t *testing.T) testStorage {
+	t.Helper()
+
+	database := mongotest.Database(t)
+	mongotest.RequireReplicaSet(t, database)
+
+	const timeoutMs = 5000
+	if _, err := repositories.NewIndexManager(database, timeoutMs).Ensure(context.Background()); err != nil {
+		t.Fatalf("ensure indexes: %v", err)
+	}
+
+	return testStorage{
+		repo:    repositories.New(database, timeoutMs),
+		history: repositories.NewHistory(database, timeoutMs),
+		tx:      repositories.NewTransactor(database),
+		outbox:  repositories.NewOutbox(database, timeoutMs),
+		events:  repositories.NewEventBus(),
+		writer:  importer.NewMongoWriter(database.Collection(repositories.ACCOUNTS_COLLECTION_NAME)),
+	}
+}
+
+// forEachStorage run fn against the memory storage and, when TEST_MONGO_URI is a replica set, the mongo one
+func forEachStorage(t *testing.T, fn func(t *testing.T, storage testStorage)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, memoryStorage())
+	})
+
+	t.Run("mongo", func(t *testing.T) {
+		fn(t, mongoStorage(t))
+	})
+}
+
+func (st testStorage) service() Service {
+	return NewService(st.repo, st.history, st.tx, st.outbox, st.events, st.events, 20)
+}
+
+// actions list the history actions of account newest first
+func (st testStorage) actions(t *testing.T, accountID int) []string {
+	t.Helper()
+
+	records, _, err := st.history.List(context.Background(), accountID, 100, 0)
+	if err != nil {
+		t.Fatalf("history of %d: %v", accountID, err)
+	}
+
+	actions := make([]string, len(records))
+	for i, record := range records {
+		actions[i] = record.Action
+	}
+
+	return actions
+}
+
+// outboxTypes list the types of the outbox records of account in publish order
+func (st testStorage) outboxTypes(t *testing.T, accountID int) []string {
+	t.Helper()
+
+	records, err := st.outbox.Pending(context.Background(), 100, nil)
+	if err != nil {
+		t.Fatalf("outbox: %v", err)
+	}
+
+	var types []string
+	for _, record := range records {
+		if record.AccountID == accountID {
+			types = append(types, record.Type)
+		}
+	}
+
+	return types
+}
+
+func validAll(any) []model.ErrorDetail {
+	return nil
+}
+
+func TestBulkCreateDuplicate(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage testStorage) {
+		ctx := context.Background()
+		service := storage.service()
+
+		if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		create := func(id int) model.AccountCreateRequest {
+			return model.AccountCreateRequest{AccountID: id, Limit: 10, Products: []string{"a"}}
+		}
+		response, err := service.Bulk(ctx, model.AccountBulkRequest{
+			Create: []model.AccountCreateRequest{create(2), create(1), create(3), create(3)},
+		}, validAll)
+		if err != nil {
+			t.Fatalf("bulk: %v", err)
+		}
+
+		want := []string{BULK_STATUS_CREATED, BULK_STATUS_CONFLICT, BULK_STATUS_CREATED, BULK_STATUS_CONFLICT}
+		for i, item := range response.Items {
+			if item.Status != want[i] {
+				t.Errorf("item %d status = %s, want %s", i, item.Status, want[i])
+			}
+		}
+
+		// the transaction was not aborted by the duplicates, so the created accounts are stored and recorded
+		for _, id := range []int{2, 3} {
+			if _, err := storage.repo.GetByAccountID(ctx, id, false); err != nil {
+				t.Errorf("account %d: %v", id, err)
+			}
+			if actions := storage.actions(t, id); len(actions) != 1 || actions[0] != HISTORY_ACTION_CREATED {
+				t.Errorf("history of %d = %v, want one created", id, actions)
+			}
+		}
+	})
+}
+
+func TestPurgeRecordHistory(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage testStorage) {
+		ctx := context.Background()
+		service := storage.service()
+		admin := NewAdminService(nil, storage.repo, storage.tx, storage.history, storage.outbox, storage.events, 0)
+
+		if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := service.DeleteAccount(ctx, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// the account must be deleted before the purge cutoff, which has millisecond precision
+		time.Sleep(2 * time.Millisecond)
+
+		response, err := admin.PurgeDeletedAccounts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Purged != 1 {
+			t.Errorf("purged %d accounts, want 1", response.Purged)
+		}
+
+		want := []string{HISTORY_ACTION_PURGED, HISTORY_ACTION_DELETED, HISTORY_ACTION_CREATED}
+		if actions := storage.actions(t, 1); strings.Join(actions, ",") != strings.Join(want, ",") {
+			t.Errorf("history = %v, want %v", actions, want)
+		}
+		if events := storage.outboxTypes(t, 1); strings.Join(events, ",") != "created,deleted,purged" {
+			t.Errorf("outbox = %v, want created, deleted and purged", events)
+		}
+	})
+}
+
+func TestImportRecordHistory(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage testStorage) {
+		ctx := context.Background()
+		service := storage.service()
+		imports := NewImportService(storage.writer, storage.repo, storage.history, storage.outbox, storage.events)
+
+		if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		body := strings.NewReader("{\"account_id\":1,\"limit\":20,\"products\":[\"a\"]}\n{\"account_id\":2,\"limit\":10,\"products\":[\"a\"]}")
+		request := model.AccountImportRequest{OnConflict: ON_CONFLICT_OVERWRITE}
+		if _, err := imports.ImportAccounts(ctx, request, body, func(model.AccountCreateRequest) []model.ErrorDetail { return nil }); err != nil {
+			t.Fatal(err)
+		}
+
+		if actions := storage.actions(t, 1); strings.Join(actions, ",") != "updated,created" {
+			t.Errorf("history of the overwritten account = %v, want updated and created", actions)
+		}
+		if actions := storage.actions(t, 2); strings.Join(actions, ",") != "created" {
+			t.Errorf("history of the imported account = %v, want created", actions)
+		}
+		if events := storage.outboxTypes(t, 1); strings.Join(events, ",") != "created,updated" {
+			t.Errorf("outbox of the overwritten account = %v, want created and updated", events)
+		}
+		if events := storage.outboxTypes(t, 2); strings.Join(events, ",") != "created" {
+			t.Errorf("outbox of the imported account = %v, want created", events)
+		}
+
+		// skipped rows change nothing
+		body = strings.NewReader(`{"account_id":2,"limit":30,"products":["a"]}`)
+		request.OnConflict = ON_CONFLICT_SKIP
+		if _, err := imports.ImportAccounts(ctx, request, body, func(model.AccountCreateRequest) []model.ErrorDetail { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if actions := storage.actions(t, 2); len(actions) != 1 {
+			t.Errorf("history of the skipped account = %v, want only created", actions)
+		}
+	})
+}
+
+func TestAsOfUntrackedChange(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage testStorage) {
+		ctx := context.Background()
+		service := storage.service()
+
+		if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		recorded := time.Now()
+		time.Sleep(2 * time.Millisecond)
+
+		// a migration writing the account leave no record
+		account, err := storage.repo.GetByAccountID(ctx, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		account.Limit = 20
+		if _, err := storage.repo.Update(ctx, account); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+
+		// before the change the recorded revision still hold
+		response, err := service.GetAccountDetail(ctx, 1, model.AccountDetailRequest{AsOf: recorded.Format(time.RFC3339Nano)})
+		if err != nil {
+			t.Fatalf("as of before the untracked change: %v", err)
+		}
+		if response.Limit != 10 {
+			t.Errorf("limit as of before the untracked change = %d, want 10", response.Limit)
+		}
+
+		_, err = service.GetAccountDetail(ctx, 1, model.AccountDetailRequest{AsOf: time.Now().Format(time.RFC3339Nano)})
+		if err != errRevisionNotRecorded {
+			t.Errorf("as of after the untracked change: err = %v, want %v", err, errRevisionNotRecorded)
+		}
+	})
+}
+
+func TestListUpdatedSince(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage testStorage) {
+		ctx := context.Background()
+		service := storage.service()
+
+		if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: 1, Limit: 10, Products: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		since := time.Now()
+		time.Sleep(2 * time.Millisecond)
+
+		for _, id := range []int{3, 2, 4} {
+			if err := service.CreateAccount(ctx, model.AccountCreateRequest{AccountID: id, Limit: 10, Products: []string{"a"}}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		if err := service.DeleteAccount(ctx, 2, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// pages of one account follow updated_at, the deleted account is a tombstone at the end when deleted ones are included
+		for includeDeleted, want := range map[bool]string{false: "[3 4]", true: "[3 4 2]"} {
+			request := model.AccountListRequest{UpdatedSince: since.Format(time.RFC3339Nano), Sort: "updated_at", Limit: 1, IncludeDeleted: includeDeleted}
+			var ids []int
+			for {
+				accounts, page, err := service.GetListAccount(ctx, request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, account := range accounts {
+					ids = append(ids, account.AccountID)
+					if deleted := account.DeletedAt != nil; deleted != (account.AccountID == 2) {
+						t.Errorf("account %d deleted = %v", account.AccountID, deleted)
+					}
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				request.Cursor = page.NextCursor
+			}
+
+			if got := fmt.Sprint(ids); got != want {
+				t.Errorf("accounts updated since with include_deleted=%v = %s, want %s", includeDeleted, got, want)
+			}
+		}
+	})
+}
+
+func TestSubscriptionIgnoreOtherAccounts(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorage()
+
+	sub, err := storage.service().SubscribeAccounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if _, err := sub.Subscribe(model.AccountSubscriptionRequest{AccountIDs: []int{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a burst on another account is larger than any feed buffer, it must not drop the idle subscriber
+	burst := make([]entity.AccountEvent, 5000)
+	for i := range burst {
+		burst[i] = entity.AccountEvent{Type: repositories.EVENT_UPDATED, AccountID: 2, Version: int64(i + 1)}
+	}
+	storage.events.Publish(burst...)
+	storage.events.Publish(entity.AccountEvent{Type: repositories.EVENT_UPDATED, AccountID: 1, Version: 2})
+
+	select {
+	case event, ok := <-sub.Events():
+		if !ok {
+			t.Fatalf("subscription closed: %v", sub.Err())
+		}
+		if event.AccountID != 1 {
+			t.Errorf("event of account %d, want 1", event.AccountID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event of the followed account")
+	}
+
+	// after unsubscribing the account is no longer delivered
+	sub.Unsubscribe(model.AccountSubscriptionRequest{AccountIDs: []int{1}})
+	storage.events.Publish(entity.AccountEvent{Type: repositories.EVENT_UPDATED, AccountID: 1, Version: 3})
+
+	select {
+	case event, ok := <-sub.Events():
+		if ok {
+			t.Errorf("event of unsubscribed account %d delivered", event.AccountID)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
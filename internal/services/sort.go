@@ -0,0 +1,79 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+// sortKeys is the whitelist of sort param keys
+var sortKeys = map[string]string{
+	"account_id":    repositories.SORT_ACCOUNT_ID,
+	"limit":         repositories.SORT_LIMIT,
+	"product_count": repositories.SORT_PRODUCT_COUNT,
+	"updated_at":    repositories.SORT_UPDATED_AT,
+}
+
+// buildSort parse sort param such as "limit:desc,account_id:asc", order defaults to ascending.
+// The legacy order_by[account_id] param is used when sort is not given.
+func buildSort(request model.AccountListRequest) ([]repositories.SortField, error) {
+	if request.Sort == "" {
+		orderBy, err := validateOrderByRequest(request.OrderBy)
+		if err != nil || orderBy == 0 {
+			return nil, err
+		}
+
+		return []repositories.SortField{{Key: repositories.SORT_ACCOUNT_ID, Order: orderBy}}, nil
+	}
+
+	if request.OrderBy.AccountID != "" {
+		return nil, &ParamError{
+			Field:   "sort",
+			Rule:    "excluded_with",
+			Message: "sort can not be combined with order_by",
+		}
+	}
+
+	var fields []repositories.SortField
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(request.Sort, ",") {
+		name, direction, _ := strings.Cut(strings.TrimSpace(part), ":")
+
+		key, ok := sortKeys[strings.ToLower(name)]
+		if !ok {
+			return nil, &ParamError{
+				Field:   "sort",
+				Rule:    "oneof",
+				Message: fmt.Sprintf("sort key %q is not supported, use account_id, limit, product_count or updated_at", name),
+			}
+		}
+
+		if seen[key] {
+			return nil, &ParamError{
+				Field:   "sort",
+				Rule:    "unique",
+				Message: fmt.Sprintf("sort key %q is given more than once", name),
+			}
+		}
+		seen[key] = true
+
+		order := 1
+		switch {
+		case direction == "" || strings.EqualFold(direction, ORDER_BY_ASC):
+		case strings.EqualFold(direction, ORDER_BY_DESC):
+			order = -1
+		default:
+			return nil, &ParamError{
+				Field:   "sort",
+				Rule:    "oneof",
+				Message: fmt.Sprintf("sort direction %q is not supported, use asc or desc", direction),
+			}
+		}
+
+		fields = append(fields, repositories.SortField{Key: key, Order: order})
+	}
+
+	return fields, nil
+}
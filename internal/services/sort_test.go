@@ -0,0 +1,103 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+)
+
+func TestBuildSort(t *testing.T) {
+	tests := []struct {
+		name    string
+		request model.AccountListRequest
+		want    []repositories.SortField
+		// rule of the param error, empty when the sort is valid
+		rule string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:    "default direction",
+			request: model.AccountListRequest{Sort: "limit"},
+			want:    []repositories.SortField{{Key: repositories.SORT_LIMIT, Order: 1}},
+		},
+		{
+			name:    "multi field",
+			request: model.AccountListRequest{Sort: "limit:desc, product_count:asc,account_id"},
+			want: []repositories.SortField{
+				{Key: repositories.SORT_LIMIT, Order: -1},
+				{Key: repositories.SORT_PRODUCT_COUNT, Order: 1},
+				{Key: repositories.SORT_ACCOUNT_ID, Order: 1},
+			},
+		},
+		{
+			name:    "direction case",
+			request: model.AccountListRequest{Sort: "Limit:DESC,account_id:Asc"},
+			want:    []repositories.SortField{{Key: repositories.SORT_LIMIT, Order: -1}, {Key: repositories.SORT_ACCOUNT_ID, Order: 1}},
+		},
+		{
+			name:    "unknown field",
+			request: model.AccountListRequest{Sort: "limit,name"},
+			rule:    "oneof",
+		},
+		{
+			name:    "empty field",
+			request: model.AccountListRequest{Sort: "limit,"},
+			rule:    "oneof",
+		},
+		{
+			name:    "unknown direction",
+			request: model.AccountListRequest{Sort: "limit:up"},
+			rule:    "oneof",
+		},
+		{
+			name:    "field twice",
+			request: model.AccountListRequest{Sort: "limit:asc,limit:desc"},
+			rule:    "unique",
+		},
+		{
+			name:    "legacy order_by",
+			request: model.AccountListRequest{OrderBy: model.OrderField{AccountID: "desc"}},
+			want:    []repositories.SortField{{Key: repositories.SORT_ACCOUNT_ID, Order: -1}},
+		},
+		{
+			name:    "sort with order_by",
+			request: model.AccountListRequest{Sort: "limit", OrderBy: model.OrderField{AccountID: "asc"}},
+			rule:    "excluded_with",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := buildSort(tt.request)
+
+			if tt.rule != "" {
+				var paramErr *ParamError
+				if !errors.As(err, &paramErr) || paramErr.Field != "sort" || paramErr.Rule != tt.rule {
+					t.Fatalf("err = %v, want a %s param error on sort", err, tt.rule)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fields) != len(tt.want) {
+				t.Fatalf("sort = %+v, want %+v", fields, tt.want)
+			}
+			for i := range fields {
+				if fields[i] != tt.want[i] {
+					t.Fatalf("sort = %+v, want %+v", fields, tt.want)
+				}
+			}
+		})
+	}
+
+	// the legacy param keep its own error
+	if _, err := buildSort(model.AccountListRequest{OrderBy: model.OrderField{AccountID: "up"}}); err != errOrderByInvalid {
+		t.Errorf("invalid order_by err = %v, want %v", err, errOrderByInvalid)
+	}
+}
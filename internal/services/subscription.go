@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+)
+
+// maxSubscriptions bound the accounts and products one subscription may follow
+const maxSubscriptions int = 1000
+
+// AccountSubscription deliver events of the accounts it follow, by account id or by a product the account hold.
+// It start following nothing.
+type AccountSubscription interface {
+	AccountEventFeed
+	// Subscribe follow more accounts and products and return everything followed
+	Subscribe(request model.AccountSubscriptionRequest) (model.AccountSubscriptionResponse, error)
+	// Unsubscribe stop following accounts and products and return everything still followed
+	Unsubscribe(request model.AccountSubscriptionRequest) model.AccountSubscriptionResponse
+}
+
+// SubscribeAccounts implements Service.
+// Events come from the event bus, so only changes made through this instance are seen. The bus filter with what the
+// subscription follow at publish time, events of other accounts never fill the subscription buffer.
+func (s *serviceImpl) SubscribeAccounts(ctx context.Context) (AccountSubscription, error) {
+	sub := &accountSubscription{
+		accountIDs: make(map[int]bool),
+		products:   make(map[string]bool),
+	}
+
+	feed, err := s.events.WatchMatching(ctx, sub.match)
+	if err != nil {
+		return nil, err
+	}
+
+	// events taken by the bus before an unsubscribe are dropped on the way out
+	sub.accountEventFeed = newAccountEventFeed(feed, sub.match)
+
+	return sub, nil
+}
+
+type accountSubscription struct {
+	*accountEventFeed
+
+	mu         sync.RWMutex
+	accountIDs map[int]bool
+	products   map[string]bool
+}
+
+// Subscribe implements AccountSubscription.
+func (s *accountSubscription) Subscribe(request model.AccountSubscriptionRequest) (model.AccountSubscriptionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newIDs := make(map[int]bool)
+	for _, id := range request.AccountIDs {
+		if !s.accountIDs[id] {
+			newIDs[id] = true
+		}
+	}
+
+	newProducts := make(map[string]bool)
+	for _, p := range cleanProducts(request.Products) {
+		if !s.products[p] {
+			newProducts[p] = true
+		}
+	}
+
+	if len(s.accountIDs)+len(s.products)+len(newIDs)+len(newProducts) > maxSubscriptions {
+		return model.AccountSubscriptionResponse{}, &ParamError{
+			Field:   "account_ids",
+			Rule:    "max",
+			Message: fmt.Sprintf("at most %d accounts and products can be subscribed to", maxSubscriptions),
+		}
+	}
+
+	for id := range newIDs {
+		s.accountIDs[id] = true
+	}
+	for p := range newProducts {
+		s.products[p] = true
+	}
+
+	return s.subscriptions(), nil
+}
+
+// Unsubscribe implements AccountSubscription.
+func (s *accountSubscription) Unsubscribe(request model.AccountSubscriptionRequest) model.AccountSubscriptionResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range request.AccountIDs {
+		delete(s.accountIDs, id)
+	}
+	for _, p := range request.Products {
+		delete(s.products, strings.TrimSpace(p))
+	}
+
+	return s.subscriptions()
+}
+
+// match report whether the account of event is followed, caller must not hold the lock
+func (s *accountSubscription) match(event entity.AccountEvent) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.accountIDs[event.AccountID] {
+		return true
+	}
+
+	if event.Account == nil {
+		return false
+	}
+
+	for _, p := range event.Account.Products {
+		if s.products[p] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subscriptions list what is followed in a stable order, caller must hold the lock
+func (s *accountSubscription) subscriptions() model.AccountSubscriptionResponse {
+	response := model.AccountSubscriptionResponse{
+		AccountIDs: make([]int, 0, len(s.accountIDs)),
+		Products:   make([]string, 0, len(s.products)),
+	}
+
+	for id := range s.accountIDs {
+		response.AccountIDs = append(response.AccountIDs, id)
+	}
+	for p := range s.products {
+		response.Products = append(response.Products, p)
+	}
+
+	sort.Ints(response.AccountIDs)
+	sort.Strings(response.Products)
+
+	return response
+}
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/Armunz/learn-mongodb/internal/entity"
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/Armunz/learn-mongodb/internal/publisher"
+	"github.com/Armunz/learn-mongodb/internal/repositories"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// webhookSecretBytes is the size of generated webhook secrets
+const webhookSecretBytes int = 32
+
+// WebhookService manage the webhooks partners register to get account events over HTTP
+type WebhookService interface {
+	CreateWebhook(ctx context.Context, request model.WebhookRequest) (model.WebhookResponse, error)
+	GetListWebhook(ctx context.Context, request model.WebhookListRequest) ([]model.WebhookResponse, model.ResponsePage, error)
+	GetWebhook(ctx context.Context, id string) (model.WebhookResponse, error)
+	UpdateWebhook(ctx context.Context, id string, request model.WebhookRequest) (model.WebhookResponse, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	GetWebhookDeliveries(ctx context.Context, id string, request model.WebhookDeliveryListRequest) ([]model.WebhookDeliveryResponse, model.ResponsePage, error)
+	ReplayWebhook(ctx context.Context, id string, request model.WebhookReplayRequest) (model.WebhookReplayResponse, error)
+}
+
+type webhookServiceImpl struct {
+	webhooks     repositories.WebhookRepository
+	deliveries   repositories.WebhookDeliveryRepository
+	tx           repositories.Transactor
+	defaultLimit int
+}
+
+func NewWebhookService(webhooks repositories.WebhookRepository, deliveries repositories.WebhookDeliveryRepository, tx repositories.Transactor, defaultLimit int) WebhookService {
+	return &webhookServiceImpl{
+		webhooks:     webhooks,
+		deliveries:   deliveries,
+		tx:           tx,
+		defaultLimit: defaultLimit,
+	}
+}
+
+// CreateWebhook implements WebhookService.
+// A secret is generated when none is given, the response is the only place it is shown.
+func (s *webhookServiceImpl) CreateWebhook(ctx context.Context, request model.WebhookRequest) (model.WebhookResponse, error) {
+	secret := request.Secret
+	if secret == "" {
+		var err error
+		if secret, err = newWebhookSecret(); err != nil {
+			return model.WebhookResponse{}, err
+		}
+	}
+
+	webhook, err := s.webhooks.Create(ctx, entity.Webhook{
+		URL:        request.URL,
+		Secret:     secret,
+		Events:     request.Events,
+		AccountIDs: request.AccountIDs,
+		Products:   cleanProducts(request.Products),
+	})
+	if err != nil {
+		return model.WebhookResponse{}, err
+	}
+
+	response := newWebhookResponse(webhook)
+	response.Secret = webhook.Secret
+
+	return response, nil
+}
+
+// GetListWebhook implements WebhookService.
+func (s *webhookServiceImpl) GetListWebhook(ctx context.Context, request model.WebhookListRequest) ([]model.WebhookResponse, model.ResponsePage, error) {
+	limit, offset := s.page(request.Limit, request.Page)
+
+	webhooks, count, err := s.webhooks.List(ctx, limit, offset)
+	if err != nil {
+		return nil, model.ResponsePage{}, err
+	}
+
+	response := make([]model.WebhookResponse, len(webhooks))
+	for i, webhook := range webhooks {
+		response[i] = newWebhookResponse(webhook)
+	}
+
+	return response, newResponsePage(count, limit), nil
+}
+
+// GetWebhook implements WebhookService.
+func (s *webhookServiceImpl) GetWebhook(ctx context.Context, id string) (model.WebhookResponse, error) {
+	webhookID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return model.WebhookResponse{}, errWebhookIDInvalid
+	}
+
+	webhook, err := s.webhooks.Get(ctx, webhookID)
+	if err != nil {
+		return model.WebhookResponse{}, err
+	}
+
+	return newWebhookResponse(webhook), nil
+}
+
+// UpdateWebhook implements WebhookService.
+// Deliveries not sent yet go to the new url, signed with the new secret.
+func (s *webhookServiceImpl) UpdateWebhook(ctx context.Context, id string, request model.WebhookRequest) (model.WebhookResponse, error) {
+	webhookID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return model.WebhookResponse{}, errWebhookIDInvalid
+	}
+
+	secret := request.Secret
+	if secret == "" {
+		stored, err := s.webhooks.Get(ctx, webhookID)
+		if err != nil {
+			return model.WebhookResponse{}, err
+		}
+		secret = stored.Secret
+	}
+
+	webhook, err := s.webhooks.Update(ctx, entity.Webhook{
+		ID:         webhookID,
+		URL:        request.URL,
+		Secret:     secret,
+		Events:     request.Events,
+		AccountIDs: request.AccountIDs,
+		Products:   cleanProducts(request.Products),
+	})
+	if err != nil {
+		return model.WebhookResponse{}, err
+	}
+
+	return newWebhookResponse(webhook), nil
+}
+
+// DeleteWebhook implements WebhookService.
+// Deliveries of the webhook are deleted with it, including the ones not sent yet.
+func (s *webhookServiceImpl) DeleteWebhook(ctx context.Context, id string) error {
+	webhookID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return errWebhookIDInvalid
+	}
+
+	return s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := s.webhooks.Delete(ctx, webhookID); err != nil {
+			return err
+		}
+
+		return s.deliveries.DeleteByWebhook(ctx, webhookID)
+	})
+}
+
+// GetWebhookDeliveries implements WebhookService.
+// Deliveries are listed newest first with their latest attempts.
+func (s *webhookServiceImpl) GetWebhookDeliveries(ctx context.Context, id string, request model.WebhookDeliveryListRequest) ([]model.WebhookDeliveryResponse, model.ResponsePage, error) {
+	webhookID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, model.ResponsePage{}, errWebhookIDInvalid
+	}
+
+	if _, err := s.webhooks.Get(ctx, webhookID); err != nil {
+		return nil, model.ResponsePage{}, err
+	}
+
+	limit, offset := s.page(request.Limit, request.Page)
+
+	deliveries, count, err := s.deliveries.List(ctx, webhookID, request.State, limit, offset)
+	if err != nil {
+		return nil, model.ResponsePage{}, err
+	}
+
+	response := make([]model.WebhookDeliveryResponse, len(deliveries))
+	for i, delivery := range deliveries {
+		response[i] = newWebhookDeliveryResponse(delivery)
+	}
+
+	return response, newResponsePage(count, limit), nil
+}
+
+// ReplayWebhook implements WebhookService.
+// Replayed deliveries are sent again from their first attempt.
+func (s *webhookServiceImpl) ReplayWebhook(ctx context.Context, id string, request model.WebhookReplayRequest) (model.WebhookReplayResponse, error) {
+	webhookID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return model.WebhookReplayResponse{}, errWebhookIDInvalid
+	}
+
+	ids := make([]primitive.ObjectID, len(request.DeliveryIDs))
+	for i, deliveryID := range request.DeliveryIDs {
+		if ids[i], err = primitive.ObjectIDFromHex(deliveryID); err != nil {
+			return model.WebhookReplayResponse{}, &ParamError{
+				Field:   "delivery_ids",
+				Rule:    "objectid",
+				Message: "delivery ids must be 24 hexadecimal characters",
+			}
+		}
+	}
+
+	if _, err := s.webhooks.Get(ctx, webhookID); err != nil {
+		return model.WebhookReplayResponse{}, err
+	}
+
+	replayed, err := s.deliveries.Replay(ctx, webhookID, ids, time.Now().UTC().Truncate(time.Millisecond))
+	if err != nil {
+		return model.WebhookReplayResponse{}, err
+	}
+
+	return model.WebhookReplayResponse{Replayed: replayed}, nil
+}
+
+// page resolve the limit and offset of a page, the default limit is used when none is given
+func (s *webhookServiceImpl) page(limit int, page int) (int, int) {
+	if limit == 0 {
+		limit = s.defaultLimit
+	}
+
+	var offset int
+	if page > 0 {
+		offset = (page - 1) * limit
+	}
+
+	return limit, offset
+}
+
+type webhookPublisherImpl struct {
+	webhooks   repositories.WebhookRepository
+	deliveries repositories.WebhookDeliveryRepository
+}
+
+// NewWebhookPublisher enqueue a delivery of every published account event for each webhook following the account,
+// to run behind the outbox relay.
+func NewWebhookPublisher(webhooks repositories.WebhookRepository, deliveries repositories.WebhookDeliveryRepository) publisher.Publisher {
+	return &webhookPublisherImpl{
+		webhooks:   webhooks,
+		deliveries: deliveries,
+	}
+}
+
+// Publish implements publisher.Publisher.
+func (p *webhookPublisherImpl) Publish(ctx context.Context, message publisher.Message) error {
+	var event model.AccountEvent
+	if err := json.Unmarshal(message.Data, &event); err != nil {
+		return err
+	}
+
+	var products []string
+	if event.Account != nil {
+		products = event.Account.Products
+	}
+
+	webhooks, err := p.webhooks.Matching(ctx, message.Type, message.AccountID, products)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	deliveries := make([]entity.WebhookDelivery, len(webhooks))
+	for i, webhook := range webhooks {
+		deliveries[i] = entity.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			EventID:       message.ID,
+			EventType:     message.Type,
+			AccountID:     message.AccountID,
+			Payload:       message.Data,
+			State:         repositories.DELIVERY_STATE_PENDING,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+	}
+
+	return p.deliveries.Enqueue(ctx, deliveries...)
+}
+
+// Close implements publisher.Publisher.
+func (p *webhookPublisherImpl) Close() error {
+	return nil
+}
+
+func newWebhookResponse(webhook entity.Webhook) model.WebhookResponse {
+	return model.WebhookResponse{
+		ID:         webhook.ID.Hex(),
+		URL:        webhook.URL,
+		Events:     append([]string{}, webhook.Events...),
+		AccountIDs: append([]int{}, webhook.AccountIDs...),
+		Products:   append([]string{}, webhook.Products...),
+		State:      webhook.State,
+		CreatedAt:  webhook.CreatedAt,
+		UpdatedAt:  webhook.UpdatedAt,
+	}
+}
+
+func newWebhookDeliveryResponse(delivery entity.WebhookDelivery) model.WebhookDeliveryResponse {
+	response := model.WebhookDeliveryResponse{
+		ID:           delivery.ID.Hex(),
+		EventID:      delivery.EventID,
+		EventType:    delivery.EventType,
+		AccountID:    delivery.AccountID,
+		State:        delivery.State,
+		AttemptCount: delivery.AttemptCount,
+		Attempts:     make([]model.WebhookAttemptResponse, len(delivery.Attempts)),
+		Event:        json.RawMessage(delivery.Payload),
+		CreatedAt:    delivery.CreatedAt,
+		DeliveredAt:  delivery.DeliveredAt,
+	}
+
+	// the next attempt of a pending delivery, others are not attempted again
+	if delivery.State == repositories.DELIVERY_STATE_PENDING {
+		next := delivery.NextAttemptAt
+		response.NextAttemptAt = &next
+	}
+
+	for i, attempt := range delivery.Attempts {
+		response.Attempts[i] = model.WebhookAttemptResponse{
+			At:         attempt.At,
+			StatusCode: attempt.StatusCode,
+			Error:      attempt.Error,
+			DurationMs: attempt.DurationMs,
+		}
+	}
+
+	return response
+}
+
+// newResponsePage count the pages of count items listed limit per page
+func newResponsePage(count int64, limit int) model.ResponsePage {
+	var totalPages int64
+	if limit > 0 {
+		totalPages = count / int64(limit)
+		if count%int64(limit) != 0 {
+			totalPages++
+		}
+	}
+
+	return model.ResponsePage{
+		TotalData: count,
+		TotalPage: totalPages,
+	}
+}
+
+// newWebhookSecret generate a random hex secret
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
@@ -0,0 +1,111 @@
+package validation
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/Armunz/learn-mongodb/internal/model"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/id"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	enTranslations "github.com/go-playground/validator/v10/translations/en"
+	idTranslations "github.com/go-playground/validator/v10/translations/id"
+)
+
+// supported languages, the first one is the fallback
+const (
+	LANG_EN string = "en"
+	LANG_ID string = "id"
+)
+
+var Languages = []string{LANG_EN, LANG_ID}
+
+// Translator turn validation errors into field error details in the requested language
+type Translator struct {
+	uni *ut.UniversalTranslator
+}
+
+// New register translations on validate and report fields by their json tag
+func New(validate *validator.Validate) (*Translator, error) {
+	validate.RegisterTagNameFunc(jsonTagName)
+
+	english := en.New()
+	uni := ut.New(english, english, id.New())
+
+	enTrans, _ := uni.GetTranslator(LANG_EN)
+	if err := enTranslations.RegisterDefaultTranslations(validate, enTrans); err != nil {
+		return nil, err
+	}
+
+	idTrans, _ := uni.GetTranslator(LANG_ID)
+	if err := idTranslations.RegisterDefaultTranslations(validate, idTrans); err != nil {
+		return nil, err
+	}
+
+	// tags the default translations miss
+	if err := registerTranslation(validate, enTrans, "http_url", "{0} must be an http or https URL"); err != nil {
+		return nil, err
+	}
+	if err := registerTranslation(validate, idTrans, "http_url", "{0} harus berupa URL http atau https"); err != nil {
+		return nil, err
+	}
+
+	return &Translator{uni: uni}, nil
+}
+
+// Details convert validation error into error details, lang is one of Languages (fallback to english).
+// Errors other than validation errors give no details.
+func (t *Translator) Details(err error, lang string) []model.ErrorDetail {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil
+	}
+
+	trans, _ := t.uni.GetTranslator(lang)
+
+	details := make([]model.ErrorDetail, len(validationErrs))
+	for i, fe := range validationErrs {
+		details[i] = model.ErrorDetail{
+			Field:   fieldPath(fe),
+			Rule:    fe.Tag(),
+			Message: fe.Translate(trans),
+		}
+	}
+
+	return details
+}
+
+// fieldPath is the field path without the root struct, e.g. create[0].limit for nested fields
+func fieldPath(fe validator.FieldError) string {
+	_, path, found := strings.Cut(fe.Namespace(), ".")
+	if !found {
+		return fe.Field()
+	}
+
+	return path
+}
+
+// registerTranslation translate errors of tag with text, {0} is replaced by the field name
+func registerTranslation(validate *validator.Validate, trans ut.Translator, tag string, text string) error {
+	register := func(trans ut.Translator) error {
+		return trans.Add(tag, text, false)
+	}
+	translate := func(trans ut.Translator, fe validator.FieldError) string {
+		message, _ := trans.T(tag, fe.Field())
+		return message
+	}
+
+	return validate.RegisterTranslation(tag, trans, register, translate)
+}
+
+// jsonTagName use json tag as field name, fields without json tag keep the struct field name
+func jsonTagName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+
+	return name
+}
@@ -0,0 +1,126 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+)
+
+type testItem struct {
+	Limit int `json:"limit" validate:"required"`
+}
+
+type testRequest struct {
+	AccountID int        `json:"account_id" validate:"required"`
+	Products  []string   `json:"products" validate:"max=1"`
+	Create    []testItem `json:"create" validate:"dive"`
+	Internal  string     `validate:"required"`
+}
+
+func newTestTranslator(t *testing.T) (*validator.Validate, *Translator) {
+	t.Helper()
+
+	validate := validator.New()
+	translator, err := New(validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return validate, translator
+}
+
+func TestDetails(t *testing.T) {
+	validate, translator := newTestTranslator(t)
+	err := validate.Struct(testRequest{Products: []string{"a", "b"}, Create: []testItem{{Limit: 1}, {}}})
+
+	tests := []struct {
+		lang     string
+		messages map[string]string
+	}{
+		{
+			lang: LANG_EN,
+			messages: map[string]string{
+				"account_id":      "account_id is a required field",
+				"products":        "products must contain at maximum 1 item",
+				"create[1].limit": "limit is a required field",
+				"Internal":        "Internal is a required field",
+			},
+		},
+		{
+			lang: LANG_ID,
+			messages: map[string]string{
+				"account_id":      "account_id wajib diisi",
+				"products":        "products harus berisi maksimal 1 item",
+				"create[1].limit": "limit wajib diisi",
+				"Internal":        "Internal wajib diisi",
+			},
+		},
+		{
+			// unsupported languages fall back to english
+			lang: "fr",
+			messages: map[string]string{
+				"account_id":      "account_id is a required field",
+				"products":        "products must contain at maximum 1 item",
+				"create[1].limit": "limit is a required field",
+				"Internal":        "Internal is a required field",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			details := translator.Details(err, tt.lang)
+			if len(details) != len(tt.messages) {
+				t.Fatalf("details = %+v, want %d", details, len(tt.messages))
+			}
+
+			for _, detail := range details {
+				want, ok := tt.messages[detail.Field]
+				if !ok {
+					t.Errorf("unexpected detail on field %q: %+v", detail.Field, detail)
+					continue
+				}
+				if detail.Message != want {
+					t.Errorf("%s message = %q, want %q", detail.Field, detail.Message, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetailsRule(t *testing.T) {
+	validate, translator := newTestTranslator(t)
+
+	details := translator.Details(validate.Struct(testRequest{AccountID: 1, Internal: "x", Products: []string{"a", "b"}}), LANG_EN)
+	if len(details) != 1 || details[0].Field != "products" || details[0].Rule != "max" {
+		t.Errorf("details = %+v, want the max rule on products", details)
+	}
+}
+
+func TestDetailsOtherError(t *testing.T) {
+	_, translator := newTestTranslator(t)
+
+	if details := translator.Details(errors.New("boom"), LANG_EN); details != nil {
+		t.Errorf("details of a non validation error = %+v, want none", details)
+	}
+}
+
+func TestDetailsHTTPURL(t *testing.T) {
+	validate, translator := newTestTranslator(t)
+
+	type webhookRequest struct {
+		URL string `json:"url" validate:"http_url"`
+	}
+	err := validate.Struct(webhookRequest{URL: "ftp://example.com"})
+
+	for lang, want := range map[string]string{
+		LANG_EN: "url must be an http or https URL",
+		LANG_ID: "url harus berupa URL http atau https",
+	} {
+		details := translator.Details(err, lang)
+		if len(details) != 1 || details[0].Rule != "http_url" || details[0].Message != want {
+			t.Errorf("%s details = %+v, want %q", lang, details, want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headers of webhook requests
+const (
+	HEADER_WEBHOOK_ID  string = "X-Webhook-Id"
+	HEADER_DELIVERY_ID string = "X-Webhook-Delivery"
+	HEADER_EVENT_TYPE  string = "X-Webhook-Event"
+	HEADER_TIMESTAMP   string = "X-Webhook-Timestamp"
+	HEADER_SIGNATURE   string = "X-Webhook-Signature"
+
+	// signaturePrefix name the algorithm, so another one can be added without breaking receivers
+	signaturePrefix string = "sha256="
+)
+
+// Sign return the X-Webhook-Signature of body sent at timestamp (unix seconds): the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed by secret. Signing the timestamp let receivers refuse replayed requests.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify report whether signature and timestamp, the X-Webhook-Signature and X-Webhook-Timestamp headers of a
+// request, were made with secret for body no more than tolerance from now
+func Verify(secret string, timestamp string, signature string, body []byte, tolerance time.Duration, now time.Time) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-tolerance)) || sent.After(now.Add(tolerance)) {
+		return false
+	}
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+
+	return hmac.Equal([]byte(Sign(secret, ts, body)), []byte(signature))
+}
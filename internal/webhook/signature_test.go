@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	testSecret    = "whsec_test"
+	testTimestamp = int64(1700000000)
+	testBody      = `{"type":"created","account_id":1}`
+	// testSignature is the known answer of testSecret, testTimestamp and testBody, from
+	// printf '%s' '1700000000.{"type":"created","account_id":1}' | openssl dgst -sha256 -hmac whsec_test
+	testSignature = "sha256=1e5d7f6ee4693437fe11ec5ef495e6f338ae91bf9ca15f2754eb871d87d7b8ba"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp int64
+		body      string
+		want      string
+	}{
+		{name: "body", timestamp: testTimestamp, body: testBody, want: testSignature},
+		{name: "empty body", timestamp: testTimestamp, body: "", want: "sha256=5967f3c560522fa40cf2876ebc3c3a08551dd6959aaade3b413460591895bdcc"},
+		{name: "timestamp is signed", timestamp: testTimestamp + 1, body: testBody, want: "sha256=d1372122ec2f00eb1965f51e821cc4241090265246ecc37ae14e9bfb7ccb16f8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign(testSecret, tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("Sign() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	sent := time.Unix(testTimestamp, 0)
+	tolerance := 5 * time.Minute
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      string
+		now       time.Time
+		want      bool
+	}{
+		{name: "valid", secret: testSecret, timestamp: "1700000000", signature: testSignature, body: testBody, now: sent, want: true},
+		{name: "within tolerance", secret: testSecret, timestamp: "1700000000", signature: testSignature, body: testBody, now: sent.Add(tolerance), want: true},
+		{name: "too old", secret: testSecret, timestamp: "1700000000", signature: testSignature, body: testBody, now: sent.Add(tolerance + time.Second), want: false},
+		{name: "from the future", secret: testSecret, timestamp: "1700000000", signature: testSignature, body: testBody, now: sent.Add(-tolerance - time.Second), want: false},
+		{name: "other secret", secret: "whsec_other", timestamp: "1700000000", signature: testSignature, body: testBody, now: sent, want: false},
+		{name: "tampered body", secret: testSecret, timestamp: "1700000000", signature: testSignature, body: `{"type":"created","account_id":2}`, now: sent, want: false},
+		{name: "other timestamp", secret: testSecret, timestamp: "1700000001", signature: testSignature, body: testBody, now: sent, want: false},
+		{name: "timestamp not a number", secret: testSecret, timestamp: "yesterday", signature: testSignature, body: testBody, now: sent, want: false},
+		{name: "missing prefix", secret: testSecret, timestamp: "1700000000", signature: testSignature[len("sha256="):], body: testBody, now: sent, want: false},
+		{name: "upper case hex", secret: testSecret, timestamp: "1700000000", signature: "sha256=1E5D7F6EE4693437FE11EC5EF495E6F338AE91BF9CA15F2754EB871D87D7B8BA", body: testBody, now: sent, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verify(tt.secret, tt.timestamp, tt.signature, []byte(tt.body), tolerance, tt.now); got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}